@@ -4,8 +4,11 @@ import (
 	"dory-backend/internal/config"
 	"dory-backend/internal/handlers"
 	"dory-backend/internal/middlewares"
+	"dory-backend/internal/models"
 	"dory-backend/internal/services"
+	"log"
 	"net/http"
+	_ "time/tzdata" // calendar imports need zone data even where the OS has none
 
 	"github.com/gin-gonic/gin"
 )
@@ -13,7 +16,23 @@ import (
 func main() {
 	config.LoadConfig()      //loading envs
 	config.ConnectDatabase() //connecting database
+	if err := services.InitSigningKeys(); err != nil {
+		log.Fatalf("Failed to set up token signing keys: %v", err)
+	}
+	services.StartSigningKeyRotation()
+	services.InitEmbedder()
+	if err := services.ValidateChunkDefaults(); err != nil {
+		log.Fatalf("Invalid chunking configuration: %v", err)
+	}
+	services.InitChatModel()
 	services.InitQdrant()
+	services.StartJobWorkers(config.AppConfig.JobWorkers)
+	if err := services.InitOIDCProviders(); err != nil {
+		log.Fatalf("Invalid OIDC configuration: %v", err)
+	}
+	services.InitMailer()
+	services.InitNotifiers()
+	services.StartReminderScheduler()
 
 	router := gin.Default()
 	router.MaxMultipartMemory = 10 << 20
@@ -21,18 +40,118 @@ func main() {
 	// Apply CORS middleware to all routes
 	router.Use(middlewares.CORSMiddleware())
 
-	protected := router.Group("/api").Use(middlewares.AuthMiddleware())
+	protected := router.Group("/api", middlewares.AuthMiddleware())
+
+	// Account routes need a logged-in session; the rest are open to API keys with the scope
+	session := protected.Group("", middlewares.RequireSession())
+	{
+		session.POST("/auth/logout", handlers.Logout)
+		session.POST("/auth/logout-all", handlers.LogoutAll)
+		session.GET("/me", handlers.GetCurrentUser)
+		session.PATCH("/me", handlers.UpdateCurrentUser)
+		session.PUT("/me/password", handlers.ChangePassword)
+		session.GET("/me/identities", handlers.ListIdentities)
+		session.POST("/me/identities/:provider", handlers.LinkIdentity)
+		session.DELETE("/me/identities/:id", handlers.UnlinkIdentity)
+		session.GET("/api-keys", handlers.ListAPIKeys)
+		session.POST("/api-keys", handlers.CreateAPIKey)
+		session.DELETE("/api-keys/:id", handlers.DeleteAPIKey)
+		session.POST("/calendar/feed", handlers.CreateCalendarFeed)
+		session.DELETE("/calendar/feed", handlers.RevokeCalendarFeed)
+		session.POST("/workspaces", handlers.CreateWorkspace)
+		session.GET("/workspaces", handlers.ListWorkspaces)
+		session.GET("/workspaces/:id", handlers.GetWorkspace)
+		session.PATCH("/workspaces/:id", handlers.UpdateWorkspace)
+		session.DELETE("/workspaces/:id", handlers.DeleteWorkspace)
+		session.GET("/workspaces/:id/members", handlers.ListWorkspaceMembers)
+		session.PATCH("/workspaces/:id/members/:userId", handlers.UpdateWorkspaceMember)
+		session.DELETE("/workspaces/:id/members/:userId", handlers.RemoveWorkspaceMember)
+		session.GET("/workspaces/:id/invitations", handlers.ListWorkspaceInvitations)
+		session.POST("/workspaces/:id/invitations", handlers.InviteToWorkspace)
+		session.DELETE("/workspaces/:id/invitations/:invitationId", handlers.RevokeWorkspaceInvitation)
+		session.POST("/workspace-invitations/accept", handlers.AcceptWorkspaceInvitation)
+	}
+
+	ingest := protected.Group("", middlewares.RequireScope(models.ScopeIngestWrite))
+	{
+		ingest.POST("/ingest/pdf", handlers.UploadPDF)
+		ingest.POST("/ingest/text", handlers.IngestText)
+		ingest.POST("/ingest/file", handlers.UploadFile)
+	}
+
+	documentsRead := protected.Group("", middlewares.RequireScope(models.ScopeDocumentsRead))
+	{
+		documentsRead.GET("/documents", handlers.ListDocuments)
+		documentsRead.GET("/documents/:id", handlers.GetDocument)
+	}
+
+	documentsWrite := protected.Group("", middlewares.RequireScope(models.ScopeDocumentsWrite))
+	{
+		documentsWrite.PATCH("/documents/:id", handlers.RenameDocument)
+		documentsWrite.DELETE("/documents/:id", handlers.DeleteDocument)
+		documentsWrite.POST("/documents/:id/rechunk", handlers.RechunkDocument)
+	}
+
+	chat := protected.Group("", middlewares.RequireScope(models.ScopeChat))
+	{
+		chat.POST("/conversations", handlers.CreateConversation)
+		chat.GET("/conversations", handlers.ListConversations)
+		chat.GET("/conversations/:id", handlers.GetConversation)
+		chat.DELETE("/conversations/:id", handlers.DeleteConversation)
+		chat.POST("/chat", middlewares.ExtractUserInfo(), handlers.Chat)
+		chat.POST("/chat/stream", middlewares.ExtractUserInfo(), handlers.ChatStream)
+	}
+
+	eventsRead := protected.Group("", middlewares.RequireScope(models.ScopeEventsRead))
+	{
+		eventsRead.GET("/events/detected", handlers.GetDetectedEvents)
+		eventsRead.GET("/events/detected/:id/merges", handlers.GetDetectedEventMerges)
+		eventsRead.GET("/events/upcoming", handlers.GetUpcomingEvents)
+		eventsRead.GET("/events/conflicts", handlers.GetEventConflicts)
+		eventsRead.GET("/events", handlers.ListEvents)
+		eventsRead.GET("/events/:id", handlers.GetEvent)
+		eventsRead.GET("/events.ics", handlers.ExportCalendar)
+		eventsRead.GET("/digest", handlers.GetDigest)
+	}
+
+	eventsWrite := protected.Group("", middlewares.RequireScope(models.ScopeEventsWrite))
+	{
+		eventsWrite.PATCH("/events/detected/:id", handlers.UpdateDetectedEvent)
+		eventsWrite.POST("/events/detected/:id/accept", handlers.AcceptDetectedEvent)
+		eventsWrite.POST("/events/detected/:id/dismiss", handlers.DismissDetectedEvent)
+		eventsWrite.POST("/events/detected/:id/merge", handlers.MergeDetectedEvent)
+		eventsWrite.POST("/events/detected/:id/unmerge", handlers.UnmergeDetectedEvent)
+		eventsWrite.POST("/events", handlers.CreateEvent)
+		eventsWrite.PATCH("/events/:id", handlers.UpdateEvent)
+		eventsWrite.DELETE("/events/:id", handlers.DeleteEvent)
+	}
+
+	remindersRead := protected.Group("", middlewares.RequireScope(models.ScopeRemindersRead))
+	{
+		remindersRead.GET("/reminders/settings", handlers.GetReminderSettings)
+		remindersRead.GET("/reminders", handlers.ListReminders)
+	}
 
+	remindersWrite := protected.Group("", middlewares.RequireScope(models.ScopeRemindersWrite))
 	{
-		protected.POST("/ingest/pdf", handlers.UploadPDF)
-		protected.POST("/ingest/text", handlers.IngestText)
-		protected.POST("/chat", middlewares.ExtractUserInfo(), handlers.Chat)
-		protected.POST("/chat/stream", middlewares.ExtractUserInfo(), handlers.ChatStream)
-		protected.GET("/events/detected", handlers.GetDetectedEvents)
-		protected.GET("/events/upcoming", handlers.GetUpcomingEvents)
+		remindersWrite.PUT("/reminders/settings", handlers.UpdateReminderSettings)
+		remindersWrite.POST("/reminders/:id/snooze", handlers.SnoozeReminder)
+		remindersWrite.POST("/reminders/:id/mute", handlers.MuteReminder)
 	}
 
 	router.POST("/api/auth/google", handlers.GoogleLogin)
+	router.GET("/api/auth/providers", handlers.ListLoginProviders)
+	router.POST("/api/auth/nonce", handlers.IssueOIDCNonce)
+	router.POST("/api/auth/oidc/:provider", handlers.OIDCLogin)
+	router.POST("/api/auth/register", handlers.Register)
+	router.POST("/api/auth/login", handlers.PasswordLogin)
+	router.POST("/api/auth/magic-link", handlers.RequestMagicLink)
+	router.POST("/api/auth/magic-link/verify", handlers.VerifyMagicLink)
+	router.POST("/api/auth/refresh", handlers.RefreshToken)
+	// Public keys for verifying our access tokens elsewhere
+	router.GET("/.well-known/jwks.json", handlers.JWKS)
+	// Calendar apps poll this without a bearer token; the secret in the URL identifies the user
+	router.GET("/api/calendar/feed/:token", handlers.CalendarFeed)
 
 	router.GET("/", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
@@ -10,13 +10,19 @@ import (
 func main() {
 	// 1. Load config to get your JWT_SECRET
 	config.LoadConfig()
+	// Tokens are signed with the server's keys, which live in the database
+	config.ConnectDatabase()
+	if err := services.InitSigningKeys(); err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
 
 	// 2. Generate a token for a mock user
 	// We use a fake UUID and email just for testing
 	testUserID := "00000000-0000-0000-0000-000000000001"
 	testEmail := "testuser@dory.com"
 
-	token, err := services.GenerateJWTToken(testUserID, testEmail)
+	// Access tokens live for ACCESS_TOKEN_TTL, so raise it in .env for longer testing
+	token, _, err := services.GenerateAccessToken(testUserID, testEmail, "")
 	if err != nil {
 		log.Fatalf("Failed to generate token: %v", err)
 	}
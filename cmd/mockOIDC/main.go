@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A local OpenID Connect issuer for trying OIDC sign-in without a real identity provider.
+// It publishes discovery and a key set, and /token hands out signed ID tokens for any user:
+//
+//	go run ./cmd/mockOIDC -addr 127.0.0.1:9000
+//	OIDC_PROVIDERS='[{"id":"mock","issuer":"http://127.0.0.1:9000","audiences":["dory"]}]'
+//	curl '127.0.0.1:9000/token?sub=alice&email=alice@uni.example&email_verified=true'
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9000", "address to listen on")
+	audience := flag.String("aud", "dory", "default audience of issued tokens")
+	flag.Parse()
+	issuer := "http://" + *addr
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+	const kid = "mock-key"
+
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                issuer,
+			"jwks_uri":                              issuer + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"subject_types_supported":               []string{"public"},
+			"response_types_supported":              []string{"id_token"},
+		})
+	})
+
+	http.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   b64.EncodeToString(key.N.Bytes()),
+			"e":   b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+
+	// /token?sub=&email=&email_verified=&name=&aud=&nonce=&ttl=
+	http.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		sub := q.Get("sub")
+		if sub == "" {
+			http.Error(w, "sub is required", http.StatusBadRequest)
+			return
+		}
+		aud := q.Get("aud")
+		if aud == "" {
+			aud = *audience
+		}
+		ttl, err := time.ParseDuration(q.Get("ttl"))
+		if err != nil {
+			ttl = time.Hour
+		}
+
+		now := time.Now()
+		claims := jwt.MapClaims{
+			"iss":            issuer,
+			"sub":            sub,
+			"aud":            aud,
+			"iat":            now.Unix(),
+			"exp":            now.Add(ttl).Unix(),
+			"email":          q.Get("email"),
+			"email_verified": q.Get("email_verified") == "true",
+			"name":           q.Get("name"),
+		}
+		if nonce := q.Get("nonce"); nonce != "" {
+			claims["nonce"] = nonce
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]string{"id_token": signed})
+	})
+
+	fmt.Printf("Mock OIDC issuer at %s (audience %q)\n", issuer, *audience)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
@@ -9,11 +9,12 @@ import (
 
 func main() {
 	config.LoadConfig()
+	services.InitEmbedder()
 
 	// 2. Define a test string
 	testText := "Dory is a student assistant app."
 
-	fmt.Println("--- Testing Hugging Face Embedding ---")
+	fmt.Printf("--- Testing %s Embedding ---\n", config.AppConfig.EmbeddingProvider)
 	fmt.Printf("Input: %s\n", testText)
 
 	vectors, err := services.EmbedText(testText)
@@ -27,9 +28,10 @@ func main() {
 		fmt.Printf("First 5 numbers: %v\n", vectors[:5])
 	}
 
-	if len(vectors) == 384 {
-		fmt.Println("Result: Dimension count is correct (384).")
+	expected := services.ActiveEmbedder.Dimension()
+	if len(vectors) == expected {
+		fmt.Printf("Result: Dimension count is correct (%d).\n", expected)
 	} else {
-		fmt.Printf("Result: Unexpected dimension count: %d\n", len(vectors))
+		fmt.Printf("Result: Unexpected dimension count: %d (provider reports %d)\n", len(vectors), expected)
 	}
 }
@@ -3,21 +3,72 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	Port              string
-	DatabaseURL       string
-	JWTSecret         string
+	Port          string
+	PublicBaseURL string
+	DatabaseURL   string
+	JWTSecret     string
+	// JWTAlgorithm signs access tokens: RS256 or EdDSA with rotating keys, or legacy HS256
+	// with JWTSecret. JWTAcceptHS256 keeps HS256 tokens valid while clients migrate.
+	JWTAlgorithm   string
+	JWTKeyRotation time.Duration
+	JWTAcceptHS256 bool
+	// Access tokens are short-lived; refresh tokens rotate on every use
+	AccessTokenTTL    time.Duration
+	RefreshTokenTTL   time.Duration
 	GeminiKey         string
 	GoogleWebClientID string
 	GoogleIOSClientID string
+	OIDCProviders     string
 	CloudinaryURL     string
 	HuggingFaceToken  string
 	QdrantHost        string
 	QdrantKey         string
+	QdrantPort        int
+	QdrantRESTPort    int
+	QdrantTLS         bool
+	JobWorkers        int
+	JobMaxAttempts    int
+	MaxUploadMB       int
+
+	EmbeddingProvider  string
+	EmbeddingModel     string
+	EmbeddingBaseURL   string
+	EmbeddingAPIKey    string
+	EmbeddingDimension int
+	EmbeddingMaxTokens int
+
+	LLMProvider string
+	LLMModel    string
+	LLMBaseURL  string
+	LLMAPIKey   string
+
+	ChatHistoryTokens int
+
+	EventDedupEmbeddings bool
+
+	// Mailer sends login links and email reminders: smtp or log
+	Mailer             string
+	MagicLinkURL       string
+	MagicLinkTTL       time.Duration
+	WorkspaceInviteURL string
+	SMTPHost           string
+	SMTPPort           string
+	SMTPUsername       string
+	SMTPPassword       string
+	SMTPFrom           string
+	// WebhookAllowPrivate lets reminder webhooks reach loopback and private addresses
+	WebhookAllowPrivate bool
+
+	ChunkStrategy      string
+	ChunkTokens        int
+	ChunkOverlapTokens int
 }
 
 var AppConfig *Config
@@ -31,15 +82,59 @@ func LoadConfig() {
 
 	AppConfig = &Config{
 		Port:              getEnv("PORT", "8080"),
+		PublicBaseURL:     os.Getenv("PUBLIC_BASE_URL"),
 		DatabaseURL:       os.Getenv("DATABASE_URL"),
 		JWTSecret:         os.Getenv("JWT_SECRET"),
+		JWTAlgorithm:      getEnv("JWT_ALGORITHM", "RS256"),
+		JWTKeyRotation:    getEnvDuration("JWT_KEY_ROTATION", 30*24*time.Hour),
+		JWTAcceptHS256:    getEnvBool("JWT_ACCEPT_HS256", true),
+		AccessTokenTTL:    getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL:   getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
 		GeminiKey:         os.Getenv("GEMINI_API_KEY"),
 		GoogleWebClientID: os.Getenv("GOOGLE_WEB_CLIENT_ID"),
 		GoogleIOSClientID: os.Getenv("GOOGLE_IOS_CLIENT_ID"),
+		OIDCProviders:     os.Getenv("OIDC_PROVIDERS"),
 		CloudinaryURL:     os.Getenv("CLOUDINARY_URL"),
 		HuggingFaceToken:  os.Getenv("HUGGING_FACE_TOKEN"),
 		QdrantHost:        os.Getenv("QDRANT_HOST"),
 		QdrantKey:         os.Getenv("QDRANT_API_KEY"),
+		QdrantPort:        getEnvInt("QDRANT_PORT", 6334),
+		QdrantRESTPort:    getEnvInt("QDRANT_REST_PORT", 6333),
+		QdrantTLS:         getEnvBool("QDRANT_TLS", true),
+		JobWorkers:        getEnvInt("JOB_WORKERS", 2),
+		JobMaxAttempts:    getEnvInt("JOB_MAX_ATTEMPTS", 5),
+		MaxUploadMB:       getEnvInt("MAX_UPLOAD_MB", 25),
+
+		EmbeddingProvider:  getEnv("EMBEDDING_PROVIDER", "huggingface"),
+		EmbeddingModel:     os.Getenv("EMBEDDING_MODEL"),
+		EmbeddingBaseURL:   os.Getenv("EMBEDDING_BASE_URL"),
+		EmbeddingAPIKey:    os.Getenv("EMBEDDING_API_KEY"),
+		EmbeddingDimension: getEnvInt("EMBEDDING_DIMENSION", 0),
+		EmbeddingMaxTokens: getEnvInt("EMBEDDING_MAX_TOKENS", 0),
+
+		LLMProvider: getEnv("LLM_PROVIDER", "gemini"),
+		LLMModel:    os.Getenv("LLM_MODEL"),
+		LLMBaseURL:  os.Getenv("LLM_BASE_URL"),
+		LLMAPIKey:   os.Getenv("LLM_API_KEY"),
+
+		ChatHistoryTokens: getEnvInt("CHAT_HISTORY_TOKENS", 2000),
+
+		EventDedupEmbeddings: getEnvBool("EVENT_DEDUP_EMBEDDINGS", false),
+
+		Mailer:              os.Getenv("MAILER"),
+		MagicLinkURL:        os.Getenv("MAGIC_LINK_URL"),
+		MagicLinkTTL:        getEnvDuration("MAGIC_LINK_TTL", 15*time.Minute),
+		WorkspaceInviteURL:  os.Getenv("WORKSPACE_INVITE_URL"),
+		SMTPHost:            os.Getenv("SMTP_HOST"),
+		SMTPPort:            getEnv("SMTP_PORT", "587"),
+		SMTPUsername:        os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:        os.Getenv("SMTP_PASSWORD"),
+		SMTPFrom:            os.Getenv("SMTP_FROM"),
+		WebhookAllowPrivate: getEnvBool("WEBHOOK_ALLOW_PRIVATE", false),
+
+		ChunkStrategy:      getEnv("CHUNK_STRATEGY", "recursive"),
+		ChunkTokens:        getEnvInt("CHUNK_TOKENS", 300),
+		ChunkOverlapTokens: getEnvInt("CHUNK_OVERLAP_TOKENS", 50),
 	}
 }
 
@@ -50,3 +145,27 @@ func getEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
@@ -15,7 +15,7 @@ func ConnectDatabase() {
 	if err != nil {
 		log.Fatal("error connecting to database", err)
 	}
-	err = database.AutoMigrate(&models.User{}, &models.Document{})
+	err = database.AutoMigrate(&models.User{}, &models.UserIdentity{}, &models.RefreshToken{}, &models.RevokedToken{}, &models.LoginToken{}, &models.OIDCNonce{}, &models.APIKey{}, &models.SigningKey{}, &models.Workspace{}, &models.WorkspaceMember{}, &models.WorkspaceInvitation{}, &models.Document{}, &models.DetectedEvent{}, &models.EventMerge{}, &models.Event{}, &models.IngestionJob{}, &models.ReminderSettings{}, &models.Reminder{}, &models.Conversation{}, &models.Message{})
 	if err != nil {
 		log.Fatal("Migration failed: ", err)
 	}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"dory-backend/internal/services"
+	"dory-backend/internal/utils"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func ListAPIKeys(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var keys []models.APIKey
+	if err := config.DB.Where("user_id = ?", userID).Order("created_at DESC").Find(&keys).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch API keys", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "API keys retrieved successfully", keys)
+}
+
+// CreateAPIKey issues a key for scripts. Body: {"name": "...", "scopes": ["ingest:write"],
+// "expires_at": "..."}; the key itself is only returned here.
+func CreateAPIKey(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		Name      string     `json:"name" binding:"required"`
+		Scopes    []string   `json:"scopes" binding:"required"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	key, secret, err := services.CreateAPIKey(userID, input.Name, input.Scopes, input.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidAPIKeySpec) {
+			utils.SendError(c, http.StatusBadRequest, "Invalid API key", err.Error())
+			return
+		}
+		utils.SendError(c, http.StatusInternalServerError, "Failed to create API key", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusCreated, "API key created; store it now, it will not be shown again", gin.H{
+		"key":     secret,
+		"api_key": key,
+	})
+}
+
+func DeleteAPIKey(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid API key ID", err.Error())
+		return
+	}
+
+	result := config.DB.Where("id = ? AND user_id = ?", id, userID).Delete(&models.APIKey{})
+	if result.Error != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to delete API key", result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		utils.SendError(c, http.StatusNotFound, "API key not found", "API key does not exist or you don't have access")
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "API key deleted", gin.H{"id": id})
+}
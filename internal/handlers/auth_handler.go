@@ -4,7 +4,11 @@ import (
 	"dory-backend/internal/config"
 	"dory-backend/internal/models"
 	"dory-backend/internal/services"
+	"dory-backend/internal/utils"
+	"errors"
 	"net/http"
+	"sort"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -29,37 +33,290 @@ func GoogleLogin(c *gin.Context) {
 		return
 	}
 
-	var user models.User
-	email, ok := payload.Claims["email"].(string)
-	if !ok || email == "" {
+	user, err := services.SignInWithIdentity(services.GoogleIdentity(payload.Subject, payload.Claims))
+	if err != nil {
+		signInError(c, err)
+		return
+	}
+
+	// 3. Start a Dory session
+	pair, err := services.StartSession(user, clientInfo(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokenResponse(pair, gin.H{"user": user}))
+
+}
+
+// IssueOIDCNonce hands out the nonce a client puts in its authorization request before
+// sending the resulting ID token to OIDCLogin or LinkIdentity
+func IssueOIDCNonce(c *gin.Context) {
+	nonce, expiresAt, err := services.IssueOIDCNonce()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue nonce"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"nonce": nonce, "expires_at": expiresAt})
+}
+
+// OIDCLogin logs in with an ID token from a configured OpenID Connect provider, or from
+// Google with the provider "google". Body: {"id_token": "...", "nonce": "..."}, where the
+// nonce comes from IssueOIDCNonce.
+func OIDCLogin(c *gin.Context) {
+	var input struct {
+		IDToken string `json:"id_token" binding:"required"`
+		Nonce   string `json:"nonce" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id_token and nonce are required"})
+		return
+	}
+
+	identity, err := services.VerifyIdentityToken(c.Request.Context(), c.Param("provider"), input.IDToken, input.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrUnknownProvider):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrInvalidIDToken):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify ID token"})
+		}
+		return
+	}
+
+	user, err := services.SignInWithIdentity(identity)
+	if err != nil {
+		signInError(c, err)
+		return
+	}
+
+	startSession(c, user, http.StatusOK)
+}
+
+// signInError answers a failed identity provider sign-in
+func signInError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrAccountNotLinkable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidEmail):
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token: email not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+	}
+}
+
+// ListLoginProviders tells login pages which identity providers they can offer
+func ListLoginProviders(c *gin.Context) {
+	providers := []gin.H{}
+	if config.AppConfig.GoogleWebClientID != "" || config.AppConfig.GoogleIOSClientID != "" {
+		providers = append(providers, gin.H{"id": models.IdentityProviderGoogle, "name": "Google", "issuer": "https://accounts.google.com"})
+	}
+	ids := make([]string, 0, len(services.OIDCProviders))
+	for id := range services.OIDCProviders {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		p := services.OIDCProviders[id]
+		providers = append(providers, gin.H{"id": p.ID, "name": p.Name, "issuer": p.Issuer, "client_ids": p.Audiences})
+	}
+	c.JSON(http.StatusOK, gin.H{"providers": providers})
+}
+
+// Register creates an account with an email and password and logs it in. The email is
+// verified through an emailed link before the account is linked to other sign-in methods.
+func Register(c *gin.Context) {
+	var input struct {
+		Email    string `json:"email" binding:"required"`
+		Password string `json:"password" binding:"required"`
+		Name     string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email and password are required"})
 		return
 	}
 
-	result := config.DB.Where("email = ?", email).First(&user)
-	if result.Error != nil {
-		name, _ := payload.Claims["name"].(string)
-		picture, _ := payload.Claims["picture"].(string)
+	user, err := services.RegisterWithPassword(input.Email, input.Password, input.Name)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidEmail), errors.Is(err, services.ErrInvalidPassword):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrEmailTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create account"})
+		}
+		return
+	}
+
+	startSession(c, user, http.StatusCreated)
+}
 
-		user = models.User{
-			Email:        email,
-			Name:         name,
-			ProfilePhoto: picture,
-			GoogleID:     payload.Subject,
+// PasswordLogin logs in with an email and password
+func PasswordLogin(c *gin.Context) {
+	var input struct {
+		Email    string `json:"email" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email and password are required"})
+		return
+	}
+
+	user, err := services.LoginWithPassword(input.Email, input.Password)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidCredentials) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
 		}
-		config.DB.Create(&user)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
 	}
 
-	// 3. Generate Dory JWT
-	token, err := services.GenerateJWTToken(user.ID.String(), user.Email)
+	startSession(c, user, http.StatusOK)
+}
+
+// RequestMagicLink emails a login link. The response is the same whether or not the address
+// has an account.
+func RequestMagicLink(c *gin.Context) {
+	var input struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email is required"})
+		return
+	}
+
+	if err := services.SendMagicLink(input.Email); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the address can receive email, a login link is on its way"})
+}
+
+// VerifyMagicLink logs in with the token from a login or verification email, creating the
+// account on first login
+func VerifyMagicLink(c *gin.Context) {
+	var input struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+
+	user, err := services.RedeemLoginToken(input.Token)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidLoginToken) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	startSession(c, user, http.StatusOK)
+}
+
+// startSession answers a successful login with a new session
+func startSession(c *gin.Context, user models.User, status int) {
+	pair, err := services.StartSession(user, clientInfo(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate session"})
 		return
 	}
+	c.JSON(status, tokenResponse(pair, gin.H{"user": user}))
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"token": token,
-		"user":  user,
-	})
+func clientInfo(c *gin.Context) services.ClientInfo {
+	return services.ClientInfo{UserAgent: c.Request.UserAgent(), IP: c.ClientIP()}
+}
+
+// tokenResponse is the body returned on login and refresh, with any extra fields
+func tokenResponse(pair services.TokenPair, extra gin.H) gin.H {
+	body := gin.H{
+		"token":              pair.AccessToken,
+		"expires_in":         int(time.Until(pair.AccessExpiresAt).Seconds()),
+		"refresh_token":      pair.RefreshToken,
+		"refresh_expires_at": pair.RefreshExpiresAt,
+	}
+	for k, v := range extra {
+		body[k] = v
+	}
+	return body
+}
+
+// RefreshToken trades a refresh token for a new access token and the next refresh token
+func RefreshToken(c *gin.Context) {
+	var input struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token is required"})
+		return
+	}
+
+	pair, err := services.RefreshSession(input.RefreshToken, clientInfo(c))
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidRefreshToken) || errors.Is(err, services.ErrRefreshTokenReused) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokenResponse(pair, nil))
+}
+
+// getTokenClaims returns the claims AuthMiddleware verified
+func getTokenClaims(c *gin.Context) (*services.AccessClaims, bool) {
+	val, exists := c.Get("tokenClaims")
+	if !exists {
+		return nil, false
+	}
+	claims, ok := val.(*services.AccessClaims)
+	return claims, ok
+}
+
+// Logout revokes the calling access token and the refresh tokens of its session
+func Logout(c *gin.Context) {
+	claims, ok := getTokenClaims(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "Token context missing")
+		return
+	}
+
+	if err := services.Logout(claims); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to log out", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Logged out", nil)
+}
+
+// LogoutAll signs the caller out on every device
+func LogoutAll(c *gin.Context) {
+	claims, ok := getTokenClaims(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "Token context missing")
+		return
+	}
+
+	if err := services.LogoutEverywhere(claims); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to log out", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Logged out on all devices", nil)
+}
 
+// JWKS publishes the public signing keys as a JSON Web Key Set
+func JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": services.PublicJWKS()})
 }
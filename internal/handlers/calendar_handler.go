@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"dory-backend/internal/config"
+	"dory-backend/internal/services"
+	"dory-backend/internal/utils"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ExportCalendar downloads the caller's calendar as an .ics file
+func ExportCalendar(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="dory.ics"`)
+	serveCalendar(c, userID, c.Query("include_detected") == "true")
+}
+
+// CalendarFeed serves the calendar to subscribing apps, which authenticate with the secret
+// token in the URL because they cannot send a bearer token
+func CalendarFeed(c *gin.Context) {
+	token := strings.TrimSuffix(c.Param("token"), ".ics")
+
+	user, err := services.UserByCalendarFeedToken(token)
+	if err != nil {
+		utils.SendError(c, http.StatusNotFound, "Calendar not found", "The feed URL is invalid or has been revoked")
+		return
+	}
+
+	serveCalendar(c, user.ID, c.Query("include_detected") == "true")
+}
+
+// serveCalendar renders the calendar and answers conditional requests with 304 so polling
+// clients only download it when something changed
+func serveCalendar(c *gin.Context, userID uuid.UUID, includeDetected bool) {
+	events, detected, err := services.CalendarEvents(userID, includeDetected)
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch events", err.Error())
+		return
+	}
+
+	body, err := services.RenderICS("Dory", events, detected)
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to render calendar", err.Error())
+		return
+	}
+
+	etag := services.CalendarETag(body)
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", body)
+}
+
+// etagMatches implements the weak comparison If-None-Match calls for
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateCalendarFeed issues a subscription URL, replacing and invalidating any earlier one
+func CreateCalendarFeed(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	token, err := services.NewCalendarFeedToken(userID)
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to create calendar feed", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusCreated, "Calendar feed created; the URL is only shown once", gin.H{
+		"url": publicBaseURL(c) + "/api/calendar/feed/" + token + ".ics",
+	})
+}
+
+func RevokeCalendarFeed(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	if err := services.RevokeCalendarFeedToken(userID); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to revoke calendar feed", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Calendar feed revoked", nil)
+}
+
+// publicBaseURL prefers PUBLIC_BASE_URL and otherwise rebuilds the origin the client used
+func publicBaseURL(c *gin.Context) string {
+	if base := config.AppConfig.PublicBaseURL; base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
@@ -1,130 +1,289 @@
 package handlers
 
 import (
+	"context"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
 	"dory-backend/internal/services"
 	"dory-backend/internal/utils"
-	"fmt"
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/iterator"
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
 )
 
-func Chat(c *gin.Context) {
-	var input struct {
-		Message string `json:"message" binding:"required"`
+type chatInput struct {
+	Message        string `json:"message" binding:"required"`
+	ConversationID string `json:"conversation_id"`
+	// Scope picks the documents searched: "mine", "workspace" (WorkspaceID's) or "both"
+	Scope       string `json:"scope"`
+	WorkspaceID string `json:"workspace_id"`
+}
+
+// chatTurn is everything Chat and ChatStream need before calling the model
+type chatTurn struct {
+	input        chatInput
+	conversation models.Conversation
+	history      []services.ChatMessage
+	sources      []models.Source
+
+	// isNew marks a conversation that is only stored once the turn is saved
+	isNew bool
+}
+
+// prepareChatTurn binds the request, resolves the conversation and retrieves context.
+// It writes the error response itself and returns false when the request cannot proceed.
+func prepareChatTurn(c *gin.Context) (chatTurn, bool) {
+	var turn chatTurn
+
+	// The body may already have been read by ExtractUserInfo, so bind from gin's cached copy
+	if err := c.ShouldBindBodyWith(&turn.input, binding.JSON); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Message is required", err.Error())
+		return turn, false
 	}
 
-	// Try to get the message from context first (populated by middleware)
-	if msg, exists := c.Get("userMessage"); exists {
-		if m, ok := msg.(string); ok {
-			input.Message = m
-		}
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "Invalid user ID")
+		return turn, false
 	}
 
-	// If not in context, bind from JSON
-	if input.Message == "" {
-		if err := c.ShouldBindJSON(&input); err != nil {
-			utils.SendError(c, http.StatusBadRequest, "Message is required", err.Error())
-			return
-		}
+	scope, err := services.ResolveSearchScope(userID, turn.input.Scope, turn.input.WorkspaceID)
+	if err != nil {
+		sendWorkspaceError(c, err, "Failed to resolve search scope")
+		return turn, false
 	}
 
-	userIDVal, exists := c.Get("userID")
-	if !exists {
-		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
-		return
+	conv, isNew, err := services.OpenConversation(userID, turn.input.ConversationID, turn.input.Message)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		utils.SendError(c, http.StatusNotFound, "Conversation not found", "Conversation does not exist or you don't have access")
+		return turn, false
+	}
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to load conversation", err.Error())
+		return turn, false
 	}
+	turn.conversation, turn.isNew = conv, isNew
 
-	userID, ok := userIDVal.(string)
-	if !ok || userID == "" {
-		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "Invalid user ID")
-		return
+	if !isNew {
+		history, err := services.LoadHistory(conv.ID, config.AppConfig.ChatHistoryTokens)
+		if err != nil {
+			utils.SendError(c, http.StatusInternalServerError, "Failed to load conversation", err.Error())
+			return turn, false
+		}
+		turn.history = history
 	}
 
-	chunks, err := services.SearchSimilarChunks(userID, input.Message)
+	sources, err := services.ActiveSearcher.SearchChunks(scope, services.RetrievalQuery(turn.history, turn.input.Message))
 	if err != nil {
 		utils.SendError(c, http.StatusInternalServerError, "Search failed", err.Error())
+		return turn, false
+	}
+	turn.sources = sources
+
+	return turn, true
+}
+
+func Chat(c *gin.Context) {
+	turn, ok := prepareChatTurn(c)
+	if !ok {
 		return
 	}
-	aiResponse, err := services.GenerateAIResponse(input.Message, chunks)
+
+	aiResponse, err := services.GenerateAIResponse(c.Request.Context(), turn.history, turn.input.Message, turn.sources)
 	if err != nil {
 		utils.SendError(c, http.StatusInternalServerError, "AI generation failed", err.Error())
 		return
 	}
+
+	citations := services.ExtractCitations(aiResponse, turn.sources)
+	saved, err := services.SaveTurn(turn.conversation, turn.isNew, turn.input.Message, aiResponse, turn.sources, citations)
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to save conversation", err.Error())
+		return
+	}
+
 	utils.SendSuccess(c, http.StatusOK, "Response generated", gin.H{
-		"response": aiResponse,
-		"sources":  chunks,
+		"response":        aiResponse,
+		"sources":         turn.sources,
+		"citations":       citations,
+		"conversation_id": turn.conversation.ID,
+		"message_id":      saved.ID,
 	})
 }
 
+const (
+	streamHeartbeatInterval = 15 * time.Second
+	// streamGenerationTimeout bounds a generation that keeps running after its client disconnects
+	streamGenerationTimeout = 5 * time.Minute
+)
+
+// ChatStream answers over server-sent events. A stream emits, in order:
+//
+//	sources  {conversation_id, sources}
+//	delta    {text}                                              zero or more
+//	done     {message_id, finish_reason, usage, citations}
+//	   or
+//	error    {code, message}
+//
+// Every event carries an id; sending it back in a Last-Event-ID header replays the
+// events after it and then follows the stream live. Comment lines keep proxies from
+// timing out idle connections.
 func ChatStream(c *gin.Context) {
-	var input struct {
-		Message string `json:"message" binding:"required"`
+	if lastEventID := c.GetHeader("Last-Event-ID"); lastEventID != "" {
+		resumeChatStream(c, lastEventID)
+		return
 	}
 
-	if msg, exists := c.Get("userMessage"); exists {
-		if m, ok := msg.(string); ok {
-			input.Message = m
-		}
+	turn, ok := prepareChatTurn(c)
+	if !ok {
+		return
 	}
 
-	if input.Message == "" {
-		if err := c.ShouldBindJSON(&input); err != nil {
-			utils.SendError(c, http.StatusBadRequest, "Message is required", err.Error())
-			return
-		}
-	}
+	userID, _ := getAuthUserID(c)
+	buf := services.NewStreamBuffer(userID.String())
+	buf.Append("sources", gin.H{
+		"conversation_id": turn.conversation.ID,
+		"sources":         turn.sources,
+	})
+
+	// Generation is detached from the request so the answer is still saved, and can be
+	// resumed, if the client drops mid-stream
+	go generateChatStream(buf, turn)
+
+	writeChatStream(c, buf, 0)
+}
 
-	userIDVal, exists := c.Get("userID")
-	if !exists {
-		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+func resumeChatStream(c *gin.Context, lastEventID string) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "Invalid user ID")
 		return
 	}
 
-	userID := userIDVal.(string)
-
-	chunks, err := services.SearchSimilarChunks(userID, input.Message)
+	buf, seq, err := services.ResumeStream(lastEventID, userID.String())
 	if err != nil {
-		utils.SendError(c, http.StatusInternalServerError, "Search failed", err.Error())
+		setStreamHeaders(c)
+		writeStreamEvent(c.Writer, services.StreamEvent{
+			Event: "error",
+			Data:  gin.H{"code": "stream_not_found", "message": err.Error()},
+		})
 		return
 	}
 
-	iterRaw, err := services.StreamAIResponse(c.Request.Context(), input.Message, chunks)
+	writeChatStream(c, buf, seq)
+}
+
+func generateChatStream(buf *services.StreamBuffer, turn chatTurn) {
+	defer buf.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamGenerationTimeout)
+	defer cancel()
+
+	stream, err := services.StreamAIResponse(ctx, turn.history, turn.input.Message, turn.sources)
 	if err != nil {
-		utils.SendError(c, http.StatusInternalServerError, "AI generation failed", err.Error())
+		buf.Append("error", gin.H{"code": "generation_failed", "message": err.Error()})
 		return
 	}
 
-	iter, ok := iterRaw.(interface {
-		Next() (*genai.GenerateContentResponse, error)
-	})
-	if !ok {
-		utils.SendError(c, http.StatusInternalServerError, "AI generation failed", "Invalid iterator type")
+	var reply strings.Builder
+	for chunk := range stream {
+		if chunk.Err != nil {
+			buf.Append("error", gin.H{"code": "generation_failed", "message": chunk.Err.Error()})
+			return
+		}
+
+		if !chunk.Done {
+			reply.WriteString(chunk.Text)
+			buf.Append("delta", gin.H{"text": chunk.Text})
+			continue
+		}
+
+		// Only completed answers are persisted, so history never holds a cut-off reply
+		answer := reply.String()
+		citations := services.ExtractCitations(answer, turn.sources)
+		saved, err := services.SaveTurn(turn.conversation, turn.isNew, turn.input.Message, answer, turn.sources, citations)
+		if err != nil {
+			buf.Append("error", gin.H{"code": "save_failed", "message": err.Error()})
+			return
+		}
+
+		buf.Append("done", gin.H{
+			"message_id":    saved.ID,
+			"finish_reason": chunk.FinishReason,
+			"usage":         chunk.Usage,
+			"citations":     citations,
+		})
 		return
 	}
 
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
+	// The channel closed without a Done chunk, which only happens when ctx expired
+	buf.Append("error", gin.H{"code": "timeout", "message": "generation did not complete in time"})
+}
+
+// writeChatStream sends the buffer's events after seq and follows it until it closes
+// or the client goes away
+func writeChatStream(c *gin.Context, buf *services.StreamBuffer, seq int) {
+	setStreamHeaders(c)
 
-	c.Stream(func(w io.Writer) bool {
-		resp, err := iter.Next()
-		if err == iterator.Done {
-			return false
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		events, closed, changed := buf.Since(seq)
+		for _, evt := range events {
+			if err := writeStreamEvent(c.Writer, evt); err != nil {
+				return
+			}
+			seq++
 		}
-		if err != nil {
-			return false
+		c.Writer.Flush()
+
+		if closed && len(events) == 0 {
+			return
 		}
 
-		if len(resp.Candidates) > 0 && len(resp.Candidates[0].Content.Parts) > 0 {
-			part := resp.Candidates[0].Content.Parts[0]
-			c.SSEvent("message", gin.H{
-				"chunk": fmt.Sprintf("%v", part),
-			})
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			if _, err := io.WriteString(c.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
 		}
-		return true
-	})
+	}
+}
+
+func setStreamHeaders(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Stop nginx-style proxies from buffering the whole response
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+}
+
+func writeStreamEvent(w io.Writer, evt services.StreamEvent) error {
+	data, err := json.Marshal(evt.Data)
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	if evt.ID != "" {
+		sb.WriteString("id: " + evt.ID + "\n")
+	}
+	sb.WriteString("event: " + evt.Event + "\n")
+	sb.WriteString("data: " + string(data) + "\n\n")
+
+	_, err = io.WriteString(w, sb.String())
+	return err
 }
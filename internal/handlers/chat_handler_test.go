@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"bytes"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"dory-backend/internal/services"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// fakeSearcher returns fixed sources and records the scopes it was asked for
+type fakeSearcher struct {
+	sources []models.Source
+	scopes  []services.SearchScope
+	queries []string
+}
+
+func (f *fakeSearcher) SearchChunks(scope services.SearchScope, query string) ([]models.Source, error) {
+	f.scopes = append(f.scopes, scope)
+	f.queries = append(f.queries, query)
+	return f.sources, nil
+}
+
+// The models default their IDs with Postgres' gen_random_uuid(), so the test schema is
+// written out by hand with an SQLite equivalent
+const chatTestSchema = `
+CREATE TABLE conversations (
+	id TEXT PRIMARY KEY DEFAULT (lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' ||
+		substr(hex(randomblob(2)), 2) || '-a' || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6)))),
+	user_id TEXT,
+	title TEXT,
+	created_at DATETIME,
+	updated_at DATETIME
+);
+CREATE TABLE messages (
+	id TEXT PRIMARY KEY DEFAULT (lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' ||
+		substr(hex(randomblob(2)), 2) || '-a' || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6)))),
+	conversation_id TEXT,
+	role TEXT NOT NULL,
+	content TEXT,
+	sources TEXT,
+	citations TEXT,
+	created_at DATETIME
+);`
+
+type chatTest struct {
+	router   *gin.Engine
+	userID   uuid.UUID
+	model    *services.ScriptedChatModel
+	searcher *fakeSearcher
+}
+
+func newChatTest(t *testing.T) *chatTest {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a new database
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.Exec(chatTestSchema).Error; err != nil {
+		t.Fatalf("creating test schema: %v", err)
+	}
+
+	ct := &chatTest{
+		userID:   uuid.New(),
+		model:    &services.ScriptedChatModel{},
+		searcher: &fakeSearcher{},
+	}
+
+	prevDB, prevConfig, prevModel, prevSearcher := config.DB, config.AppConfig, services.ActiveChatModel, services.ActiveSearcher
+	t.Cleanup(func() {
+		config.DB, config.AppConfig, services.ActiveChatModel, services.ActiveSearcher = prevDB, prevConfig, prevModel, prevSearcher
+	})
+	config.DB = db
+	config.AppConfig = &config.Config{ChatHistoryTokens: 2000}
+	services.ActiveChatModel = ct.model
+	services.ActiveSearcher = ct.searcher
+
+	ct.router = gin.New()
+	ct.router.POST("/api/chat", func(c *gin.Context) {
+		c.Set("userID", ct.userID.String())
+		c.Next()
+	}, Chat)
+	return ct
+}
+
+type chatResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Data    struct {
+		Response       string            `json:"response"`
+		ConversationID string            `json:"conversation_id"`
+		MessageID      string            `json:"message_id"`
+		Sources        []models.Source   `json:"sources"`
+		Citations      []models.Citation `json:"citations"`
+	} `json:"data"`
+}
+
+func (ct *chatTest) post(t *testing.T, body map[string]string) (int, chatResponse) {
+	t.Helper()
+	raw, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, "/api/chat", bytes.NewReader(raw))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	ct.router.ServeHTTP(rec, req)
+
+	var resp chatResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, resp
+}
+
+func TestChatAnswersFromSources(t *testing.T) {
+	ct := newChatTest(t)
+	ct.searcher.sources = []models.Source{{
+		DocumentID: uuid.NewString(),
+		Filename:   "syllabus.pdf",
+		ChunkIndex: 3,
+		PageStart:  2,
+		PageEnd:    2,
+		Content:    "The midterm exam is on Friday 14 March in room B12.",
+	}}
+	ct.model.Responses = []string{"The midterm is on Friday 14 March [1]."}
+
+	code, resp := ct.post(t, map[string]string{"message": "When is the midterm?"})
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", code, resp.Message)
+	}
+	if resp.Data.Response != "The midterm is on Friday 14 March [1]." {
+		t.Errorf("response = %q", resp.Data.Response)
+	}
+	if len(resp.Data.Citations) != 1 || resp.Data.Citations[0].Marker != 1 || resp.Data.Citations[0].Source.Filename != "syllabus.pdf" {
+		t.Errorf("citations = %+v, want marker 1 for syllabus.pdf", resp.Data.Citations)
+	}
+	if _, err := uuid.Parse(resp.Data.ConversationID); err != nil {
+		t.Errorf("conversation_id %q is not a UUID", resp.Data.ConversationID)
+	}
+
+	// Without a scope the search covers only the user's own documents
+	if len(ct.searcher.scopes) != 1 {
+		t.Fatalf("searched %d times, want 1", len(ct.searcher.scopes))
+	}
+	if scope := ct.searcher.scopes[0]; scope.UserID != ct.userID || !scope.Personal || len(scope.WorkspaceIDs) != 0 {
+		t.Errorf("scope = %+v, want the user's personal documents", scope)
+	}
+
+	// The model sees the retrieved chunk labelled with its number and page
+	if len(ct.model.Requests) != 1 {
+		t.Fatalf("model called %d times, want 1", len(ct.model.Requests))
+	}
+	prompt := ct.model.Requests[0].Messages[len(ct.model.Requests[0].Messages)-1].Content
+	if !strings.Contains(prompt, "[1] (syllabus.pdf, p. 2)") || !strings.Contains(prompt, "room B12") {
+		t.Errorf("prompt does not carry the source:\n%s", prompt)
+	}
+
+	var messages []models.Message
+	if err := config.DB.Where("conversation_id = ?", resp.Data.ConversationID).Order("created_at").Find(&messages).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Role != services.RoleUser || messages[1].Role != services.RoleAssistant {
+		t.Fatalf("saved messages = %+v, want a user and an assistant turn", messages)
+	}
+	if len(messages[0].Sources) != 1 {
+		t.Errorf("user turn saved %d sources, want 1", len(messages[0].Sources))
+	}
+	if len(messages[1].Sources) != 1 || len(messages[1].Citations) != 1 {
+		t.Errorf("assistant turn saved %d sources and %d citations, want 1 and 1", len(messages[1].Sources), len(messages[1].Citations))
+	}
+}
+
+func TestChatContinuesConversation(t *testing.T) {
+	ct := newChatTest(t)
+	ct.model.Responses = []string{"It is in room B12.", "It starts at 9:00."}
+
+	_, first := ct.post(t, map[string]string{"message": "Where is the midterm?"})
+	code, second := ct.post(t, map[string]string{"message": "And when?", "conversation_id": first.Data.ConversationID})
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", code, second.Message)
+	}
+	if second.Data.ConversationID != first.Data.ConversationID {
+		t.Errorf("conversation_id = %s, want %s", second.Data.ConversationID, first.Data.ConversationID)
+	}
+
+	// The earlier turns are sent as history and the follow-up is searched together with them
+	req := ct.model.Requests[1]
+	if len(req.Messages) != 3 || req.Messages[0].Content != "Where is the midterm?" || req.Messages[1].Content != "It is in room B12." {
+		t.Errorf("history = %+v, want the first question and answer", req.Messages)
+	}
+	if !strings.Contains(ct.searcher.queries[1], "Where is the midterm?") {
+		t.Errorf("retrieval query %q does not include the previous question", ct.searcher.queries[1])
+	}
+}
+
+func TestChatRejectsOtherUsersConversation(t *testing.T) {
+	ct := newChatTest(t)
+	other := models.Conversation{UserID: uuid.New(), Title: "Not yours"}
+	if err := config.DB.Create(&other).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := ct.post(t, map[string]string{"message": "Hello", "conversation_id": other.ID.String()})
+	if code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", code)
+	}
+	if len(ct.model.Requests) != 0 {
+		t.Errorf("model was called for a conversation the user cannot access")
+	}
+}
+
+func TestChatRequiresMessage(t *testing.T) {
+	ct := newChatTest(t)
+
+	code, _ := ct.post(t, map[string]string{"conversation_id": ""})
+	if code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", code)
+	}
+}
+
+func TestChatModelFailureSavesNothing(t *testing.T) {
+	ct := newChatTest(t)
+	ct.model.Err = errors.New("model unavailable")
+
+	code, resp := ct.post(t, map[string]string{"message": "When is the midterm?"})
+	if code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", code)
+	}
+	if resp.Success {
+		t.Error("success = true for a failed generation")
+	}
+
+	var count int64
+	config.DB.Model(&models.Message{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d messages saved after a failed generation, want 0", count)
+	}
+	// The new conversation is only stored with its first turn
+	config.DB.Model(&models.Conversation{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d conversations saved after a failed generation, want 0", count)
+	}
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"dory-backend/internal/services"
+	"dory-backend/internal/utils"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func CreateConversation(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		Title string `json:"title" binding:"max=255"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	conv := models.Conversation{
+		UserID: userID,
+		Title:  strings.TrimSpace(input.Title),
+	}
+	if conv.Title == "" {
+		conv.Title = "New conversation"
+	}
+
+	if err := config.DB.Create(&conv).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to create conversation", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusCreated, "Conversation created successfully", conv)
+}
+
+func ListConversations(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		utils.SendError(c, http.StatusBadRequest, "Invalid page", "page must be a positive integer")
+		return
+	}
+
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		utils.SendError(c, http.StatusBadRequest, "Invalid page size", "page_size must be between 1 and 100")
+		return
+	}
+
+	query := config.DB.Model(&models.Conversation{}).Where("user_id = ?", userID)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch conversations", err.Error())
+		return
+	}
+
+	var convs []models.Conversation
+	if err := query.Order("updated_at DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&convs).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch conversations", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Conversations retrieved successfully", gin.H{
+		"conversations": convs,
+		"total":         total,
+		"page":          page,
+		"page_size":     pageSize,
+	})
+}
+
+func GetConversation(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	convUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid conversation ID", err.Error())
+		return
+	}
+
+	var conv models.Conversation
+	err = config.DB.Preload("Messages", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at ASC")
+	}).Where("id = ? AND user_id = ?", convUUID, userID).First(&conv).Error
+	if err != nil {
+		utils.SendError(c, http.StatusNotFound, "Conversation not found", "Conversation does not exist or you don't have access")
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Conversation retrieved successfully", conv)
+}
+
+func DeleteConversation(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	convUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid conversation ID", err.Error())
+		return
+	}
+
+	var conv models.Conversation
+	if err := config.DB.Where("id = ? AND user_id = ?", convUUID, userID).First(&conv).Error; err != nil {
+		utils.SendError(c, http.StatusNotFound, "Conversation not found", "Conversation does not exist or you don't have access")
+		return
+	}
+
+	if err := services.DeleteConversation(conv.ID); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to delete conversation", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Conversation deleted successfully", gin.H{"id": conv.ID})
+}
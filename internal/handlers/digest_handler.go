@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"dory-backend/internal/models"
+	"dory-backend/internal/services"
+	"dory-backend/internal/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetDigest builds the caller's digest now. Query: period = day (default) or week,
+// summarize = false to skip the model's briefing
+func GetDigest(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	period := c.DefaultQuery("period", models.DigestDaily)
+	if period != models.DigestDaily && period != models.DigestWeekly {
+		utils.SendError(c, http.StatusBadRequest, "Invalid period", services.ErrInvalidDigestPeriod.Error())
+		return
+	}
+	summarize := c.DefaultQuery("summarize", "true") != "false"
+
+	digest, err := services.BuildDigest(c.Request.Context(), userID, period, time.Now(), summarize)
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to build digest", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Digest generated successfully", digest)
+}
@@ -5,10 +5,13 @@ import (
 	"dory-backend/internal/models"
 	"dory-backend/internal/services"
 	"dory-backend/internal/utils"
+	"errors"
+	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -37,9 +40,8 @@ func UploadPDF(c *gin.Context) {
 		return
 	}
 
-	header, err := c.FormFile("file")
-	if err != nil {
-		utils.SendError(c, http.StatusBadRequest, "File is required", err.Error())
+	header, ok := formUpload(c)
+	if !ok {
 		return
 	}
 
@@ -63,16 +65,37 @@ func UploadPDF(c *gin.Context) {
 		return
 	}
 
+	documentDate, err := parseDocumentDate(c.PostForm("document_date"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid document date", err.Error())
+		return
+	}
+
+	workspaceID, ok := uploadWorkspace(c, userID, c.PostForm("workspace_id"))
+	if !ok {
+		return
+	}
+
 	// Reset file pointer after validation
 	file.Seek(0, 0)
 
+	data, err := io.ReadAll(file)
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to read file", err.Error())
+		return
+	}
+
 	// Extract text from PDF before uploading to Cloudinary
 	// This avoids the need to download from Cloudinary later (which can have auth issues)
-	text, err := services.ExtractTextFromFile(file)
+	extractor := services.PDFExtractor{}
+	text, pages, err := extractor.Extract(data)
 	if err != nil {
 		utils.SendError(c, http.StatusBadRequest, "PDF extraction failed", err.Error())
 		return
 	}
+	if documentDate == nil {
+		documentDate = extractor.DocumentDate(data)
+	}
 
 	// Reset file pointer again for Cloudinary upload
 	file.Seek(0, 0)
@@ -88,66 +111,254 @@ func UploadPDF(c *gin.Context) {
 		Filename: filename,
 		FileURL:  cloudURL,
 		PublicID: publicID,
+		FileType: services.FileTypePDF,
 		Status:   "processing",
 		Content:  text, // Store extracted text immediately
+		// Page offsets let chunks and citations point back to a page
+		PageCount:    len(pages),
+		PageStats:    pages,
+		DocumentDate: documentDate,
+		WorkspaceID:  workspaceID,
 	}
+	services.ApplyChunkDefaults(&newDoc)
 
 	config.DB.Create(&newDoc)
 
-	// Synchronous Event Detection
-	var events []models.DetectedEvent
-	const minConfidence = 0.6
-	detectedEvents, err := services.DetectEvents(text)
+	// Chunking, embedding and event detection run on the job queue so they survive restarts
+	// and transient API failures
+	if err := services.EnqueueJob(userID, newDoc.ID, models.JobTypeEmbedDocument); err != nil {
+		log.Printf("Failed to queue processing for doc %s: %v", newDoc.ID, err)
+		config.DB.Model(&newDoc).Update("status", "failed")
+	}
+	enqueueEventDetection(newDoc)
+
+	utils.SendSuccess(c, http.StatusAccepted, "Upload successful, processing started", gin.H{
+		"document": newDoc,
+	})
+}
+
+// UploadFile ingests any supported file type, picking an extractor from the file's content
+// rather than its extension
+func UploadFile(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	header, ok := formUpload(c)
+	if !ok {
+		return
+	}
+
+	documentDate, err := parseDocumentDate(c.PostForm("document_date"))
 	if err != nil {
-		log.Printf("Event detection failed for doc %s: %v", newDoc.ID, err)
-	} else {
-		for _, evt := range detectedEvents {
-			if evt.Confidence < minConfidence {
-				continue
-			}
-
-			detected := models.DetectedEvent{
-				ID:         uuid.New(),
-				UserID:     userID,
-				DocumentID: newDoc.ID,
-				Title:      evt.Title,
-				StartTime:  evt.StartTime,
-				EndTime:    evt.EndTime,
-				Location:   evt.Location,
-				Confidence: evt.Confidence,
-				SourceText: evt.SourceText,
-				DetectedAt: time.Now(),
-			}
-			config.DB.Create(&detected)
-			events = append(events, detected)
+		utils.SendError(c, http.StatusBadRequest, "Invalid document date", err.Error())
+		return
+	}
+
+	workspaceID, ok := uploadWorkspace(c, userID, c.PostForm("workspace_id"))
+	if !ok {
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to open file", err.Error())
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to read file", err.Error())
+		return
+	}
+
+	extractor, fileType, err := services.DetectExtractor(data, header.Filename)
+	if err != nil {
+		utils.SendError(c, http.StatusUnsupportedMediaType, "Invalid file type",
+			"Supported types are PDF, DOCX, Markdown, HTML, EPUB, iCalendar and plain text")
+		return
+	}
+
+	text, pages, err := extractor.Extract(data)
+	if err != nil && fileType == services.FileTypeICS {
+		utils.SendError(c, http.StatusUnprocessableEntity, "Invalid calendar file", err.Error())
+		return
+	}
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Text extraction failed", err.Error())
+		return
+	}
+
+	// A date given by the uploader wins over whatever the file's metadata says
+	if dater, ok := extractor.(services.DocumentDater); ok && documentDate == nil {
+		documentDate = dater.DocumentDate(data)
+	}
+
+	// Calendar files are parsed up front so a broken one is rejected before anything is stored.
+	// Floating times in the file are in the user's own zone.
+	var calendar *services.ICSCalendar
+	if fileType == services.FileTypeICS {
+		calendar, err = services.ParseICS(data, services.UserLocation(userID))
+		if err != nil {
+			utils.SendError(c, http.StatusUnprocessableEntity, "Invalid calendar file", err.Error())
+			return
 		}
 	}
 
-	// Process the extracted text asynchronously (chunking, embedding)
-	go func(docID uuid.UUID, uID uuid.UUID, extractedText string, cloudPublicID string) {
-		chunks := services.ChunkText(extractedText, 300)
-		err := services.StoreChunksInQdrant(uID.String(), docID.String(), chunks)
+	// Reset file pointer for Cloudinary upload
+	file.Seek(0, 0)
+
+	cloudURL, publicID, err := services.UploadToCloudinary(file, uuid.New().String())
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Cloud upload failed", err.Error())
+		return
+	}
+
+	newDoc := models.Document{
+		UserID:       userID,
+		WorkspaceID:  workspaceID,
+		Filename:     header.Filename,
+		FileURL:      cloudURL,
+		PublicID:     publicID,
+		FileType:     fileType,
+		Status:       "processing",
+		Content:      text,
+		PageCount:    len(pages),
+		PageStats:    pages,
+		DocumentDate: documentDate,
+	}
+	services.ApplyChunkDefaults(&newDoc)
+
+	config.DB.Create(&newDoc)
+
+	response := gin.H{"document": newDoc}
+	if fileType == services.FileTypeICS {
+		// Calendar files already describe their events exactly, so they skip LLM detection
+		// and become confirmed events directly
+		imported, err := services.ImportICSEvents(userID, newDoc.ID, calendar)
 		if err != nil {
-			log.Printf("Qdrant storage failed for doc %s: %v", docID, err)
-			config.DB.Model(&models.Document{}).Where("id = ?", docID).Update("status", "failed")
+			log.Printf("Calendar import failed for doc %s: %v", newDoc.ID, err)
+			newDoc.Status = "failed"
+			config.DB.Model(&newDoc).Update("status", newDoc.Status)
+			response["import_error"] = err.Error()
+			utils.SendSuccess(c, http.StatusAccepted, "Upload stored, but its events could not be imported", response)
 			return
 		}
+		response["imported_events"] = imported
+	} else {
+		enqueueEventDetection(newDoc)
+	}
+
+	// The text is still embedded so chat can answer questions about event details
+	if err := services.EnqueueJob(userID, newDoc.ID, models.JobTypeEmbedDocument); err != nil {
+		log.Printf("Failed to queue processing for doc %s: %v", newDoc.ID, err)
+		config.DB.Model(&newDoc).Update("status", "failed")
+	}
 
-		// Update status to ready
-		config.DB.Model(&models.Document{}).Where("id = ?", docID).Update("status", "ready")
-		log.Printf("Document %s fully processed and embedded", docID)
+	utils.SendSuccess(c, http.StatusAccepted, "Upload successful, processing started", response)
+}
+
+// enqueueEventDetection queues event detection for a new document; the job retries when
+// the model is unavailable, so a failure to queue is only logged
+func enqueueEventDetection(doc models.Document) {
+	if err := services.EnqueueJob(doc.UserID, doc.ID, models.JobTypeDetectEvents); err != nil {
+		log.Printf("Event detection could not be queued for doc %s: %v", doc.ID, err)
+	}
+}
 
-		// Delete from Cloudinary after processing (since we have the content stored)
-		if cloudPublicID != "" {
-			services.DeleteFromCloudinary(cloudPublicID)
-			config.DB.Model(&models.Document{}).Where("id = ?", docID).Update("file_url", "")
+func maxUploadBytes() int64 {
+	return int64(config.AppConfig.MaxUploadMB) << 20
+}
+
+func sendUploadTooLarge(c *gin.Context) {
+	utils.SendError(c, http.StatusRequestEntityTooLarge, "File too large",
+		"Uploads are limited to "+strconv.Itoa(config.AppConfig.MaxUploadMB)+" MB")
+}
+
+// formUpload reads the multipart "file" field, refusing uploads over MAX_UPLOAD_MB before
+// they are read into memory. It writes the error response itself.
+func formUpload(c *gin.Context) (*multipart.FileHeader, bool) {
+	// The body may be a little larger than the file for the other form fields
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadBytes()+1<<20)
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			sendUploadTooLarge(c)
+			return nil, false
 		}
-	}(newDoc.ID, userID, text, publicID)
+		utils.SendError(c, http.StatusBadRequest, "File is required", err.Error())
+		return nil, false
+	}
+	if header.Size > maxUploadBytes() {
+		sendUploadTooLarge(c)
+		return nil, false
+	}
+	return header, true
+}
 
-	utils.SendSuccess(c, http.StatusAccepted, "Upload successful, processing started", gin.H{
-		"document":        newDoc,
-		"detected_events": events,
-	})
+// uploadWorkspace resolves the optional workspace an upload goes to, which needs an editor.
+// It writes the error response itself.
+func uploadWorkspace(c *gin.Context, userID uuid.UUID, value string) (*uuid.UUID, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, true
+	}
+	workspaceID, err := uuid.Parse(value)
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid workspace ID", err.Error())
+		return nil, false
+	}
+	if _, err := services.RequireWorkspaceRole(workspaceID, userID, models.WorkspaceRoleEditor); err != nil {
+		sendWorkspaceError(c, err, "Failed to check workspace")
+		return nil, false
+	}
+	return &workspaceID, true
+}
+
+// loadDocument fetches a document the caller can access with at least role min: their own
+// personal documents, or documents of their workspaces. It writes the error response itself.
+func loadDocument(c *gin.Context, userID uuid.UUID, min string) (models.Document, bool) {
+	var doc models.Document
+	docUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid document ID", err.Error())
+		return doc, false
+	}
+	if err := config.DB.Where("id = ?", docUUID).First(&doc).Error; err != nil {
+		utils.SendError(c, http.StatusNotFound, "Document not found", "Document does not exist or you don't have access")
+		return doc, false
+	}
+	role, err := services.DocumentRole(doc, userID)
+	if err != nil {
+		utils.SendError(c, http.StatusNotFound, "Document not found", "Document does not exist or you don't have access")
+		return doc, false
+	}
+	if !services.RoleAtLeast(role, min) {
+		utils.SendError(c, http.StatusForbidden, "Insufficient workspace role", services.ErrWorkspaceForbidden.Error())
+		return doc, false
+	}
+	return doc, true
+}
+
+// parseDocumentDate reads an optional date the uploader gives for when the document was written
+func parseDocumentDate(value string) (*time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	// A bare date is pinned to midday UTC so it stays on the same day in every user's zone
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		t = t.Add(12 * time.Hour)
+		return &t, nil
+	}
+	return nil, errors.New("document_date must be YYYY-MM-DD or an RFC 3339 timestamp")
 }
 
 // Helper function to check if file has PDF extension
@@ -175,72 +386,59 @@ func IngestText(c *gin.Context) {
 	}
 
 	var input struct {
-		Content  string `json:"content" binding:"required"`
-		Filename string `json:"filename"`
+		Content      string `json:"content" binding:"required"`
+		Filename     string `json:"filename"`
+		DocumentDate string `json:"document_date"`
+		WorkspaceID  string `json:"workspace_id"`
 	}
 
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadBytes())
 	if err := c.ShouldBindJSON(&input); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			sendUploadTooLarge(c)
+			return
+		}
 		utils.SendError(c, http.StatusBadRequest, "Content is required", err.Error())
 		return
 	}
 
+	documentDate, err := parseDocumentDate(input.DocumentDate)
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid document date", err.Error())
+		return
+	}
+
+	workspaceID, ok := uploadWorkspace(c, userID, input.WorkspaceID)
+	if !ok {
+		return
+	}
+
 	newDoc := models.Document{
-		UserID:   userID,
-		Filename: input.Filename,
-		Content:  input.Content,
-		FileType: "text",
-		Status:   "ready",
+		UserID:       userID,
+		WorkspaceID:  workspaceID,
+		Filename:     input.Filename,
+		Content:      input.Content,
+		FileType:     services.FileTypeText,
+		Status:       "processing",
+		DocumentDate: documentDate,
 	}
 
 	if newDoc.Filename == "" {
 		newDoc.Filename = "Quick Note " + uuid.New().String()[:8]
 	}
+	services.ApplyChunkDefaults(&newDoc)
 
 	config.DB.Create(&newDoc)
 
-	// Synchronous Event Detection
-	var events []models.DetectedEvent
-	const minConfidence = 0.6
-	detectedEvents, err := services.DetectEvents(input.Content)
-	if err != nil {
-		log.Printf("Event detection failed for doc %s: %v", newDoc.ID, err)
-	} else {
-		for _, evt := range detectedEvents {
-			if evt.Confidence < minConfidence {
-				continue
-			}
-
-			detected := models.DetectedEvent{
-				ID:         uuid.New(),
-				UserID:     userID,
-				DocumentID: newDoc.ID,
-				Title:      evt.Title,
-				StartTime:  evt.StartTime,
-				EndTime:    evt.EndTime,
-				Location:   evt.Location,
-				Confidence: evt.Confidence,
-				SourceText: evt.SourceText,
-				DetectedAt: time.Now(),
-			}
-			config.DB.Create(&detected)
-			events = append(events, detected)
-		}
+	if err := services.EnqueueJob(userID, newDoc.ID, models.JobTypeEmbedDocument); err != nil {
+		log.Printf("Failed to queue embedding for doc %s: %v", newDoc.ID, err)
+		config.DB.Model(&newDoc).Update("status", "failed")
 	}
-
-	// Async processing for Qdrant
-	go func(uID uuid.UUID, docID uuid.UUID, content string) {
-		chunks := services.ChunkText(content, 300)
-		err := services.StoreChunksInQdrant(uID.String(), docID.String(), chunks)
-		if err != nil {
-			log.Printf("Text embedding failed for doc %s: %v", docID, err)
-			config.DB.Model(&models.Document{}).Where("id = ?", docID).Update("status", "failed")
-			return
-		}
-	}(userID, newDoc.ID, input.Content) // Pass variables explicitly to the closure
+	enqueueEventDetection(newDoc)
 
 	utils.SendSuccess(c, http.StatusCreated, "Text ingested and embedding started", gin.H{
-		"document":        newDoc,
-		"detected_events": events,
+		"document": newDoc,
 	})
 }
 
@@ -251,23 +449,164 @@ func GetDocument(c *gin.Context) {
 		return
 	}
 
-	documentID := c.Param("id")
-	if documentID == "" {
-		utils.SendError(c, http.StatusBadRequest, "Document ID is required", "Missing document ID parameter")
+	doc, ok := loadDocument(c, userID, models.WorkspaceRoleViewer)
+	if !ok {
 		return
 	}
 
-	docUUID, err := uuid.Parse(documentID)
+	utils.SendSuccess(c, http.StatusOK, "Document retrieved successfully", doc)
+}
+
+func ListDocuments(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		utils.SendError(c, http.StatusBadRequest, "Invalid page", "page must be a positive integer")
+		return
+	}
+
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		utils.SendError(c, http.StatusBadRequest, "Invalid page size", "page_size must be between 1 and 100")
+		return
+	}
+
+	scope, err := services.ResolveSearchScope(userID, c.Query("scope"), c.Query("workspace_id"))
 	if err != nil {
-		utils.SendError(c, http.StatusBadRequest, "Invalid document ID", err.Error())
+		sendWorkspaceError(c, err, "Failed to resolve search scope")
 		return
 	}
 
-	var doc models.Document
-	if err := config.DB.Where("id = ? AND user_id = ?", docUUID, userID).First(&doc).Error; err != nil {
-		utils.SendError(c, http.StatusNotFound, "Document not found", "Document does not exist or you don't have access")
+	query := config.DB.Model(&models.Document{}).Scopes(services.DocumentsInScope(scope))
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if fileType := c.Query("file_type"); fileType != "" {
+		query = query.Where("file_type = ?", fileType)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch documents", err.Error())
 		return
 	}
 
-	utils.SendSuccess(c, http.StatusOK, "Document retrieved successfully", doc)
+	// Content can be large, so the listing leaves it out; fetch a single document to read it
+	var docs []models.Document
+	if err := query.Omit("content").Order("uploaded_at DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).Find(&docs).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch documents", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Documents retrieved successfully", gin.H{
+		"documents": docs,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+func RenameDocument(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		Filename string `json:"filename" binding:"required,max=255"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Filename is required", err.Error())
+		return
+	}
+
+	filename := strings.TrimSpace(input.Filename)
+	if filename == "" {
+		utils.SendError(c, http.StatusBadRequest, "Filename is required", "Filename cannot be blank")
+		return
+	}
+
+	doc, ok := loadDocument(c, userID, models.WorkspaceRoleEditor)
+	if !ok {
+		return
+	}
+
+	if err := config.DB.Model(&doc).Update("filename", filename).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to rename document", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Document renamed successfully", doc)
+}
+
+func DeleteDocument(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	doc, ok := loadDocument(c, userID, models.WorkspaceRoleEditor)
+	if !ok {
+		return
+	}
+
+	if err := services.DeleteDocument(doc); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to delete document", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Document deleted successfully", gin.H{"id": doc.ID})
+}
+
+func RechunkDocument(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		Strategy string `json:"strategy"`
+		Size     int    `json:"chunk_size"`
+		Overlap  *int   `json:"chunk_overlap"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	doc, ok := loadDocument(c, userID, models.WorkspaceRoleEditor)
+	if !ok {
+		return
+	}
+
+	// Anything left out falls back to the configured defaults
+	defaults := models.Document{}
+	services.ApplyChunkDefaults(&defaults)
+	strategy, size, overlap := defaults.ChunkStrategy, defaults.ChunkSize, defaults.ChunkOverlap
+	if input.Strategy != "" {
+		strategy = input.Strategy
+		size, overlap = 0, 0
+	}
+	if input.Size > 0 {
+		size = input.Size
+	}
+	if input.Overlap != nil {
+		overlap = *input.Overlap
+	}
+
+	if err := services.RechunkDocument(&doc, strategy, size, overlap); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Failed to re-chunk document", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusAccepted, "Re-chunking started", doc)
 }
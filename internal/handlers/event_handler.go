@@ -3,12 +3,69 @@ package handlers
 import (
 	"dory-backend/internal/config"
 	"dory-backend/internal/models"
+	"dory-backend/internal/services"
 	"dory-backend/internal/utils"
+	"errors"
+	"io"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
+// eventInput carries the editable fields of an event; omitted fields are left unchanged and
+// an empty location or rrule clears it
+type eventInput struct {
+	Title     *string      `json:"title"`
+	StartTime *time.Time   `json:"start_time"`
+	EndTime   *time.Time   `json:"end_time"`
+	Location  *string      `json:"location"`
+	AllDay    *bool        `json:"all_day"`
+	RRule     *string      `json:"rrule"`
+	ExDates   *[]time.Time `json:"exdates"`
+	TimeZone  *string      `json:"time_zone"`
+	// RemindersMuted only applies to calendar events
+	RemindersMuted *bool `json:"reminders_muted"`
+}
+
+func (in eventInput) applyTo(title *string, start **time.Time, end **time.Time, location **string, allDay *bool) {
+	if in.Title != nil {
+		*title = strings.TrimSpace(*in.Title)
+	}
+	if in.StartTime != nil {
+		*start = in.StartTime
+	}
+	if in.EndTime != nil {
+		*end = in.EndTime
+	}
+	if in.Location != nil {
+		if loc := strings.TrimSpace(*in.Location); loc != "" {
+			*location = &loc
+		} else {
+			*location = nil
+		}
+	}
+	if in.AllDay != nil {
+		*allDay = *in.AllDay
+	}
+}
+
+func (in eventInput) applyRecurrence(rrule *string, exdates *models.JSONList[time.Time], timeZone *string) {
+	if in.RRule != nil {
+		*rrule = strings.TrimSpace(*in.RRule)
+	}
+	if in.ExDates != nil {
+		*exdates = *in.ExDates
+	}
+	if in.TimeZone != nil {
+		*timeZone = strings.TrimSpace(*in.TimeZone)
+	}
+}
+
 func GetDetectedEvents(c *gin.Context) {
 	userID, ok := getAuthUserID(c)
 	if !ok {
@@ -16,8 +73,19 @@ func GetDetectedEvents(c *gin.Context) {
 		return
 	}
 
+	// Only detections awaiting review are listed unless asked otherwise
+	query := config.DB.Where("user_id = ?", userID)
+	switch status := c.DefaultQuery("status", models.DetectedEventPending); status {
+	case "all":
+	case models.DetectedEventPending, models.DetectedEventAccepted, models.DetectedEventDismissed, models.DetectedEventMerged:
+		query = query.Where("status = ?", status)
+	default:
+		utils.SendError(c, http.StatusBadRequest, "Invalid status", "status must be pending, accepted, dismissed, merged or all")
+		return
+	}
+
 	var events []models.DetectedEvent
-	if err := config.DB.Where("user_id = ?", userID).Order("detected_at DESC").Find(&events).Error; err != nil {
+	if err := query.Order("detected_at DESC").Find(&events).Error; err != nil {
 		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch events", err.Error())
 		return
 	}
@@ -25,6 +93,459 @@ func GetDetectedEvents(c *gin.Context) {
 	utils.SendSuccess(c, http.StatusOK, "Events retrieved successfully", events)
 }
 
+// loadDetectedEvent fetches a detection owned by the caller, writing the error response itself
+func loadDetectedEvent(c *gin.Context, userID uuid.UUID) (models.DetectedEvent, bool) {
+	var detected models.DetectedEvent
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid event ID", err.Error())
+		return detected, false
+	}
+	if err := config.DB.Where("id = ? AND user_id = ?", id, userID).First(&detected).Error; err != nil {
+		utils.SendError(c, http.StatusNotFound, "Event not found", "Detected event does not exist or you don't have access")
+		return detected, false
+	}
+	return detected, true
+}
+
+func UpdateDetectedEvent(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input eventInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	detected, ok := loadDetectedEvent(c, userID)
+	if !ok {
+		return
+	}
+	if detected.Status != models.DetectedEventPending {
+		utils.SendError(c, http.StatusConflict, "Event already reviewed", services.ErrEventAlreadyReviewed.Error())
+		return
+	}
+
+	input.applyTo(&detected.Title, &detected.StartTime, &detected.EndTime, &detected.Location, &detected.AllDay)
+	input.applyRecurrence(&detected.RRule, &detected.ExDates, &detected.TimeZone)
+	if detected.StartTime != nil && detected.EndTime != nil && detected.EndTime.Before(*detected.StartTime) {
+		utils.SendError(c, http.StatusBadRequest, "Invalid event", services.ErrEventEndBeforeStart.Error())
+		return
+	}
+
+	// Checking the rule the way accepting will means a bad edit is caught now, not at accept time
+	draft := models.Event{StartTime: time.Now(), AllDay: detected.AllDay, RRule: detected.RRule, TimeZone: detected.TimeZone}
+	if detected.StartTime != nil {
+		draft.StartTime = *detected.StartTime
+	}
+	if err := services.PrepareEventRecurrence(&draft); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid event", err.Error())
+		return
+	}
+	detected.RRule = draft.RRule
+
+	if err := config.DB.Model(&detected).Select("title", "start_time", "end_time", "location", "all_day", "rrule", "ex_dates", "time_zone").Updates(&detected).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to update event", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Detected event updated successfully", detected)
+}
+
+// AcceptDetectedEvent confirms a detection, optionally with last-minute edits in the body,
+// and adds it to the calendar
+func AcceptDetectedEvent(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input eventInput
+	// An empty body, which chunked requests send without a Content-Length, means no changes
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	detected, ok := loadDetectedEvent(c, userID)
+	if !ok {
+		return
+	}
+	input.applyTo(&detected.Title, &detected.StartTime, &detected.EndTime, &detected.Location, &detected.AllDay)
+	input.applyRecurrence(&detected.RRule, &detected.ExDates, &detected.TimeZone)
+
+	event, err := services.AcceptDetectedEvent(&detected)
+	if err != nil {
+		if errors.Is(err, services.ErrEventAlreadyReviewed) {
+			utils.SendError(c, http.StatusConflict, "Event already reviewed", err.Error())
+			return
+		}
+		if errors.Is(err, services.ErrEventStartRequired) {
+			utils.SendError(c, http.StatusUnprocessableEntity, "Start time required", "Provide start_time to accept an event detected without a date")
+			return
+		}
+		utils.SendError(c, http.StatusBadRequest, "Invalid event", err.Error())
+		return
+	}
+
+	// Conflicts are only warnings; the event is accepted either way
+	conflicts, err := services.EventConflicts(event)
+	if err != nil {
+		log.Printf("Conflict check for event %s failed: %v", event.ID, err)
+	}
+
+	utils.SendSuccess(c, http.StatusCreated, "Event accepted", gin.H{
+		"event":          event,
+		"detected_event": detected,
+		"conflicts":      conflicts,
+	})
+}
+
+func DismissDetectedEvent(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	detected, ok := loadDetectedEvent(c, userID)
+	if !ok {
+		return
+	}
+
+	if err := services.DismissDetectedEvent(&detected); err != nil {
+		if errors.Is(err, services.ErrEventAlreadyReviewed) {
+			utils.SendError(c, http.StatusConflict, "Event already reviewed", err.Error())
+			return
+		}
+		utils.SendError(c, http.StatusInternalServerError, "Failed to dismiss event", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Event dismissed", detected)
+}
+
+// GetDetectedEventMerges shows which duplicates were merged into a detection, and so which
+// other documents mention it, along with the merge history
+func GetDetectedEventMerges(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	detected, ok := loadDetectedEvent(c, userID)
+	if !ok {
+		return
+	}
+
+	history, duplicates, err := services.DetectedEventMerges(detected)
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch merge history", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Merge history retrieved successfully", gin.H{
+		"detected_event": detected,
+		"duplicates":     duplicates,
+		"history":        history,
+	})
+}
+
+// MergeDetectedEvent merges the pending detection named in the body into the one in the URL
+func MergeDetectedEvent(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		DuplicateID uuid.UUID `json:"duplicate_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	canonical, ok := loadDetectedEvent(c, userID)
+	if !ok {
+		return
+	}
+	var duplicate models.DetectedEvent
+	if err := config.DB.Where("id = ? AND user_id = ?", input.DuplicateID, userID).First(&duplicate).Error; err != nil {
+		utils.SendError(c, http.StatusNotFound, "Event not found", "Duplicate detected event does not exist or you don't have access")
+		return
+	}
+
+	if err := services.MergeDetectedEvents(&canonical, &duplicate); err != nil {
+		switch {
+		case errors.Is(err, services.ErrEventAlreadyReviewed):
+			utils.SendError(c, http.StatusConflict, "Event already reviewed", err.Error())
+		case errors.Is(err, services.ErrEventMergeTarget):
+			utils.SendError(c, http.StatusBadRequest, "Invalid merge", "Merge a pending detection into a different pending or accepted one")
+		default:
+			utils.SendError(c, http.StatusInternalServerError, "Failed to merge events", err.Error())
+		}
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Events merged", gin.H{
+		"detected_event": canonical,
+		"duplicate":      duplicate,
+	})
+}
+
+// UnmergeDetectedEvent splits a merged duplicate off again so it can be reviewed on its own
+func UnmergeDetectedEvent(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	detected, ok := loadDetectedEvent(c, userID)
+	if !ok {
+		return
+	}
+
+	if err := services.UnmergeDetectedEvent(&detected); err != nil {
+		if errors.Is(err, services.ErrEventNotMerged) {
+			utils.SendError(c, http.StatusConflict, "Event not merged", err.Error())
+			return
+		}
+		utils.SendError(c, http.StatusInternalServerError, "Failed to unmerge event", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Event unmerged", detected)
+}
+
+// parseTimeRange reads optional RFC 3339 from/to query parameters
+func parseTimeRange(c *gin.Context) (from *time.Time, to *time.Time, err error) {
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, nil, errors.New("from must be an RFC 3339 timestamp")
+		}
+		from = &t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, nil, errors.New("to must be an RFC 3339 timestamp")
+		}
+		to = &t
+	}
+	if from != nil && to != nil && !to.After(*from) {
+		return nil, nil, errors.New("to must be after from")
+	}
+	return from, to, nil
+}
+
+// ListEvents returns calendar events, recurring series included once, with an occurrence
+// overlapping the optional [from, to) range
+func ListEvents(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid range", err.Error())
+		return
+	}
+
+	events, err := services.EventsInRange(userID, from, to)
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch events", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Events retrieved successfully", events)
+}
+
+func CreateEvent(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input eventInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+	if input.Title == nil || input.StartTime == nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid event", "title and start_time are required")
+		return
+	}
+
+	event := models.Event{ID: uuid.New(), UserID: userID}
+	start := &event.StartTime
+	input.applyTo(&event.Title, &start, &event.EndTime, &event.Location, &event.AllDay)
+	input.applyRecurrence(&event.RRule, &event.ExDates, &event.TimeZone)
+	event.StartTime = *start
+	if input.RemindersMuted != nil {
+		event.RemindersMuted = *input.RemindersMuted
+	}
+	if event.RRule != "" && event.TimeZone == "" {
+		// Recurring events keep the wall-clock time of the user's zone unless told otherwise
+		event.TimeZone = services.UserLocation(userID).String()
+	}
+
+	if err := services.ValidateEvent(event); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid event", err.Error())
+		return
+	}
+	if err := services.PrepareEventRecurrence(&event); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid event", err.Error())
+		return
+	}
+
+	if err := config.DB.Create(&event).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to create event", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusCreated, "Event created successfully", event)
+}
+
+// loadEvent fetches a calendar event owned by the caller, writing the error response itself
+func loadEvent(c *gin.Context, userID uuid.UUID) (models.Event, bool) {
+	var event models.Event
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid event ID", err.Error())
+		return event, false
+	}
+	if err := config.DB.Where("id = ? AND user_id = ?", id, userID).First(&event).Error; err != nil {
+		utils.SendError(c, http.StatusNotFound, "Event not found", "Event does not exist or you don't have access")
+		return event, false
+	}
+	return event, true
+}
+
+func GetEvent(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	event, ok := loadEvent(c, userID)
+	if !ok {
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Event retrieved successfully", event)
+}
+
+func UpdateEvent(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input eventInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	event, ok := loadEvent(c, userID)
+	if !ok {
+		return
+	}
+
+	start := &event.StartTime
+	input.applyTo(&event.Title, &start, &event.EndTime, &event.Location, &event.AllDay)
+	input.applyRecurrence(&event.RRule, &event.ExDates, &event.TimeZone)
+	event.StartTime = *start
+	if input.RemindersMuted != nil {
+		event.RemindersMuted = *input.RemindersMuted
+	}
+	if event.RRule != "" && event.TimeZone == "" {
+		event.TimeZone = services.UserLocation(userID).String()
+	}
+
+	if err := services.ValidateEvent(event); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid event", err.Error())
+		return
+	}
+	if err := services.PrepareEventRecurrence(&event); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid event", err.Error())
+		return
+	}
+
+	err := config.DB.Model(&event).
+		Select("title", "start_time", "end_time", "location", "all_day", "rrule", "ex_dates", "time_zone", "recurrence_end", "reminders_muted").
+		Updates(&event).Error
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to update event", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Event updated successfully", event)
+}
+
+func DeleteEvent(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	event, ok := loadEvent(c, userID)
+	if !ok {
+		return
+	}
+
+	if err := services.DeleteEvents(config.DB, []uuid.UUID{event.ID}); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to delete event", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Event deleted successfully", gin.H{"id": event.ID})
+}
+
+// Range defaults and caps for expanded occurrences
+const (
+	upcomingWindow         = 30 * 24 * time.Hour
+	maxUpcomingOccurrences = 500
+)
+
+// upcomingRange reads from and to, defaulting to now and 30 days after from
+func upcomingRange(c *gin.Context) (*time.Time, *time.Time, error) {
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if from == nil {
+		now := time.Now()
+		if to != nil && !to.After(now) {
+			return nil, nil, errors.New("to must be after from")
+		}
+		from = &now
+	}
+	if to == nil {
+		end := from.Add(upcomingWindow)
+		to = &end
+	}
+	return from, to, nil
+}
+
+// GetUpcomingEvents lists the occurrences of calendar events in [from, to), with recurring
+// events expanded. from defaults to now and to to 30 days after from.
 func GetUpcomingEvents(c *gin.Context) {
 	userID, ok := getAuthUserID(c)
 	if !ok {
@@ -32,12 +553,60 @@ func GetUpcomingEvents(c *gin.Context) {
 		return
 	}
 
-	var events []models.DetectedEvent
-	// Filter for events where StartTime is in the future
-	if err := config.DB.Where("user_id = ? AND start_time > ?", userID, "NOW()").Order("start_time ASC").Find(&events).Error; err != nil {
+	from, to, err := upcomingRange(c)
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid range", err.Error())
+		return
+	}
+
+	events, err := services.EventsInRange(userID, from, to)
+	if err != nil {
 		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch upcoming events", err.Error())
 		return
 	}
 
-	utils.SendSuccess(c, http.StatusOK, "Upcoming events retrieved successfully", events)
+	utils.SendSuccess(c, http.StatusOK, "Upcoming events retrieved successfully",
+		services.ExpandEvents(events, *from, *to, maxUpcomingOccurrences))
+}
+
+// GetEventConflicts reports overlapping events, back-to-back events at different places and
+// days with too many deadlines. Query: from (default now), to (default 30 days after from),
+// gap_minutes (default 15) and deadlines_per_day (default 3); 0 turns either check off.
+func GetEventConflicts(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	from, to, err := upcomingRange(c)
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid range", err.Error())
+		return
+	}
+	opts := services.DefaultConflictOptions
+	if v := c.Query("gap_minutes"); v != "" {
+		gap, err := strconv.Atoi(v)
+		if err != nil || gap < 0 || gap > 24*60 {
+			utils.SendError(c, http.StatusBadRequest, "Invalid gap_minutes", "gap_minutes must be between 0 and 1440")
+			return
+		}
+		opts.BackToBackGap = time.Duration(gap) * time.Minute
+	}
+	if v := c.Query("deadlines_per_day"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			utils.SendError(c, http.StatusBadRequest, "Invalid deadlines_per_day", "deadlines_per_day must be a non-negative integer")
+			return
+		}
+		opts.DeadlinesPerDay = n
+	}
+
+	conflicts, err := services.ScheduleConflicts(userID, *from, *to, opts)
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to check conflicts", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Conflicts retrieved successfully", conflicts)
 }
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"dory-backend/internal/services"
+	"dory-backend/internal/utils"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ListIdentities returns the identity provider accounts the caller can sign in with
+func ListIdentities(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var identities []models.UserIdentity
+	if err := config.DB.Where("user_id = ?", userID).Order("created_at").Find(&identities).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch identities", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Identities retrieved successfully", identities)
+}
+
+// LinkIdentity adds an identity provider account to the caller's account, proven by an ID
+// token from it. Body: {"id_token": "...", "nonce": "..."}, where the nonce comes from
+// IssueOIDCNonce.
+func LinkIdentity(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		IDToken string `json:"id_token" binding:"required"`
+		Nonce   string `json:"nonce" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	identity, err := services.VerifyIdentityToken(c.Request.Context(), c.Param("provider"), input.IDToken, input.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrUnknownProvider):
+			utils.SendError(c, http.StatusNotFound, "Unknown identity provider", err.Error())
+		case errors.Is(err, services.ErrInvalidIDToken):
+			utils.SendError(c, http.StatusUnauthorized, "Invalid ID token", err.Error())
+		default:
+			utils.SendError(c, http.StatusInternalServerError, "Failed to verify ID token", err.Error())
+		}
+		return
+	}
+
+	linked, err := services.LinkIdentity(userID, identity)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrIdentityInUse):
+			utils.SendError(c, http.StatusConflict, "Identity already linked", err.Error())
+		case errors.Is(err, services.ErrEmailNotVerified):
+			utils.SendError(c, http.StatusForbidden, "Email not verified", err.Error())
+		default:
+			utils.SendError(c, http.StatusInternalServerError, "Failed to link identity", err.Error())
+		}
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusCreated, "Identity linked", linked)
+}
+
+func UnlinkIdentity(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid identity ID", err.Error())
+		return
+	}
+
+	if err := services.UnlinkIdentity(userID, id); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			utils.SendError(c, http.StatusNotFound, "Identity not found", "Identity does not exist or you don't have access")
+		case errors.Is(err, services.ErrLastSignInMethod):
+			utils.SendError(c, http.StatusConflict, "Cannot unlink identity", err.Error())
+		default:
+			utils.SendError(c, http.StatusInternalServerError, "Failed to unlink identity", err.Error())
+		}
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Identity unlinked", nil)
+}
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"dory-backend/internal/services"
+	"dory-backend/internal/utils"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultSnoozeMinutes = 10
+	maxSnoozeMinutes     = 7 * 24 * 60
+	maxListedReminders   = 200
+)
+
+func GetReminderSettings(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	settings, err := services.LoadReminderSettings(userID)
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch reminder settings", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Reminder settings retrieved successfully", settings)
+}
+
+// UpdateReminderSettings changes when and how the caller is reminded and sent digests;
+// omitted fields keep their current value
+func UpdateReminderSettings(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		Offsets    *[]int     `json:"offsets"`
+		Channels   *[]string  `json:"channels"`
+		WebhookURL *string    `json:"webhook_url"`
+		MutedUntil *time.Time `json:"muted_until"`
+		// Unmute clears muted_until, since a JSON null cannot be told apart from an omitted field
+		Unmute        bool    `json:"unmute"`
+		DigestPeriod  *string `json:"digest_period"`
+		DigestHour    *int    `json:"digest_hour"`
+		DigestWeekday *int    `json:"digest_weekday"`
+
+		// RotateWebhookSecret replaces the signing secret while keeping the URL
+		RotateWebhookSecret bool `json:"rotate_webhook_secret"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	settings, err := services.LoadReminderSettings(userID)
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch reminder settings", err.Error())
+		return
+	}
+	if input.Offsets != nil {
+		settings.Offsets = *input.Offsets
+	}
+	if input.Channels != nil {
+		settings.Channels = *input.Channels
+	}
+	secret := settings.WebhookSecret
+	if input.WebhookURL != nil {
+		// A new URL gets a new signing secret
+		if strings.TrimSpace(*input.WebhookURL) != settings.WebhookURL {
+			settings.WebhookSecret = ""
+		}
+		settings.WebhookURL = *input.WebhookURL
+	}
+	if input.RotateWebhookSecret {
+		settings.WebhookSecret = ""
+	}
+	if input.MutedUntil != nil {
+		settings.MutedUntil = input.MutedUntil
+	}
+	if input.Unmute {
+		settings.MutedUntil = nil
+	}
+	if input.DigestPeriod != nil {
+		settings.DigestPeriod = *input.DigestPeriod
+	}
+	if input.DigestHour != nil {
+		settings.DigestHour = *input.DigestHour
+	}
+	if input.DigestWeekday != nil {
+		settings.DigestWeekday = *input.DigestWeekday
+	}
+
+	if err := services.SaveReminderSettings(&settings); err != nil {
+		if errors.Is(err, services.ErrInvalidReminderSettings) {
+			utils.SendError(c, http.StatusBadRequest, "Invalid reminder settings", err.Error())
+			return
+		}
+		utils.SendError(c, http.StatusInternalServerError, "Failed to save reminder settings", err.Error())
+		return
+	}
+
+	// The secret is only shown when it is created; it is needed to check the signatures
+	response := struct {
+		models.ReminderSettings
+		WebhookSecret string `json:",omitempty"`
+	}{ReminderSettings: settings}
+	if settings.WebhookSecret != secret {
+		response.WebhookSecret = settings.WebhookSecret
+	}
+	utils.SendSuccess(c, http.StatusOK, "Reminder settings updated successfully", response)
+}
+
+// ListReminders returns the caller's reminders by due time. Query: status (default pending)
+func ListReminders(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	query := config.DB.Where("user_id = ?", userID)
+	switch status := c.DefaultQuery("status", models.ReminderStatusPending); status {
+	case "all":
+	case models.ReminderStatusPending, models.ReminderStatusSent, models.ReminderStatusFailed, models.ReminderStatusMuted:
+		query = query.Where("status = ?", status)
+	default:
+		utils.SendError(c, http.StatusBadRequest, "Invalid status", "status must be pending, sent, failed, muted or all")
+		return
+	}
+
+	var reminders []models.Reminder
+	if err := query.Order("remind_at ASC").Limit(maxListedReminders).Find(&reminders).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch reminders", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Reminders retrieved successfully", reminders)
+}
+
+// loadReminder fetches a reminder owned by the caller, writing the error response itself
+func loadReminder(c *gin.Context, userID uuid.UUID) (models.Reminder, bool) {
+	var reminder models.Reminder
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid reminder ID", err.Error())
+		return reminder, false
+	}
+	if err := config.DB.Where("id = ? AND user_id = ?", id, userID).First(&reminder).Error; err != nil {
+		utils.SendError(c, http.StatusNotFound, "Reminder not found", "Reminder does not exist or you don't have access")
+		return reminder, false
+	}
+	return reminder, true
+}
+
+// SnoozeReminder sends a reminder again later. Body (optional): {"minutes": 10}
+func SnoozeReminder(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	input := struct {
+		Minutes int `json:"minutes"`
+	}{Minutes: defaultSnoozeMinutes}
+	// An empty body, which chunked requests send without a Content-Length, keeps the default
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+	if input.Minutes < 1 || input.Minutes > maxSnoozeMinutes {
+		utils.SendError(c, http.StatusBadRequest, "Invalid snooze", "minutes must be between 1 and 10080")
+		return
+	}
+
+	reminder, ok := loadReminder(c, userID)
+	if !ok {
+		return
+	}
+
+	if err := services.SnoozeReminder(&reminder, time.Duration(input.Minutes)*time.Minute); err != nil {
+		if errors.Is(err, services.ErrReminderNotPending) {
+			utils.SendError(c, http.StatusConflict, "Reminder is being sent", err.Error())
+			return
+		}
+		utils.SendError(c, http.StatusInternalServerError, "Failed to snooze reminder", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Reminder snoozed", reminder)
+}
+
+func MuteReminder(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	reminder, ok := loadReminder(c, userID)
+	if !ok {
+		return
+	}
+
+	if err := services.MuteReminder(&reminder); err != nil {
+		if errors.Is(err, services.ErrReminderNotPending) {
+			utils.SendError(c, http.StatusConflict, "Reminder not pending", err.Error())
+			return
+		}
+		utils.SendError(c, http.StatusInternalServerError, "Failed to mute reminder", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Reminder muted", reminder)
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"dory-backend/internal/services"
+	"dory-backend/internal/utils"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetCurrentUser(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, "id = ?", userID).Error; err != nil {
+		utils.SendError(c, http.StatusNotFound, "User not found", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "User retrieved successfully", user)
+}
+
+// UpdateCurrentUser changes the caller's settings; currently only the time zone used to
+// read dates in their documents
+func UpdateCurrentUser(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		Timezone *string `json:"timezone"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, "id = ?", userID).Error; err != nil {
+		utils.SendError(c, http.StatusNotFound, "User not found", err.Error())
+		return
+	}
+
+	if input.Timezone != nil {
+		tz := strings.TrimSpace(*input.Timezone)
+		// Only IANA names are accepted; "Local" would mean the server's zone
+		if _, err := time.LoadLocation(tz); err != nil || tz == "" || tz == "Local" {
+			utils.SendError(c, http.StatusBadRequest, "Invalid timezone", "timezone must be an IANA zone name such as Europe/Berlin")
+			return
+		}
+		user.Timezone = tz
+	}
+
+	if err := config.DB.Model(&user).Select("timezone").Updates(&user).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to update user", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "User updated successfully", user)
+}
+
+// ChangePassword sets the caller's password. Body: {"current_password", "new_password"};
+// current_password is only needed when the account already has one.
+func ChangePassword(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	if err := services.SetPassword(userID, input.CurrentPassword, input.NewPassword); err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidPassword):
+			utils.SendError(c, http.StatusBadRequest, "Invalid password", err.Error())
+		case errors.Is(err, services.ErrInvalidCredentials):
+			utils.SendError(c, http.StatusForbidden, "Current password is wrong", err.Error())
+		default:
+			utils.SendError(c, http.StatusInternalServerError, "Failed to change password", err.Error())
+		}
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Password changed", nil)
+}
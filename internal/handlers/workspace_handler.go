@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"dory-backend/internal/services"
+	"dory-backend/internal/utils"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// sendWorkspaceError maps workspace service errors to responses; anything unexpected is a 500
+// with the given message
+func sendWorkspaceError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrWorkspaceNotFound):
+		utils.SendError(c, http.StatusNotFound, "Workspace not found", err.Error())
+	case errors.Is(err, services.ErrMemberNotFound):
+		utils.SendError(c, http.StatusNotFound, "Member not found", err.Error())
+	case errors.Is(err, services.ErrWorkspaceForbidden):
+		utils.SendError(c, http.StatusForbidden, "Insufficient workspace role", err.Error())
+	case errors.Is(err, services.ErrInvalidWorkspace),
+		errors.Is(err, services.ErrInvalidWorkspaceRole),
+		errors.Is(err, services.ErrInvalidSearchScope),
+		errors.Is(err, services.ErrInvalidInvitation),
+		errors.Is(err, services.ErrInvalidEmail):
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+	case errors.Is(err, services.ErrAlreadyMember),
+		errors.Is(err, services.ErrLastWorkspaceOwner),
+		errors.Is(err, services.ErrTooManyWorkspaces):
+		utils.SendError(c, http.StatusConflict, message, err.Error())
+	default:
+		utils.SendError(c, http.StatusInternalServerError, message, err.Error())
+	}
+}
+
+// loadWorkspace fetches the workspace in the :id param if the caller's role in it is at least
+// min, returning that role. It writes the error response itself.
+func loadWorkspace(c *gin.Context, userID uuid.UUID, min string) (models.Workspace, string, bool) {
+	var workspace models.Workspace
+	workspaceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid workspace ID", err.Error())
+		return workspace, "", false
+	}
+	role, err := services.RequireWorkspaceRole(workspaceID, userID, min)
+	if err != nil {
+		sendWorkspaceError(c, err, "Failed to check workspace")
+		return workspace, "", false
+	}
+	if err := config.DB.First(&workspace, "id = ?", workspaceID).Error; err != nil {
+		utils.SendError(c, http.StatusNotFound, "Workspace not found", services.ErrWorkspaceNotFound.Error())
+		return workspace, "", false
+	}
+	return workspace, role, true
+}
+
+// workspaceResponse is a workspace with the caller's role in it
+type workspaceResponse struct {
+	models.Workspace
+	Role string
+}
+
+// workspaceMemberResponse is a member with the account details other members see
+type workspaceMemberResponse struct {
+	UserID       uuid.UUID
+	Name         string
+	Email        string
+	ProfilePhoto string
+	Role         string
+	JoinedAt     time.Time
+}
+
+// CreateWorkspace creates a workspace owned by the caller. Body: {"name": "...", "description": "..."}
+func CreateWorkspace(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		Name        string `json:"name" binding:"required"`
+		Description string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	workspace, err := services.CreateWorkspace(userID, input.Name, input.Description)
+	if err != nil {
+		sendWorkspaceError(c, err, "Failed to create workspace")
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusCreated, "Workspace created", workspaceResponse{workspace, models.WorkspaceRoleOwner})
+}
+
+// ListWorkspaces returns the workspaces the caller is a member of, with their role in each
+func ListWorkspaces(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var memberships []models.WorkspaceMember
+	if err := config.DB.Where("user_id = ?", userID).Find(&memberships).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch workspaces", err.Error())
+		return
+	}
+	roles := make(map[uuid.UUID]string, len(memberships))
+	ids := make([]uuid.UUID, 0, len(memberships))
+	for _, m := range memberships {
+		roles[m.WorkspaceID] = m.Role
+		ids = append(ids, m.WorkspaceID)
+	}
+
+	workspaces := []workspaceResponse{}
+	if len(ids) > 0 {
+		var found []models.Workspace
+		if err := config.DB.Where("id IN ?", ids).Order("name").Find(&found).Error; err != nil {
+			utils.SendError(c, http.StatusInternalServerError, "Failed to fetch workspaces", err.Error())
+			return
+		}
+		for _, w := range found {
+			workspaces = append(workspaces, workspaceResponse{w, roles[w.ID]})
+		}
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Workspaces retrieved successfully", workspaces)
+}
+
+func GetWorkspace(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	workspace, role, ok := loadWorkspace(c, userID, models.WorkspaceRoleViewer)
+	if !ok {
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Workspace retrieved successfully", workspaceResponse{workspace, role})
+}
+
+// UpdateWorkspace renames a workspace or changes its description; owners only
+func UpdateWorkspace(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	workspace, role, ok := loadWorkspace(c, userID, models.WorkspaceRoleOwner)
+	if !ok {
+		return
+	}
+
+	if err := services.UpdateWorkspace(&workspace, input.Name, input.Description); err != nil {
+		sendWorkspaceError(c, err, "Failed to update workspace")
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Workspace updated", workspaceResponse{workspace, role})
+}
+
+// DeleteWorkspace deletes a workspace and every document in it; owners only
+func DeleteWorkspace(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	workspace, _, ok := loadWorkspace(c, userID, models.WorkspaceRoleOwner)
+	if !ok {
+		return
+	}
+
+	if err := services.DeleteWorkspace(workspace.ID); err != nil {
+		sendWorkspaceError(c, err, "Failed to delete workspace")
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Workspace deleted", nil)
+}
+
+func ListWorkspaceMembers(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	workspace, _, ok := loadWorkspace(c, userID, models.WorkspaceRoleViewer)
+	if !ok {
+		return
+	}
+
+	members := []workspaceMemberResponse{}
+	err := config.DB.Model(&models.WorkspaceMember{}).
+		Select("users.id AS user_id, users.name, users.email, users.profile_photo, workspace_members.role, workspace_members.created_at AS joined_at").
+		Joins("JOIN users ON users.id = workspace_members.user_id").
+		Where("workspace_members.workspace_id = ?", workspace.ID).
+		Order("workspace_members.created_at").
+		Scan(&members).Error
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch members", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Members retrieved successfully", members)
+}
+
+// UpdateWorkspaceMember changes a member's role; owners only. Body: {"role": "editor"}
+func UpdateWorkspaceMember(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	memberID, err := uuid.Parse(c.Param("userId"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid user ID", err.Error())
+		return
+	}
+
+	var input struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	workspace, _, ok := loadWorkspace(c, userID, models.WorkspaceRoleOwner)
+	if !ok {
+		return
+	}
+
+	member, err := services.SetMemberRole(workspace.ID, memberID, input.Role)
+	if err != nil {
+		sendWorkspaceError(c, err, "Failed to update member")
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Member updated", member)
+}
+
+// RemoveWorkspaceMember removes a member, which owners can do for anyone and every member
+// can do for themselves to leave the workspace
+func RemoveWorkspaceMember(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	memberID, err := uuid.Parse(c.Param("userId"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid user ID", err.Error())
+		return
+	}
+
+	min := models.WorkspaceRoleOwner
+	if memberID == userID {
+		min = models.WorkspaceRoleViewer
+	}
+	workspace, _, ok := loadWorkspace(c, userID, min)
+	if !ok {
+		return
+	}
+
+	if err := services.RemoveMember(workspace.ID, memberID); err != nil {
+		sendWorkspaceError(c, err, "Failed to remove member")
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Member removed", nil)
+}
+
+// ListWorkspaceInvitations returns the invitations that are still open; owners only
+func ListWorkspaceInvitations(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	workspace, _, ok := loadWorkspace(c, userID, models.WorkspaceRoleOwner)
+	if !ok {
+		return
+	}
+
+	var invitations []models.WorkspaceInvitation
+	err := config.DB.Where("workspace_id = ? AND accepted_at IS NULL AND expires_at > ?", workspace.ID, time.Now()).
+		Order("created_at DESC").Find(&invitations).Error
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch invitations", err.Error())
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Invitations retrieved successfully", invitations)
+}
+
+// InviteToWorkspace emails an invitation to join the workspace; owners only.
+// Body: {"email": "...", "role": "viewer"}
+func InviteToWorkspace(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		Email string `json:"email" binding:"required"`
+		Role  string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+	if input.Role == "" {
+		input.Role = models.WorkspaceRoleViewer
+	}
+
+	workspace, _, ok := loadWorkspace(c, userID, models.WorkspaceRoleOwner)
+	if !ok {
+		return
+	}
+
+	var inviter models.User
+	if err := config.DB.First(&inviter, "id = ?", userID).Error; err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to fetch user", err.Error())
+		return
+	}
+
+	invitation, err := services.InviteToWorkspace(workspace, inviter, input.Email, input.Role)
+	if err != nil {
+		sendWorkspaceError(c, err, "Failed to send invitation")
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusCreated, "Invitation sent", invitation)
+}
+
+// RevokeWorkspaceInvitation deletes an invitation that has not been accepted yet; owners only
+func RevokeWorkspaceInvitation(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	invitationID, err := uuid.Parse(c.Param("invitationId"))
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid invitation ID", err.Error())
+		return
+	}
+
+	workspace, _, ok := loadWorkspace(c, userID, models.WorkspaceRoleOwner)
+	if !ok {
+		return
+	}
+
+	result := config.DB.Where("id = ? AND workspace_id = ? AND accepted_at IS NULL", invitationID, workspace.ID).
+		Delete(&models.WorkspaceInvitation{})
+	if result.Error != nil {
+		utils.SendError(c, http.StatusInternalServerError, "Failed to revoke invitation", result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		utils.SendError(c, http.StatusNotFound, "Invitation not found", "Invitation does not exist or was already accepted")
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Invitation revoked", nil)
+}
+
+// AcceptWorkspaceInvitation joins the workspace an emailed invitation is for. Body: {"token": "..."}
+func AcceptWorkspaceInvitation(c *gin.Context) {
+	userID, ok := getAuthUserID(c)
+	if !ok {
+		utils.SendError(c, http.StatusUnauthorized, "Unauthorized", "User context missing")
+		return
+	}
+
+	var input struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "Invalid request", err.Error())
+		return
+	}
+
+	workspace, err := services.AcceptInvitation(userID, input.Token)
+	if err != nil {
+		sendWorkspaceError(c, err, "Failed to accept invitation")
+		return
+	}
+
+	role, err := services.WorkspaceRole(workspace.ID, userID)
+	if err != nil {
+		sendWorkspaceError(c, err, "Failed to accept invitation")
+		return
+	}
+
+	utils.SendSuccess(c, http.StatusOK, "Joined workspace", workspaceResponse{workspace, role})
+}
@@ -1,14 +1,17 @@
 package middlewares
 
 import (
-	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"dory-backend/internal/services"
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 )
 
+// AuthMiddleware accepts a JWT access token or an API key as the bearer credential. API key
+// requests only reach routes that RequireScope grants them.
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
@@ -19,41 +22,69 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-			// Validate the signing method
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
+		if services.IsAPIKey(tokenStr) {
+			key, err := services.AuthenticateAPIKey(tokenStr)
+			if errors.Is(err, services.ErrInvalidAPIKey) || errors.Is(err, services.ErrAPIKeyExpired) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				c.Abort()
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API key"})
+				c.Abort()
+				return
 			}
-			return []byte(config.AppConfig.JWTSecret), nil
-		})
 
+			c.Set("userID", key.UserID.String())
+			c.Set("apiKey", key)
+			c.Next()
+			return
+		}
+
+		claims, err := services.ParseAccessToken(tokenStr)
+		if errors.Is(err, services.ErrTokenRevoked) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+			c.Abort()
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token", "details": err.Error()})
 			c.Abort()
 			return
 		}
 
-		if !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
-			c.Abort()
+		c.Set("userID", claims.UserID)
+		c.Set("tokenClaims", claims)
+		c.Next()
+	}
+}
+
+// RequireScope lets API keys through only when they were granted scope. Logged-in users
+// have every scope.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		val, isKey := c.Get("apiKey")
+		if !isKey {
+			c.Next()
 			return
 		}
-
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		if key, ok := val.(models.APIKey); !ok || !services.HasScope(key, scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + scope + " scope"})
 			c.Abort()
 			return
 		}
+		c.Next()
+	}
+}
 
-		userID, ok := claims["user_id"].(string)
-		if !ok || userID == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in token"})
+// RequireSession keeps API keys away from account routes such as key management
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, isKey := c.Get("apiKey"); isKey {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint requires a logged-in session, not an API key"})
 			c.Abort()
 			return
 		}
-
-		c.Set("userID", userID)
 		c.Next()
 	}
 }
@@ -6,15 +6,23 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 func ExtractUserInfo() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// A resumed stream replays an earlier request, so its message was already processed
+		if c.GetHeader("Last-Event-ID") != "" {
+			c.Next()
+			return
+		}
+
 		var input struct {
 			Message string `json:"message" binding:"required"`
 		}
 
-		if err := c.ShouldBindJSON(&input); err != nil {
+		// Bind with a cached body so the chat handler can read the request again
+		if err := c.ShouldBindBodyWith(&input, binding.JSON); err != nil {
 			utils.SendError(c, http.StatusBadRequest, "Message is required", err.Error())
 			return
 		}
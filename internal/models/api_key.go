@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scopes an API key can be granted
+const (
+	ScopeIngestWrite    = "ingest:write"
+	ScopeDocumentsRead  = "documents:read"
+	ScopeDocumentsWrite = "documents:write"
+	ScopeChat           = "chat"
+	ScopeEventsRead     = "events:read"
+	ScopeEventsWrite    = "events:write"
+	ScopeRemindersRead  = "reminders:read"
+	ScopeRemindersWrite = "reminders:write"
+)
+
+// AllScopes lists every scope, in the order they are documented
+var AllScopes = []string{
+	ScopeIngestWrite, ScopeDocumentsRead, ScopeDocumentsWrite, ScopeChat,
+	ScopeEventsRead, ScopeEventsWrite, ScopeRemindersRead, ScopeRemindersWrite,
+}
+
+// APIKey lets scripts and integrations call the API as a user without a login. The key is
+// only shown once; Prefix identifies it in listings.
+type APIKey struct {
+	ID         uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	UserID     uuid.UUID `gorm:"type:uuid;index"`
+	Name       string    `gorm:"size:100;not null"`
+	Prefix     string    `gorm:"size:20"`
+	KeyHash    string    `gorm:"size:64;uniqueIndex" json:"-"`
+	Scopes     JSONList[string]
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
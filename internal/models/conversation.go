@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Conversation struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	UserID    uuid.UUID `gorm:"type:uuid;index"`
+	Title     string    `gorm:"size:255"`
+	Messages  []Message `gorm:"foreignKey:ConversationID;constraint:OnDelete:CASCADE"`
+	CreatedAt time.Time
+	UpdatedAt time.Time `gorm:"index"`
+}
+
+type Message struct {
+	ID             uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	ConversationID uuid.UUID `gorm:"type:uuid;index"`
+	Role           string    `gorm:"size:20;not null"`
+	Content        string    `gorm:"type:text"`
+	// Sources holds the retrieved chunks the assistant turn was grounded on
+	Sources JSONList[Source]
+	// Citations maps the [n] markers used in Content to entries in Sources
+	Citations JSONList[Citation]
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// Source is a retrieved chunk with enough metadata to link it back to its document.
+// CharStart and CharEnd are Unicode code point offsets into the document's content.
+type Source struct {
+	DocumentID string   `json:"document_id"`
+	Filename   string   `json:"filename"`
+	ChunkIndex int      `json:"chunk_index"`
+	Score      float32  `json:"score"`
+	CharStart  int      `json:"char_start"`
+	CharEnd    int      `json:"char_end"`
+	Headings   []string `json:"headings,omitempty"`
+	PageStart  int      `json:"page_start,omitempty"`
+	PageEnd    int      `json:"page_end,omitempty"`
+	Content    string   `json:"content"`
+	// WorkspaceID is set when the document belongs to a workspace
+	WorkspaceID string `json:"workspace_id,omitempty"`
+}
+
+// Citation ties a marker such as [2] in an answer to the source it was numbered after
+type Citation struct {
+	Marker int    `json:"marker"`
+	Source Source `json:"source"`
+}
@@ -16,4 +16,23 @@ type Document struct {
 	Content    string    `gorm:"type:text"`
 	Status     string    `gorm:"size:20;default:'processing'"`
 	UploadedAt time.Time `gorm:"autoCreateTime"`
+	// WorkspaceID is set for documents shared in a workspace; UserID is then the uploader
+	WorkspaceID *uuid.UUID `gorm:"type:uuid;index"`
+	// DocumentDate is when the document itself was written, from its metadata or the uploader;
+	// relative dates like "next Friday" are resolved against it
+	DocumentDate *time.Time
+	// Chunk settings used for the stored vectors; documents from before strategies existed are "words"
+	ChunkStrategy string `gorm:"size:20;default:'words'"`
+	ChunkSize     int
+	ChunkOverlap  int
+	// PageCount and PageStats are only set for paginated sources such as PDFs
+	PageCount int
+	PageStats JSONList[PageStat]
+}
+
+// PageStat locates one page inside Content, in Unicode code points
+type PageStat struct {
+	Page      int `json:"page"`
+	CharStart int `json:"char_start"`
+	Chars     int `json:"chars"`
 }
@@ -6,6 +6,15 @@ import (
 	"github.com/google/uuid"
 )
 
+// Review states of a DetectedEvent
+const (
+	DetectedEventPending   = "pending"
+	DetectedEventAccepted  = "accepted"
+	DetectedEventDismissed = "dismissed"
+	// DetectedEventMerged detections are duplicates folded into the one in MergedIntoID
+	DetectedEventMerged = "merged"
+)
+
 type DetectedEvent struct {
 	ID         uuid.UUID `gorm:"type:uuid;primaryKey"`
 	UserID     uuid.UUID `gorm:"type:uuid;index"`
@@ -17,14 +26,85 @@ type DetectedEvent struct {
 	Confidence float64
 	SourceText string
 	DetectedAt time.Time
+	// AllDay detections start at UTC midnight of their date
+	AllDay bool
+	// DateText is the date expression as written in the document, kept for auditing
+	DateText string
+	// RRule, ExDates and TimeZone describe a recurring detection; see Event
+	RRule    string `gorm:"column:rrule"`
+	ExDates  JSONList[time.Time]
+	TimeZone string `gorm:"size:64"`
+	Status   string `gorm:"size:20;default:'pending';index"`
+	// EventID is the calendar event created when the detection was accepted
+	EventID    *uuid.UUID `gorm:"type:uuid"`
+	ReviewedAt *time.Time
+	// MergedIntoID is the canonical detection this duplicate was merged into. The duplicate
+	// keeps its own document and source text, so the canonical event stays linked to every
+	// document that mentions it.
+	MergedIntoID *uuid.UUID `gorm:"type:uuid;index"`
+}
+
+// Merge methods recorded in EventMerge
+const (
+	EventMergeAuto   = "auto"
+	EventMergeManual = "manual"
+)
+
+// EventMerge is the history of one detection being merged into another. FilledFields lists
+// the canonical's empty fields the duplicate supplied, so an unmerge can take them back.
+type EventMerge struct {
+	ID                 uuid.UUID `gorm:"type:uuid;primaryKey"`
+	UserID             uuid.UUID `gorm:"type:uuid;index"`
+	CanonicalID        uuid.UUID `gorm:"type:uuid;index"`
+	MergedID           uuid.UUID `gorm:"type:uuid;index"`
+	Method             string    `gorm:"size:20"`
+	Score              float64
+	FilledFields       JSONList[string]
+	PreviousConfidence float64
+	MergedAt           time.Time
+	UnmergedAt         *time.Time
 }
+
+// Event is a confirmed calendar entry, either accepted from a DetectedEvent or created by hand
 type Event struct {
 	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
-	UserID    uuid.UUID `gorm:"type:uuid;index"`
+	UserID    uuid.UUID `gorm:"type:uuid;index:idx_events_user_start,priority:1"`
+	Title     string    `gorm:"not null"`
+	StartTime time.Time `gorm:"not null;index:idx_events_user_start,priority:2"`
+	EndTime   *time.Time
+	Location  *string
+	// AllDay events start at UTC midnight of their date
+	AllDay bool
+	// RRule is an RFC 5545 recurrence rule without the "RRULE:" prefix; empty for single
+	// events. StartTime is the first occurrence and EndTime bounds it, so every occurrence
+	// lasts as long. ExDates lists the starts of skipped occurrences.
+	RRule   string `gorm:"column:rrule"`
+	ExDates JSONList[time.Time]
+	// TimeZone is the IANA zone whose wall clock occurrences keep across DST changes
+	TimeZone string `gorm:"size:64"`
+	// RecurrenceEnd is the end of the last occurrence, nil while the series is unbounded,
+	// so range queries can skip finished series
+	RecurrenceEnd *time.Time `gorm:"index"`
+	// RemindersMuted turns off reminders for this event only
+	RemindersMuted bool
+	// SourceID points at the DetectedEvent this was accepted from; nil for manual events
+	SourceID *uuid.UUID `gorm:"type:uuid;index"`
+	// DocumentID and ExternalUID are set for events imported from a calendar file; the UID
+	// identifies the event, or one occurrence of a series, across re-imports
+	DocumentID  *uuid.UUID `gorm:"type:uuid;index"`
+	ExternalUID string     `gorm:"size:512;index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// EventOccurrence is one instance of an event within a queried range. Single events have
+// exactly one, at their own start.
+type EventOccurrence struct {
+	EventID   uuid.UUID
 	Title     string
 	StartTime time.Time
 	EndTime   *time.Time
 	Location  *string
-	SourceID  uuid.UUID
-	CreatedAt time.Time
+	AllDay    bool
+	Recurring bool
 }
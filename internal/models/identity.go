@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdentityProviderGoogle names Google sign-in among the configured OIDC providers
+const IdentityProviderGoogle = "google"
+
+// UserIdentity links an account at an identity provider to a user. A user can have several,
+// e.g. Google and their university's login.
+type UserIdentity struct {
+	ID     uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	UserID uuid.UUID `gorm:"type:uuid;index"`
+	// Provider is "google" or the ID of an OIDC provider; Subject is the provider's sub claim
+	Provider    string `gorm:"size:50;uniqueIndex:idx_user_identities_subject,priority:1"`
+	Subject     string `gorm:"size:255;uniqueIndex:idx_user_identities_subject,priority:2"`
+	Email       string `gorm:"size:255"`
+	LastLoginAt *time.Time
+	CreatedAt   time.Time
+}
+
+// OIDCNonce is a nonce handed out for an identity provider sign-in. An ID token is only
+// accepted if it carries one that is unexpired and unused, and using it deletes it.
+type OIDCNonce struct {
+	NonceHash string    `gorm:"size:64;primaryKey" json:"-"`
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
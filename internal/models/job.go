@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	JobTypeEmbedDocument = "embed_document"
+	JobTypeDetectEvents  = "detect_events"
+
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusDead      = "dead"
+)
+
+// IngestionJob is a unit of background work on a document, claimed by the worker pool
+type IngestionJob struct {
+	ID          uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	UserID      uuid.UUID `gorm:"type:uuid;index"`
+	DocumentID  uuid.UUID `gorm:"type:uuid;index"`
+	Type        string    `gorm:"size:50;not null"`
+	Status      string    `gorm:"size:20;default:'pending';index:idx_jobs_status_run_at,priority:1"`
+	Attempts    int       `gorm:"default:0"`
+	MaxAttempts int       `gorm:"default:5"`
+	LastError   string    `gorm:"type:text"`
+	RunAt       time.Time `gorm:"index:idx_jobs_status_run_at,priority:2"`
+	LockedAt    *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// JSONList stores a slice in a Postgres jsonb column and serialises as a plain JSON array
+type JSONList[T any] []T
+
+func (JSONList[T]) GormDataType() string {
+	return "jsonb"
+}
+
+func (l JSONList[T]) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]T(l))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (l *JSONList[T]) Scan(value interface{}) error {
+	var raw []byte
+	switch v := value.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return fmt.Errorf("unsupported type %T for JSONList", value)
+	}
+	return json.Unmarshal(raw, (*[]T)(l))
+}
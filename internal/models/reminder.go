@@ -0,0 +1,72 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Notification channels a reminder can be delivered through
+const (
+	ReminderChannelEmail   = "email"
+	ReminderChannelWebhook = "webhook"
+	ReminderChannelLog     = "log"
+)
+
+const (
+	ReminderStatusPending = "pending"
+	ReminderStatusSending = "sending"
+	ReminderStatusSent    = "sent"
+	ReminderStatusFailed  = "failed"
+	ReminderStatusMuted   = "muted"
+)
+
+// Digest periods
+const (
+	DigestDaily  = "day"
+	DigestWeekly = "week"
+)
+
+// ReminderSettings are a user's reminder and digest preferences. Users without a row get the
+// defaults from services.DefaultReminderSettings.
+type ReminderSettings struct {
+	UserID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	// Offsets are how many minutes before each event a reminder is sent, e.g. 1440 and 60
+	Offsets  JSONList[int]
+	Channels JSONList[string]
+	// WebhookURL receives reminders sent through the webhook channel
+	WebhookURL string `gorm:"type:text"`
+	// WebhookSecret is the user's own key for signing webhook requests. It is shown to the
+	// user once, when the webhook URL is set.
+	WebhookSecret string `gorm:"type:text" json:"-"`
+	// MutedUntil silences every reminder due before it; a far-future time mutes indefinitely
+	MutedUntil *time.Time
+	// DigestPeriod schedules a digest through the same channels: "day", "week" or "" for none.
+	// It is sent at DigestHour local time, on DigestWeekday (0 is Sunday) for weekly digests.
+	DigestPeriod  string `gorm:"size:10"`
+	DigestHour    int
+	DigestWeekday int
+	// DigestNextAt is when the next digest is due, moved on by the scheduler as it sends them
+	DigestNextAt *time.Time `gorm:"index"`
+	UpdatedAt    time.Time
+}
+
+// Reminder is one notification about one occurrence of an event, planned ahead by the
+// scheduler so it survives restarts and is delivered once
+type Reminder struct {
+	ID              uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	UserID          uuid.UUID `gorm:"type:uuid;index"`
+	EventID         uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_reminders_slot,priority:1"`
+	OccurrenceStart time.Time `gorm:"uniqueIndex:idx_reminders_slot,priority:2"`
+	OffsetMinutes   int       `gorm:"uniqueIndex:idx_reminders_slot,priority:3"`
+	Channel         string    `gorm:"size:20;uniqueIndex:idx_reminders_slot,priority:4"`
+	Status          string    `gorm:"size:20;default:'pending';index:idx_reminders_status_remind_at,priority:1"`
+	// RemindAt is when the reminder is due; snoozing moves it later
+	RemindAt  time.Time `gorm:"index:idx_reminders_status_remind_at,priority:2"`
+	Attempts  int       `gorm:"default:0"`
+	LastError string    `gorm:"type:text"`
+	SentAt    *time.Time
+	LockedAt  *time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
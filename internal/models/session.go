@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RefreshToken is one link in a chain of rotating refresh tokens. Each login starts a family
+// and every refresh marks the presented token used and issues the next one in the family.
+type RefreshToken struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	UserID    uuid.UUID `gorm:"type:uuid;index"`
+	FamilyID  uuid.UUID `gorm:"type:uuid;index"`
+	TokenHash string    `gorm:"size:64;uniqueIndex" json:"-"`
+	UserAgent string    `gorm:"size:255"`
+	IP        string    `gorm:"size:64"`
+	ExpiresAt time.Time `gorm:"index"`
+	// UsedAt is set once the token has been exchanged; presenting it again means it leaked
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// RevokedToken denylists an access token by its jti until it would have expired anyway
+type RevokedToken struct {
+	JTI       string    `gorm:"size:64;primaryKey"`
+	UserID    uuid.UUID `gorm:"type:uuid;index"`
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+// Login token purposes
+const (
+	LoginTokenLogin  = "login"
+	LoginTokenVerify = "verify"
+)
+
+// LoginToken is a single-use emailed link that signs in, or verifies the address of, whoever
+// owns Email. Login tokens may create the account; verify tokens name it in UserID.
+type LoginToken struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Email     string     `gorm:"size:255;index"`
+	UserID    *uuid.UUID `gorm:"type:uuid;index"`
+	Purpose   string     `gorm:"size:10"`
+	TokenHash string     `gorm:"size:64;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"index"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// SigningKey is an asymmetric key for access tokens. The newest key whose ActivatesAt has
+// passed signs new tokens; older ones only verify until the tokens they signed expire, and
+// a key is published ahead of its activation so verifiers can fetch it in time.
+type SigningKey struct {
+	KID       string `gorm:"size:64;primaryKey"`
+	Algorithm string `gorm:"size:10"`
+	// PrivateKey is PKCS #8 PEM
+	PrivateKey  string    `gorm:"type:text" json:"-"`
+	ActivatesAt time.Time `gorm:"index"`
+	CreatedAt   time.Time
+}
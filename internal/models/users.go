@@ -7,12 +7,28 @@ import (
 )
 
 type User struct {
-	ID           uuid.UUID  `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
-	Email        string     `gorm:"uniqueIndex;not null"`
-	Name         string     `gorm:"size:255"`
-	GoogleID     string     `gorm:"uniqueIndex"`
-	ProfilePhoto string     `gorm:"type:text"`
-	Documents    []Document `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	ID    uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Email string    `gorm:"uniqueIndex;not null"`
+	Name  string    `gorm:"size:255"`
+	// GoogleID is the Google subject of accounts from before Identities; it is moved to an
+	// identity on their next Google login
+	GoogleID     *string `gorm:"uniqueIndex" json:"-"`
+	ProfilePhoto string  `gorm:"type:text"`
+	// PasswordHash is a bcrypt hash, empty for accounts that sign in without a password
+	PasswordHash string `gorm:"size:60" json:"-"`
+	// EmailVerified is set once the user proved they own Email, through a magic link or an
+	// identity provider. Only verified accounts are linked to other sign-in methods.
+	EmailVerified   bool `gorm:"default:false"`
+	EmailVerifiedAt *time.Time
+	// Timezone is an IANA zone name used to read dates in the user's documents
+	Timezone  string     `gorm:"size:64;default:'UTC'"`
+	Documents []Document `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	// Identities are the Google and OIDC accounts the user signs in with
+	Identities []UserIdentity `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	// CalendarTokenHash is the SHA-256 of the secret in the user's calendar feed URL
+	CalendarTokenHash *string `gorm:"size:64;uniqueIndex" json:"-"`
+	// TokensValidAfter rejects access tokens issued before it; set when logging out everywhere
+	TokensValidAfter *time.Time `json:"-"`
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
 }
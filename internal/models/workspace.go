@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Workspace roles, from most to least privileged. Owners manage members and invitations,
+// editors add and change documents, viewers read and chat with them.
+const (
+	WorkspaceRoleOwner  = "owner"
+	WorkspaceRoleEditor = "editor"
+	WorkspaceRoleViewer = "viewer"
+)
+
+// Workspace is a shared knowledge base, e.g. for a study group. Documents uploaded to it
+// belong to the workspace rather than to the member who uploaded them.
+type Workspace struct {
+	ID          uuid.UUID             `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Name        string                `gorm:"size:100;not null"`
+	Description string                `gorm:"type:text"`
+	CreatedBy   uuid.UUID             `gorm:"type:uuid"`
+	Members     []WorkspaceMember     `gorm:"foreignKey:WorkspaceID;constraint:OnDelete:CASCADE"`
+	Invitations []WorkspaceInvitation `gorm:"foreignKey:WorkspaceID;constraint:OnDelete:CASCADE" json:"-"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+type WorkspaceMember struct {
+	WorkspaceID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	UserID      uuid.UUID `gorm:"type:uuid;primaryKey;index"`
+	Role        string    `gorm:"size:10;not null"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// WorkspaceInvitation is an emailed, single-use invitation to join a workspace with a role
+type WorkspaceInvitation struct {
+	ID          uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	WorkspaceID uuid.UUID `gorm:"type:uuid;index"`
+	Email       string    `gorm:"size:255"`
+	Role        string    `gorm:"size:10"`
+	TokenHash   string    `gorm:"size:64;uniqueIndex" json:"-"`
+	InvitedBy   uuid.UUID `gorm:"type:uuid"`
+	ExpiresAt   time.Time
+	AcceptedAt  *time.Time
+	// AcceptedBy is the user who joined with the invitation, whatever their email
+	AcceptedBy *uuid.UUID `gorm:"type:uuid"`
+	CreatedAt  time.Time
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// APIKeyPrefix starts every API key, which tells them apart from JWTs
+const APIKeyPrefix = "dory_"
+
+const (
+	maxAPIKeysPerUser = 50
+	// Last use is only written when it moved on by more than this, to spare a write per request
+	apiKeyUsageResolution = time.Minute
+)
+
+var (
+	ErrInvalidAPIKey     = errors.New("invalid API key")
+	ErrAPIKeyExpired     = errors.New("API key has expired")
+	ErrInvalidAPIKeySpec = errors.New("invalid API key settings")
+)
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsAPIKey reports whether a bearer credential is an API key rather than a JWT
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, APIKeyPrefix)
+}
+
+// normalizeScopes checks scopes against models.AllScopes and drops duplicates
+func normalizeScopes(scopes []string) (models.JSONList[string], error) {
+	var out models.JSONList[string]
+	for _, s := range scopes {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if !containsString(models.AllScopes, s) {
+			return nil, fmt.Errorf("%w: unknown scope %q", ErrInvalidAPIKeySpec, s)
+		}
+		if !containsString(out, s) {
+			out = append(out, s)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidAPIKeySpec)
+	}
+	return out, nil
+}
+
+// CreateAPIKey stores a new key for the user and returns it with the secret, which is not
+// kept and cannot be shown again
+func CreateAPIKey(userID uuid.UUID, name string, scopes []string, expiresAt *time.Time) (models.APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return models.APIKey{}, "", fmt.Errorf("%w: name must be 1 to 100 characters", ErrInvalidAPIKeySpec)
+	}
+	normalized, err := normalizeScopes(scopes)
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return models.APIKey{}, "", fmt.Errorf("%w: expires_at must be in the future", ErrInvalidAPIKeySpec)
+	}
+
+	var count int64
+	if err := config.DB.Model(&models.APIKey{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		return models.APIKey{}, "", err
+	}
+	if count >= maxAPIKeysPerUser {
+		return models.APIKey{}, "", fmt.Errorf("%w: at most %d keys per user", ErrInvalidAPIKeySpec, maxAPIKeysPerUser)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return models.APIKey{}, "", err
+	}
+	secret := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	key := models.APIKey{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Name:      name,
+		Prefix:    secret[:len(APIKeyPrefix)+8],
+		KeyHash:   hashAPIKey(secret),
+		Scopes:    normalized,
+		ExpiresAt: expiresAt,
+	}
+	if err := config.DB.Create(&key).Error; err != nil {
+		return models.APIKey{}, "", err
+	}
+	return key, secret, nil
+}
+
+// AuthenticateAPIKey looks up the key behind a secret and records that it was used
+func AuthenticateAPIKey(secret string) (models.APIKey, error) {
+	var key models.APIKey
+	err := config.DB.Where("key_hash = ?", hashAPIKey(secret)).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return key, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return key, err
+	}
+
+	now := time.Now()
+	if key.ExpiresAt != nil && !now.Before(*key.ExpiresAt) {
+		return key, ErrAPIKeyExpired
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyUsageResolution {
+		if err := config.DB.Model(&key).Update("last_used_at", now).Error; err != nil {
+			return key, err
+		}
+	}
+	return key, nil
+}
+
+// HasScope reports whether an API key was granted scope
+func HasScope(key models.APIKey, scope string) bool {
+	return containsString(key.Scopes, scope)
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"google.golang.org/api/idtoken"
 )
 
@@ -26,14 +27,64 @@ func VerfiyGoogleToken(idTokenStr string) (*idtoken.Payload, error) {
 
 	return nil, errors.New("identity verification failed for all platforms")
 }
-func GenerateJWTToken(userID string, email string) (string, error) {
-	claims := jwt.MapClaims{
-		"user_id": userID,
-		"email":   email,
-		"exp":     time.Now().Add(time.Hour * 72 * 3).Unix(),
+
+// AccessClaims are the claims of a Dory access token. SessionID names the refresh token
+// family the token was issued from, so logging out can end both.
+type AccessClaims struct {
+	UserID    string `json:"user_id"`
+	Email     string `json:"email"`
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// GenerateAccessToken issues a short-lived access token with a unique jti, signed as
+// JWT_ALGORITHM says
+func GenerateAccessToken(userID string, email string, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(config.AppConfig.AccessTokenTTL)
+	claims := AccessClaims{
+		UserID:    userID,
+		Email:     email,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    tokenIssuer(),
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := signAccessToken(claims)
+	return signed, expiresAt, err
+}
+
+// ParseAccessToken verifies an access token and rejects it if its jti was revoked or its user
+// logged out everywhere after it was issued
+func ParseAccessToken(tokenStr string) (*AccessClaims, error) {
+	claims := &AccessClaims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, accessTokenKey,
+		jwt.WithValidMethods([]string{AlgRS256, AlgEdDSA, AlgHS256}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	// Tokens from before revocation existed have no jti and could never be revoked
+	if claims.ID == "" || claims.IssuedAt == nil {
+		return nil, ErrTokenRevoked
+	}
+	if _, err := uuid.Parse(claims.UserID); err != nil {
+		return nil, errors.New("user ID not found in token")
+	}
 
-	return token.SignedString([]byte(config.AppConfig.JWTSecret))
+	var revoked bool
+	err = config.DB.Raw(`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?)
+		OR EXISTS (SELECT 1 FROM users WHERE id = ? AND tokens_valid_after > ?)`,
+		claims.ID, claims.UserID, claims.IssuedAt.Time).Scan(&revoked).Error
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
 }
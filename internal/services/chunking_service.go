@@ -0,0 +1,390 @@
+package services
+
+import (
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	ChunkStrategyWords     = "words"
+	ChunkStrategyRecursive = "recursive"
+
+	// defaultWordChunkSize is what every document was chunked with before strategies existed
+	defaultWordChunkSize = 300
+)
+
+// TextChunk is a piece of a document along with where it sits in the original text,
+// as Unicode code point offsets, and the headings it falls under
+type TextChunk struct {
+	Content  string
+	Start    int
+	End      int
+	Headings []string
+}
+
+// Chunker splits extracted text into pieces small enough to embed
+type Chunker interface {
+	Chunk(text string) []TextChunk
+}
+
+// NewChunker builds a chunker for a stored strategy. Size is in words for the legacy
+// words strategy and in estimated tokens for recursive; zero picks the default.
+func NewChunker(strategy string, size int, overlap int) (Chunker, error) {
+	switch strategy {
+	case ChunkStrategyWords:
+		if size <= 0 {
+			size = defaultWordChunkSize
+		}
+		return WordChunker{Size: size}, nil
+	case ChunkStrategyRecursive:
+		if size <= 0 {
+			size = config.AppConfig.ChunkTokens
+		}
+		size = capChunkTokens(size)
+		if overlap < 0 || overlap >= size {
+			return nil, fmt.Errorf("chunk overlap must be between 0 and %d", size-1)
+		}
+		return RecursiveChunker{MaxTokens: size, OverlapTokens: overlap}, nil
+	default:
+		return nil, fmt.Errorf("unknown chunk strategy %q (expected %s or %s)", strategy, ChunkStrategyWords, ChunkStrategyRecursive)
+	}
+}
+
+// capChunkTokens keeps chunks inside the embedder's input limit, with headroom because
+// EstimateTokens is only an approximation
+func capChunkTokens(size int) int {
+	limit := ActiveEmbedder.MaxInputTokens()
+	if limit > 0 && size > limit*4/5 {
+		return limit * 4 / 5
+	}
+	return size
+}
+
+// ChunkerForDocument returns the chunker recorded on the document
+func ChunkerForDocument(doc models.Document) (Chunker, error) {
+	return NewChunker(doc.ChunkStrategy, doc.ChunkSize, doc.ChunkOverlap)
+}
+
+// ValidateChunkDefaults checks CHUNK_STRATEGY and the recursive chunk settings at startup,
+// so a typo fails the boot instead of every embedding job
+func ValidateChunkDefaults() error {
+	cfg := config.AppConfig
+	size, overlap := 0, 0
+	if cfg.ChunkStrategy == ChunkStrategyRecursive {
+		size, overlap = cfg.ChunkTokens, cfg.ChunkOverlapTokens
+	}
+	_, err := NewChunker(cfg.ChunkStrategy, size, overlap)
+	return err
+}
+
+// ApplyChunkDefaults records the configured strategy on a new document before it is saved,
+// so it can be re-chunked the same way later even if the defaults change
+func ApplyChunkDefaults(doc *models.Document) {
+	doc.ChunkStrategy = config.AppConfig.ChunkStrategy
+	doc.ChunkSize = 0
+	doc.ChunkOverlap = 0
+	if doc.ChunkStrategy == ChunkStrategyRecursive {
+		doc.ChunkSize = capChunkTokens(config.AppConfig.ChunkTokens)
+		doc.ChunkOverlap = config.AppConfig.ChunkOverlapTokens
+	}
+}
+
+// WordChunker is the original fixed window of whitespace-separated words with no overlap
+type WordChunker struct {
+	Size int
+}
+
+func (w WordChunker) Chunk(text string) []TextChunk {
+	return ChunkText(text, w.Size)
+}
+
+func ChunkText(text string, chunkSize int) []TextChunk {
+	type word struct {
+		text       string
+		start, end int
+	}
+
+	// Record each word's position so chunks can point back into the source text
+	var words []word
+	pos, wordStart := 0, -1
+	var sb strings.Builder
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			if wordStart >= 0 {
+				words = append(words, word{sb.String(), wordStart, pos})
+				sb.Reset()
+				wordStart = -1
+			}
+		} else {
+			if wordStart < 0 {
+				wordStart = pos
+			}
+			sb.WriteRune(r)
+		}
+		pos++
+	}
+	if wordStart >= 0 {
+		words = append(words, word{sb.String(), wordStart, pos})
+	}
+
+	if len(words) == 0 {
+		return []TextChunk{}
+	}
+
+	var chunks []TextChunk
+	for i := 0; i < len(words); i += chunkSize {
+		end := i + chunkSize
+		if end > len(words) {
+			end = len(words)
+		}
+
+		parts := make([]string, 0, end-i)
+		for _, w := range words[i:end] {
+			parts = append(parts, w.text)
+		}
+		chunks = append(chunks, TextChunk{
+			Content: strings.Join(parts, " "),
+			Start:   words[i].start,
+			End:     words[end-1].end,
+		})
+	}
+
+	return chunks
+}
+
+// RecursiveChunker splits on the largest structural boundary that yields pieces under
+// MaxTokens (headings, then paragraphs, lines, sentences and finally words), packs the
+// pieces back together up to MaxTokens, and repeats up to OverlapTokens of trailing
+// pieces at the start of the next chunk.
+type RecursiveChunker struct {
+	MaxTokens     int
+	OverlapTokens int
+}
+
+type span struct {
+	start, end int // byte offsets
+}
+
+var (
+	atxHeading    = regexp.MustCompile(`(?m)^(#{1,6})[ \t]+(.+?)[ \t#]*$`)
+	setextHeading = regexp.MustCompile(`(?m)^([^\n]+)\n(=+|-+)[ \t]*$`)
+	headingBreak  = regexp.MustCompile(`(?m)^#{1,6}[ \t]|^[^\n]+\n(?:=+|-+)[ \t]*$`)
+	paragraphGap  = regexp.MustCompile(`\n[ \t]*\n`)
+	lineBreak     = regexp.MustCompile(`\n`)
+	sentenceEnd   = regexp.MustCompile(`[.!?…。！？]["')\]]*\s+`)
+	wordGap       = regexp.MustCompile(`\s+`)
+)
+
+// splitLevels are tried in order; each entry returns the byte offsets where a new piece begins
+var splitLevels = []func(text string) []int{
+	func(text string) []int { return matchStarts(headingBreak, text) },
+	func(text string) []int { return matchEnds(paragraphGap, text) },
+	func(text string) []int { return matchEnds(lineBreak, text) },
+	func(text string) []int { return matchEnds(sentenceEnd, text) },
+	func(text string) []int { return matchEnds(wordGap, text) },
+}
+
+func matchStarts(re *regexp.Regexp, text string) []int {
+	var cuts []int
+	for _, m := range re.FindAllStringIndex(text, -1) {
+		cuts = append(cuts, m[0])
+	}
+	return cuts
+}
+
+func matchEnds(re *regexp.Regexp, text string) []int {
+	var cuts []int
+	for _, m := range re.FindAllStringIndex(text, -1) {
+		cuts = append(cuts, m[1])
+	}
+	return cuts
+}
+
+func (r RecursiveChunker) tokens(text string, s span) int {
+	return EstimateTokens(text[s.start:s.end])
+}
+
+// pieces breaks a span into units that each fit within MaxTokens
+func (r RecursiveChunker) pieces(text string, s span, level int) []span {
+	if r.tokens(text, s) <= r.MaxTokens {
+		return []span{s}
+	}
+
+	if level >= len(splitLevels) {
+		// A single "word" longer than the limit, e.g. a URL or base64 blob; cut it by characters,
+		// leaving room for the extra token EstimateTokens adds to every piece
+		maxRunes := (r.MaxTokens - 1) * 4
+		if maxRunes < 1 {
+			maxRunes = 1
+		}
+		var out []span
+		start, n := s.start, 0
+		for i := range text[s.start:s.end] {
+			if n == maxRunes {
+				out = append(out, span{start, s.start + i})
+				start, n = s.start+i, 0
+			}
+			n++
+		}
+		return append(out, span{start, s.end})
+	}
+
+	var out []span
+	prev := s.start
+	for _, cut := range splitLevels[level](text[s.start:s.end]) {
+		cut += s.start
+		if cut <= prev || cut >= s.end {
+			continue
+		}
+		out = append(out, r.pieces(text, span{prev, cut}, level+1)...)
+		prev = cut
+	}
+	return append(out, r.pieces(text, span{prev, s.end}, level+1)...)
+}
+
+func (r RecursiveChunker) Chunk(text string) []TextChunk {
+	if strings.TrimSpace(text) == "" {
+		return []TextChunk{}
+	}
+
+	headings := findHeadings(text)
+	runeOffset := newRuneOffsets(text)
+
+	// Sections under different headings are never packed into the same chunk
+	var chunks []TextChunk
+	prev := 0
+	for _, cut := range append(splitLevels[0](text), len(text)) {
+		if cut <= prev {
+			continue
+		}
+		units := r.pieces(text, span{prev, cut}, 1)
+		chunks = append(chunks, r.pack(text, units, headings, runeOffset)...)
+		prev = cut
+	}
+
+	return chunks
+}
+
+// pack greedily joins consecutive units up to MaxTokens, starting each chunk with up to
+// OverlapTokens of the previous chunk's trailing units
+func (r RecursiveChunker) pack(text string, units []span, headings headingIndex, runeOffset func(int) int) []TextChunk {
+	var chunks []TextChunk
+	first := 0
+	for first < len(units) {
+		last := first
+		for last+1 < len(units) && r.tokens(text, span{units[first].start, units[last+1].end}) <= r.MaxTokens {
+			last++
+		}
+
+		raw := text[units[first].start:units[last].end]
+		content := strings.TrimSpace(raw)
+		if content != "" {
+			// Offsets point at the trimmed content, not the surrounding whitespace
+			start := units[first].start + len(raw) - len(strings.TrimLeftFunc(raw, unicode.IsSpace))
+			chunks = append(chunks, TextChunk{
+				Content:  content,
+				Start:    runeOffset(start),
+				End:      runeOffset(start + len(content)),
+				Headings: headings.at(start),
+			})
+		}
+
+		if last+1 >= len(units) {
+			break
+		}
+
+		// Step back over trailing units for overlap, as long as the overlap still leaves room
+		// for the next unit and the chunker keeps moving forward
+		next := last + 1
+		for next-1 > first &&
+			r.tokens(text, span{units[next-1].start, units[last].end}) <= r.OverlapTokens &&
+			r.tokens(text, span{units[next-1].start, units[last+1].end}) <= r.MaxTokens {
+			next--
+		}
+		first = next
+	}
+	return chunks
+}
+
+type heading struct {
+	offset int
+	level  int
+	title  string
+}
+
+type headingIndex []heading
+
+// findHeadings collects Markdown ATX (# Title) and setext (Title / ===) headings in order
+func findHeadings(text string) headingIndex {
+	var found headingIndex
+	for _, m := range atxHeading.FindAllStringSubmatchIndex(text, -1) {
+		found = append(found, heading{
+			offset: m[0],
+			level:  m[3] - m[2],
+			title:  strings.TrimSpace(text[m[4]:m[5]]),
+		})
+	}
+	for _, m := range setextHeading.FindAllStringSubmatchIndex(text, -1) {
+		level := 1
+		if text[m[4]] == '-' {
+			level = 2
+		}
+		title := strings.TrimSpace(text[m[2]:m[3]])
+		// A line of dashes under a table row or list item is not a heading
+		if title == "" || strings.HasPrefix(title, "|") || strings.HasPrefix(title, "- ") {
+			continue
+		}
+		found = append(found, heading{offset: m[0], level: level, title: title})
+	}
+
+	// Merge the two passes back into document order
+	for i := 1; i < len(found); i++ {
+		for j := i; j > 0 && found[j].offset < found[j-1].offset; j-- {
+			found[j], found[j-1] = found[j-1], found[j]
+		}
+	}
+	return found
+}
+
+// at returns the breadcrumb of headings in effect at a byte offset, outermost first
+func (h headingIndex) at(offset int) []string {
+	var stack []heading
+	for _, hd := range h {
+		if hd.offset > offset {
+			break
+		}
+		for len(stack) > 0 && stack[len(stack)-1].level >= hd.level {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, hd)
+	}
+
+	if len(stack) == 0 {
+		return nil
+	}
+	titles := make([]string, len(stack))
+	for i, hd := range stack {
+		titles[i] = hd.title
+	}
+	return titles
+}
+
+// newRuneOffsets converts byte offsets to code point offsets, counting only the distance
+// from the previous lookup since chunk offsets mostly move forward
+func newRuneOffsets(text string) func(int) int {
+	lastByte, lastRune := 0, 0
+	return func(b int) int {
+		if b >= lastByte {
+			lastRune += utf8.RuneCountInString(text[lastByte:b])
+		} else {
+			lastRune -= utf8.RuneCountInString(text[b:lastByte])
+		}
+		lastByte = b
+		return lastRune
+	}
+}
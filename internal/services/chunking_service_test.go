@@ -0,0 +1,188 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+)
+
+const chunkerSample = `Course Handbook
+===============
+
+Welcome to the course. Lectures run every Tuesday in room B12, café opens at 8.
+
+## Assessment
+
+The midterm exam is worth 30% of the grade. Le devoir final compte pour 50 %.
+Late work loses 10% per day — no exceptions! 日本語の説明もあります。課題は金曜日までに提出してください。
+
+### Deadlines
+
+- Essay: Friday 14 March 🎓
+- Project: Monday 12 May
+
+## Contact
+
+Email the teaching team at https://example.com/a-very-long-url-that-keeps-going-and-going-and-going-and-going-and-going-and-going
+`
+
+// checkRoundTrip asserts every chunk's offsets point at exactly its content, in runes
+func checkRoundTrip(t *testing.T, text string, chunks []TextChunk) {
+	t.Helper()
+	runes := []rune(text)
+	for i, c := range chunks {
+		if c.Start < 0 || c.End > len(runes) || c.Start > c.End {
+			t.Fatalf("chunk %d has offsets [%d, %d) outside the %d-rune text", i, c.Start, c.End, len(runes))
+		}
+		if got := string(runes[c.Start:c.End]); got != c.Content {
+			t.Errorf("chunk %d: text[%d:%d] = %q, want its content %q", i, c.Start, c.End, got, c.Content)
+		}
+	}
+}
+
+// checkCoverage asserts every non-space rune of the text falls inside some chunk
+func checkCoverage(t *testing.T, text string, chunks []TextChunk) {
+	t.Helper()
+	runes := []rune(text)
+	covered := make([]bool, len(runes))
+	for _, c := range chunks {
+		for i := c.Start; i < c.End; i++ {
+			covered[i] = true
+		}
+	}
+	for i, r := range runes {
+		if !covered[i] && !unicode.IsSpace(r) {
+			t.Fatalf("rune %d (%q) is not in any chunk", i, r)
+		}
+	}
+}
+
+func TestRecursiveChunkerRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		chunker  RecursiveChunker
+		minCount int
+	}{
+		{"whole sections", RecursiveChunker{MaxTokens: 200, OverlapTokens: 0}, 4},
+		{"split paragraphs", RecursiveChunker{MaxTokens: 20, OverlapTokens: 0}, 6},
+		{"split with overlap", RecursiveChunker{MaxTokens: 20, OverlapTokens: 8}, 6},
+		{"split words", RecursiveChunker{MaxTokens: 5, OverlapTokens: 2}, 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks := tc.chunker.Chunk(chunkerSample)
+			if len(chunks) < tc.minCount {
+				t.Fatalf("got %d chunks, want at least %d", len(chunks), tc.minCount)
+			}
+			checkRoundTrip(t, chunkerSample, chunks)
+			checkCoverage(t, chunkerSample, chunks)
+			for i, c := range chunks {
+				if n := EstimateTokens(c.Content); n > tc.chunker.MaxTokens {
+					t.Errorf("chunk %d is %d tokens, over the %d limit: %q", i, n, tc.chunker.MaxTokens, c.Content)
+				}
+				if strings.TrimSpace(c.Content) != c.Content || c.Content == "" {
+					t.Errorf("chunk %d is empty or not trimmed: %q", i, c.Content)
+				}
+			}
+		})
+	}
+}
+
+func TestRecursiveChunkerOverlap(t *testing.T) {
+	text := strings.Repeat("One short sentence here. ", 40)
+
+	without := RecursiveChunker{MaxTokens: 30, OverlapTokens: 0}.Chunk(text)
+	for i := 1; i < len(without); i++ {
+		if without[i].Start < without[i-1].End {
+			t.Errorf("chunks %d and %d overlap with OverlapTokens 0", i-1, i)
+		}
+	}
+
+	with := RecursiveChunker{MaxTokens: 30, OverlapTokens: 10}.Chunk(text)
+	checkRoundTrip(t, text, with)
+	if len(with) < 2 {
+		t.Fatalf("got %d chunks, want several", len(with))
+	}
+	for i := 1; i < len(with); i++ {
+		if with[i].Start >= with[i-1].End {
+			t.Errorf("chunk %d starts at %d, after chunk %d ends at %d; want an overlap", i, with[i].Start, i-1, with[i-1].End)
+		}
+		if with[i].Start <= with[i-1].Start {
+			t.Errorf("chunk %d does not move forward from chunk %d", i, i-1)
+		}
+	}
+}
+
+func TestRecursiveChunkerHeadings(t *testing.T) {
+	chunks := RecursiveChunker{MaxTokens: 200}.Chunk(chunkerSample)
+
+	want := map[string][]string{
+		"Welcome to the course":    {"Course Handbook"},
+		"The midterm exam":         {"Course Handbook", "Assessment"},
+		"- Essay: Friday 14 March": {"Course Handbook", "Assessment", "Deadlines"},
+		"Email the teaching team":  {"Course Handbook", "Contact"},
+	}
+	for prefix, headings := range want {
+		found := false
+		for _, c := range chunks {
+			if !strings.Contains(c.Content, prefix) {
+				continue
+			}
+			found = true
+			if strings.Join(c.Headings, " > ") != strings.Join(headings, " > ") {
+				t.Errorf("chunk with %q has headings %q, want %q", prefix, c.Headings, headings)
+			}
+		}
+		if !found {
+			t.Errorf("no chunk contains %q", prefix)
+		}
+	}
+
+	// Sections under different headings are never packed together
+	for _, c := range chunks {
+		if strings.Contains(c.Content, "Project: Monday") && strings.Contains(c.Content, "Email") {
+			t.Errorf("chunk spans the Deadlines and Contact sections: %q", c.Content)
+		}
+	}
+}
+
+func TestRecursiveChunkerSplitsLongWordOnRuneBoundaries(t *testing.T) {
+	text := strings.Repeat("é日🎓", 50)
+	chunks := RecursiveChunker{MaxTokens: 4}.Chunk(text)
+	if len(chunks) < 2 {
+		t.Fatalf("got %d chunks, want the word cut into several", len(chunks))
+	}
+	checkRoundTrip(t, text, chunks)
+	checkCoverage(t, text, chunks)
+}
+
+func TestChunkersReturnNothingForBlankText(t *testing.T) {
+	for _, text := range []string{"", "   \n\t\n  "} {
+		if chunks := (RecursiveChunker{MaxTokens: 50}).Chunk(text); len(chunks) != 0 {
+			t.Errorf("RecursiveChunker.Chunk(%q) = %d chunks, want none", text, len(chunks))
+		}
+		if chunks := ChunkText(text, 10); len(chunks) != 0 {
+			t.Errorf("ChunkText(%q) = %d chunks, want none", text, len(chunks))
+		}
+	}
+}
+
+func TestChunkTextWordWindows(t *testing.T) {
+	text := "  Deadline:\tFriday 14 March — café B12\n\n日本語 テスト 🎓 end  "
+	chunks := ChunkText(text, 3)
+
+	want := []string{"Deadline: Friday 14", "March — café", "B12 日本語 テスト", "🎓 end"}
+	if len(chunks) != len(want) {
+		t.Fatalf("got %d chunks, want %d: %+v", len(chunks), len(want), chunks)
+	}
+	runes := []rune(text)
+	for i, c := range chunks {
+		if c.Content != want[i] {
+			t.Errorf("chunk %d content = %q, want %q", i, c.Content, want[i])
+		}
+		// Word chunks join words with single spaces, so the span only matches up to whitespace
+		span := strings.Join(strings.Fields(string(runes[c.Start:c.End])), " ")
+		if span != c.Content {
+			t.Errorf("chunk %d: text[%d:%d] = %q, want the words %q", i, c.Start, c.End, span, c.Content)
+		}
+	}
+}
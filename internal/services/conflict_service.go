@@ -0,0 +1,228 @@
+package services
+
+import (
+	"dory-backend/internal/models"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of schedule conflict
+const (
+	ConflictOverlap    = "overlap"
+	ConflictBackToBack = "back_to_back"
+	ConflictBusyDay    = "busy_day"
+)
+
+const (
+	// A recurring event is checked against this much of its series when it is accepted
+	conflictCheckWindow = 90 * 24 * time.Hour
+	// At most this many occurrences are analysed at once
+	MaxConflictOccurrences = 2000
+)
+
+// Conflict is a problem in a user's schedule. Start and End are the overlap for overlaps, the
+// gap between the events for back-to-back ones and the local day for busy days.
+type Conflict struct {
+	Type string
+	// Date is the local day the conflict falls on, as YYYY-MM-DD
+	Date    string
+	Start   time.Time
+	End     time.Time
+	Events  []models.EventOccurrence
+	Message string
+}
+
+// ConflictOptions tune what counts as a conflict
+type ConflictOptions struct {
+	// BackToBackGap is the longest break between events at different places that is flagged
+	BackToBackGap time.Duration
+	// DeadlinesPerDay is how many deadlines on one day make it a busy day
+	DeadlinesPerDay int
+}
+
+var DefaultConflictOptions = ConflictOptions{
+	BackToBackGap:   15 * time.Minute,
+	DeadlinesPerDay: 3,
+}
+
+// isTimedSpan reports whether an occurrence takes up time in the day. All-day events and
+// events without an end, i.e. deadlines, cannot overlap anything.
+func isTimedSpan(occ models.EventOccurrence) bool {
+	return !occ.AllDay && occ.EndTime != nil && occ.EndTime.After(occ.StartTime)
+}
+
+// occurrenceDay is the local day an occurrence starts on. All-day events are stored at
+// midnight UTC of their date.
+func occurrenceDay(occ models.EventOccurrence, loc *time.Location) string {
+	if occ.AllDay {
+		return occ.StartTime.UTC().Format("2006-01-02")
+	}
+	return occ.StartTime.In(loc).Format("2006-01-02")
+}
+
+// differentPlaces reports whether both occurrences have a location and they are not the same
+func differentPlaces(a models.EventOccurrence, b models.EventOccurrence) bool {
+	if a.Location == nil || b.Location == nil {
+		return false
+	}
+	la := strings.ToLower(strings.TrimSpace(*a.Location))
+	lb := strings.ToLower(strings.TrimSpace(*b.Location))
+	return la != "" && lb != "" && la != lb
+}
+
+// FindConflicts flags overlapping events, events at different places with too short a break
+// between them, and days with too many deadlines. Occurrences of the same event are never
+// compared with each other.
+func FindConflicts(occurrences []models.EventOccurrence, loc *time.Location, opts ConflictOptions) []Conflict {
+	var spans []models.EventOccurrence
+	deadlines := map[string][]models.EventOccurrence{}
+	for _, occ := range occurrences {
+		if isTimedSpan(occ) {
+			spans = append(spans, occ)
+		} else if occ.EndTime == nil {
+			day := occurrenceDay(occ, loc)
+			deadlines[day] = append(deadlines[day], occ)
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].StartTime.Before(spans[j].StartTime)
+	})
+
+	conflicts := []Conflict{}
+	for i, a := range spans {
+		for _, b := range spans[i+1:] {
+			// Spans are sorted by start, so nothing later can touch a
+			if b.StartTime.After(a.EndTime.Add(opts.BackToBackGap)) {
+				break
+			}
+			if a.EventID == b.EventID {
+				continue
+			}
+			if b.StartTime.Before(*a.EndTime) {
+				end := *a.EndTime
+				if b.EndTime.Before(end) {
+					end = *b.EndTime
+				}
+				conflicts = append(conflicts, Conflict{
+					Type:   ConflictOverlap,
+					Date:   b.StartTime.In(loc).Format("2006-01-02"),
+					Start:  b.StartTime,
+					End:    end,
+					Events: []models.EventOccurrence{a, b},
+					Message: fmt.Sprintf("%q overlaps %q from %s to %s on %s", a.Title, b.Title,
+						b.StartTime.In(loc).Format("15:04"), end.In(loc).Format("15:04"), b.StartTime.In(loc).Format("Mon 2 Jan")),
+				})
+			} else if opts.BackToBackGap > 0 && differentPlaces(a, b) {
+				conflicts = append(conflicts, Conflict{
+					Type:   ConflictBackToBack,
+					Date:   b.StartTime.In(loc).Format("2006-01-02"),
+					Start:  *a.EndTime,
+					End:    b.StartTime,
+					Events: []models.EventOccurrence{a, b},
+					Message: fmt.Sprintf("%q ends at %s at %s and %q starts at %s at %s", a.Title,
+						a.EndTime.In(loc).Format("15:04"), *a.Location, b.Title, b.StartTime.In(loc).Format("15:04"), *b.Location),
+				})
+			}
+		}
+	}
+
+	if opts.DeadlinesPerDay > 0 {
+		for day, occs := range deadlines {
+			if len(occs) < opts.DeadlinesPerDay {
+				continue
+			}
+			date, _ := time.ParseInLocation("2006-01-02", day, loc)
+			conflicts = append(conflicts, Conflict{
+				Type:    ConflictBusyDay,
+				Date:    day,
+				Start:   date,
+				End:     date.AddDate(0, 0, 1),
+				Events:  occs,
+				Message: fmt.Sprintf("%d deadlines on %s", len(occs), date.Format("Monday 2 January")),
+			})
+		}
+	}
+
+	sort.SliceStable(conflicts, func(i, j int) bool {
+		if !conflicts[i].Start.Equal(conflicts[j].Start) {
+			return conflicts[i].Start.Before(conflicts[j].Start)
+		}
+		return conflicts[i].Type < conflicts[j].Type
+	})
+	return conflicts
+}
+
+// LocalDayBounds widens [from, to) to whole days in loc, so days at the edges are counted
+// in full
+func LocalDayBounds(from time.Time, to time.Time, loc *time.Location) (time.Time, time.Time) {
+	f := from.In(loc)
+	start := time.Date(f.Year(), f.Month(), f.Day(), 0, 0, 0, 0, loc)
+	t := to.In(loc)
+	end := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	if end.Before(to) || !end.After(start) {
+		end = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+	}
+	return start, end
+}
+
+// ScheduleConflicts analyses the user's occurrences in [from, to), widened to whole local days
+func ScheduleConflicts(userID uuid.UUID, from time.Time, to time.Time, opts ConflictOptions) ([]Conflict, error) {
+	loc := UserLocation(userID)
+	from, to = LocalDayBounds(from, to, loc)
+	// All-day events sit at midnight UTC, which can fall on the neighbouring local day, so a
+	// day more is loaded on each side and conflicts outside the range dropped afterwards
+	loadFrom, loadTo := from.AddDate(0, 0, -1), to.AddDate(0, 0, 1)
+	events, err := EventsInRange(userID, &loadFrom, &loadTo)
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := []Conflict{}
+	for _, c := range FindConflicts(ExpandEvents(events, loadFrom, loadTo, MaxConflictOccurrences), loc, opts) {
+		if c.Start.Before(to) && (c.End.After(from) || !c.Start.Before(from)) {
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts, nil
+}
+
+// EventConflicts lists the conflicts an event takes part in, looking at the days it covers
+// or, for a recurring event, its first 90 days
+func EventConflicts(event models.Event) ([]Conflict, error) {
+	to := event.StartTime
+	if event.EndTime != nil {
+		to = *event.EndTime
+	}
+	if event.RRule != "" {
+		to = event.StartTime.Add(conflictCheckWindow)
+		if event.RecurrenceEnd != nil && event.RecurrenceEnd.Before(to) {
+			to = *event.RecurrenceEnd
+		}
+	}
+	from := event.StartTime
+	if event.AllDay {
+		// All-day dates are read as the same date in the user's zone
+		d := event.StartTime.UTC()
+		from = time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, UserLocation(event.UserID))
+		to = from.Add(to.Sub(event.StartTime))
+	}
+	all, err := ScheduleConflicts(event.UserID, from, to, DefaultConflictOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := []Conflict{}
+	for _, c := range all {
+		for _, occ := range c.Events {
+			if occ.EventID == event.ID {
+				conflicts = append(conflicts, c)
+				break
+			}
+		}
+	}
+	return conflicts, nil
+}
@@ -0,0 +1,215 @@
+package services
+
+import (
+	"dory-backend/internal/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// describeConflicts renders conflicts as "type date title+title" for comparison
+func describeConflicts(conflicts []Conflict) []string {
+	out := make([]string, len(conflicts))
+	for i, c := range conflicts {
+		titles := make([]string, len(c.Events))
+		for j, e := range c.Events {
+			titles[j] = e.Title
+		}
+		out[i] = c.Type + " " + c.Date + " " + strings.Join(titles, "+")
+	}
+	return out
+}
+
+func TestFindConflicts(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, berlin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	place := func(s string) *string { return &s }
+	span := func(title, start, end string, location *string) models.EventOccurrence {
+		e := at(end)
+		return models.EventOccurrence{EventID: uuid.New(), Title: title, StartTime: at(start), EndTime: &e, Location: location}
+	}
+	deadline := func(title, start string) models.EventOccurrence {
+		return models.EventOccurrence{EventID: uuid.New(), Title: title, StartTime: at(start)}
+	}
+	allDay := func(title, date string) models.EventOccurrence {
+		d, _ := time.Parse("2006-01-02", date)
+		end := d.AddDate(0, 0, 1)
+		return models.EventOccurrence{EventID: uuid.New(), Title: title, StartTime: d, EndTime: &end, AllDay: true}
+	}
+	sameEvent := func(a, b models.EventOccurrence) (models.EventOccurrence, models.EventOccurrence) {
+		b.EventID = a.EventID
+		return a, b
+	}
+	lecture, lectureNextHour := sameEvent(
+		span("Lecture", "2025-03-10 09:00", "2025-03-10 10:30", place("B12")),
+		span("Lecture", "2025-03-10 10:00", "2025-03-10 11:30", place("B12")),
+	)
+
+	tests := []struct {
+		name        string
+		occurrences []models.EventOccurrence
+		want        []string
+	}{
+		{
+			name: "overlap",
+			occurrences: []models.EventOccurrence{
+				span("Lab", "2025-03-10 10:00", "2025-03-10 12:00", nil),
+				span("Lecture", "2025-03-10 09:00", "2025-03-10 10:30", nil),
+			},
+			want: []string{"overlap 2025-03-10 Lecture+Lab"},
+		},
+		{
+			name: "touching ends do not overlap",
+			occurrences: []models.EventOccurrence{
+				span("Lecture", "2025-03-10 09:00", "2025-03-10 10:00", nil),
+				span("Lab", "2025-03-10 10:00", "2025-03-10 12:00", nil),
+			},
+			want: []string{},
+		},
+		{
+			name: "one event inside another",
+			occurrences: []models.EventOccurrence{
+				span("Workshop", "2025-03-10 09:00", "2025-03-10 17:00", nil),
+				span("Call", "2025-03-10 11:00", "2025-03-10 11:30", nil),
+				span("Lunch", "2025-03-10 12:00", "2025-03-10 13:00", nil),
+			},
+			want: []string{"overlap 2025-03-10 Workshop+Call", "overlap 2025-03-10 Workshop+Lunch"},
+		},
+		{
+			name: "back to back at different places",
+			occurrences: []models.EventOccurrence{
+				span("Lecture", "2025-03-10 09:00", "2025-03-10 10:00", place("Room B12")),
+				span("Lab", "2025-03-10 10:10", "2025-03-10 12:00", place("Science building")),
+			},
+			want: []string{"back_to_back 2025-03-10 Lecture+Lab"},
+		},
+		{
+			name: "back to back at the same place",
+			occurrences: []models.EventOccurrence{
+				span("Lecture", "2025-03-10 09:00", "2025-03-10 10:00", place("Room B12")),
+				span("Tutorial", "2025-03-10 10:05", "2025-03-10 11:00", place(" room b12 ")),
+			},
+			want: []string{},
+		},
+		{
+			name: "enough of a break between places",
+			occurrences: []models.EventOccurrence{
+				span("Lecture", "2025-03-10 09:00", "2025-03-10 10:00", place("Room B12")),
+				span("Lab", "2025-03-10 10:30", "2025-03-10 12:00", place("Science building")),
+			},
+			want: []string{},
+		},
+		{
+			name: "unknown place is not flagged",
+			occurrences: []models.EventOccurrence{
+				span("Lecture", "2025-03-10 09:00", "2025-03-10 10:00", place("Room B12")),
+				span("Call", "2025-03-10 10:05", "2025-03-10 11:00", nil),
+			},
+			want: []string{},
+		},
+		{
+			name:        "occurrences of the same event",
+			occurrences: []models.EventOccurrence{lecture, lectureNextHour},
+			want:        []string{},
+		},
+		{
+			name: "all-day events and deadlines never overlap",
+			occurrences: []models.EventOccurrence{
+				allDay("Field trip", "2025-03-10"),
+				deadline("Essay due", "2025-03-10 12:00"),
+				span("Lecture", "2025-03-10 09:00", "2025-03-10 17:00", nil),
+			},
+			want: []string{},
+		},
+		{
+			name: "busy day",
+			occurrences: []models.EventOccurrence{
+				deadline("Essay due", "2025-03-14 09:00"),
+				deadline("Quiz closes", "2025-03-14 17:00"),
+				deadline("Project due", "2025-03-14 23:59"),
+				deadline("Reading", "2025-03-15 09:00"),
+			},
+			want: []string{"busy_day 2025-03-14 Essay due+Quiz closes+Project due"},
+		},
+		{
+			// 00:30 in Berlin is still the previous day in UTC
+			name: "busy day uses the local date",
+			occurrences: []models.EventOccurrence{
+				deadline("Essay due", "2025-03-14 00:30"),
+				deadline("Quiz closes", "2025-03-14 12:00"),
+				deadline("Project due", "2025-03-14 23:30"),
+			},
+			want: []string{"busy_day 2025-03-14 Essay due+Quiz closes+Project due"},
+		},
+		{
+			name: "two deadlines are not a busy day",
+			occurrences: []models.EventOccurrence{
+				deadline("Essay due", "2025-03-14 09:00"),
+				deadline("Quiz closes", "2025-03-14 17:00"),
+			},
+			want: []string{},
+		},
+		{
+			name: "conflicts are ordered by start",
+			occurrences: []models.EventOccurrence{
+				span("Seminar", "2025-03-11 14:00", "2025-03-11 16:00", nil),
+				span("Meeting", "2025-03-11 15:00", "2025-03-11 15:30", nil),
+				span("Lecture", "2025-03-10 09:00", "2025-03-10 10:30", nil),
+				span("Lab", "2025-03-10 10:00", "2025-03-10 12:00", nil),
+			},
+			want: []string{"overlap 2025-03-10 Lecture+Lab", "overlap 2025-03-11 Seminar+Meeting"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := describeConflicts(FindConflicts(tt.occurrences, berlin, DefaultConflictOptions))
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("conflicts\n got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindConflictsOverlapBounds(t *testing.T) {
+	start := time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+	end := func(d time.Duration) *time.Time { v := start.Add(d); return &v }
+	occurrences := []models.EventOccurrence{
+		{EventID: uuid.New(), Title: "Lecture", StartTime: start, EndTime: end(90 * time.Minute)},
+		{EventID: uuid.New(), Title: "Lab", StartTime: start.Add(time.Hour), EndTime: end(3 * time.Hour)},
+	}
+
+	conflicts := FindConflicts(occurrences, time.UTC, DefaultConflictOptions)
+	if len(conflicts) != 1 {
+		t.Fatalf("got %d conflicts, want 1", len(conflicts))
+	}
+	c := conflicts[0]
+	if !c.Start.Equal(start.Add(time.Hour)) || !c.End.Equal(start.Add(90*time.Minute)) {
+		t.Errorf("overlap runs %s to %s, want 10:00 to 10:30", c.Start.Format("15:04"), c.End.Format("15:04"))
+	}
+}
+
+func TestFindConflictsOptionsDisableChecks(t *testing.T) {
+	place := func(s string) *string { return &s }
+	start := time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+	end, labEnd := start.Add(time.Hour), start.Add(2*time.Hour)
+	occurrences := []models.EventOccurrence{
+		{EventID: uuid.New(), Title: "Lecture", StartTime: start, EndTime: &end, Location: place("B12")},
+		{EventID: uuid.New(), Title: "Lab", StartTime: end.Add(5 * time.Minute), EndTime: &labEnd, Location: place("C3")},
+	}
+	for i := 0; i < 5; i++ {
+		occurrences = append(occurrences, models.EventOccurrence{EventID: uuid.New(), Title: "Deadline", StartTime: start})
+	}
+
+	if got := FindConflicts(occurrences, time.UTC, ConflictOptions{}); len(got) != 0 {
+		t.Errorf("zero options found %q, want no conflicts", describeConflicts(got))
+	}
+}
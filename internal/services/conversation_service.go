@@ -0,0 +1,159 @@
+package services
+
+import (
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// maxHistoryMessages bounds the rows loaded per request before the token budget is applied
+const maxHistoryMessages = 50
+
+// OpenConversation returns the user's conversation, or a new one titled after the first
+// message when no ID is given. A new conversation is not stored yet: isNew tells SaveTurn to
+// create it with the first turn, so a failed turn leaves no empty conversation behind.
+func OpenConversation(userID uuid.UUID, conversationID string, firstMessage string) (conv models.Conversation, isNew bool, err error) {
+	if conversationID != "" {
+		convUUID, err := uuid.Parse(conversationID)
+		if err != nil {
+			return conv, false, gorm.ErrRecordNotFound
+		}
+		err = config.DB.Where("id = ? AND user_id = ?", convUUID, userID).First(&conv).Error
+		return conv, false, err
+	}
+
+	// The ID is chosen here so it can be reported before the turn is saved
+	conv = models.Conversation{
+		ID:     uuid.New(),
+		UserID: userID,
+		Title:  conversationTitle(firstMessage),
+	}
+	return conv, true, nil
+}
+
+func conversationTitle(message string) string {
+	title := strings.Join(strings.Fields(message), " ")
+	if utf8.RuneCountInString(title) > 60 {
+		title = string([]rune(title)[:60]) + "..."
+	}
+	if title == "" {
+		title = "New conversation"
+	}
+	return title
+}
+
+// LoadHistory returns the most recent turns of a conversation, oldest first, that fit within
+// the token budget. Older turns are dropped whole rather than truncated.
+func LoadHistory(conversationID uuid.UUID, tokenBudget int) ([]ChatMessage, error) {
+	var messages []models.Message
+	err := config.DB.Where("conversation_id = ?", conversationID).
+		Order("created_at DESC").
+		Limit(maxHistoryMessages).
+		Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var history []ChatMessage
+	used := 0
+	for _, m := range messages {
+		cost := EstimateTokens(m.Content)
+		if used+cost > tokenBudget {
+			break
+		}
+		used += cost
+
+		content := m.Content
+		if m.Role == RoleAssistant {
+			// Markers refer to that turn's numbering and would point at the wrong sources now
+			content = citationMarker.ReplaceAllString(content, "")
+		}
+		history = append(history, ChatMessage{Role: m.Role, Content: content})
+	}
+
+	// Reverse into chronological order
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+
+	// Providers expect the history to open with a user turn
+	for len(history) > 0 && history[0].Role != RoleUser {
+		history = history[1:]
+	}
+
+	return history, nil
+}
+
+// EstimateTokens approximates the token count at roughly four characters per token,
+// which is close enough for budgeting without a provider-specific tokenizer
+func EstimateTokens(text string) int {
+	return utf8.RuneCountInString(text)/4 + 1
+}
+
+// RetrievalQuery folds the previous user turn into the search query so follow-ups such as
+// "and when is it due?" still retrieve the chunks the conversation is about
+func RetrievalQuery(history []ChatMessage, message string) string {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role == RoleUser {
+			return history[i].Content + "\n" + message
+		}
+	}
+	return message
+}
+
+// SaveTurn stores the user message and the assistant reply together, both with the sources
+// retrieved for the turn, and bumps the conversation. isNew creates the conversation first.
+func SaveTurn(conv models.Conversation, isNew bool, userMessage string, reply string, sources []models.Source, citations []models.Citation) (models.Message, error) {
+	conversationID := conv.ID
+	assistant := models.Message{
+		ConversationID: conversationID,
+		Role:           RoleAssistant,
+		Content:        reply,
+		Sources:        sources,
+		Citations:      citations,
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if isNew {
+			if err := tx.Create(&conv).Error; err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		user := models.Message{
+			ConversationID: conversationID,
+			Role:           RoleUser,
+			Content:        userMessage,
+			Sources:        sources,
+			CreatedAt:      now,
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+
+		// Keep the assistant turn strictly after the user turn so ordering by created_at is stable
+		assistant.CreatedAt = now.Add(time.Millisecond)
+		if err := tx.Create(&assistant).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Conversation{}).Where("id = ?", conversationID).Update("updated_at", now).Error
+	})
+
+	return assistant, err
+}
+
+func DeleteConversation(conversationID uuid.UUID) error {
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("conversation_id = ?", conversationID).Delete(&models.Message{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.Conversation{}, "id = ?", conversationID).Error
+	})
+}
@@ -0,0 +1,566 @@
+package services
+
+import (
+	"context"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"errors"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrEventNotMerged   = errors.New("detected event is not merged into another")
+	ErrEventMergeTarget = errors.New("detected events cannot be merged")
+)
+
+// Duplicate detection settings. A pair scores by title similarity and how close the two
+// times are; pairs in the borderline band are settled by embedding similarity when
+// EVENT_DEDUP_EMBEDDINGS is on.
+const (
+	dedupThreshold       = 0.75
+	dedupBorderline      = 0.55
+	dedupEmbeddingWeight = 0.5
+	dedupMinTitleScore   = 0.5
+	dedupWindow          = 36 * time.Hour
+	dedupCandidateLimit  = 200
+	dedupEmbedTimeout    = 10 * time.Second
+	dedupMaxEmbeddings   = 20
+)
+
+// titleStopWords carry no meaning about which event a title names
+var titleStopWords = map[string]bool{
+	"the": true, "a": true, "an": true, "of": true, "for": true, "and": true, "to": true,
+	"in": true, "on": true, "at": true, "my": true, "our": true, "your": true,
+	"reminder": true, "upcoming": true, "re": true, "fwd": true, "fw": true,
+}
+
+// SaveDetectedEvent stores a new detection. When it repeats a detection the user already
+// has, e.g. the reminder email for an exam listed in the syllabus, it is stored merged into
+// that one instead of being queued for review a second time.
+func SaveDetectedEvent(db *gorm.DB, detected *models.DetectedEvent) error {
+	// Embedding calls go out over the network, so they are made before any row is locked
+	vectors := dedupEmbeddings(db, []models.DetectedEvent{*detected})
+	return db.Transaction(func(tx *gorm.DB) error {
+		return saveDetectedEvent(tx, detected, vectors)
+	})
+}
+
+// saveDetectedEvent does the work of SaveDetectedEvent inside tx, using embeddings
+// prepared by dedupEmbeddings
+func saveDetectedEvent(tx *gorm.DB, detected *models.DetectedEvent, vectors map[string][]float32) error {
+	canonical, score, err := findDuplicate(tx, *detected, vectors)
+	if err != nil {
+		return err
+	}
+	if canonical == nil {
+		return tx.Create(detected).Error
+	}
+	return mergeDetectedEvents(tx, canonical, detected, models.EventMergeAuto, score, true)
+}
+
+// dedupCandidates lists the user's pending or accepted detections near d in time
+func dedupCandidates(db *gorm.DB, d models.DetectedEvent) ([]models.DetectedEvent, error) {
+	query := db.Where("user_id = ? AND id <> ? AND status IN ?", d.UserID, d.ID,
+		[]string{models.DetectedEventPending, models.DetectedEventAccepted})
+	if d.StartTime != nil {
+		query = query.Where("(start_time IS NULL OR start_time BETWEEN ? AND ?)",
+			d.StartTime.Add(-dedupWindow), d.StartTime.Add(dedupWindow))
+	}
+
+	var candidates []models.DetectedEvent
+	err := query.Order("detected_at DESC").Limit(dedupCandidateLimit).Find(&candidates).Error
+	return candidates, err
+}
+
+// findDuplicate returns the user's pending or accepted detection that best matches d, if any
+// scores above the threshold. Borderline pairs are settled with the embeddings in vectors;
+// a pair without both embeddings keeps its title and time score.
+func findDuplicate(tx *gorm.DB, d models.DetectedEvent, vectors map[string][]float32) (*models.DetectedEvent, float64, error) {
+	candidates, err := dedupCandidates(tx, d)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var best *models.DetectedEvent
+	bestScore := 0.0
+	embedding := vectors[dedupText(d)]
+	for i := range candidates {
+		score := duplicateScore(d, candidates[i])
+		if score >= dedupBorderline && score < dedupThreshold && embedding != nil {
+			if other := vectors[dedupText(candidates[i])]; other != nil {
+				score = (1-dedupEmbeddingWeight)*score + dedupEmbeddingWeight*cosineSimilarity(embedding, other)
+			}
+		}
+		if score >= dedupThreshold && score > bestScore {
+			best, bestScore = &candidates[i], score
+		}
+	}
+	return best, bestScore, nil
+}
+
+// dedupEmbeddings embeds the detections and the candidates they are borderline with, keyed
+// by dedupText. Detections earlier in the list count as candidates for later ones, as they
+// will be saved first. Each detection triggers at most dedupMaxEmbeddings embedding calls;
+// the result is nil when embeddings are disabled.
+func dedupEmbeddings(db *gorm.DB, detections []models.DetectedEvent) map[string][]float32 {
+	if !config.AppConfig.EventDedupEmbeddings || ActiveEmbedder == nil {
+		return nil
+	}
+
+	vectors := map[string][]float32{}
+	for i, d := range detections {
+		candidates, err := dedupCandidates(db, d)
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, detections[:i]...)
+
+		calls := 0
+		embed := func(e models.DetectedEvent) {
+			text := dedupText(e)
+			if _, done := vectors[text]; done || calls >= dedupMaxEmbeddings {
+				return
+			}
+			calls++
+			// A failed call is remembered as nil so it is not retried for every pair
+			vectors[text] = embedDedupText(text)
+		}
+		for _, c := range candidates {
+			if score := duplicateScore(d, c); score < dedupBorderline || score >= dedupThreshold {
+				continue
+			}
+			embed(d)
+			if vectors[dedupText(d)] == nil {
+				break
+			}
+			embed(c)
+		}
+	}
+	return vectors
+}
+
+// duplicateScore rates from 0 to 1 how likely two detections describe the same event
+func duplicateScore(a models.DetectedEvent, b models.DetectedEvent) float64 {
+	// A weekly class and a one-off session of it are different things on a calendar
+	if a.RRule != b.RRule {
+		return 0
+	}
+	title := titleSimilarity(a.Title, b.Title)
+	if title < dedupMinTitleScore {
+		return 0
+	}
+	if a.StartTime == nil || b.StartTime == nil {
+		return 0.6*title + 0.4*0.5
+	}
+	closeness := timeCloseness(*a.StartTime, a.AllDay, *b.StartTime, b.AllDay)
+	if closeness == 0 {
+		return 0
+	}
+	return 0.6*title + 0.4*closeness
+}
+
+// timeCloseness is 1 for the same start and falls off over a few hours; an all-day event
+// matches anything on its day
+func timeCloseness(a time.Time, aAllDay bool, b time.Time, bAllDay bool) float64 {
+	if aAllDay || bAllDay {
+		if a.UTC().Format("2006-01-02") == b.UTC().Format("2006-01-02") {
+			return 0.9
+		}
+		return 0
+	}
+	diff := a.Sub(b)
+	if diff < 0 {
+		diff = -diff
+	}
+	switch {
+	case diff <= 15*time.Minute:
+		return 1
+	case diff <= 2*time.Hour:
+		return 0.8
+	case diff <= 12*time.Hour:
+		return 0.4
+	default:
+		return 0
+	}
+}
+
+// titleSimilarity compares titles by shared words and, to tolerate typos and plurals, by
+// shared character trigrams. Titles that differ in a number ("Exam 1", "Exam 2") never match.
+func titleSimilarity(a string, b string) float64 {
+	ta, tb := titleTokens(a), titleTokens(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	if !sameNumbers(ta, tb) {
+		return 0
+	}
+
+	shared := 0
+	seen := map[string]bool{}
+	for _, t := range ta {
+		seen[t] = true
+	}
+	union := len(seen)
+	counted := map[string]bool{}
+	for _, t := range tb {
+		if counted[t] {
+			continue
+		}
+		counted[t] = true
+		if seen[t] {
+			shared++
+		} else {
+			union++
+		}
+	}
+	jaccard := float64(shared) / float64(union)
+
+	return math.Max(jaccard, trigramDice(strings.Join(ta, " "), strings.Join(tb, " ")))
+}
+
+func titleTokens(title string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var tokens []string
+	for _, f := range fields {
+		if !titleStopWords[f] {
+			tokens = append(tokens, f)
+		}
+	}
+	return tokens
+}
+
+func sameNumbers(a []string, b []string) bool {
+	numbers := func(tokens []string) string {
+		var out []string
+		for _, t := range tokens {
+			if strings.IndexFunc(t, unicode.IsDigit) >= 0 {
+				out = append(out, t)
+			}
+		}
+		return strings.Join(out, " ")
+	}
+	return numbers(a) == numbers(b)
+}
+
+func trigramDice(a string, b string) float64 {
+	grams := func(s string) map[string]int {
+		out := map[string]int{}
+		r := []rune(" " + s + " ")
+		for i := 0; i+3 <= len(r); i++ {
+			out[string(r[i:i+3])]++
+		}
+		return out
+	}
+	ga, gb := grams(a), grams(b)
+	total, shared := 0, 0
+	for g, n := range ga {
+		total += n
+		shared += min(n, gb[g])
+	}
+	for _, n := range gb {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	return 2 * float64(shared) / float64(total)
+}
+
+// dedupText is what a detection is embedded as: its title with the text it came from
+func dedupText(d models.DetectedEvent) string {
+	return strings.TrimSpace(d.Title + ". " + d.SourceText)
+}
+
+// embedDedupText embeds text for duplicate detection; nil when the provider fails, so dedup
+// falls back to titles and times
+func embedDedupText(text string) []float32 {
+	ctx, cancel := context.WithTimeout(context.Background(), dedupEmbedTimeout)
+	defer cancel()
+	vector, err := ActiveEmbedder.Embed(ctx, text)
+	if err != nil {
+		return nil
+	}
+	return vector
+}
+
+func cosineSimilarity(a []float32, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// mergeDetectedEvents folds dup into canonical. A pending canonical takes over whatever
+// fields it lacks from the duplicate; the duplicate keeps its own document and text.
+// isNew is set when dup has not been saved yet.
+func mergeDetectedEvents(tx *gorm.DB, canonical *models.DetectedEvent, dup *models.DetectedEvent, method string, score float64, isNew bool) error {
+	now := time.Now()
+	merge := models.EventMerge{
+		ID:                 uuid.New(),
+		UserID:             canonical.UserID,
+		CanonicalID:        canonical.ID,
+		MergedID:           dup.ID,
+		Method:             method,
+		Score:              score,
+		PreviousConfidence: canonical.Confidence,
+		MergedAt:           now,
+	}
+
+	updates := map[string]interface{}{}
+	if canonical.Status == models.DetectedEventPending {
+		if canonical.StartTime == nil && dup.StartTime != nil {
+			canonical.StartTime, canonical.AllDay = dup.StartTime, dup.AllDay
+			updates["start_time"], updates["all_day"] = canonical.StartTime, canonical.AllDay
+			merge.FilledFields = append(merge.FilledFields, "start_time")
+		}
+		if canonical.EndTime == nil && dup.EndTime != nil && canonical.StartTime != nil && dup.EndTime.After(*canonical.StartTime) {
+			canonical.EndTime = dup.EndTime
+			updates["end_time"] = canonical.EndTime
+			merge.FilledFields = append(merge.FilledFields, "end_time")
+		}
+		if canonical.Location == nil && dup.Location != nil {
+			canonical.Location = dup.Location
+			updates["location"] = canonical.Location
+			merge.FilledFields = append(merge.FilledFields, "location")
+		}
+		if canonical.RRule == "" && dup.RRule != "" {
+			canonical.RRule, canonical.ExDates, canonical.TimeZone = dup.RRule, dup.ExDates, dup.TimeZone
+			updates["rrule"], updates["ex_dates"], updates["time_zone"] = canonical.RRule, canonical.ExDates, canonical.TimeZone
+			merge.FilledFields = append(merge.FilledFields, "rrule")
+		}
+	}
+	if dup.Confidence > canonical.Confidence {
+		canonical.Confidence = dup.Confidence
+		updates["confidence"] = canonical.Confidence
+	}
+	if len(updates) > 0 {
+		if err := tx.Model(canonical).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+
+	dup.Status = models.DetectedEventMerged
+	dup.MergedIntoID = &canonical.ID
+	dup.ReviewedAt = &now
+	if isNew {
+		if err := tx.Create(dup).Error; err != nil {
+			return err
+		}
+	} else {
+		result := tx.Model(&models.DetectedEvent{}).
+			Where("id = ? AND status = ?", dup.ID, models.DetectedEventPending).
+			Updates(map[string]interface{}{
+				"status":         dup.Status,
+				"merged_into_id": dup.MergedIntoID,
+				"reviewed_at":    now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrEventAlreadyReviewed
+		}
+
+		// Duplicates already merged into dup now belong to the canonical detection
+		if err := tx.Model(&models.DetectedEvent{}).Where("merged_into_id = ?", dup.ID).
+			Update("merged_into_id", canonical.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.EventMerge{}).Where("canonical_id = ? AND unmerged_at IS NULL", dup.ID).
+			Update("canonical_id", canonical.ID).Error; err != nil {
+			return err
+		}
+	}
+
+	return tx.Create(&merge).Error
+}
+
+// MergeDetectedEvents merges a pending detection into another one the user picked
+func MergeDetectedEvents(canonical *models.DetectedEvent, dup *models.DetectedEvent) error {
+	if canonical.ID == dup.ID || canonical.UserID != dup.UserID {
+		return ErrEventMergeTarget
+	}
+	if canonical.Status != models.DetectedEventPending && canonical.Status != models.DetectedEventAccepted {
+		return ErrEventMergeTarget
+	}
+	if dup.Status != models.DetectedEventPending {
+		return ErrEventAlreadyReviewed
+	}
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		return mergeDetectedEvents(tx, canonical, dup, models.EventMergeManual, duplicateScore(*canonical, *dup), false)
+	})
+}
+
+// UnmergeDetectedEvent splits a merged duplicate off again as a pending detection and takes
+// back the fields it filled in on the canonical one, unless they were edited since
+func UnmergeDetectedEvent(dup *models.DetectedEvent) error {
+	if dup.Status != models.DetectedEventMerged || dup.MergedIntoID == nil {
+		return ErrEventNotMerged
+	}
+
+	now := time.Now()
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		var merge models.EventMerge
+		if err := tx.Where("merged_id = ? AND unmerged_at IS NULL", dup.ID).Order("merged_at DESC").First(&merge).Error; err != nil {
+			return err
+		}
+		var canonical models.DetectedEvent
+		if err := tx.First(&canonical, "id = ?", *dup.MergedIntoID).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{}
+		if canonical.Status == models.DetectedEventPending {
+			for _, field := range merge.FilledFields {
+				switch field {
+				case "start_time":
+					if sameTime(canonical.StartTime, dup.StartTime) {
+						updates["start_time"], updates["all_day"] = nil, false
+					}
+				case "end_time":
+					if sameTime(canonical.EndTime, dup.EndTime) {
+						updates["end_time"] = nil
+					}
+				case "location":
+					if canonical.Location != nil && dup.Location != nil && *canonical.Location == *dup.Location {
+						updates["location"] = nil
+					}
+				case "rrule":
+					if canonical.RRule == dup.RRule {
+						updates["rrule"], updates["ex_dates"], updates["time_zone"] = "", models.JSONList[time.Time]{}, ""
+					}
+				}
+			}
+		}
+
+		// Confidence falls back to the best of what is still merged
+		confidence := merge.PreviousConfidence
+		var others []models.DetectedEvent
+		if err := tx.Select("confidence").Where("merged_into_id = ? AND id <> ?", canonical.ID, dup.ID).Find(&others).Error; err != nil {
+			return err
+		}
+		for _, o := range others {
+			confidence = math.Max(confidence, o.Confidence)
+		}
+		if confidence != canonical.Confidence {
+			updates["confidence"] = confidence
+		}
+		if len(updates) > 0 {
+			if err := tx.Model(&canonical).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(&merge).Update("unmerged_at", now).Error; err != nil {
+			return err
+		}
+		result := tx.Model(&models.DetectedEvent{}).
+			Where("id = ? AND status = ?", dup.ID, models.DetectedEventMerged).
+			Updates(map[string]interface{}{
+				"status":         models.DetectedEventPending,
+				"merged_into_id": nil,
+				"reviewed_at":    nil,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrEventNotMerged
+		}
+
+		dup.Status = models.DetectedEventPending
+		dup.MergedIntoID = nil
+		dup.ReviewedAt = nil
+		return nil
+	})
+}
+
+func sameTime(a *time.Time, b *time.Time) bool {
+	return a != nil && b != nil && a.Equal(*b)
+}
+
+// DetectedEventMerges returns a detection's merge history and the detections merged into it,
+// which are the other documents it was found in
+func DetectedEventMerges(detected models.DetectedEvent) ([]models.EventMerge, []models.DetectedEvent, error) {
+	var history []models.EventMerge
+	if err := config.DB.Where("canonical_id = ? OR merged_id = ?", detected.ID, detected.ID).
+		Order("merged_at ASC").Find(&history).Error; err != nil {
+		return nil, nil, err
+	}
+	var duplicates []models.DetectedEvent
+	if err := config.DB.Where("merged_into_id = ?", detected.ID).Order("detected_at ASC").Find(&duplicates).Error; err != nil {
+		return nil, nil, err
+	}
+	return history, duplicates, nil
+}
+
+// promoteMergedDuplicates runs before a document's detections are deleted. A canonical
+// detection from that document hands over to its oldest duplicate from another document,
+// which takes its fields, review state and calendar event, so the event is not lost.
+func promoteMergedDuplicates(tx *gorm.DB, docID uuid.UUID) error {
+	var canonicals []models.DetectedEvent
+	err := tx.Where("document_id = ? AND id IN (?)", docID,
+		tx.Model(&models.DetectedEvent{}).Select("merged_into_id").Where("document_id <> ? AND merged_into_id IS NOT NULL", docID)).
+		Find(&canonicals).Error
+	if err != nil {
+		return err
+	}
+
+	for _, c := range canonicals {
+		var heir models.DetectedEvent
+		if err := tx.Where("merged_into_id = ? AND document_id <> ?", c.ID, docID).Order("detected_at ASC").First(&heir).Error; err != nil {
+			return err
+		}
+
+		err := tx.Model(&heir).Updates(map[string]interface{}{
+			"title":          c.Title,
+			"start_time":     c.StartTime,
+			"end_time":       c.EndTime,
+			"location":       c.Location,
+			"all_day":        c.AllDay,
+			"rrule":          c.RRule,
+			"ex_dates":       c.ExDates,
+			"time_zone":      c.TimeZone,
+			"confidence":     c.Confidence,
+			"status":         c.Status,
+			"event_id":       c.EventID,
+			"reviewed_at":    c.ReviewedAt,
+			"merged_into_id": nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&models.DetectedEvent{}).Where("merged_into_id = ?", c.ID).
+			Update("merged_into_id", heir.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.EventMerge{}).Where("canonical_id = ? AND merged_id <> ?", c.ID, heir.ID).
+			Update("canonical_id", heir.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Event{}).Where("source_id = ?", c.ID).Update("source_id", heir.ID).Error; err != nil {
+			return err
+		}
+	}
+
+	// History involving the document's own detections goes with them
+	docDetections := tx.Model(&models.DetectedEvent{}).Select("id").Where("document_id = ?", docID)
+	return tx.Where("canonical_id IN (?) OR merged_id IN (?)", docDetections, docDetections).Delete(&models.EventMerge{}).Error
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"dory-backend/internal/models"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTitleSimilarity(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     string
+		min, max float64
+	}{
+		{"identical", "Midterm Exam", "Midterm Exam", 1, 1},
+		{"case and punctuation", "Midterm exam!", "MIDTERM: Exam", 1, 1},
+		{"stopwords ignored", "Reminder: the Midterm Exam", "Midterm Exam", 1, 1},
+		{"forwarded subject", "Fwd: Re: Project deadline", "Project Deadline", 1, 1},
+		{"typo", "Midterm Exam", "Midterm Exma", dedupMinTitleScore, 0.99},
+		{"plural", "Lab report", "Lab reports", dedupMinTitleScore, 0.99},
+		{"extra word", "Chemistry midterm exam", "Chemistry midterm", dedupMinTitleScore, 0.99},
+		{"different numbers", "Exam 1", "Exam 2", 0, 0},
+		{"number only on one side", "Homework 3", "Homework", 0, 0},
+		{"same numbers", "Week 3 quiz", "Quiz week 3", 1, 1},
+		{"unrelated", "Team lunch", "Physics lab", 0, 0.3},
+		{"only stopwords", "The reminder", "The reminder", 0, 0},
+		{"empty", "", "Midterm", 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := titleSimilarity(tt.a, tt.b)
+			if got < tt.min || got > tt.max {
+				t.Errorf("titleSimilarity(%q, %q) = %.3f, want between %.2f and %.2f", tt.a, tt.b, got, tt.min, tt.max)
+			}
+			if back := titleSimilarity(tt.b, tt.a); math.Abs(back-got) > 1e-9 {
+				t.Errorf("titleSimilarity is not symmetric: %.3f one way, %.3f the other", got, back)
+			}
+		})
+	}
+}
+
+func TestDuplicateScore(t *testing.T) {
+	at := func(s string) *time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &v
+	}
+	event := func(title string, start *time.Time) models.DetectedEvent {
+		return models.DetectedEvent{Title: title, StartTime: start}
+	}
+	allDay := func(title string, start *time.Time) models.DetectedEvent {
+		return models.DetectedEvent{Title: title, StartTime: start, AllDay: true}
+	}
+	weekly := func(d models.DetectedEvent) models.DetectedEvent {
+		d.RRule = "FREQ=WEEKLY;BYDAY=TU"
+		return d
+	}
+
+	exam := event("Midterm Exam", at("2025-03-14T09:00:00Z"))
+
+	tests := []struct {
+		name string
+		a, b models.DetectedEvent
+		want float64
+	}{
+		{"same title and time", exam, event("Midterm exam", at("2025-03-14T09:00:00Z")), 1},
+		{"within 15 minutes", exam, event("Midterm Exam", at("2025-03-14T09:10:00Z")), 1},
+		{"within two hours", exam, event("Midterm Exam", at("2025-03-14T10:30:00Z")), 0.6 + 0.4*0.8},
+		{"within twelve hours", exam, event("Midterm Exam", at("2025-03-14T18:00:00Z")), 0.6 + 0.4*0.4},
+		{"a day apart", exam, event("Midterm Exam", at("2025-03-15T09:00:00Z")), 0},
+		{"all-day on the same date", exam, allDay("Midterm Exam", at("2025-03-14T00:00:00Z")), 0.6 + 0.4*0.9},
+		{"all-day on another date", exam, allDay("Midterm Exam", at("2025-03-13T00:00:00Z")), 0},
+		{"one without a time", exam, event("Midterm Exam", nil), 0.6 + 0.4*0.5},
+		{"different exam number", event("Exam 1", at("2025-03-14T09:00:00Z")), event("Exam 2", at("2025-03-14T09:00:00Z")), 0},
+		{"unrelated title at the same time", exam, event("Team lunch", at("2025-03-14T09:00:00Z")), 0},
+		{"recurring and one-off", weekly(exam), exam, 0},
+		{"same recurrence", weekly(exam), weekly(event("Midterm Exam", at("2025-03-14T09:00:00Z"))), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := duplicateScore(tt.a, tt.b)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("duplicateScore = %.3f, want %.3f", got, tt.want)
+			}
+			if back := duplicateScore(tt.b, tt.a); math.Abs(back-got) > 1e-9 {
+				t.Errorf("duplicateScore is not symmetric: %.3f one way, %.3f the other", got, back)
+			}
+		})
+	}
+
+	// A reworded title at the same time is at least worth an embedding comparison
+	if score := duplicateScore(exam, event("Chemistry midterm exam", at("2025-03-14T09:00:00Z"))); score < dedupBorderline {
+		t.Errorf("reworded title scored %.3f, want at least the borderline %.2f", score, dedupBorderline)
+	}
+}
+
+func TestCosineSimilarity(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float32
+		want float64
+	}{
+		{"same direction", []float32{1, 2, 3}, []float32{2, 4, 6}, 1},
+		{"orthogonal", []float32{1, 0}, []float32{0, 1}, 0},
+		{"opposite", []float32{1, 1}, []float32{-1, -1}, -1},
+		{"different lengths", []float32{1, 2}, []float32{1, 2, 3}, 0},
+		{"zero vector", []float32{0, 0}, []float32{1, 1}, 0},
+		{"empty", nil, nil, 0},
+	}
+	for _, tt := range tests {
+		if got := cosineSimilarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-6 {
+			t.Errorf("%s: cosineSimilarity = %.4f, want %.4f", tt.name, got, tt.want)
+		}
+	}
+}
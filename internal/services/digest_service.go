@@ -0,0 +1,355 @@
+package services
+
+import (
+	"context"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// At most this many events and documents of each kind are listed in a digest
+	maxDigestEvents    = 50
+	maxDigestDocuments = 20
+	digestSummaryTime  = 30 * time.Second
+	digestSendTimeout  = 2 * time.Minute
+)
+
+var ErrInvalidDigestPeriod = errors.New("period must be day or week")
+
+// Digest is a user's briefing for one period: events coming up in the next period, documents
+// uploaded in the last one, and documents still processing or failed
+type Digest struct {
+	Period      string
+	TimeZone    string
+	GeneratedAt time.Time
+	// Upcoming lists occurrences starting in [GeneratedAt, Until)
+	Until    time.Time
+	Upcoming []models.EventOccurrence
+	// NewDocuments were uploaded in [Since, GeneratedAt)
+	Since             time.Time
+	NewDocuments      []DigestDocument
+	Processing        []DigestDocument
+	Failed            []DigestDocument
+	PendingDetections int64
+	// Text is the plain-text digest; Summary is the model's briefing, empty when the model
+	// was not asked or could not be reached
+	Text    string
+	Summary string
+}
+
+type DigestDocument struct {
+	ID         uuid.UUID
+	Filename   string
+	FileType   string
+	Status     string
+	UploadedAt time.Time
+}
+
+// digestPeriodLength is how far a digest looks back and ahead
+func digestPeriodLength(period string) (time.Duration, error) {
+	switch period {
+	case models.DigestDaily:
+		return 24 * time.Hour, nil
+	case models.DigestWeekly:
+		return 7 * 24 * time.Hour, nil
+	default:
+		return 0, ErrInvalidDigestPeriod
+	}
+}
+
+// BuildDigest assembles the digest for userID as of now. With summarize set the chat model
+// writes a short briefing from it; if that fails the digest still has its plain text.
+func BuildDigest(ctx context.Context, userID uuid.UUID, period string, now time.Time, summarize bool) (Digest, error) {
+	length, err := digestPeriodLength(period)
+	if err != nil {
+		return Digest{}, err
+	}
+	loc := UserLocation(userID)
+	d := Digest{
+		Period:      period,
+		TimeZone:    loc.String(),
+		GeneratedAt: now,
+		Until:       now.Add(length),
+		Since:       now.Add(-length),
+	}
+
+	events, err := EventsInRange(userID, &d.GeneratedAt, &d.Until)
+	if err != nil {
+		return Digest{}, err
+	}
+	for _, occ := range ExpandEvents(events, now, d.Until, maxDigestEvents) {
+		// Occurrences already under way are not coming up
+		if !occ.StartTime.Before(now) {
+			d.Upcoming = append(d.Upcoming, occ)
+		}
+	}
+
+	docs := config.DB.Model(&models.Document{}).Where("user_id = ?", userID).
+		Select("id", "filename", "file_type", "status", "uploaded_at")
+	if err := docs.Session(&gorm.Session{}).Where("uploaded_at >= ?", d.Since).
+		Order("uploaded_at DESC").Limit(maxDigestDocuments).Find(&d.NewDocuments).Error; err != nil {
+		return Digest{}, err
+	}
+	if err := docs.Session(&gorm.Session{}).Where("status = ?", "processing").
+		Order("uploaded_at DESC").Limit(maxDigestDocuments).Find(&d.Processing).Error; err != nil {
+		return Digest{}, err
+	}
+	if err := docs.Session(&gorm.Session{}).Where("status = ?", "failed").
+		Order("uploaded_at DESC").Limit(maxDigestDocuments).Find(&d.Failed).Error; err != nil {
+		return Digest{}, err
+	}
+	if err := config.DB.Model(&models.DetectedEvent{}).
+		Where("user_id = ? AND status = ?", userID, models.DetectedEventPending).
+		Count(&d.PendingDetections).Error; err != nil {
+		return Digest{}, err
+	}
+
+	d.Text = renderDigest(d, loc)
+	if summarize && ActiveChatModel != nil {
+		summary, err := summarizeDigest(ctx, d, loc)
+		if err != nil {
+			log.Printf("Digest summary for user %s failed, sending plain text: %v", userID, err)
+		} else {
+			d.Summary = summary
+		}
+	}
+	return d, nil
+}
+
+// digestTitle names the digest after the local day it was generated on
+func digestTitle(d Digest, loc *time.Location) string {
+	kind := "Daily"
+	if d.Period == models.DigestWeekly {
+		kind = "Weekly"
+	}
+	return fmt.Sprintf("%s digest for %s", kind, d.GeneratedAt.In(loc).Format("Monday 2 January 2006"))
+}
+
+// formatOccurrence renders an occurrence on one line in the user's zone
+func formatOccurrence(occ models.EventOccurrence, loc *time.Location) string {
+	var line string
+	if occ.AllDay {
+		line = occ.StartTime.UTC().Format("Mon 2 Jan") + " (all day)"
+	} else {
+		line = occ.StartTime.In(loc).Format("Mon 2 Jan 15:04")
+	}
+	line += "  " + occ.Title
+	if occ.Location != nil && *occ.Location != "" {
+		line += " (" + *occ.Location + ")"
+	}
+	return line
+}
+
+// renderDigest is the plain-text digest, also sent when no summary could be written
+func renderDigest(d Digest, loc *time.Location) string {
+	var b strings.Builder
+	b.WriteString(digestTitle(d, loc) + "\n")
+
+	if len(d.Upcoming) == 0 {
+		b.WriteString("\nNothing scheduled.\n")
+	} else {
+		fmt.Fprintf(&b, "\nComing up (%d):\n", len(d.Upcoming))
+		for _, occ := range d.Upcoming {
+			b.WriteString("- " + formatOccurrence(occ, loc) + "\n")
+		}
+	}
+
+	sections := []struct {
+		heading string
+		docs    []DigestDocument
+	}{
+		{"New documents", d.NewDocuments},
+		{"Still processing", d.Processing},
+		{"Failed to process", d.Failed},
+	}
+	for _, s := range sections {
+		if len(s.docs) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s (%d):\n", s.heading, len(s.docs))
+		for _, doc := range s.docs {
+			b.WriteString("- " + doc.Filename + "\n")
+		}
+	}
+
+	switch d.PendingDetections {
+	case 0:
+	case 1:
+		b.WriteString("\n1 detected event is waiting for review.\n")
+	default:
+		fmt.Fprintf(&b, "\n%d detected events are waiting for review.\n", d.PendingDetections)
+	}
+	return b.String()
+}
+
+// summarizeDigest asks the chat model for a short briefing written only from the digest
+func summarizeDigest(ctx context.Context, d Digest, loc *time.Location) (string, error) {
+	type item struct {
+		When     string `json:"when"`
+		Title    string `json:"title"`
+		Location string `json:"location,omitempty"`
+	}
+	var upcoming []item
+	for _, occ := range d.Upcoming {
+		it := item{Title: occ.Title}
+		if occ.AllDay {
+			it.When = occ.StartTime.UTC().Format("Monday 2 January") + ", all day"
+		} else {
+			it.When = occ.StartTime.In(loc).Format("Monday 2 January 15:04")
+		}
+		if occ.Location != nil {
+			it.Location = *occ.Location
+		}
+		upcoming = append(upcoming, it)
+	}
+	names := func(docs []DigestDocument) []string {
+		out := []string{}
+		for _, doc := range docs {
+			out = append(out, doc.Filename)
+		}
+		return out
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"today":              d.GeneratedAt.In(loc).Format("Monday 2 January 2006, 15:04"),
+		"upcoming_events":    upcoming,
+		"new_documents":      names(d.NewDocuments),
+		"processing":         names(d.Processing),
+		"failed":             names(d.Failed),
+		"pending_detections": d.PendingDetections,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	window := "day"
+	if d.Period == models.DigestWeekly {
+		window = "week"
+	}
+	prompt := fmt.Sprintf(`Write a short briefing for the %s ahead from the JSON below, in at most 120 words of plain text without Markdown.
+Lead with the most pressing deadlines, then mention new, still processing and failed documents and detected events awaiting review.
+Only use facts from the JSON; do not invent events or dates. If there is nothing to report, say so in one sentence.
+
+%s`, window, data)
+
+	ctx, cancel := context.WithTimeout(ctx, digestSummaryTime)
+	defer cancel()
+	text, err := generateText(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", errors.New("empty summary")
+	}
+	return text, nil
+}
+
+// NextDigestAt is the first scheduled digest time after after, at hour on the user's local
+// calendar and, for weekly digests, on weekday
+func NextDigestAt(period string, hour int, weekday int, loc *time.Location, after time.Time) time.Time {
+	local := after.In(loc)
+	next := time.Date(local.Year(), local.Month(), local.Day(), hour, 0, 0, 0, loc)
+	if period == models.DigestWeekly {
+		days := (weekday - int(next.Weekday()) + 7) % 7
+		next = time.Date(local.Year(), local.Month(), local.Day()+days, hour, 0, 0, 0, loc)
+	}
+	step := 1
+	if period == models.DigestWeekly {
+		step = 7
+	}
+	for !next.After(after) {
+		next = time.Date(next.Year(), next.Month(), next.Day()+step, hour, 0, 0, 0, loc)
+	}
+	return next
+}
+
+// DeliverDueDigests sends each digest whose time has come. Digests are not retried: the
+// schedule moves on when a digest is claimed, and a failed channel is only logged.
+func DeliverDueDigests(now time.Time) {
+	for {
+		settings, err := claimNextDigest(now)
+		if err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Printf("Failed to claim digest: %v", err)
+			}
+			return
+		}
+		sendDigest(settings, now)
+	}
+}
+
+// claimNextDigest locks one due digest schedule and moves it to its next run
+func claimNextDigest(now time.Time) (models.ReminderSettings, error) {
+	var settings models.ReminderSettings
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("COALESCE(digest_period, '') <> '' AND digest_next_at <= ?", now).
+			Order("digest_next_at").First(&settings).Error
+		if err != nil {
+			return err
+		}
+		next := NextDigestAt(settings.DigestPeriod, settings.DigestHour, settings.DigestWeekday, UserLocation(settings.UserID), now)
+		settings.DigestNextAt = &next
+		return tx.Model(&settings).Update("digest_next_at", next).Error
+	})
+	return settings, err
+}
+
+func sendDigest(settings models.ReminderSettings, now time.Time) {
+	if settings.MutedUntil != nil && now.Before(*settings.MutedUntil) {
+		return
+	}
+	var user models.User
+	if err := config.DB.First(&user, "id = ?", settings.UserID).Error; err != nil {
+		log.Printf("Digest for user %s skipped: %v", settings.UserID, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), digestSendTimeout)
+	defer cancel()
+	digest, err := BuildDigest(ctx, user.ID, settings.DigestPeriod, now, true)
+	if err != nil {
+		log.Printf("Failed to build digest for user %s: %v", user.ID, err)
+		return
+	}
+
+	loc := UserLocation(user.ID)
+	body := digest.Text
+	if digest.Summary != "" {
+		body = digest.Summary + "\n\n" + digest.Text
+	}
+	n := Notification{
+		UserID:        user.ID,
+		Email:         user.Email,
+		Name:          user.Name,
+		WebhookURL:    settings.WebhookURL,
+		WebhookSecret: settings.WebhookSecret,
+		Subject:       digestTitle(digest, loc),
+		Body:          body,
+		Digest:        &digest,
+		Location:      loc,
+	}
+	for _, channel := range settings.Channels {
+		notifier, ok := Notifiers[channel]
+		if !ok {
+			log.Printf("Digest for user %s: channel %q is not configured", user.ID, channel)
+			continue
+		}
+		sendCtx, cancel := context.WithTimeout(ctx, reminderSendTimeout)
+		err := notifier.Notify(sendCtx, n)
+		cancel()
+		if err != nil {
+			log.Printf("Digest for user %s via %s failed: %v", user.ID, channel, err)
+		}
+	}
+}
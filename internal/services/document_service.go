@@ -1,166 +1,14 @@
 package services
 
 import (
-	"bytes"
 	"dory-backend/internal/config"
 	"dory-backend/internal/models"
-	"fmt"
-	"io"
 	"log"
-	"mime/multipart"
-	"net/http"
-	"strings"
-	"time"
 
 	"github.com/google/uuid"
-	"github.com/ledongthuc/pdf"
+	"gorm.io/gorm"
 )
 
-func ProcessPDF(docID uuid.UUID) {
-	go func() {
-		var doc models.Document
-		if err := config.DB.First(&doc, "id = ?", docID).Error; err != nil {
-			log.Printf("Error finding document: %v", err)
-			return
-		}
-
-		text, err := extractTextFromURL(doc.FileURL)
-		if err != nil {
-			log.Printf("Extraction failed for %s: %v", doc.Filename, err)
-			// Update document status to failed with error details
-			config.DB.Model(&doc).Update("status", "failed")
-			// Optionally store error message in content field for debugging
-			config.DB.Model(&doc).Update("content", fmt.Sprintf("Error: %v", err))
-			return
-		}
-
-		chunks := ChunkText(text, 300)
-		err = StoreChunksInQdrant(doc.UserID.String(), doc.ID.String(), chunks)
-		if err != nil {
-			log.Printf("Qdrant storage failed: %v", err)
-			config.DB.Model(&doc).Update("status", "failed")
-			return
-		}
-
-		events, err := DetectEvents(text)
-		if err == nil {
-			for _, e := range events {
-				detected := models.DetectedEvent{
-					ID:         uuid.New(),
-					UserID:     doc.UserID,
-					DocumentID: doc.ID,
-					Title:      e.Title,
-					StartTime:  e.StartTime,
-					EndTime:    e.EndTime,
-					Location:   e.Location,
-					Confidence: e.Confidence,
-					SourceText: e.SourceText,
-					DetectedAt: time.Now(),
-				}
-				config.DB.Create(&detected)
-			}
-		}
-
-		config.DB.Model(&doc).Updates(models.Document{
-			Content: text,
-			Status:  "ready",
-		})
-
-		log.Printf("Document %s fully processed and embedded", doc.Filename)
-
-		if doc.PublicID != "" {
-			DeleteFromCloudinary(doc.PublicID)
-			config.DB.Model(&doc).Update("file_url", "")
-		}
-	}()
-}
-
-// Extract text directly from a file stream
-func ExtractTextFromFile(file multipart.File) (string, error) {
-	// Read entire file into memory
-	bodyBytes, err := io.ReadAll(file)
-	if err != nil {
-		return "", fmt.Errorf("failed to read file: %v", err)
-	}
-
-	// Validate PDF header
-	if len(bodyBytes) < 4 || string(bodyBytes[0:4]) != "%PDF" {
-		return "", fmt.Errorf("invalid PDF file: file does not start with PDF header")
-	}
-
-	bodyReader := bytes.NewReader(bodyBytes)
-	pdfReader, err := pdf.NewReader(bodyReader, int64(len(bodyBytes)))
-	if err != nil {
-		return "", fmt.Errorf("failed to create PDF reader: %v", err)
-	}
-
-	textReader, err := pdfReader.GetPlainText()
-	if err != nil {
-		return "", fmt.Errorf("failed to extract text from PDF: %v", err)
-	}
-
-	var buf bytes.Buffer
-	_, err = buf.ReadFrom(textReader)
-	if err != nil {
-		return "", fmt.Errorf("failed to read extracted text: %v", err)
-	}
-
-	text := buf.String()
-	if len(text) == 0 {
-		return "", fmt.Errorf("PDF appears to be empty or text extraction returned no content")
-	}
-
-	return text, nil
-}
-
-// Extract text from URL (fallback method)
-func extractTextFromURL(url string) (string, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// Check HTTP status code
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to download PDF: HTTP %d", resp.StatusCode)
-	}
-
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %v", err)
-	}
-
-	// Validate PDF header
-	if len(bodyBytes) < 4 || string(bodyBytes[0:4]) != "%PDF" {
-		return "", fmt.Errorf("invalid PDF file: file does not start with PDF header")
-	}
-
-	bodyReader := bytes.NewReader(bodyBytes)
-	pdfReader, err := pdf.NewReader(bodyReader, int64(len(bodyBytes)))
-	if err != nil {
-		return "", fmt.Errorf("failed to create PDF reader: %v", err)
-	}
-
-	textReader, err := pdfReader.GetPlainText()
-	if err != nil {
-		return "", fmt.Errorf("failed to extract text from PDF: %v", err)
-	}
-
-	var buf bytes.Buffer
-	_, err = buf.ReadFrom(textReader)
-	if err != nil {
-		return "", fmt.Errorf("failed to read extracted text: %v", err)
-	}
-
-	text := buf.String()
-	if len(text) == 0 {
-		return "", fmt.Errorf("PDF appears to be empty or text extraction returned no content")
-	}
-
-	return text, nil
-}
-
 func IngestManualText(uIDStr string, content string) error {
 	uID, err := uuid.Parse(uIDStr)
 	if err != nil {
@@ -172,60 +20,82 @@ func IngestManualText(uIDStr string, content string) error {
 		Filename: "Extracted Info " + uuid.New().String()[:8],
 		Content:  content,
 		FileType: "text",
-		Status:   "ready",
+		Status:   "processing",
 	}
+	ApplyChunkDefaults(&newDoc)
 
 	if err := config.DB.Create(&newDoc).Error; err != nil {
 		return err
 	}
 
-	// Process Qdrant and Event Detection
-	go func(userID uuid.UUID, docID uuid.UUID, text string) {
-		chunks := ChunkText(text, 300)
-		err := StoreChunksInQdrant(userID.String(), docID.String(), chunks)
-		if err != nil {
-			log.Printf("Text embedding failed for doc %s: %v", docID, err)
-			config.DB.Model(&models.Document{}).Where("id = ?", docID).Update("status", "failed")
-			return
+	// Embedding and event detection run as separate jobs so each can be retried on its own
+	if err := EnqueueJob(uID, newDoc.ID, models.JobTypeEmbedDocument); err != nil {
+		config.DB.Model(&newDoc).Update("status", "failed")
+		return err
+	}
+	if err := EnqueueJob(uID, newDoc.ID, models.JobTypeDetectEvents); err != nil {
+		log.Printf("Event detection could not be queued for doc %s: %v", newDoc.ID, err)
+	}
+
+	return nil
+}
+
+// DeleteDocument removes a document together with its vectors, detected events and queued jobs.
+// Qdrant is cleaned up first so a failure there leaves the row in place for a retry.
+func DeleteDocument(doc models.Document) error {
+	if err := DeleteDocumentChunks(doc.UserID.String(), doc.ID.String()); err != nil {
+		return err
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := promoteMergedDuplicates(tx, doc.ID); err != nil {
+			return err
+		}
+		// Accepted and imported events stay on the calendar but lose their link to the document
+		if err := tx.Model(&models.Event{}).
+			Where("source_id IN (?)", tx.Model(&models.DetectedEvent{}).Select("id").Where("document_id = ?", doc.ID)).
+			Update("source_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Event{}).Where("document_id = ?", doc.ID).Update("document_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("document_id = ? AND user_id = ?", doc.ID, doc.UserID).Delete(&models.DetectedEvent{}).Error; err != nil {
+			return err
 		}
+		if err := tx.Where("document_id = ?", doc.ID).Delete(&models.IngestionJob{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&doc).Error
+	})
+	if err != nil {
+		return err
+	}
 
-		events, err := DetectEvents(text)
-		if err == nil {
-			for _, e := range events {
-				detected := models.DetectedEvent{
-					ID:         uuid.New(),
-					UserID:     userID,
-					DocumentID: docID,
-					Title:      e.Title,
-					StartTime:  e.StartTime,
-					EndTime:    e.EndTime,
-					Location:   e.Location,
-					Confidence: e.Confidence,
-					SourceText: e.SourceText,
-					DetectedAt: time.Now(),
-				}
-				config.DB.Create(&detected)
-			}
+	if doc.PublicID != "" && doc.FileURL != "" {
+		if err := DeleteFromCloudinary(doc.PublicID); err != nil {
+			log.Printf("Cloudinary cleanup failed for doc %s: %v", doc.ID, err)
 		}
-	}(uID, newDoc.ID, content)
+	}
 
 	return nil
 }
 
-func ChunkText(text string, chunkSize int) []string {
-	words := strings.Fields(text)
-	if len(words) == 0 {
-		return []string{}
+// RechunkDocument records new chunk settings and queues the document to be embedded again
+func RechunkDocument(doc *models.Document, strategy string, size int, overlap int) error {
+	if _, err := NewChunker(strategy, size, overlap); err != nil {
+		return err
 	}
 
-	var chunks []string
-	for i := 0; i < len(words); i += chunkSize {
-		end := i + chunkSize
-		if end > len(words) {
-			end = len(words)
-		}
-		chunks = append(chunks, strings.Join(words[i:end], " "))
+	err := config.DB.Model(doc).Updates(map[string]interface{}{
+		"chunk_strategy": strategy,
+		"chunk_size":     size,
+		"chunk_overlap":  overlap,
+		"status":         "processing",
+	}).Error
+	if err != nil {
+		return err
 	}
 
-	return chunks
+	return EnqueueJob(doc.UserID, doc.ID, models.JobTypeEmbedDocument)
 }
@@ -0,0 +1,67 @@
+package services
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+const defaultHashDimension = 384
+
+// HashEmbedder is a deterministic, offline embedder for development and tests.
+// It hashes words and character trigrams into a signed bag-of-features vector, so texts
+// sharing vocabulary land close together without any model or network access.
+type HashEmbedder struct {
+	dimension int
+}
+
+func NewHashEmbedder(dimension int) *HashEmbedder {
+	return &HashEmbedder{dimension: dimension}
+}
+
+func (h *HashEmbedder) Dimension() int { return h.dimension }
+
+func (h *HashEmbedder) MaxInputTokens() int { return 0 }
+
+func (h *HashEmbedder) Embed(_ context.Context, text string) ([]float32, error) {
+	vector := make([]float32, h.dimension)
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		h.add(vector, "w:"+word, 1)
+
+		padded := []rune("#" + word + "#")
+		for i := 0; i+3 <= len(padded); i++ {
+			h.add(vector, "t:"+string(padded[i:i+3]), 0.5)
+		}
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	if norm > 0 {
+		scale := float32(1 / math.Sqrt(norm))
+		for i := range vector {
+			vector[i] *= scale
+		}
+	}
+
+	return vector, nil
+}
+
+// add uses one hash for the bucket and a second bit for the sign to reduce collision bias
+func (h *HashEmbedder) add(vector []float32, feature string, weight float32) {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(feature))
+	sum := hasher.Sum64()
+
+	if sum>>63 == 1 {
+		weight = -weight
+	}
+	vector[sum%uint64(h.dimension)] += weight
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func embedOrFail(t *testing.T, e Embedder, text string) []float32 {
+	t.Helper()
+	vector, err := e.Embed(context.Background(), text)
+	if err != nil {
+		t.Fatalf("Embed(%q): %v", text, err)
+	}
+	return vector
+}
+
+func cosine(a, b []float32) float64 {
+	var dot float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+	}
+	return dot // vectors are unit length
+}
+
+func TestHashEmbedderIsDeterministic(t *testing.T) {
+	text := "The chemistry lab report is due on Friday."
+	a := embedOrFail(t, NewHashEmbedder(defaultHashDimension), text)
+	b := embedOrFail(t, NewHashEmbedder(defaultHashDimension), text)
+
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("component %d differs between runs: %v != %v", i, a[i], b[i])
+		}
+	}
+}
+
+func TestHashEmbedderDimensionAndNorm(t *testing.T) {
+	for _, dimension := range []int{8, defaultHashDimension, 1024} {
+		e := NewHashEmbedder(dimension)
+		if e.Dimension() != dimension {
+			t.Errorf("Dimension() = %d, want %d", e.Dimension(), dimension)
+		}
+
+		vector := embedOrFail(t, e, "Exam 1 covers chapters three to five")
+		if len(vector) != dimension {
+			t.Fatalf("len(vector) = %d, want %d", len(vector), dimension)
+		}
+		var norm float64
+		for _, v := range vector {
+			norm += float64(v) * float64(v)
+		}
+		if math.Abs(norm-1) > 1e-5 {
+			t.Errorf("dimension %d: squared norm = %f, want 1", dimension, norm)
+		}
+	}
+}
+
+func TestHashEmbedderEmptyText(t *testing.T) {
+	vector := embedOrFail(t, NewHashEmbedder(16), "  ...  ")
+	for i, v := range vector {
+		if v != 0 {
+			t.Fatalf("component %d = %v, want a zero vector for text without words", i, v)
+		}
+	}
+}
+
+func TestHashEmbedderSharedVocabularyIsCloser(t *testing.T) {
+	e := NewHashEmbedder(defaultHashDimension)
+	query := embedOrFail(t, e, "When is the chemistry exam?")
+	related := embedOrFail(t, e, "The chemistry exam takes place on 14 March.")
+	unrelated := embedOrFail(t, e, "Bring your own laptop to the football practice.")
+
+	if cosine(query, related) <= cosine(query, unrelated) {
+		t.Errorf("similarity to related text %.3f is not above unrelated text %.3f",
+			cosine(query, related), cosine(query, unrelated))
+	}
+	// Case and punctuation are ignored
+	if got := cosine(embedOrFail(t, e, "Chemistry EXAM!"), embedOrFail(t, e, "chemistry exam")); math.Abs(got-1) > 1e-5 {
+		t.Errorf("similarity of texts differing only in case and punctuation = %f, want 1", got)
+	}
+}
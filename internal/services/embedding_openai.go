@@ -0,0 +1,74 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// OpenAIEmbedder talks to any server exposing the OpenAI /v1/embeddings API,
+// including local runtimes such as Ollama and llama.cpp
+type OpenAIEmbedder struct {
+	// BaseURL includes the version prefix, e.g. https://api.openai.com/v1 or http://localhost:11434/v1
+	BaseURL   string
+	APIKey    string
+	Model     string
+	dimension int
+	maxTokens int
+	client    *http.Client
+}
+
+func (o *OpenAIEmbedder) Dimension() int { return o.dimension }
+
+func (o *OpenAIEmbedder) MaxInputTokens() int { return o.maxTokens }
+
+func (o *OpenAIEmbedder) setDimension(d int) { o.dimension = d }
+
+func (o *OpenAIEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	if o.BaseURL == "" || o.Model == "" {
+		return nil, errors.New("openai embedder requires EMBEDDING_BASE_URL and EMBEDDING_MODEL")
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"model": o.Model,
+		"input": text,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, "POST", o.BaseURL+"/embeddings", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.APIKey)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("embeddings API error: status %d: %s", resp.StatusCode, body)
+	}
+
+	var result struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 || len(result.Data[0].Embedding) == 0 {
+		return nil, errors.New("embeddings API returned no vectors")
+	}
+
+	return result.Data[0].Embedding, nil
+}
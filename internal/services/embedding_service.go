@@ -2,15 +2,150 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"dory-backend/internal/config"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
 )
 
+// Embedder turns text into a fixed-size vector for storage and search in Qdrant
+type Embedder interface {
+	Embed(ctx context.Context, text string) ([]float32, error)
+	// Dimension is the length of every vector returned by Embed
+	Dimension() int
+	// MaxInputTokens is the longest input the model embeds without truncating; 0 means no limit
+	MaxInputTokens() int
+}
+
+// ActiveEmbedder is the provider selected by EMBEDDING_PROVIDER in InitEmbedder
+var ActiveEmbedder Embedder
+
+const defaultHFEmbeddingModel = "intfloat/multilingual-e5-large"
+
+// knownEmbeddingDimensions avoids a probe request for models we already know
+var knownEmbeddingDimensions = map[string]int{
+	"intfloat/multilingual-e5-large": 1024,
+	"text-embedding-3-small":         1536,
+	"text-embedding-3-large":         3072,
+	"nomic-embed-text":               768,
+}
+
+// knownEmbeddingInputLimits lists the maximum input length, in tokens, of common models
+var knownEmbeddingInputLimits = map[string]int{
+	"intfloat/multilingual-e5-large": 512,
+	"text-embedding-3-small":         8191,
+	"text-embedding-3-large":         8191,
+	"nomic-embed-text":               2048,
+}
+
+// InitEmbedder selects the embedding provider from config. It must run before InitQdrant,
+// which sizes the collection from the provider's dimension.
+func InitEmbedder() {
+	cfg := config.AppConfig
+	provider := strings.ToLower(cfg.EmbeddingProvider)
+
+	switch provider {
+	case "", "huggingface", "hf":
+		model := cfg.EmbeddingModel
+		if model == "" {
+			model = defaultHFEmbeddingModel
+		}
+		ActiveEmbedder = &HuggingFaceEmbedder{
+			Model:     model,
+			Token:     cfg.HuggingFaceToken,
+			dimension: embeddingDimension(model),
+			maxTokens: embeddingInputLimit(model),
+			client:    &http.Client{},
+		}
+	case "openai":
+		ActiveEmbedder = &OpenAIEmbedder{
+			BaseURL:   strings.TrimSuffix(cfg.EmbeddingBaseURL, "/"),
+			APIKey:    cfg.EmbeddingAPIKey,
+			Model:     cfg.EmbeddingModel,
+			dimension: embeddingDimension(cfg.EmbeddingModel),
+			maxTokens: embeddingInputLimit(cfg.EmbeddingModel),
+			client:    &http.Client{},
+		}
+	case "hash":
+		dimension := cfg.EmbeddingDimension
+		if dimension <= 0 {
+			dimension = defaultHashDimension
+		}
+		ActiveEmbedder = NewHashEmbedder(dimension)
+	default:
+		log.Fatalf("Unknown EMBEDDING_PROVIDER %q (expected huggingface, openai or hash)", cfg.EmbeddingProvider)
+	}
+
+	// Remote models of unknown size report their dimension on the first embedding
+	if ActiveEmbedder.Dimension() <= 0 {
+		if err := probeEmbeddingDimension(ActiveEmbedder); err != nil {
+			log.Fatalf("Failed to determine embedding dimension: %v", err)
+		}
+	}
+
+	log.Printf("Embedding provider %q initialized with dimension %d", provider, ActiveEmbedder.Dimension())
+}
+
+// embeddingDimension prefers an explicit EMBEDDING_DIMENSION, then the known model table; 0 means unknown
+func embeddingDimension(model string) int {
+	if config.AppConfig.EmbeddingDimension > 0 {
+		return config.AppConfig.EmbeddingDimension
+	}
+	return knownEmbeddingDimensions[model]
+}
+
+// embeddingInputLimit prefers an explicit EMBEDDING_MAX_TOKENS, then the known model table; 0 means unknown
+func embeddingInputLimit(model string) int {
+	if config.AppConfig.EmbeddingMaxTokens > 0 {
+		return config.AppConfig.EmbeddingMaxTokens
+	}
+	return knownEmbeddingInputLimits[model]
+}
+
+type dimensionSetter interface {
+	setDimension(int)
+}
+
+func probeEmbeddingDimension(e Embedder) error {
+	vector, err := e.Embed(context.Background(), "dimension probe")
+	if err != nil {
+		return err
+	}
+	if len(vector) == 0 {
+		return errors.New("provider returned an empty vector")
+	}
+	if s, ok := e.(dimensionSetter); ok {
+		s.setDimension(len(vector))
+	}
+	return nil
+}
+
+// EmbedText embeds text with the active provider
 func EmbedText(text string) ([]float32, error) {
-	apiURL := "https://router.huggingface.co/hf-inference/models/intfloat/multilingual-e5-large/pipeline/feature-extraction"
+	return ActiveEmbedder.Embed(context.Background(), text)
+}
+
+// HuggingFaceEmbedder calls the Hugging Face inference router's feature-extraction pipeline
+type HuggingFaceEmbedder struct {
+	Model     string
+	Token     string
+	dimension int
+	maxTokens int
+	client    *http.Client
+}
+
+func (h *HuggingFaceEmbedder) Dimension() int { return h.dimension }
+
+func (h *HuggingFaceEmbedder) MaxInputTokens() int { return h.maxTokens }
+
+func (h *HuggingFaceEmbedder) setDimension(d int) { h.dimension = d }
+
+func (h *HuggingFaceEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	apiURL := "https://router.huggingface.co/hf-inference/models/" + h.Model + "/pipeline/feature-extraction"
 
 	payload, _ := json.Marshal(map[string]interface{}{
 		"inputs": text,
@@ -19,12 +154,14 @@ func EmbedText(text string) ([]float32, error) {
 		},
 	})
 
-	req, _ := http.NewRequest("POST", apiURL, bytes.NewBuffer(payload))
-	req.Header.Set("Authorization", "Bearer "+config.AppConfig.HuggingFaceToken)
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.Token)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := h.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -5,77 +5,150 @@ import (
 	"dory-backend/internal/config"
 	"dory-backend/internal/models"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
-	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/option"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrEventStartRequired   = errors.New("event start time is required")
+	ErrEventEndBeforeStart  = errors.New("event end time is before its start time")
+	ErrEventAlreadyReviewed = errors.New("detected event has already been accepted or dismissed")
+	ErrInvalidRecurrence    = errors.New("invalid recurrence")
 )
 
 type inferredEventRaw struct {
-	Title      string  `json:"title"`
-	StartTime  *string `json:"start_time"`
-	EndTime    *string `json:"end_time"`
-	Location   *string `json:"location"`
-	Confidence float64 `json:"confidence"`
-	SourceText string  `json:"source_text"`
+	Title      string   `json:"title"`
+	StartTime  *string  `json:"start_time"`
+	EndTime    *string  `json:"end_time"`
+	AllDay     bool     `json:"all_day"`
+	Location   *string  `json:"location"`
+	Confidence float64  `json:"confidence"`
+	SourceText string   `json:"source_text"`
+	DateText   string   `json:"date_text"`
+	RRule      *string  `json:"rrule"`
+	ExDates    []string `json:"exdates"`
 }
 
 type InferredEvent struct {
 	Title      string
 	StartTime  *time.Time
 	EndTime    *time.Time
+	AllDay     bool
 	Location   *string
 	Confidence float64
 	SourceText string
+	DateText   string
+	RRule      string
+	ExDates    []time.Time
+	TimeZone   string
 }
 
-func DetectServices(text string) ([]models.DetectedEvent, error) {
-	ctx := context.Background()
-	client, _ := genai.NewClient(ctx, option.WithAPIKey(config.AppConfig.GeminiKey))
-	defer client.Close()
+// EventContext is what the extractor needs to turn "next Friday at 3pm" into a timestamp:
+// the day the text was written and the zone its times are in
+type EventContext struct {
+	Anchor   time.Time
+	Location *time.Location
+}
 
-	model := client.GenerativeModel("gemini-2.5-flash")
+// UserLocation loads the user's configured time zone, falling back to UTC
+func UserLocation(userID uuid.UUID) *time.Location {
+	var user models.User
+	if err := config.DB.Select("timezone").First(&user, "id = ?", userID).Error; err != nil || user.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// EventContextForDocument anchors relative dates to the document's own date when known,
+// then to when it was uploaded
+func EventContextForDocument(doc models.Document) EventContext {
+	anchor := time.Now()
+	if doc.DocumentDate != nil {
+		anchor = *doc.DocumentDate
+	} else if !doc.UploadedAt.IsZero() {
+		anchor = doc.UploadedAt
+	}
+	return EventContext{Anchor: anchor, Location: UserLocation(doc.UserID)}
+}
 
+// NewDetectedEvent records an extracted event against the document it came from
+func NewDetectedEvent(userID uuid.UUID, docID uuid.UUID, e InferredEvent) models.DetectedEvent {
+	return models.DetectedEvent{
+		ID:         uuid.New(),
+		UserID:     userID,
+		DocumentID: docID,
+		Title:      e.Title,
+		StartTime:  e.StartTime,
+		EndTime:    e.EndTime,
+		AllDay:     e.AllDay,
+		Location:   e.Location,
+		Confidence: e.Confidence,
+		SourceText: e.SourceText,
+		DateText:   e.DateText,
+		RRule:      e.RRule,
+		ExDates:    e.ExDates,
+		TimeZone:   e.TimeZone,
+		DetectedAt: time.Now(),
+	}
+}
+
+func DetectServices(text string) ([]models.DetectedEvent, error) {
 	prompt := fmt.Sprintf(`
 		Extract all deadlines, exams, and recurring classes from the text.
 		Return ONLY a JSON array. No conversational text.
-		Use this format: [{"title": "Name", "start_time": "ISO8601", "confidence": 0.9, "source_text": "text from doc"}]
+		Use this format: [{"title": "Name", "start_time": "ISO8601", "rrule": "FREQ=WEEKLY;BYDAY=MO or null", "confidence": 0.9, "source_text": "text from doc"}]
 		
 		TEXT: %s`, text)
 
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	rawResponse, err := generateText(context.Background(), prompt)
 	if err != nil {
 		return nil, err
 	}
 
-	rawResponse := fmt.Sprintf("%v", resp.Candidates[0].Content.Parts[0])
-
 	// 2. Parse that string into our Go slice
 	var events []models.DetectedEvent
-	err = json.Unmarshal([]byte(rawResponse), &events)
+	err = json.Unmarshal([]byte(cleanAIJSON(rawResponse)), &events)
 
 	return events, err
 }
 
-func DetectEvents(text string) ([]InferredEvent, error) {
-	ctx := context.Background()
-
-	client, err := genai.NewClient(ctx, option.WithAPIKey(config.AppConfig.GeminiKey))
-	if err != nil {
-		return nil, err
+func DetectEvents(text string, ectx EventContext) ([]InferredEvent, error) {
+	loc := ectx.Location
+	if loc == nil {
+		loc = time.UTC
 	}
-	defer client.Close()
-
-	model := client.GenerativeModel("gemini-2.5-flash")
+	anchor := ectx.Anchor
+	if anchor.IsZero() {
+		anchor = time.Now()
+	}
+	anchor = anchor.In(loc)
 
 	prompt := fmt.Sprintf(`
 You are an event extraction engine.
 
+Context:
+- Reference date: %s. Treat it as "today" when resolving relative dates such as "tomorrow", "next Friday" or "in two weeks".
+- Time zone: %s
+
 Rules:
-- Extract ONLY future or upcoming events
+- Extract ONLY events on or after the reference date
 - Ignore past events, hypotheticals, examples
+- Write times as local wall-clock time in the time zone above, without an offset, e.g. "2026-03-06T15:00:00"
+- Include an offset only when the text names a different time zone explicitly
+- When the text gives a date but no time, write the date alone ("2026-03-06") and set all_day to true
+- Copy the date or time expression exactly as written into date_text
+- For repeating events such as weekly classes, return ONE event: start_time and end_time are the first occurrence and rrule is an RFC 5545 RRULE, e.g. "FREQ=WEEKLY;BYDAY=MO,WE;UNTIL=20260612"
+- List dates the text says are skipped (holidays, cancelled sessions) in exdates
+- Use null for rrule and [] for exdates on one-off events
 - Return ONLY valid JSON
 - No markdown
 - No explanations
@@ -84,11 +157,15 @@ Schema:
 [
   {
     "title": "string",
-    "start_time": "ISO8601 or null",
-    "end_time": "ISO8601 or null",
+    "start_time": "ISO8601 date or date-time, or null",
+    "end_time": "ISO8601 date or date-time, or null",
+    "all_day": boolean,
     "location": "string or null",
     "confidence": number (0 to 1),
-    "source_text": "exact snippet"
+    "source_text": "exact snippet",
+    "date_text": "the date expression as written, e.g. next Friday at 3pm",
+    "rrule": "RRULE value without the RRULE: prefix, or null",
+    "exdates": ["ISO8601 date or date-time of each skipped occurrence"]
   }
 ]
 
@@ -96,19 +173,13 @@ If no events exist, return: []
 
 TEXT:
 %s
-`, text)
+`, anchor.Format("Monday, 2 January 2006"), loc.String(), text)
 
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	raw, err := generateText(context.Background(), prompt)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(resp.Candidates) == 0 ||
-		len(resp.Candidates[0].Content.Parts) == 0 {
-		return nil, fmt.Errorf("empty LLM response")
-	}
-
-	raw := fmt.Sprintf("%v", resp.Candidates[0].Content.Parts[0])
 	clean := cleanAIJSON(raw)
 
 	var rawEvents []inferredEventRaw
@@ -120,32 +191,277 @@ TEXT:
 	var results []InferredEvent
 	for _, e := range rawEvents {
 		var start, end *time.Time
+		allDay := e.AllDay
 
 		if e.StartTime != nil {
-			if t, err := time.Parse(time.RFC3339, *e.StartTime); err == nil {
+			if t, dateOnly, ok := ParseEventTime(*e.StartTime, loc); ok {
+				if !dateOnly {
+					t = t.In(loc)
+				}
 				start = &t
+				allDay = allDay || dateOnly
 			}
 		}
 
 		if e.EndTime != nil {
-			if t, err := time.Parse(time.RFC3339, *e.EndTime); err == nil {
+			if t, dateOnly, ok := ParseEventTime(*e.EndTime, loc); ok {
+				if !dateOnly {
+					t = t.In(loc)
+				}
 				end = &t
 			}
 		}
 
+		if allDay && start != nil {
+			start, end = allDayRange(*start, end)
+		}
+
+		var rrule, timeZone string
+		var exdates []time.Time
+		if e.RRule != nil && start != nil {
+			ruleLoc := loc
+			if allDay {
+				ruleLoc = time.UTC
+			}
+			// A rule the model got wrong is dropped and the first occurrence kept
+			if normalized, rule, err := NormalizeRRule(*e.RRule, ruleLoc); err == nil && rule != nil {
+				rrule = normalized
+				exdates = parseExDates(e.ExDates, *start, allDay, loc)
+				if !allDay {
+					timeZone = zoneName(loc)
+				}
+			}
+		}
+
 		results = append(results, InferredEvent{
 			Title:      e.Title,
 			StartTime:  start,
 			EndTime:    end,
+			AllDay:     allDay && start != nil,
 			Location:   e.Location,
 			Confidence: e.Confidence,
 			SourceText: e.SourceText,
+			DateText:   strings.TrimSpace(e.DateText),
+			RRule:      rrule,
+			ExDates:    exdates,
+			TimeZone:   timeZone,
 		})
 	}
 
 	return results, nil
 }
 
+// Layouts ParseEventTime accepts, most specific first. Zoned layouts keep their offset,
+// the rest are read in the user's zone.
+var (
+	zonedEventLayouts = []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04Z07:00",
+		time.RFC1123Z,
+		time.RFC1123,
+	}
+	localEventLayouts = []string{
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04",
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04",
+		"2006-01-02 3:04 PM",
+		"2006-01-02 3:04PM",
+		"January 2, 2006 15:04",
+		"January 2, 2006 3:04 PM",
+		"January 2, 2006 at 3:04 PM",
+		"Jan 2, 2006 3:04 PM",
+		"2 January 2006 15:04",
+		"2 Jan 2006 15:04",
+		"Monday, January 2, 2006 3:04 PM",
+	}
+	dateEventLayouts = []string{
+		"2006-01-02",
+		"January 2, 2006",
+		"Jan 2, 2006",
+		"2 January 2006",
+		"2 Jan 2006",
+		"Monday, January 2, 2006",
+		"Monday, 2 January 2006",
+	}
+)
+
+// ParseEventTime reads the date formats models tend to produce. Date-only values are
+// returned as UTC midnight with dateOnly set.
+func ParseEventTime(value string, loc *time.Location) (t time.Time, dateOnly bool, ok bool) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.EqualFold(value, "null") {
+		return time.Time{}, false, false
+	}
+
+	for _, layout := range zonedEventLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, false, true
+		}
+	}
+	for _, layout := range localEventLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, false, true
+		}
+	}
+	for _, layout := range dateEventLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true, true
+		}
+	}
+	return time.Time{}, false, false
+}
+
+// parseExDates reads skipped occurrences. A bare date skips the occurrence on that day, at
+// the series' own time of day.
+func parseExDates(values []string, start time.Time, allDay bool, loc *time.Location) []time.Time {
+	var out []time.Time
+	for _, v := range values {
+		t, dateOnly, ok := ParseEventTime(v, loc)
+		if !ok {
+			continue
+		}
+		switch {
+		case allDay:
+			t = civilDate(t.Year(), t.Month(), t.Day())
+		case dateOnly:
+			local := start.In(loc)
+			t = time.Date(t.Year(), t.Month(), t.Day(), local.Hour(), local.Minute(), local.Second(), 0, loc)
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// allDayRange pins an all-day event to whole dates. The end becomes exclusive, as in
+// iCalendar, and is dropped for single-day events.
+func allDayRange(start time.Time, end *time.Time) (*time.Time, *time.Time) {
+	day := civilDate(start.Year(), start.Month(), start.Day())
+	if end == nil {
+		return &day, nil
+	}
+	last := civilDate(end.Year(), end.Month(), end.Day())
+	if !last.After(day) {
+		return &day, nil
+	}
+	exclusive := last.AddDate(0, 0, 1)
+	return &day, &exclusive
+}
+
+// ValidateEvent checks the fields every calendar event needs
+func ValidateEvent(event models.Event) error {
+	if strings.TrimSpace(event.Title) == "" {
+		return errors.New("event title is required")
+	}
+	if event.StartTime.IsZero() {
+		return ErrEventStartRequired
+	}
+	if event.EndTime != nil && event.EndTime.Before(event.StartTime) {
+		return ErrEventEndBeforeStart
+	}
+	return nil
+}
+
+// AcceptDetectedEvent turns a pending detection, including any edits already applied to it,
+// into a calendar event and marks the detection accepted
+func AcceptDetectedEvent(detected *models.DetectedEvent) (models.Event, error) {
+	if detected.StartTime == nil {
+		return models.Event{}, ErrEventStartRequired
+	}
+
+	event := models.Event{
+		ID:        uuid.New(),
+		UserID:    detected.UserID,
+		Title:     detected.Title,
+		StartTime: *detected.StartTime,
+		EndTime:   detected.EndTime,
+		Location:  detected.Location,
+		AllDay:    detected.AllDay,
+		RRule:     detected.RRule,
+		ExDates:   detected.ExDates,
+		TimeZone:  detected.TimeZone,
+		SourceID:  &detected.ID,
+	}
+	if err := ValidateEvent(event); err != nil {
+		return models.Event{}, err
+	}
+	if err := PrepareEventRecurrence(&event); err != nil {
+		return models.Event{}, err
+	}
+
+	now := time.Now()
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		// The status guard stops two concurrent accepts from creating duplicate events
+		result := tx.Model(&models.DetectedEvent{}).
+			Where("id = ? AND status = ?", detected.ID, models.DetectedEventPending).
+			Updates(map[string]interface{}{
+				"title":       detected.Title,
+				"start_time":  detected.StartTime,
+				"end_time":    detected.EndTime,
+				"location":    detected.Location,
+				"all_day":     detected.AllDay,
+				"rrule":       event.RRule,
+				"ex_dates":    event.ExDates,
+				"time_zone":   event.TimeZone,
+				"status":      models.DetectedEventAccepted,
+				"event_id":    event.ID,
+				"reviewed_at": now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrEventAlreadyReviewed
+		}
+		return tx.Create(&event).Error
+	})
+	if err != nil {
+		return models.Event{}, err
+	}
+
+	detected.RRule = event.RRule
+	detected.ExDates = event.ExDates
+	detected.Status = models.DetectedEventAccepted
+	detected.EventID = &event.ID
+	detected.ReviewedAt = &now
+	return event, nil
+}
+
+// DismissDetectedEvent marks a pending detection as not a real event
+func DismissDetectedEvent(detected *models.DetectedEvent) error {
+	now := time.Now()
+	result := config.DB.Model(&models.DetectedEvent{}).
+		Where("id = ? AND status = ?", detected.ID, models.DetectedEventPending).
+		Updates(map[string]interface{}{
+			"status":      models.DetectedEventDismissed,
+			"reviewed_at": now,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrEventAlreadyReviewed
+	}
+
+	detected.Status = models.DetectedEventDismissed
+	detected.ReviewedAt = &now
+	return nil
+}
+
+// DeleteEvents removes calendar events together with their reminders, so no reminder is
+// left pointing at an event that no longer exists
+func DeleteEvents(db *gorm.DB, ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("event_id IN ?", ids).Delete(&models.Reminder{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&models.Event{}).Error
+	})
+}
+
 func cleanAIJSON(input string) string {
 	input = strings.TrimSpace(input)
 	input = strings.TrimPrefix(input, "```json")
@@ -0,0 +1,220 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"dory-backend/internal/models"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DOCXExtractor reads the main document part of a Word file. Heading styles become
+// Markdown headings so the recursive chunker keeps the outline; table cells are tab
+// separated, one row per line.
+type DOCXExtractor struct{}
+
+func (DOCXExtractor) Extract(data []byte) (string, []models.PageStat, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid DOCX file: %v", err)
+	}
+
+	part, err := openZipFile(archive, "word/document.xml")
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid DOCX file: %v", err)
+	}
+	defer part.Close()
+
+	text, err := docxText(part)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read DOCX content: %v", err)
+	}
+	if text == "" {
+		return "", nil, errors.New("DOCX contains no text")
+	}
+	return text, nil, nil
+}
+
+// DocumentDate reads dcterms:created from the document's core properties
+func (DOCXExtractor) DocumentDate(data []byte) *time.Time {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil
+	}
+	raw, err := readZipFile(archive, "docProps/core.xml")
+	if err != nil {
+		return nil
+	}
+
+	var props struct {
+		Created string `xml:"created"`
+	}
+	if err := xml.Unmarshal(raw, &props); err != nil {
+		return nil
+	}
+	return parseMetadataDate(props.Created)
+}
+
+// Zip parts are decompressed in memory, so a small archive must not expand without bound
+const (
+	maxZipEntrySize = 64 << 20
+	maxZipTotalSize = 256 << 20
+)
+
+var errZipEntryTooLarge = fmt.Errorf("archive entry is larger than %d MB when decompressed", maxZipEntrySize>>20)
+
+func openZipFile(archive *zip.Reader, name string) (io.ReadCloser, error) {
+	for _, f := range archive.File {
+		if f.Name == name {
+			if f.UncompressedSize64 > maxZipEntrySize {
+				return nil, errZipEntryTooLarge
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			return &zipEntryReader{ReadCloser: rc, remaining: maxZipEntrySize}, nil
+		}
+	}
+	return nil, fmt.Errorf("missing %s", name)
+}
+
+// zipEntryReader fails once more than its limit has been read, in case an entry's header
+// understates its size
+type zipEntryReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *zipEntryReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, errZipEntryTooLarge
+	}
+	return n, err
+}
+
+func docxText(r io.Reader) (string, error) {
+	decoder := xml.NewDecoder(r)
+	var sb, para strings.Builder
+	headingLevel := 0
+	tableDepth := 0
+	cellParas := 0
+	// Tabs and breaks only count inside a run (w:r); a paragraph's w:pPr also holds w:tab
+	// elements, which define its tab stops
+	runDepth := 0
+
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p":
+				para.Reset()
+				headingLevel = 0
+			case "pStyle":
+				headingLevel = docxHeadingLevel(xmlAttr(t, "val"))
+			case "t":
+				var s string
+				if err := decoder.DecodeElement(&s, &t); err != nil {
+					return "", err
+				}
+				para.WriteString(s)
+			case "r":
+				runDepth++
+			case "tab":
+				if runDepth > 0 {
+					para.WriteString("\t")
+				}
+			case "br", "cr":
+				if runDepth > 0 {
+					para.WriteString("\n")
+				}
+			case "tbl":
+				tableDepth++
+			case "tc":
+				cellParas = 0
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "r":
+				runDepth--
+			case "p":
+				text := strings.TrimSpace(para.String())
+				if tableDepth > 0 {
+					// Paragraphs inside a cell stay on the row's line
+					if text != "" {
+						if cellParas > 0 {
+							sb.WriteString(" ")
+						}
+						sb.WriteString(text)
+						cellParas++
+					}
+					continue
+				}
+				if text == "" {
+					continue
+				}
+				if headingLevel > 0 {
+					sb.WriteString(strings.Repeat("#", headingLevel) + " ")
+				}
+				sb.WriteString(text)
+				sb.WriteString("\n\n")
+			case "tc":
+				sb.WriteString("\t")
+			case "tr":
+				sb.WriteString("\n")
+			case "tbl":
+				tableDepth--
+				if tableDepth == 0 {
+					sb.WriteString("\n")
+				}
+			}
+		}
+	}
+
+	return tidyLines(sb.String()), nil
+}
+
+// docxHeadingLevel maps built-in style IDs such as Title, Heading1 and Heading2 to a level
+func docxHeadingLevel(style string) int {
+	style = strings.ToLower(style)
+	if style == "title" {
+		return 1
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(style, "heading")); err == nil && strings.HasPrefix(style, "heading") {
+		if n < 1 {
+			n = 1
+		}
+		if n > 6 {
+			n = 6
+		}
+		return n
+	}
+	return 0
+}
+
+func xmlAttr(el xml.StartElement, name string) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,29 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDocxTextTabs(t *testing.T) {
+	const body = `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p>
+  <w:pPr><w:pStyle w:val="Heading1"/><w:tabs><w:tab w:val="left" w:pos="720"/><w:tab w:val="right" w:pos="9000"/></w:tabs></w:pPr>
+  <w:r><w:t>Schedule</w:t></w:r>
+</w:p>
+<w:p>
+  <w:pPr><w:tabs><w:tab w:val="left" w:pos="2880"/></w:tabs></w:pPr>
+  <w:r><w:t>Midterm</w:t></w:r><w:r><w:tab/><w:t>14 March</w:t></w:r>
+  <w:r><w:br/><w:t>Room B12</w:t></w:r>
+</w:p>
+</w:body></w:document>`
+
+	got, err := docxText(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the tab inside the run is text; the tab stop definitions in w:pPr are not
+	if want := "# Schedule\n\nMidterm\t14 March\nRoom B12"; got != want {
+		t.Errorf("docxText = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"dory-backend/internal/models"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// EPUBExtractor reads the chapters of an e-book in spine (reading) order
+type EPUBExtractor struct{}
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubPackage struct {
+	Dates    []string `xml:"metadata>date"`
+	Manifest []struct {
+		ID        string `xml:"id,attr"`
+		Href      string `xml:"href,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IDRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// DocumentDate reads the publication's dc:date
+func (EPUBExtractor) DocumentDate(data []byte) *time.Time {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil
+	}
+	_, pkg, err := epubPackageDocument(archive)
+	if err != nil || len(pkg.Dates) == 0 {
+		return nil
+	}
+	return parseMetadataDate(pkg.Dates[0])
+}
+
+func (EPUBExtractor) Extract(data []byte) (string, []models.PageStat, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid EPUB file: %v", err)
+	}
+
+	chapters, err := epubChapters(archive)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid EPUB file: %v", err)
+	}
+
+	var parts []string
+	total := 0
+	for _, name := range chapters {
+		raw, err := readZipFile(archive, name)
+		if errors.Is(err, errZipEntryTooLarge) {
+			return "", nil, fmt.Errorf("invalid EPUB file: %v", err)
+		}
+		if err != nil {
+			continue
+		}
+		// Chapters may be listed more than once, so the total is capped as well
+		if total += len(raw); total > maxZipTotalSize {
+			return "", nil, fmt.Errorf("invalid EPUB file: chapters are larger than %d MB when decompressed", maxZipTotalSize>>20)
+		}
+		text, err := htmlText(raw)
+		if err != nil || text == "" {
+			continue
+		}
+		parts = append(parts, text)
+	}
+
+	if len(parts) == 0 {
+		return "", nil, errors.New("EPUB contains no text")
+	}
+	return strings.Join(parts, "\n\n"), nil, nil
+}
+
+// epubPackageDocument finds the package document through META-INF/container.xml
+func epubPackageDocument(archive *zip.Reader) (string, epubPackage, error) {
+	var pkg epubPackage
+	raw, err := readZipFile(archive, "META-INF/container.xml")
+	if err != nil {
+		return "", pkg, err
+	}
+	var container epubContainer
+	if err := xml.Unmarshal(raw, &container); err != nil {
+		return "", pkg, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return "", pkg, errors.New("container lists no package document")
+	}
+
+	opfPath := container.Rootfiles[0].FullPath
+	raw, err = readZipFile(archive, opfPath)
+	if err != nil {
+		return "", pkg, err
+	}
+	err = xml.Unmarshal(raw, &pkg)
+	return opfPath, pkg, err
+}
+
+// epubChapters resolves the spine of the package document
+func epubChapters(archive *zip.Reader) ([]string, error) {
+	opfPath, pkg, err := epubPackageDocument(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	hrefs := make(map[string]string, len(pkg.Manifest))
+	for _, item := range pkg.Manifest {
+		if strings.Contains(item.MediaType, "html") {
+			hrefs[item.ID] = item.Href
+		}
+	}
+
+	// Manifest hrefs are relative to the package document
+	base := path.Dir(opfPath)
+	var chapters []string
+	for _, ref := range pkg.Spine {
+		href, ok := hrefs[ref.IDRef]
+		if !ok {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(href); err == nil {
+			href = unescaped
+		}
+		chapters = append(chapters, path.Join(base, href))
+	}
+	if len(chapters) == 0 {
+		return nil, errors.New("spine lists no chapters")
+	}
+	return chapters, nil
+}
+
+func readZipFile(archive *zip.Reader, name string) ([]byte, error) {
+	f, err := openZipFile(archive, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"bytes"
+	"dory-backend/internal/models"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLExtractor renders the visible text of a saved web page. Headings become Markdown
+// headings and block elements become paragraphs so the recursive chunker can split on them.
+type HTMLExtractor struct{}
+
+func (HTMLExtractor) Extract(data []byte) (string, []models.PageStat, error) {
+	text, err := htmlText(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse HTML: %v", err)
+	}
+	if text == "" {
+		return "", nil, errors.New("HTML contains no text")
+	}
+	return text, nil, nil
+}
+
+// htmlDateMeta lists meta tags that carry a page's publication date, by attribute value
+var htmlDateMeta = map[string]bool{
+	"article:published_time": true,
+	"og:published_time":      true,
+	"date":                   true,
+	"dc.date":                true,
+	"dcterms.created":        true,
+	"pubdate":                true,
+	"datepublished":          true,
+}
+
+// DocumentDate reads the publication date from the page's meta tags
+func (HTMLExtractor) DocumentDate(data []byte) *time.Time {
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+
+	var found *time.Time
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if found != nil {
+			return
+		}
+		if n.Type == html.ElementNode && n.DataAtom == atom.Meta {
+			var key, content string
+			for _, a := range n.Attr {
+				switch strings.ToLower(a.Key) {
+				case "name", "property", "itemprop":
+					if htmlDateMeta[strings.ToLower(a.Val)] {
+						key = a.Val
+					}
+				case "content":
+					content = a.Val
+				}
+			}
+			if key != "" {
+				found = parseMetadataDate(content)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return found
+}
+
+func htmlText(data []byte) (string, error) {
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	renderHTML(&sb, doc, false)
+	return tidyLines(sb.String()), nil
+}
+
+// skippedElements never contain readable text
+var skippedElements = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Noscript: true,
+	atom.Template: true, atom.Svg: true, atom.Iframe: true, atom.Object: true,
+	atom.Button: true, atom.Select: true, atom.Nav: true,
+}
+
+var blockElements = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Section: true, atom.Article: true, atom.Main: true,
+	atom.Header: true, atom.Footer: true, atom.Aside: true, atom.Blockquote: true,
+	atom.Ul: true, atom.Ol: true, atom.Dl: true, atom.Dt: true, atom.Dd: true,
+	atom.Table: true, atom.Figure: true, atom.Figcaption: true, atom.Hr: true, atom.Body: true,
+}
+
+var headingLevels = map[atom.Atom]int{
+	atom.H1: 1, atom.H2: 2, atom.H3: 3, atom.H4: 4, atom.H5: 5, atom.H6: 6,
+}
+
+func renderHTML(sb *strings.Builder, n *html.Node, pre bool) {
+	switch n.Type {
+	case html.TextNode:
+		if pre {
+			sb.WriteString(n.Data)
+		} else if text := strings.Join(strings.Fields(n.Data), " "); text != "" {
+			// Keep a single space where the source had whitespace around inline text
+			if strings.TrimLeft(n.Data, " \t\r\n") != n.Data && !endsWithSpace(sb) {
+				sb.WriteString(" ")
+			}
+			sb.WriteString(text)
+			if strings.TrimRight(n.Data, " \t\r\n") != n.Data {
+				sb.WriteString(" ")
+			}
+		}
+		return
+	case html.ElementNode:
+		if skippedElements[n.DataAtom] {
+			return
+		}
+	case html.CommentNode, html.DoctypeNode:
+		return
+	}
+
+	switch {
+	case headingLevels[n.DataAtom] > 0:
+		sb.WriteString("\n\n" + strings.Repeat("#", headingLevels[n.DataAtom]) + " ")
+	case n.DataAtom == atom.Li:
+		sb.WriteString("\n- ")
+	case n.DataAtom == atom.Br:
+		sb.WriteString("\n")
+	case n.DataAtom == atom.Tr:
+		sb.WriteString("\n")
+	case n.DataAtom == atom.Td, n.DataAtom == atom.Th:
+		sb.WriteString("\t")
+	case n.DataAtom == atom.Pre:
+		sb.WriteString("\n\n")
+		pre = true
+	case blockElements[n.DataAtom]:
+		sb.WriteString("\n\n")
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		renderHTML(sb, c, pre)
+	}
+
+	if headingLevels[n.DataAtom] > 0 || n.DataAtom == atom.Pre || blockElements[n.DataAtom] {
+		sb.WriteString("\n\n")
+	}
+}
+
+func endsWithSpace(sb *strings.Builder) bool {
+	s := sb.String()
+	return s == "" || strings.HasSuffix(s, " ") || strings.HasSuffix(s, "\n") || strings.HasSuffix(s, "\t")
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"dory-backend/internal/models"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ICSExtractor renders a calendar file as readable text, one section per event, so event
+// details and descriptions can be searched from chat. The events themselves are imported
+// separately by ImportICSEvents.
+type ICSExtractor struct{}
+
+func (ICSExtractor) Extract(data []byte) (string, []models.PageStat, error) {
+	cal, err := ParseICS(data, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid calendar file: %v", err)
+	}
+	return describeCalendar(cal), nil, nil
+}
+
+func describeCalendar(cal *ICSCalendar) string {
+	overrides := map[string][]ICSEvent{}
+	for _, e := range cal.Events {
+		if e.RecurrenceID != nil {
+			overrides[e.UID] = append(overrides[e.UID], e)
+		}
+	}
+
+	var sb strings.Builder
+	name := cal.Name
+	if name == "" {
+		name = "Calendar"
+	}
+	sb.WriteString("# " + name + "\n\n")
+
+	for _, e := range cal.Events {
+		if e.RecurrenceID != nil {
+			continue
+		}
+
+		sb.WriteString("## " + e.Summary + "\n\n")
+		if e.Cancelled {
+			sb.WriteString("Status: cancelled\n")
+		}
+		sb.WriteString("When: " + describeEventTime(e.Start, e.Start.Add(e.Duration()), e.AllDay) + "\n")
+		if e.Rule != nil {
+			sb.WriteString("Repeats: " + describeRule(*e.Rule, e.Start) + "\n")
+		}
+		if len(e.ExDates) > 0 {
+			dates := make([]string, len(e.ExDates))
+			for i, t := range e.ExDates {
+				dates[i] = t.Format("2 January 2006")
+			}
+			sb.WriteString("Except: " + strings.Join(dates, ", ") + "\n")
+		}
+
+		changes := overrides[e.UID]
+		sort.Slice(changes, func(i, j int) bool { return changes[i].RecurrenceID.Before(*changes[j].RecurrenceID) })
+		for _, o := range changes {
+			original := o.RecurrenceID.Format("2 January 2006")
+			if o.Cancelled {
+				sb.WriteString("Cancelled on " + original + "\n")
+			} else {
+				sb.WriteString("Changed on " + original + ": " + describeEventTime(o.Start, o.Start.Add(o.Duration()), o.AllDay))
+				if o.Location != "" && o.Location != e.Location {
+					sb.WriteString(" at " + o.Location)
+				}
+				sb.WriteString("\n")
+			}
+		}
+
+		if e.Location != "" {
+			sb.WriteString("Where: " + e.Location + "\n")
+		}
+		if e.Description != "" {
+			sb.WriteString("\n" + e.Description + "\n")
+		}
+		sb.WriteString("\n")
+	}
+
+	return strings.TrimSpace(sb.String())
+}
+
+func describeEventTime(start time.Time, end time.Time, allDay bool) string {
+	if allDay {
+		if end.Sub(start) > 24*time.Hour {
+			return start.Format("Monday 2 January 2006") + " to " + end.AddDate(0, 0, -1).Format("Monday 2 January 2006") + " (all day)"
+		}
+		return start.Format("Monday 2 January 2006") + " (all day)"
+	}
+
+	zone := start.Location().String()
+	s := start.Format("Monday 2 January 2006, 15:04")
+	if end.After(start) {
+		if end.YearDay() == start.YearDay() && end.Year() == start.Year() {
+			s += "–" + end.Format("15:04")
+		} else {
+			s += " to " + end.Format("Monday 2 January 2006, 15:04")
+		}
+	}
+	return s + " (" + zone + ")"
+}
+
+var ruleWeekdayNames = []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+
+var ordinalNames = map[int]string{1: "first", 2: "second", 3: "third", 4: "fourth", 5: "fifth", -1: "last", -2: "second to last"}
+
+func describeRule(r RecurrenceRule, start time.Time) string {
+	units := map[string]string{FreqDaily: "day", FreqWeekly: "week", FreqMonthly: "month", FreqYearly: "year"}
+	s := "every " + units[r.Freq]
+	if r.Interval > 1 {
+		s = fmt.Sprintf("every %d %ss", r.Interval, units[r.Freq])
+	}
+
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, d := range r.ByDay {
+			days[i] = ruleWeekdayNames[d.Weekday]
+			if ord, ok := ordinalNames[d.N]; ok {
+				days[i] = "the " + ord + " " + days[i]
+			} else if d.N != 0 {
+				days[i] = fmt.Sprintf("%s #%d", days[i], d.N)
+			}
+		}
+		s += " on " + strings.Join(days, ", ")
+	} else if r.Freq == FreqWeekly {
+		s += " on " + ruleWeekdayNames[start.Weekday()]
+	}
+	if len(r.ByMonthDay) > 0 {
+		days := make([]string, len(r.ByMonthDay))
+		for i, d := range r.ByMonthDay {
+			days[i] = fmt.Sprint(d)
+		}
+		s += " on day " + strings.Join(days, ", ")
+	}
+	if len(r.ByMonth) > 0 {
+		months := make([]string, len(r.ByMonth))
+		for i, m := range r.ByMonth {
+			months[i] = time.Month(m).String()
+		}
+		s += " in " + strings.Join(months, ", ")
+	}
+
+	switch {
+	case !r.Until.IsZero():
+		s += " until " + r.Until.In(start.Location()).Format("2 January 2006")
+	case r.Count > 0:
+		s += fmt.Sprintf(", %d times", r.Count)
+	}
+	return s
+}
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"dory-backend/internal/models"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// File types recorded on Document.FileType
+const (
+	FileTypePDF      = "pdf"
+	FileTypeDOCX     = "docx"
+	FileTypeMarkdown = "markdown"
+	FileTypeHTML     = "html"
+	FileTypeEPUB     = "epub"
+	FileTypeText     = "text"
+	FileTypeICS      = "ics"
+)
+
+// ErrUnsupportedFileType is returned when no extractor handles the detected content type
+var ErrUnsupportedFileType = errors.New("unsupported file type")
+
+// Extractor turns an uploaded file into plain text for chunking. Pages are only returned
+// by formats with fixed pagination.
+type Extractor interface {
+	Extract(data []byte) (string, []models.PageStat, error)
+}
+
+// DocumentDater is implemented by extractors whose format records when a document was
+// written; relative dates in the text are resolved against it
+type DocumentDater interface {
+	DocumentDate(data []byte) *time.Time
+}
+
+// parseMetadataDate reads the date formats used by document metadata
+func parseMetadataDate(value string) *time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04Z07:00"} {
+		if t, err := time.Parse(layout, value); err == nil && t.Year() > 1970 {
+			return &t
+		}
+	}
+	// Bare dates are pinned to midday UTC so they stay on the same day in every zone
+	for _, layout := range []string{"2006-01-02", "2006-01"} {
+		if t, err := time.Parse(layout, value); err == nil && t.Year() > 1970 {
+			t = t.Add(12 * time.Hour)
+			return &t
+		}
+	}
+	return nil
+}
+
+// DetectExtractor sniffs the content type and picks an extractor for it. The filename is
+// only consulted to tell Markdown apart from plain text, which look identical to a sniffer.
+func DetectExtractor(data []byte, filename string) (Extractor, string, error) {
+	mtype := mimetype.Detect(data)
+
+	switch {
+	case mtype.Is("application/pdf"):
+		return PDFExtractor{}, FileTypePDF, nil
+	case mtype.Is("application/vnd.openxmlformats-officedocument.wordprocessingml.document"):
+		return DOCXExtractor{}, FileTypeDOCX, nil
+	case mtype.Is("application/epub+zip"):
+		return EPUBExtractor{}, FileTypeEPUB, nil
+	case mtype.Is("text/calendar"):
+		return ICSExtractor{}, FileTypeICS, nil
+	case mtype.Is("text/html"), mtype.Is("application/xhtml+xml"):
+		return HTMLExtractor{}, FileTypeHTML, nil
+	case mtype.Is("application/zip"):
+		// Sniffing relies on the archive's first entry; zip tools that reorder or compress it
+		// leave a generic zip, so look for each format's required part instead
+		if archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err == nil {
+			for _, f := range archive.File {
+				switch f.Name {
+				case "word/document.xml":
+					return DOCXExtractor{}, FileTypeDOCX, nil
+				case "META-INF/container.xml":
+					return EPUBExtractor{}, FileTypeEPUB, nil
+				}
+			}
+		}
+	}
+
+	// Everything else that sniffs as text (CSV, JSON, source files...) is ingested verbatim
+	for m := mtype; m != nil; m = m.Parent() {
+		if m.Is("text/plain") {
+			switch strings.ToLower(filepath.Ext(filename)) {
+			case ".md", ".markdown", ".mdown", ".mkd":
+				return MarkdownExtractor{}, FileTypeMarkdown, nil
+			case ".ics", ".ical", ".ifb":
+				return ICSExtractor{}, FileTypeICS, nil
+			}
+			return PlainTextExtractor{}, FileTypeText, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("%w: %s", ErrUnsupportedFileType, mtype.String())
+}
+
+// PDFExtractor extracts PDFs page by page
+type PDFExtractor struct{}
+
+func (PDFExtractor) Extract(data []byte) (string, []models.PageStat, error) {
+	return ExtractPDFText(data)
+}
+
+func (PDFExtractor) DocumentDate(data []byte) *time.Time {
+	return pdfCreationDate(data)
+}
+
+// PlainTextExtractor passes text through, normalising line endings and invalid UTF-8
+type PlainTextExtractor struct{}
+
+func (PlainTextExtractor) Extract(data []byte) (string, []models.PageStat, error) {
+	text := normalizeText(data)
+	if strings.TrimSpace(text) == "" {
+		return "", nil, errors.New("file contains no text")
+	}
+	return text, nil, nil
+}
+
+var frontMatter = regexp.MustCompile(`\A---[ \t]*\n(?s:.*?)\n(?:---|\.\.\.)[ \t]*(?:\n|\z)`)
+
+// MarkdownExtractor keeps Markdown as-is, since the recursive chunker reads its headings,
+// and drops YAML front matter that note apps put at the top of exports
+type MarkdownExtractor struct{}
+
+func (MarkdownExtractor) Extract(data []byte) (string, []models.PageStat, error) {
+	text := frontMatter.ReplaceAllString(normalizeText(data), "")
+	if strings.TrimSpace(text) == "" {
+		return "", nil, errors.New("file contains no text")
+	}
+	return text, nil, nil
+}
+
+func normalizeText(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	text := string(data)
+	if !utf8.ValidString(text) {
+		text = strings.ToValidUTF8(text, "�")
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n")
+}
+
+// tidyLines trims trailing spaces and collapses runs of blank lines left behind by markup
+func tidyLines(text string) string {
+	lines := strings.Split(text, "\n")
+	out := make([]string, 0, len(lines))
+	blank := true
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			if blank {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		out = append(out, line)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
@@ -2,150 +2,119 @@ package services
 
 import (
 	"context"
-	"dory-backend/internal/config"
+	"dory-backend/internal/models"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
-
-	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/option"
 )
 
-func GenerateAIResponse(userQuery string, contextChunks []string) (string, error) {
-	ctx := context.Background()
-	client, err := genai.NewClient(ctx, option.WithAPIKey(config.AppConfig.GeminiKey))
-	if err != nil {
-		return "", err
+const ragSystemPrompt = `You are a knowledgeable RAG (Retrieval-Augmented Generation) assistant. Your role is to answer user questions based on their personal documents and information they've shared with you.
+
+CORE PRINCIPLES:
+- Answer questions accurately and directly based on the provided information
+- Match the user's tone and language style (formal if they're formal, casual if they're casual)
+- Be professional, informative, and helpful without being overly polite or robotic
+- Maintain a conversational yet authoritative tone
+- Do NOT use emojis or excessive exclamation marks
+- Do NOT start with phrases like "Based on the context provided" or "According to your documents"
+- Do NOT mention "documents", "chunks", "sources", or "context" explicitly
+- Present information as if naturally recalling it
+
+LANGUAGE REQUIREMENT:
+- Always respond in the SAME LANGUAGE as the user's question
+
+CONTENT GUIDELINES:
+- Use the provided information to answer comprehensively
+- If the user asks something not covered in their information, clearly state that this information isn't available
+- Provide specific details and examples from their information when relevant
+- Keep responses concise but thorough
+- Avoid filler words and unnecessary elaboration
+
+INFORMATION REFERENCE:
+- Do NOT say "Your documents mention..." or "In your files, it says..."
+- Instead, naturally incorporate the information as the answer itself
+
+CITATIONS:
+- Each piece of information is numbered, e.g. [1], [2]
+- After every sentence that relies on a piece of information, add its marker, e.g. "The exam is on May 4 [2]."
+- Use several markers when a sentence relies on several pieces, e.g. [1][3]
+- Only use the numbers you were given and do NOT add a list of references at the end`
+
+// buildRAGRequest puts the behaviour rules in the system instruction and the numbered
+// sources alongside the question in the final user turn, after any prior conversation turns
+func buildRAGRequest(history []ChatMessage, userQuery string, sources []models.Source) ChatRequest {
+	blocks := make([]string, 0, len(sources))
+	for i, src := range sources {
+		label := src.Filename
+		if src.PageStart > 0 {
+			label = fmt.Sprintf("%s, p. %d", label, src.PageStart)
+			if src.PageEnd > src.PageStart {
+				label = fmt.Sprintf("%s-%d", label, src.PageEnd)
+			}
+		}
+		blocks = append(blocks, fmt.Sprintf("[%d] (%s)\n%s", i+1, label, src.Content))
 	}
-	defer client.Close()
+	joinedContext := strings.Join(blocks, "\n\n---\n\n")
 
-	model := client.GenerativeModel("gemini-2.5-flash")
+	prompt := fmt.Sprintf(`CONTEXT FROM USER'S INFORMATION:
+%s
 
-	joinedContext := strings.Join(contextChunks, "\n\n---\n\n")
+USER'S QUESTION:
+%s
 
-	prompt := fmt.Sprintf(`You are a knowledgeable RAG (Retrieval-Augmented Generation) assistant. Your role is to answer user questions based on their personal documents and information they've shared with you.
-	
-	CORE PRINCIPLES:
-	- Answer questions accurately and directly based on the provided information
-	- Match the user's tone and language style (formal if they're formal, casual if they're casual)
-	- Be professional, informative, and helpful without being overly polite or robotic
-	- Maintain a conversational yet authoritative tone
-	- Do NOT use emojis or excessive exclamation marks
-	- Do NOT start with phrases like "Based on the context provided" or "According to your documents"
-	- Do NOT mention "documents", "chunks", "sources", or "context" explicitly
-	- Present information as if naturally recalling it
-	
-	LANGUAGE REQUIREMENT:
-	- Always respond in the SAME LANGUAGE as the user's question
-	
-	CONTENT GUIDELINES:
-	- Use the provided information to answer comprehensively
-	- If the user asks something not covered in their information, clearly state that this information isn't available
-	- Provide specific details and examples from their information when relevant
-	- Keep responses concise but thorough
-	- Avoid filler words and unnecessary elaboration
-	
-	INFORMATION REFERENCE:
-	- Do NOT say "Your documents mention..." or "In your files, it says..."
-	- Instead, naturally incorporate the information as the answer itself
-	
-	CONTEXT FROM USER'S INFORMATION:
-	%s
-	
-	USER'S QUESTION:
-	%s
-	
-	Now provide a helpful, natural response:
-	`, joinedContext, userQuery)
+Now provide a helpful, natural response:`, joinedContext, userQuery)
 
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	messages := make([]ChatMessage, 0, len(history)+1)
+	messages = append(messages, history...)
+	messages = append(messages, ChatMessage{Role: RoleUser, Content: prompt})
 
-	if err != nil {
-		return "", err
+	return ChatRequest{
+		System:   ragSystemPrompt,
+		Messages: messages,
 	}
+}
 
-	if len(resp.Candidates) > 0 && len(resp.Candidates[0].Content.Parts) > 0 {
-		return fmt.Sprintf("%v", resp.Candidates[0].Content.Parts[0]), nil
+var citationMarker = regexp.MustCompile(`\[(\d+)\]`)
+
+// ExtractCitations maps each [n] marker in the answer to the nth source, in order of first use.
+// Markers outside the range of sources are ignored rather than trusted.
+func ExtractCitations(answer string, sources []models.Source) []models.Citation {
+	citations := []models.Citation{}
+	seen := make(map[int]bool)
+
+	for _, match := range citationMarker.FindAllStringSubmatch(answer, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err != nil || n < 1 || n > len(sources) || seen[n] {
+			continue
+		}
+		seen[n] = true
+		citations = append(citations, models.Citation{Marker: n, Source: sources[n-1]})
 	}
 
-	return "I'm sorry, I couldn't generate a response.", nil
+	return citations
 }
 
-func StreamAIResponse(ctx context.Context, userQuery string, contextChunks []string) (any, error) {
-	client, err := genai.NewClient(ctx, option.WithAPIKey(config.AppConfig.GeminiKey))
+func GenerateAIResponse(ctx context.Context, history []ChatMessage, userQuery string, sources []models.Source) (string, error) {
+	resp, err := ActiveChatModel.Generate(ctx, buildRAGRequest(history, userQuery, sources))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	// We don't close the client here because the iterator needs it.
-	// The caller should ideally manage the client or we should change how we handle it.
-	// However, for simplicity in this RAG setup, we'll let it be for now,
-	// but normally you'd want a long-lived client.
-
-	model := client.GenerativeModel("gemini-2.5-flash")
-
-	joinedContext := strings.Join(contextChunks, "\n\n---\n\n")
-
-	prompt := fmt.Sprintf(`You are a knowledgeable RAG (Retrieval-Augmented Generation) assistant. Your role is to answer user questions based on their personal documents and information they've shared with you.
-	
-	CORE PRINCIPLES:
-	- Answer questions accurately and directly based on the provided information
-	- Match the user's tone and language style (formal if they're formal, casual if they're casual)
-	- Be professional, informative, and helpful without being overly polite or robotic
-	- Maintain a conversational yet authoritative tone
-	- Do NOT use emojis or excessive exclamation marks
-	- Do NOT start with phrases like "Based on the context provided" or "According to your documents"
-	- Do NOT mention "documents", "chunks", "sources", or "context" explicitly
-	- Present information as if naturally recalling it
-	
-	LANGUAGE REQUIREMENT:
-	- Always respond in the SAME LANGUAGE as the user's question
-	
-	CONTENT GUIDELINES:
-	- Use the provided information to answer comprehensively
-	- If the user asks something not covered in their information, clearly state that this information isn't available
-	- Provide specific details and examples from their information when relevant
-	- Keep responses concise but thorough
-	- Avoid filler words and unnecessary elaboration
-	
-	INFORMATION REFERENCE:
-	- Do NOT say "Your documents mention..." or "In your files, it says..."
-	- Instead, naturally incorporate the information as the answer itself
-	
-	CONTEXT FROM USER'S INFORMATION:
-	%s
-	
-	USER'S QUESTION:
-	%s
-	
-	Now provide a helpful, natural response:
-	`, joinedContext, userQuery)
+	return resp.Text, nil
+}
 
-	iter := model.GenerateContentStream(ctx, genai.Text(prompt))
-	return iter, nil
+// StreamAIResponse streams the answer as token deltas; the channel closes after a Done or Err chunk
+func StreamAIResponse(ctx context.Context, history []ChatMessage, userQuery string, sources []models.Source) (<-chan StreamChunk, error) {
+	return ActiveChatModel.Stream(ctx, buildRAGRequest(history, userQuery, sources))
 }
 
 func RetrieveInfoAndSave(userQuery string) (string, error) {
-	ctx := context.Background()
-	client, err := genai.NewClient(ctx, option.WithAPIKey(config.AppConfig.GeminiKey))
-	if err != nil {
-		return "", err
-	}
-	defer client.Close()
-	model := client.GenerativeModel("gemini-2.5-flash")
-
 	prompt := fmt.Sprintf(`You are a knowledgeable RAG (Retrieval-Augmented Generation) assistant. Your role is to answer user questions based on their personal documents and information they've shared with you.
 	You are provided by a user query and you have to check the sentiment of it, if it is kind of informative or something like user is telling you something,
 	so i want you to take that info and return the info in a plain text format , make sure to not include any other word or any supportive line, just send the response sent by user, return the information sent by user only nothing else extra
 	here is the user query: 
 	%s
 `, userQuery)
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
-	if err != nil {
-		return "", err
-	}
-
-	if len(resp.Candidates) > 0 && len(resp.Candidates[0].Content.Parts) > 0 {
-		return fmt.Sprintf("%v", resp.Candidates[0].Content.Parts[0]), nil
-	}
 
-	return "", fmt.Errorf("no response candidates found")
+	return generateText(context.Background(), prompt)
 }
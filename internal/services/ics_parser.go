@@ -0,0 +1,423 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ICSEvent is one VEVENT. Instances that override part of a recurring series share its UID
+// and carry the original start they replace in RecurrenceID.
+type ICSEvent struct {
+	UID          string
+	Summary      string
+	Description  string
+	Location     string
+	Start        time.Time
+	End          *time.Time
+	AllDay       bool
+	Rule         *RecurrenceRule
+	RRule        string
+	RDates       []time.Time
+	ExDates      []time.Time
+	RecurrenceID *time.Time
+	Cancelled    bool
+}
+
+// Duration is the length of each occurrence, or 0 for an instant
+func (e ICSEvent) Duration() time.Duration {
+	if e.End != nil && e.End.After(e.Start) {
+		return e.End.Sub(e.Start)
+	}
+	if e.AllDay {
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+type ICSCalendar struct {
+	Name   string
+	Events []ICSEvent
+}
+
+type icsProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+type icsComponent struct {
+	name     string
+	props    []icsProperty
+	children []*icsComponent
+}
+
+func (c *icsComponent) prop(name string) (icsProperty, bool) {
+	for _, p := range c.props {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return icsProperty{}, false
+}
+
+func (c *icsComponent) text(name string) string {
+	p, _ := c.prop(name)
+	return unescapeICSText(p.value)
+}
+
+// ParseICS reads an iCalendar file. Floating times, which have no zone of their own, are
+// read in the calendar's X-WR-TIMEZONE, or in defaultLoc when it has none.
+func ParseICS(data []byte, defaultLoc *time.Location) (*ICSCalendar, error) {
+	root, err := parseICSComponents(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var calendar *icsComponent
+	for _, child := range root.children {
+		if child.name == "VCALENDAR" {
+			calendar = child
+			break
+		}
+	}
+	if calendar == nil {
+		return nil, errors.New("no VCALENDAR found")
+	}
+
+	zones := newICSZones(calendar)
+	if tz := calendar.text("X-WR-TIMEZONE"); tz != "" {
+		if loc, ok := zones.lookup(tz); ok {
+			defaultLoc = loc
+		}
+	}
+	if defaultLoc == nil {
+		defaultLoc = time.UTC
+	}
+
+	cal := &ICSCalendar{Name: calendar.text("X-WR-CALNAME")}
+	for _, child := range calendar.children {
+		if child.name != "VEVENT" {
+			continue
+		}
+		event, err := parseVEvent(child, zones, defaultLoc)
+		if err != nil {
+			// One malformed event should not sink a whole semester's timetable
+			continue
+		}
+		cal.Events = append(cal.Events, event)
+	}
+
+	if len(cal.Events) == 0 {
+		return nil, errors.New("calendar contains no events")
+	}
+	return cal, nil
+}
+
+func parseVEvent(c *icsComponent, zones icsZones, defaultLoc *time.Location) (ICSEvent, error) {
+	event := ICSEvent{
+		UID:         c.text("UID"),
+		Summary:     strings.TrimSpace(c.text("SUMMARY")),
+		Description: strings.TrimSpace(c.text("DESCRIPTION")),
+		Location:    strings.TrimSpace(c.text("LOCATION")),
+		Cancelled:   strings.EqualFold(c.text("STATUS"), "CANCELLED"),
+	}
+	if event.Summary == "" {
+		event.Summary = "Untitled event"
+	}
+
+	dtstart, ok := c.prop("DTSTART")
+	if !ok {
+		return event, errors.New("VEVENT has no DTSTART")
+	}
+	start, allDay, err := zones.parseTime(dtstart.value, dtstart.params, defaultLoc)
+	if err != nil {
+		return event, err
+	}
+	event.Start, event.AllDay = start, allDay
+
+	if dtend, ok := c.prop("DTEND"); ok {
+		if end, _, err := zones.parseTime(dtend.value, dtend.params, defaultLoc); err == nil {
+			event.End = &end
+		}
+	} else if dur, ok := c.prop("DURATION"); ok {
+		if d, err := parseICSDuration(dur.value); err == nil {
+			end := start.Add(d)
+			event.End = &end
+		}
+	}
+
+	if rrule, ok := c.prop("RRULE"); ok {
+		rule, err := ParseRRule(rrule.value, start.Location())
+		if err != nil {
+			return event, err
+		}
+		event.Rule = &rule
+		event.RRule = rrule.value
+	}
+
+	for _, p := range c.props {
+		switch p.name {
+		case "RDATE", "EXDATE":
+			for _, v := range strings.Split(p.value, ",") {
+				t, _, err := zones.parseTime(v, p.params, defaultLoc)
+				if err != nil {
+					continue
+				}
+				if p.name == "RDATE" {
+					event.RDates = append(event.RDates, t)
+				} else {
+					event.ExDates = append(event.ExDates, t)
+				}
+			}
+		case "RECURRENCE-ID":
+			if t, _, err := zones.parseTime(p.value, p.params, defaultLoc); err == nil {
+				event.RecurrenceID = &t
+			}
+		}
+	}
+
+	return event, nil
+}
+
+// parseICSComponents unfolds content lines and nests BEGIN/END blocks
+func parseICSComponents(data []byte) (*icsComponent, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\n ", "")
+	text = strings.ReplaceAll(text, "\n\t", "")
+
+	root := &icsComponent{}
+	stack := []*icsComponent{root}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		prop, err := parseICSLine(line)
+		if err != nil {
+			continue
+		}
+
+		current := stack[len(stack)-1]
+		switch prop.name {
+		case "BEGIN":
+			child := &icsComponent{name: strings.ToUpper(prop.value)}
+			current.children = append(current.children, child)
+			stack = append(stack, child)
+		case "END":
+			if len(stack) == 1 || current.name != strings.ToUpper(prop.value) {
+				return nil, fmt.Errorf("unexpected END:%s", prop.value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			current.props = append(current.props, prop)
+		}
+	}
+
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("unterminated %s", stack[len(stack)-1].name)
+	}
+	return root, nil
+}
+
+// parseICSLine splits NAME;PARAM=value;PARAM="quoted":VALUE
+func parseICSLine(line string) (icsProperty, error) {
+	prop := icsProperty{params: map[string]string{}}
+
+	inQuotes := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			inQuotes = !inQuotes
+		} else if r == ':' && !inQuotes {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return prop, fmt.Errorf("invalid content line %q", line)
+	}
+
+	head, value := line[:colon], line[colon+1:]
+	parts := splitOutsideQuotes(head, ';')
+	prop.name = strings.ToUpper(parts[0])
+	prop.value = value
+	for _, param := range parts[1:] {
+		key, val, _ := strings.Cut(param, "=")
+		prop.params[strings.ToUpper(key)] = strings.Trim(val, `"`)
+	}
+	return prop, nil
+}
+
+func splitOutsideQuotes(s string, sep rune) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i, r := range s {
+		if r == '"' {
+			inQuotes = !inQuotes
+		} else if r == sep && !inQuotes {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+var icsUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+func unescapeICSText(s string) string {
+	return icsUnescaper.Replace(s)
+}
+
+var icsDurationPattern = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+func parseICSDuration(value string) (time.Duration, error) {
+	m := icsDurationPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if m == nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, unit := range units {
+		if m[i+2] != "" {
+			n, _ := strconv.Atoi(m[i+2])
+			d += time.Duration(n) * unit
+		}
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// icsZones resolves TZID parameters, preferring the IANA database and falling back to the
+// fixed standard offset declared in the calendar's own VTIMEZONE
+type icsZones map[string]*time.Location
+
+// windowsZones maps the zone names Outlook and Exchange export to IANA names
+var windowsZones = map[string]string{
+	"Eastern Standard Time":          "America/New_York",
+	"Central Standard Time":          "America/Chicago",
+	"Mountain Standard Time":         "America/Denver",
+	"Pacific Standard Time":          "America/Los_Angeles",
+	"GMT Standard Time":              "Europe/London",
+	"W. Europe Standard Time":        "Europe/Berlin",
+	"Romance Standard Time":          "Europe/Paris",
+	"Central Europe Standard Time":   "Europe/Budapest",
+	"Central European Standard Time": "Europe/Warsaw",
+	"E. Europe Standard Time":        "Europe/Chisinau",
+	"India Standard Time":            "Asia/Kolkata",
+	"China Standard Time":            "Asia/Shanghai",
+	"Tokyo Standard Time":            "Asia/Tokyo",
+	"AUS Eastern Standard Time":      "Australia/Sydney",
+	"Singapore Standard Time":        "Asia/Singapore",
+	"UTC":                            "UTC",
+}
+
+func newICSZones(calendar *icsComponent) icsZones {
+	zones := icsZones{}
+	for _, child := range calendar.children {
+		if child.name != "VTIMEZONE" {
+			continue
+		}
+		tzid := child.text("TZID")
+		if tzid == "" {
+			continue
+		}
+		if loc, ok := lookupZoneName(tzid); ok {
+			zones[tzid] = loc
+			continue
+		}
+		for _, sub := range child.children {
+			if sub.name != "STANDARD" {
+				continue
+			}
+			if offset, err := parseUTCOffset(sub.text("TZOFFSETTO")); err == nil {
+				zones[tzid] = time.FixedZone(tzid, offset)
+				break
+			}
+		}
+	}
+	return zones
+}
+
+func (z icsZones) lookup(tzid string) (*time.Location, bool) {
+	if loc, ok := z[tzid]; ok {
+		return loc, true
+	}
+	return lookupZoneName(tzid)
+}
+
+func lookupZoneName(tzid string) (*time.Location, bool) {
+	tzid = strings.Trim(tzid, `"`)
+	if name, ok := windowsZones[tzid]; ok {
+		tzid = name
+	}
+	if loc, err := time.LoadLocation(tzid); err == nil {
+		return loc, true
+	}
+	// Some exporters prefix the IANA name, e.g. /mozilla.org/20050126_1/Europe/Berlin
+	parts := strings.Split(strings.Trim(tzid, "/"), "/")
+	for n := 3; n >= 2; n-- {
+		if len(parts) > n {
+			if loc, err := time.LoadLocation(strings.Join(parts[len(parts)-n:], "/")); err == nil {
+				return loc, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func parseUTCOffset(value string) (int, error) {
+	if len(value) != 5 && len(value) != 7 {
+		return 0, fmt.Errorf("invalid UTC offset %q", value)
+	}
+	sign := 1
+	switch value[0] {
+	case '-':
+		sign = -1
+	case '+':
+	default:
+		return 0, fmt.Errorf("invalid UTC offset %q", value)
+	}
+	h, err1 := strconv.Atoi(value[1:3])
+	m, err2 := strconv.Atoi(value[3:5])
+	s := 0
+	var err3 error
+	if len(value) == 7 {
+		s, err3 = strconv.Atoi(value[5:7])
+	}
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, fmt.Errorf("invalid UTC offset %q", value)
+	}
+	return sign * (h*3600 + m*60 + s), nil
+}
+
+// parseTime reads DATE and DATE-TIME values. All-day dates are returned as UTC midnight so
+// they stay on the same calendar day wherever they are viewed.
+func (z icsZones) parseTime(value string, params map[string]string, defaultLoc *time.Location) (time.Time, bool, error) {
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(params["VALUE"], "DATE") || len(value) == 8 {
+		t, err := time.Parse("20060102", value)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+
+	loc := defaultLoc
+	if tzid := params["TZID"]; tzid != "" {
+		if zoneLoc, ok := z.lookup(tzid); ok {
+			loc = zoneLoc
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
@@ -0,0 +1,312 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// icsFile joins content lines with the CRLF endings RFC 5545 requires
+func icsFile(lines ...string) []byte {
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+var semesterICS = icsFile(
+	"BEGIN:VCALENDAR",
+	"VERSION:2.0",
+	"X-WR-CALNAME:Chemistry",
+	"X-WR-TIMEZONE:Europe/Berlin",
+	"BEGIN:VTIMEZONE",
+	"TZID:Campus Time",
+	"BEGIN:STANDARD",
+	"DTSTART:19700101T000000",
+	"TZOFFSETFROM:+0530",
+	"TZOFFSETTO:+0530",
+	"END:STANDARD",
+	"END:VTIMEZONE",
+	"BEGIN:VEVENT",
+	"UID:lecture@uni.example",
+	"SUMMARY:Organic Chemistry\\, Pa",
+	"\trt 1",
+	"DESCRIPTION:Bring your lab coat.\\nRoom B12 is on the",
+	"  second floor.",
+	"DTSTART;TZID=Europe/Berlin:20240305T101500",
+	"DTEND;TZID=Europe/Berlin:20240305T114500",
+	"RRULE:FREQ=WEEKLY;COUNT=10",
+	"EXDATE;TZID=Europe/Berlin:20240312T101500,20240319T101500",
+	"END:VEVENT",
+	"BEGIN:VEVENT",
+	"UID:lecture@uni.example",
+	"RECURRENCE-ID;TZID=Europe/Berlin:20240326T101500",
+	"SUMMARY:Organic Chemistry (moved)",
+	"DTSTART;TZID=Europe/Berlin:20240327T101500",
+	"DURATION:PT1H30M",
+	"END:VEVENT",
+	"BEGIN:VEVENT",
+	"UID:exam@uni.example",
+	"SUMMARY:Midterm",
+	`DTSTART;TZID="W. Europe Standard Time":20240410T090000`,
+	"DTEND;TZID=/mozilla.org/20050126_1/Europe/Berlin:20240410T110000",
+	"LOCATION:Hall A\\; Building 3",
+	"END:VEVENT",
+	"BEGIN:VEVENT",
+	"UID:office-hour@uni.example",
+	"SUMMARY:Office hour",
+	"DTSTART;TZID=Campus Time:20240402T140000",
+	"END:VEVENT",
+	"BEGIN:VEVENT",
+	"UID:floating@uni.example",
+	"SUMMARY:Study group",
+	"DTSTART:20240402T080000",
+	"END:VEVENT",
+	"BEGIN:VEVENT",
+	"UID:cancelled@uni.example",
+	"DTSTART:20240402T080000Z",
+	"STATUS:CANCELLED",
+	"END:VEVENT",
+	"BEGIN:VEVENT",
+	"UID:holiday@uni.example",
+	"SUMMARY:Labour Day",
+	"DTSTART;VALUE=DATE:20240501",
+	"END:VEVENT",
+	"BEGIN:VEVENT",
+	"SUMMARY:Event without a start is skipped",
+	"END:VEVENT",
+	"END:VCALENDAR",
+)
+
+func TestParseICS(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	cal, err := ParseICS(semesterICS, time.UTC)
+	if err != nil {
+		t.Fatalf("ParseICS: %v", err)
+	}
+	if cal.Name != "Chemistry" {
+		t.Errorf("Name = %q, want Chemistry", cal.Name)
+	}
+	if len(cal.Events) != 7 {
+		t.Fatalf("parsed %d events, want 7", len(cal.Events))
+	}
+	lecture, moved, exam, office, floating, cancelled, holiday := cal.Events[0], cal.Events[1], cal.Events[2], cal.Events[3], cal.Events[4], cal.Events[5], cal.Events[6]
+
+	t.Run("folded and escaped text", func(t *testing.T) {
+		if lecture.Summary != "Organic Chemistry, Part 1" {
+			t.Errorf("Summary = %q", lecture.Summary)
+		}
+		// Unfolding drops the line break and one whitespace character, keeping the rest
+		if lecture.Description != "Bring your lab coat.\nRoom B12 is on the second floor." {
+			t.Errorf("Description = %q", lecture.Description)
+		}
+		if exam.Location != "Hall A; Building 3" {
+			t.Errorf("Location = %q", exam.Location)
+		}
+		if cancelled.Summary != "Untitled event" || !cancelled.Cancelled {
+			t.Errorf("cancelled event = %q, Cancelled %v", cancelled.Summary, cancelled.Cancelled)
+		}
+	})
+
+	t.Run("recurring series", func(t *testing.T) {
+		if want := time.Date(2024, 3, 5, 10, 15, 0, 0, berlin); !lecture.Start.Equal(want) || lecture.Start.Location().String() != "Europe/Berlin" {
+			t.Errorf("Start = %s, want %s in Europe/Berlin", lecture.Start, want)
+		}
+		if lecture.Duration() != 90*time.Minute {
+			t.Errorf("Duration = %s, want 1h30m", lecture.Duration())
+		}
+		if lecture.Rule == nil || lecture.Rule.Count != 10 || lecture.RRule != "FREQ=WEEKLY;COUNT=10" {
+			t.Fatalf("Rule = %+v, RRule = %q", lecture.Rule, lecture.RRule)
+		}
+		// Both EXDATE values take the property's TZID
+		if len(lecture.ExDates) != 2 || !lecture.ExDates[1].Equal(time.Date(2024, 3, 19, 10, 15, 0, 0, berlin)) {
+			t.Errorf("ExDates = %v", lecture.ExDates)
+		}
+
+		if moved.UID != lecture.UID || moved.RecurrenceID == nil || !moved.RecurrenceID.Equal(time.Date(2024, 3, 26, 10, 15, 0, 0, berlin)) {
+			t.Errorf("override UID %q, RecurrenceID %v", moved.UID, moved.RecurrenceID)
+		}
+		if moved.End == nil || !moved.End.Equal(time.Date(2024, 3, 27, 11, 45, 0, 0, berlin)) {
+			t.Errorf("override End = %v, want DTSTART plus DURATION", moved.End)
+		}
+	})
+
+	t.Run("time zones", func(t *testing.T) {
+		// A quoted Windows zone name and a prefixed IANA name both resolve to Berlin
+		if want := time.Date(2024, 4, 10, 9, 0, 0, 0, berlin); !exam.Start.Equal(want) {
+			t.Errorf("exam Start = %s, want %s", exam.Start, want)
+		}
+		if exam.End == nil || !exam.End.Equal(time.Date(2024, 4, 10, 11, 0, 0, 0, berlin)) {
+			t.Errorf("exam End = %v", exam.End)
+		}
+		// A zone only the file defines uses its VTIMEZONE's standard offset
+		if want := time.Date(2024, 4, 2, 8, 30, 0, 0, time.UTC); !office.Start.Equal(want) {
+			t.Errorf("office hour Start = %s, want %s", office.Start, want)
+		}
+		// Floating times are read in X-WR-TIMEZONE rather than the default zone
+		if want := time.Date(2024, 4, 2, 8, 0, 0, 0, berlin); !floating.Start.Equal(want) {
+			t.Errorf("floating Start = %s, want %s", floating.Start, want)
+		}
+		if want := time.Date(2024, 4, 2, 8, 0, 0, 0, time.UTC); !cancelled.Start.Equal(want) {
+			t.Errorf("UTC Start = %s, want %s", cancelled.Start, want)
+		}
+		if !holiday.AllDay || !holiday.Start.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) || holiday.Duration() != 24*time.Hour {
+			t.Errorf("all-day event: AllDay %v, Start %s, Duration %s", holiday.AllDay, holiday.Start, holiday.Duration())
+		}
+	})
+}
+
+func TestParseICSFloatingTimesUseDefaultZone(t *testing.T) {
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+	cal, err := ParseICS(icsFile(
+		"BEGIN:VCALENDAR",
+		"BEGIN:VEVENT",
+		"UID:a",
+		"DTSTART:20240402T080000",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:b",
+		"DTSTART;TZID=Nowhere/Unknown:20240402T080000",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	), tokyo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An unknown TZID falls back to the default zone too
+	want := time.Date(2024, 4, 2, 8, 0, 0, 0, tokyo)
+	for _, e := range cal.Events {
+		if !e.Start.Equal(want) {
+			t.Errorf("event %s Start = %s, want %s", e.UID, e.Start, want)
+		}
+	}
+}
+
+func TestParseICSRejectsBrokenFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"unterminated", icsFile("BEGIN:VCALENDAR", "BEGIN:VEVENT", "DTSTART:20240101T100000Z", "END:VEVENT"), "unterminated VCALENDAR"},
+		{"mismatched END", icsFile("BEGIN:VCALENDAR", "BEGIN:VEVENT", "END:VCALENDAR"), "unexpected END"},
+		{"no calendar", icsFile("BEGIN:VTODO", "END:VTODO"), "no VCALENDAR"},
+		{"no events", icsFile("BEGIN:VCALENDAR", "BEGIN:VTODO", "SUMMARY:Read chapter 3", "END:VTODO", "END:VCALENDAR"), "no events"},
+		{"not a calendar", []byte("%PDF-1.7"), "no VCALENDAR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseICS(tt.data, time.UTC)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseICSLineQuotedParameters(t *testing.T) {
+	prop, err := parseICSLine(`attendee;CN="Doe; Jane";ROLE=CHAIR:mailto:jane@uni.example`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prop.name != "ATTENDEE" || prop.params["CN"] != "Doe; Jane" || prop.params["ROLE"] != "CHAIR" || prop.value != "mailto:jane@uni.example" {
+		t.Errorf("parsed %+v", prop)
+	}
+	if _, err := parseICSLine("no colon here"); err == nil {
+		t.Error("a line without a value parsed without error")
+	}
+}
+
+func TestParseICSDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"PT1H30M", 90 * time.Minute},
+		{"P1D", 24 * time.Hour},
+		{"P2W", 14 * 24 * time.Hour},
+		{"P1DT12H", 36 * time.Hour},
+		{"PT45S", 45 * time.Second},
+		{"-PT15M", -15 * time.Minute},
+		{"+PT5M", 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got, err := parseICSDuration(tt.value); err != nil || got != tt.want {
+			t.Errorf("parseICSDuration(%q) = %s, %v; want %s", tt.value, got, err, tt.want)
+		}
+	}
+	for _, value := range []string{"1H", "PT1.5H", "P1H", ""} {
+		if _, err := parseICSDuration(value); err == nil {
+			t.Errorf("parseICSDuration(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestUTCOffsets(t *testing.T) {
+	tests := []struct {
+		value   string
+		seconds int
+	}{
+		{"+0000", 0},
+		{"+0530", 5*3600 + 30*60},
+		{"-0800", -8 * 3600},
+		{"+013015", 3600 + 30*60 + 15},
+	}
+	for _, tt := range tests {
+		got, err := parseUTCOffset(tt.value)
+		if err != nil || got != tt.seconds {
+			t.Errorf("parseUTCOffset(%q) = %d, %v; want %d", tt.value, got, err, tt.seconds)
+		}
+		if back := formatUTCOffset(tt.seconds); back != tt.value {
+			t.Errorf("formatUTCOffset(%d) = %q, want %q", tt.seconds, back, tt.value)
+		}
+	}
+	for _, value := range []string{"0530", "+5", "+ab00", "+05300"} {
+		if _, err := parseUTCOffset(value); err == nil {
+			t.Errorf("parseUTCOffset(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestWriteICSLineFoldsAndUnfolds(t *testing.T) {
+	line := "DESCRIPTION:" + strings.Repeat("Prüfungsvorbereitung für Organische Chemie – ", 5)
+
+	var b strings.Builder
+	writeICSLine(&b, line)
+	for i, physical := range strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n") {
+		if len(physical) > 75 {
+			t.Errorf("line of %d octets exceeds 75: %q", len(physical), physical)
+		}
+		if i > 0 && !strings.HasPrefix(physical, " ") {
+			t.Errorf("continuation line does not start with a space: %q", physical)
+		}
+	}
+
+	root, err := parseICSComponents([]byte("BEGIN:VCALENDAR\r\n" + b.String() + "END:VCALENDAR\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := root.children[0].props[0].name + ":" + root.children[0].props[0].value; got != line {
+		t.Errorf("round trip changed the line:\n got %q\nwant %q", got, line)
+	}
+}
+
+func TestWriteVTimezone(t *testing.T) {
+	var b strings.Builder
+	writeVTimezone(&b, mustLoadLocation(t, "Europe/Berlin"), 2024)
+	out := b.String()
+	for _, want := range []string{
+		"TZID:Europe/Berlin\r\n",
+		// Clocks go forward at 02:00 CET on the last Sunday of March...
+		"BEGIN:DAYLIGHT\r\nDTSTART:20240331T020000\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0200\r\nTZNAME:CEST\r\nRRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU\r\nEND:DAYLIGHT",
+		// ...and back at 03:00 CEST on the last Sunday of October
+		"BEGIN:STANDARD\r\nDTSTART:20241027T030000\r\nTZOFFSETFROM:+0200\r\nTZOFFSETTO:+0100\r\nTZNAME:CET\r\nRRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU\r\nEND:STANDARD",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("VTIMEZONE lacks %q:\n%s", want, out)
+		}
+	}
+
+	b.Reset()
+	writeVTimezone(&b, mustLoadLocation(t, "Asia/Kolkata"), 2024)
+	if out := b.String(); strings.Contains(out, "DAYLIGHT") || strings.Contains(out, "RRULE") || !strings.Contains(out, "TZOFFSETTO:+0530") {
+		t.Errorf("zone without DST written as:\n%s", out)
+	}
+}
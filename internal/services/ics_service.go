@@ -0,0 +1,504 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DetectedFeedMinConfidence is the confidence a pending detection needs to appear in a calendar
+// export as a tentative event
+const DetectedFeedMinConfidence = 0.8
+
+const (
+	icsTimeFormat = "20060102T150405Z"
+	icsDateFormat = "20060102"
+)
+
+// CalendarEvents loads what a user's calendar export shows: every confirmed event and,
+// optionally, pending detections with a start time and high confidence
+func CalendarEvents(userID uuid.UUID, includeDetected bool) ([]models.Event, []models.DetectedEvent, error) {
+	var events []models.Event
+	// Ordering by ID as well keeps ties in a stable order, and with it the ETag
+	if err := config.DB.Where("user_id = ?", userID).Order("start_time ASC, id ASC").Find(&events).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var detected []models.DetectedEvent
+	if includeDetected {
+		err := config.DB.Where("user_id = ? AND status = ? AND start_time IS NOT NULL AND confidence >= ?",
+			userID, models.DetectedEventPending, DetectedFeedMinConfidence).
+			Order("start_time ASC, id ASC").Find(&detected).Error
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return events, detected, nil
+}
+
+// RenderICS writes events as an RFC 5545 calendar. Output only depends on the rows passed in,
+// so an unchanged calendar always renders to the same bytes and the same ETag.
+func RenderICS(calendarName string, events []models.Event, detected []models.DetectedEvent) ([]byte, error) {
+	// Accepted events quote the text they were detected from
+	sourceText := map[uuid.UUID]string{}
+	var sourceIDs []uuid.UUID
+	for _, e := range events {
+		if e.SourceID != nil {
+			sourceIDs = append(sourceIDs, *e.SourceID)
+		}
+	}
+	if len(sourceIDs) > 0 {
+		var sources []models.DetectedEvent
+		if err := config.DB.Select("id", "source_text").Where("id IN ?", sourceIDs).Find(&sources).Error; err != nil {
+			return nil, err
+		}
+		for _, s := range sources {
+			sourceText[s.ID] = s.SourceText
+		}
+	}
+
+	var vevents []icsEvent
+	for _, e := range events {
+		quote := ""
+		if e.SourceID != nil {
+			quote = sourceText[*e.SourceID]
+		}
+		vevents = append(vevents, icsEvent{
+			uid:         "event-" + e.ID.String() + "@dory",
+			stamp:       e.UpdatedAt,
+			title:       e.Title,
+			start:       e.StartTime,
+			end:         e.EndTime,
+			location:    e.Location,
+			allDay:      e.AllDay,
+			rrule:       e.RRule,
+			exdates:     e.ExDates,
+			zone:        seriesZone(e),
+			description: quotedSource(quote),
+			status:      "CONFIRMED",
+		})
+	}
+
+	for _, d := range detected {
+		vevents = append(vevents, icsEvent{
+			uid:         "detected-" + d.ID.String() + "@dory",
+			stamp:       d.DetectedAt,
+			title:       d.Title,
+			start:       *d.StartTime,
+			end:         d.EndTime,
+			location:    d.Location,
+			allDay:      d.AllDay,
+			rrule:       d.RRule,
+			exdates:     d.ExDates,
+			zone:        seriesZone(models.Event{AllDay: d.AllDay, RRule: d.RRule, TimeZone: d.TimeZone}),
+			description: quotedSource(d.SourceText),
+			status:      "TENTATIVE",
+		})
+	}
+
+	var b strings.Builder
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//Dory//Dory Calendar//EN")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "METHOD:PUBLISH")
+	writeICSLine(&b, "X-WR-CALNAME:"+escapeICSText(calendarName))
+
+	// Each zone is described once, from the year its earliest series starts
+	zones := map[string]*time.Location{}
+	firstYear := map[string]int{}
+	for _, e := range vevents {
+		if e.zone == nil {
+			continue
+		}
+		name := e.zone.String()
+		year := e.start.In(e.zone).Year()
+		if y, ok := firstYear[name]; !ok || year < y {
+			firstYear[name] = year
+		}
+		zones[name] = e.zone
+	}
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeVTimezone(&b, zones[name], firstYear[name])
+	}
+
+	for _, e := range vevents {
+		writeVEvent(&b, e)
+	}
+
+	writeICSLine(&b, "END:VCALENDAR")
+	return []byte(b.String()), nil
+}
+
+// CalendarETag is a strong validator over the rendered calendar
+func CalendarETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+type icsEvent struct {
+	uid      string
+	stamp    time.Time
+	title    string
+	start    time.Time
+	end      *time.Time
+	location *string
+	allDay   bool
+	rrule    string
+	exdates  []time.Time
+	// zone is set for recurring events whose times are written as wall-clock times with a
+	// TZID, so occurrences keep their local time across DST changes
+	zone        *time.Location
+	description string
+	status      string
+}
+
+// seriesZone is the zone a recurring event is exported in, or nil to write UTC times
+func seriesZone(e models.Event) *time.Location {
+	if e.RRule == "" || e.AllDay || zoneName(EventLocation(e)) == "" {
+		return nil
+	}
+	return EventLocation(e)
+}
+
+// icsTimeValue formats a DTSTART, DTEND or EXDATE property in the event's form
+func (e icsEvent) icsTimeValue(name string, times ...time.Time) string {
+	values := make([]string, len(times))
+	for i, t := range times {
+		switch {
+		case e.allDay:
+			values[i] = t.UTC().Format(icsDateFormat)
+		case e.zone != nil:
+			values[i] = t.In(e.zone).Format("20060102T150405")
+		default:
+			values[i] = t.UTC().Format(icsTimeFormat)
+		}
+	}
+
+	switch {
+	case e.allDay:
+		name += ";VALUE=DATE"
+	case e.zone != nil:
+		name += ";TZID=" + e.zone.String()
+	}
+	return name + ":" + strings.Join(values, ",")
+}
+
+func writeVEvent(b *strings.Builder, e icsEvent) {
+	writeICSLine(b, "BEGIN:VEVENT")
+	writeICSLine(b, "UID:"+e.uid)
+	writeICSLine(b, "DTSTAMP:"+e.stamp.UTC().Format(icsTimeFormat))
+	writeICSLine(b, e.icsTimeValue("DTSTART", e.start))
+	if e.end != nil && e.end.After(e.start) {
+		writeICSLine(b, e.icsTimeValue("DTEND", *e.end))
+	}
+	if e.rrule != "" {
+		writeICSLine(b, "RRULE:"+e.rrule)
+		if len(e.exdates) > 0 {
+			writeICSLine(b, e.icsTimeValue("EXDATE", e.exdates...))
+		}
+	}
+	writeICSLine(b, "SUMMARY:"+escapeICSText(e.title))
+	if e.location != nil && *e.location != "" {
+		writeICSLine(b, "LOCATION:"+escapeICSText(*e.location))
+	}
+	if e.description != "" {
+		writeICSLine(b, "DESCRIPTION:"+escapeICSText(e.description))
+	}
+	writeICSLine(b, "STATUS:"+e.status)
+	writeICSLine(b, "END:VEVENT")
+}
+
+func quotedSource(text string) string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ""
+	}
+	return "From your notes: “" + text + "”"
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+func escapeICSText(s string) string {
+	return icsEscaper.Replace(s)
+}
+
+// writeICSLine folds content lines longer than 75 octets without splitting a UTF-8 sequence
+func writeICSLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// Continuation lines lose one octet to the leading space
+		limit = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+const icsUpsertBatchSize = 500
+
+// ImportICSEvents turns a parsed calendar file into confirmed events owned by the document.
+// A recurring series is stored once with its rule; instances the file moves or edits become
+// events of their own and are skipped in the series. Events are keyed by UID, plus the
+// original start for single instances, so importing an updated export of the same calendar
+// updates events instead of duplicating them.
+func ImportICSEvents(userID uuid.UUID, docID uuid.UUID, cal *ICSCalendar) ([]models.Event, error) {
+	var order []string
+	masters := map[string]ICSEvent{}
+	overrides := map[string]map[int64]ICSEvent{}
+	for _, e := range cal.Events {
+		uid := e.UID
+		if uid == "" {
+			// Without a UID, title and start are the best identity available
+			sum := sha256.Sum256([]byte(e.Summary + "|" + e.Start.UTC().Format(icsTimeFormat)))
+			uid = "ics-" + hex.EncodeToString(sum[:8])
+		}
+		if e.RecurrenceID != nil {
+			if overrides[uid] == nil {
+				overrides[uid] = map[int64]ICSEvent{}
+			}
+			overrides[uid][e.RecurrenceID.Unix()] = e
+			continue
+		}
+		if _, seen := masters[uid]; !seen {
+			order = append(order, uid)
+		}
+		masters[uid] = e
+	}
+
+	var events []models.Event
+	var cancelled []string
+	// UIDs of series whose moved instances and RDATEs are stored as uid/<start> events
+	var seriesUIDs []string
+	for _, uid := range order {
+		master := masters[uid]
+		if master.Cancelled {
+			cancelled = append(cancelled, uid)
+			seriesUIDs = append(seriesUIDs, uid)
+			continue
+		}
+		if master.Rule != nil || len(master.RDates) > 0 {
+			seriesUIDs = append(seriesUIDs, uid)
+		}
+
+		event := importedEvent(userID, docID, uid, master, master.Start)
+		if master.Rule != nil {
+			event.RRule = master.RRule
+			event.TimeZone = zoneName(master.Start.Location())
+			event.ExDates = append(event.ExDates, master.ExDates...)
+			for original := range overrides[uid] {
+				event.ExDates = append(event.ExDates, time.Unix(original, 0))
+			}
+			sort.Slice(event.ExDates, func(i, j int) bool { return event.ExDates[i].Before(event.ExDates[j]) })
+			if err := PrepareEventRecurrence(&event); err != nil {
+				// The rule parsed when the file was read, so this only guards odd zones
+				event.RRule, event.ExDates, event.TimeZone = "", nil, ""
+			}
+		} else if o, ok := overrides[uid][master.Start.Unix()]; ok {
+			// A single event edited through RECURRENCE-ID
+			delete(overrides[uid], master.Start.Unix())
+			if o.Cancelled {
+				cancelled = append(cancelled, uid)
+				continue
+			}
+			event = importedEvent(userID, docID, uid, o, o.Start)
+		}
+		events = append(events, event)
+
+		// RDATEs add occurrences outside the rule; those overridden are added below
+		for _, rd := range master.RDates {
+			if _, overridden := overrides[uid][rd.Unix()]; overridden || containsTime(master.ExDates, rd) {
+				continue
+			}
+			events = append(events, importedEvent(userID, docID, icsInstanceKey(uid, rd), master, rd))
+		}
+	}
+
+	for uid, byStart := range overrides {
+		if master, ok := masters[uid]; ok && master.Cancelled {
+			continue
+		}
+		for original, o := range byStart {
+			key := icsInstanceKey(uid, time.Unix(original, 0))
+			if o.Cancelled {
+				cancelled = append(cancelled, key)
+				continue
+			}
+			events = append(events, importedEvent(userID, docID, key, o, o.Start))
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		if !events[i].StartTime.Equal(events[j].StartTime) {
+			return events[i].StartTime.Before(events[j].StartTime)
+		}
+		return events[i].ExternalUID < events[j].ExternalUID
+	})
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if len(cancelled) > 0 {
+			var ids []uuid.UUID
+			if err := tx.Model(&models.Event{}).Where("user_id = ? AND external_uid IN ?", userID, cancelled).
+				Pluck("id", &ids).Error; err != nil {
+				return err
+			}
+			if err := DeleteEvents(tx, ids); err != nil {
+				return err
+			}
+		}
+
+		// A moved instance or RDATE dropped from an updated export, or belonging to a series
+		// now cancelled, is removed along with its reminders
+		for _, uid := range seriesUIDs {
+			var keep []string
+			for _, e := range events {
+				if strings.HasPrefix(e.ExternalUID, uid+"/") {
+					keep = append(keep, e.ExternalUID)
+				}
+			}
+			query := tx.Where("user_id = ? AND external_uid LIKE ?", userID, likeEscaper.Replace(uid)+"/%")
+			if len(keep) > 0 {
+				query = query.Where("external_uid NOT IN ?", keep)
+			}
+			var ids []uuid.UUID
+			if err := query.Model(&models.Event{}).Pluck("id", &ids).Error; err != nil {
+				return err
+			}
+			if err := DeleteEvents(tx, ids); err != nil {
+				return err
+			}
+		}
+
+		for batchStart := 0; batchStart < len(events); batchStart += icsUpsertBatchSize {
+			batch := events[batchStart:min(batchStart+icsUpsertBatchSize, len(events))]
+
+			keys := make([]string, len(batch))
+			for i, e := range batch {
+				keys[i] = e.ExternalUID
+			}
+			var existing []models.Event
+			if err := tx.Select("id", "external_uid", "created_at").
+				Where("user_id = ? AND external_uid IN ?", userID, keys).Find(&existing).Error; err != nil {
+				return err
+			}
+			known := make(map[string]models.Event, len(existing))
+			for _, e := range existing {
+				known[e.ExternalUID] = e
+			}
+
+			var fresh []models.Event
+			for i := range batch {
+				if prev, ok := known[batch[i].ExternalUID]; ok {
+					batch[i].ID = prev.ID
+					batch[i].CreatedAt = prev.CreatedAt
+					err := tx.Model(&batch[i]).
+						Select("title", "start_time", "end_time", "location", "all_day", "document_id",
+							"rrule", "ex_dates", "time_zone", "recurrence_end").
+						Updates(&batch[i]).Error
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				fresh = append(fresh, batch[i])
+			}
+			if len(fresh) > 0 {
+				if err := tx.Create(&fresh).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// icsInstanceKey identifies one occurrence of a series by the start it was scheduled for
+func icsInstanceKey(uid string, start time.Time) string {
+	return uid + "/" + start.UTC().Format(icsTimeFormat)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func importedEvent(userID uuid.UUID, docID uuid.UUID, key string, e ICSEvent, start time.Time) models.Event {
+	event := models.Event{
+		ID:          uuid.New(),
+		UserID:      userID,
+		Title:       e.Summary,
+		StartTime:   start,
+		AllDay:      e.AllDay,
+		DocumentID:  &docID,
+		ExternalUID: key,
+	}
+	if d := e.Duration(); d > 0 {
+		end := start.Add(d)
+		event.EndTime = &end
+	}
+	if e.Location != "" {
+		location := e.Location
+		event.Location = &location
+	}
+	return event
+}
+
+// NewCalendarFeedToken issues a new secret for the user's subscription URL, replacing any
+// previous one. Only a hash is stored, so the token is shown to the user once.
+func NewCalendarFeedToken(userID uuid.UUID) (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	hash := hashFeedToken(token)
+	if err := config.DB.Model(&models.User{}).Where("id = ?", userID).Update("calendar_token_hash", hash).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeCalendarFeedToken disables the user's subscription URL
+func RevokeCalendarFeedToken(userID uuid.UUID) error {
+	return config.DB.Model(&models.User{}).Where("id = ?", userID).Update("calendar_token_hash", nil).Error
+}
+
+// UserByCalendarFeedToken resolves a subscription URL's token to its owner
+func UserByCalendarFeedToken(token string) (models.User, error) {
+	var user models.User
+	if token == "" {
+		return user, fmt.Errorf("empty feed token")
+	}
+	err := config.DB.Where("calendar_token_hash = ?", hashFeedToken(token)).First(&user).Error
+	return user, err
+}
+
+func hashFeedToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var icsWeekdayNames = [...]string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// writeVTimezone describes loc so clients can place TZID times without their own copy of the
+// zone database. Offsets come from the given year; when the zone switches to and from DST
+// that year, each switch is repeated yearly on the same weekday of its month, which is how
+// DST rules are defined.
+func writeVTimezone(b *strings.Builder, loc *time.Location, year int) {
+	start := time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+	end := start.AddDate(1, 0, 0)
+
+	var transitions []time.Time
+	for t := start; ; {
+		_, next := t.ZoneBounds()
+		if next.IsZero() || !next.Before(end) {
+			break
+		}
+		transitions = append(transitions, next)
+		t = next
+	}
+
+	writeICSLine(b, "BEGIN:VTIMEZONE")
+	writeICSLine(b, "TZID:"+loc.String())
+	if len(transitions) == 0 {
+		name, offset := start.Zone()
+		writeObservance(b, "STANDARD", start.Format("20060102T150405"), offset, offset, name, "")
+	}
+	for _, t := range transitions {
+		_, fromOffset := t.Add(-time.Second).Zone()
+		name, toOffset := t.Zone()
+		kind := "STANDARD"
+		if t.IsDST() {
+			kind = "DAYLIGHT"
+		}
+
+		// DTSTART is the wall-clock time of the switch, read in the offset being left
+		local := t.In(time.FixedZone("", fromOffset))
+		rule := ""
+		if len(transitions) == 2 {
+			rule = fmt.Sprintf("FREQ=YEARLY;BYMONTH=%d;BYDAY=%s", local.Month(), monthWeekdayOrdinal(local))
+		}
+		writeObservance(b, kind, local.Format("20060102T150405"), fromOffset, toOffset, name, rule)
+	}
+	writeICSLine(b, "END:VTIMEZONE")
+}
+
+func writeObservance(b *strings.Builder, kind string, dtstart string, from int, to int, name string, rule string) {
+	writeICSLine(b, "BEGIN:"+kind)
+	writeICSLine(b, "DTSTART:"+dtstart)
+	writeICSLine(b, "TZOFFSETFROM:"+formatUTCOffset(from))
+	writeICSLine(b, "TZOFFSETTO:"+formatUTCOffset(to))
+	if name != "" {
+		writeICSLine(b, "TZNAME:"+escapeICSText(name))
+	}
+	if rule != "" {
+		writeICSLine(b, "RRULE:"+rule)
+	}
+	writeICSLine(b, "END:"+kind)
+}
+
+// monthWeekdayOrdinal writes t's day as a BYDAY entry such as 2SU, or -1SU for the last one
+func monthWeekdayOrdinal(t time.Time) string {
+	name := icsWeekdayNames[t.Weekday()]
+	if t.Day()+7 > daysIn(t.Year(), t.Month()) {
+		return "-1" + name
+	}
+	return fmt.Sprintf("%d%s", (t.Day()-1)/7+1, name)
+}
+
+func formatUTCOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	out := fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds/60%60)
+	if s := seconds % 60; s != 0 {
+		out += fmt.Sprintf("%02d", s)
+	}
+	return out
+}
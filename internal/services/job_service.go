@@ -0,0 +1,294 @@
+package services
+
+import (
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	jobPollInterval = 2 * time.Second
+	jobBaseBackoff  = 10 * time.Second
+	jobMaxBackoff   = 30 * time.Minute
+	// A running job's locked_at is refreshed every jobHeartbeatInterval; one that has not
+	// been refreshed for jobLockTimeout belongs to a worker that died mid-run
+	jobHeartbeatInterval = 30 * time.Second
+	jobLockTimeout       = 2 * time.Minute
+	// Detections the model is less sure of than this are not queued for review
+	minDetectionConfidence = 0.6
+)
+
+// permanentJobError marks a failure that retrying cannot fix, so the job is dead-lettered at once
+type permanentJobError struct {
+	err error
+}
+
+func (e permanentJobError) Error() string { return e.err.Error() }
+
+func (e permanentJobError) Unwrap() error { return e.err }
+
+// jobWake lets EnqueueJob nudge an idle worker instead of waiting for the next poll
+var jobWake = make(chan struct{}, 1)
+
+// EnqueueJob persists a job so it survives restarts; workers pick it up as soon as one is free
+func EnqueueJob(userID uuid.UUID, docID uuid.UUID, jobType string) error {
+	job := models.IngestionJob{
+		UserID:      userID,
+		DocumentID:  docID,
+		Type:        jobType,
+		Status:      models.JobStatusPending,
+		MaxAttempts: config.AppConfig.JobMaxAttempts,
+		RunAt:       time.Now(),
+	}
+
+	if err := config.DB.Create(&job).Error; err != nil {
+		return fmt.Errorf("failed to enqueue %s job for doc %s: %v", jobType, docID, err)
+	}
+
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// StartJobWorkers requeues jobs orphaned by a previous process and launches the worker pool
+func StartJobWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	requeueStaleJobs()
+
+	for i := 0; i < workers; i++ {
+		go runJobWorker(i)
+	}
+	log.Printf("Started %d ingestion job workers", workers)
+}
+
+func runJobWorker(id int) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Drain the queue before going back to sleep
+		for {
+			job, err := claimNextJob()
+			if err != nil {
+				if !errors.Is(err, gorm.ErrRecordNotFound) {
+					log.Printf("Job worker %d failed to claim job: %v", id, err)
+				}
+				break
+			}
+			runJob(job)
+		}
+
+		select {
+		case <-ticker.C:
+			requeueStaleJobs()
+		case <-jobWake:
+		}
+	}
+}
+
+// claimNextJob locks the oldest due job so concurrent workers and instances never run it twice
+func claimNextJob() (models.IngestionJob, error) {
+	var job models.IngestionJob
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND run_at <= ?", models.JobStatusPending, time.Now()).
+			Order("run_at ASC").
+			First(&job).Error
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		job.Status = models.JobStatusRunning
+		job.Attempts++
+		job.LockedAt = &now
+		return tx.Model(&job).Updates(map[string]interface{}{
+			"status":    job.Status,
+			"attempts":  job.Attempts,
+			"locked_at": job.LockedAt,
+		}).Error
+	})
+	return job, err
+}
+
+func requeueStaleJobs() {
+	result := config.DB.Model(&models.IngestionJob{}).
+		Where("status = ? AND locked_at < ?", models.JobStatusRunning, time.Now().Add(-jobLockTimeout)).
+		Updates(map[string]interface{}{
+			"status":    models.JobStatusPending,
+			"locked_at": nil,
+			"run_at":    time.Now(),
+		})
+	if result.Error != nil {
+		log.Printf("Failed to requeue stale jobs: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Requeued %d stale ingestion jobs", result.RowsAffected)
+	}
+}
+
+// heartbeatJob refreshes the job's lock until stop is closed, so long jobs are not mistaken
+// for orphans
+func heartbeatJob(jobID uuid.UUID, stop <-chan struct{}) {
+	ticker := time.NewTicker(jobHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := config.DB.Model(&models.IngestionJob{}).
+				Where("id = ? AND status = ?", jobID, models.JobStatusRunning).
+				Update("locked_at", time.Now()).Error
+			if err != nil {
+				log.Printf("Failed to refresh lock of job %s: %v", jobID, err)
+			}
+		}
+	}
+}
+
+func runJob(job models.IngestionJob) {
+	stop := make(chan struct{})
+	go heartbeatJob(job.ID, stop)
+	defer close(stop)
+
+	var err error
+	switch job.Type {
+	case models.JobTypeEmbedDocument:
+		err = embedDocument(job)
+	case models.JobTypeDetectEvents:
+		err = detectDocumentEvents(job)
+	default:
+		err = fmt.Errorf("unknown job type %q", job.Type)
+		job.Attempts = job.MaxAttempts
+	}
+
+	if err == nil {
+		config.DB.Model(&job).Updates(map[string]interface{}{
+			"status":     models.JobStatusSucceeded,
+			"last_error": "",
+			"locked_at":  nil,
+		})
+		return
+	}
+
+	var permanent permanentJobError
+	if errors.Is(err, gorm.ErrRecordNotFound) || errors.As(err, &permanent) {
+		// The document was deleted while the job was queued, or the failure is not transient
+		job.Attempts = job.MaxAttempts
+	}
+
+	if job.Attempts >= job.MaxAttempts {
+		log.Printf("Job %s (%s) for doc %s dead-lettered after %d attempts: %v", job.ID, job.Type, job.DocumentID, job.Attempts, err)
+		config.DB.Model(&job).Updates(map[string]interface{}{
+			"status":     models.JobStatusDead,
+			"last_error": err.Error(),
+			"locked_at":  nil,
+		})
+		if job.Type == models.JobTypeEmbedDocument {
+			config.DB.Model(&models.Document{}).Where("id = ?", job.DocumentID).Update("status", "failed")
+		}
+		return
+	}
+
+	delay := jobBackoff(job.Attempts)
+	log.Printf("Job %s (%s) for doc %s failed on attempt %d, retrying in %s: %v", job.ID, job.Type, job.DocumentID, job.Attempts, delay, err)
+	config.DB.Model(&job).Updates(map[string]interface{}{
+		"status":     models.JobStatusPending,
+		"last_error": err.Error(),
+		"locked_at":  nil,
+		"run_at":     time.Now().Add(delay),
+	})
+}
+
+// jobBackoff doubles the wait after every failed attempt, capped at jobMaxBackoff
+func jobBackoff(attempts int) time.Duration {
+	delay := jobBaseBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= jobMaxBackoff {
+			return jobMaxBackoff
+		}
+	}
+	return delay
+}
+
+func embedDocument(job models.IngestionJob) error {
+	var doc models.Document
+	if err := config.DB.First(&doc, "id = ?", job.DocumentID).Error; err != nil {
+		return err
+	}
+
+	chunker, err := ChunkerForDocument(doc)
+	if err != nil {
+		// Bad settings will not fix themselves on retry
+		return permanentJobError{err}
+	}
+
+	// Point IDs follow the chunk index, so upserting overwrites the earlier vectors in place and
+	// search keeps working while a document is re-chunked; only chunks past the new end are removed
+	chunks := chunker.Chunk(doc.Content)
+	if err := StoreChunksInQdrant(doc, chunks, doc.PageStats); err != nil {
+		return err
+	}
+	if err := DeleteStaleDocumentChunks(doc.UserID.String(), doc.ID.String(), len(chunks)); err != nil {
+		return err
+	}
+
+	config.DB.Model(&doc).Update("status", "ready")
+	log.Printf("Document %s fully processed and embedded", doc.ID)
+
+	// Delete from Cloudinary after processing (since we have the content stored)
+	if doc.PublicID != "" && doc.FileURL != "" {
+		if err := DeleteFromCloudinary(doc.PublicID); err != nil {
+			log.Printf("Cloudinary cleanup failed for doc %s: %v", doc.ID, err)
+		} else {
+			config.DB.Model(&doc).Update("file_url", "")
+		}
+	}
+
+	return nil
+}
+
+func detectDocumentEvents(job models.IngestionJob) error {
+	var doc models.Document
+	if err := config.DB.First(&doc, "id = ?", job.DocumentID).Error; err != nil {
+		return err
+	}
+
+	events, err := DetectEvents(doc.Content, EventContextForDocument(doc))
+	if err != nil {
+		return err
+	}
+
+	var detections []models.DetectedEvent
+	for _, e := range events {
+		if e.Confidence < minDetectionConfidence {
+			continue
+		}
+		detections = append(detections, NewDetectedEvent(doc.UserID, doc.ID, e))
+	}
+	vectors := dedupEmbeddings(config.DB, detections)
+
+	// Insert all or nothing so a retry never leaves duplicates behind
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		for i := range detections {
+			if err := saveDetectedEvent(tx, &detections[i], vectors); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// GeminiChatModel wraps a single long-lived genai client
+type GeminiChatModel struct {
+	client *genai.Client
+	model  string
+}
+
+func NewGeminiChatModel(ctx context.Context, apiKey string, model string) (*GeminiChatModel, error) {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, err
+	}
+	return &GeminiChatModel{client: client, model: model}, nil
+}
+
+// session maps the request onto a chat session whose history holds every turn but the last
+func (g *GeminiChatModel) session(req ChatRequest) (*genai.ChatSession, genai.Part, error) {
+	if len(req.Messages) == 0 {
+		return nil, nil, errors.New("chat request has no messages")
+	}
+
+	model := g.client.GenerativeModel(g.model)
+	if req.System != "" {
+		model.SystemInstruction = genai.NewUserContent(genai.Text(req.System))
+	}
+
+	cs := model.StartChat()
+	for _, m := range req.Messages[:len(req.Messages)-1] {
+		role := "user"
+		if m.Role == RoleAssistant {
+			role = "model"
+		}
+		cs.History = append(cs.History, &genai.Content{Role: role, Parts: []genai.Part{genai.Text(m.Content)}})
+	}
+
+	return cs, genai.Text(req.Messages[len(req.Messages)-1].Content), nil
+}
+
+func (g *GeminiChatModel) Generate(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	cs, last, err := g.session(req)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+
+	resp, err := cs.SendMessage(ctx, last)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+
+	text, finish := geminiText(resp)
+	if text == "" {
+		return ChatResponse{}, errors.New("empty LLM response")
+	}
+
+	return ChatResponse{Text: text, FinishReason: finish, Usage: geminiUsage(resp)}, nil
+}
+
+func (g *GeminiChatModel) Stream(ctx context.Context, req ChatRequest) (<-chan StreamChunk, error) {
+	cs, last, err := g.session(req)
+	if err != nil {
+		return nil, err
+	}
+
+	iter := cs.SendMessageStream(ctx, last)
+	out := make(chan StreamChunk)
+
+	go func() {
+		defer close(out)
+
+		var finish string
+		var usage Usage
+		for {
+			resp, err := iter.Next()
+			if err == iterator.Done {
+				sendChunk(ctx, out, StreamChunk{Done: true, FinishReason: finish, Usage: usage})
+				return
+			}
+			if err != nil {
+				sendChunk(ctx, out, StreamChunk{Err: err})
+				return
+			}
+
+			text, reason := geminiText(resp)
+			if reason != "" {
+				finish = reason
+			}
+			if resp.UsageMetadata != nil {
+				usage = geminiUsage(resp)
+			}
+			if text != "" && !sendChunk(ctx, out, StreamChunk{Text: text}) {
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// geminiText joins the text parts of the first candidate
+func geminiText(resp *genai.GenerateContentResponse) (string, string) {
+	if resp == nil || len(resp.Candidates) == 0 {
+		return "", ""
+	}
+
+	cand := resp.Candidates[0]
+	var finish string
+	switch cand.FinishReason {
+	case genai.FinishReasonUnspecified:
+	case genai.FinishReasonStop:
+		finish = "stop"
+	case genai.FinishReasonMaxTokens:
+		finish = "length"
+	default:
+		finish = strings.ToLower(strings.TrimPrefix(cand.FinishReason.String(), "FinishReason"))
+	}
+	if cand.Content == nil {
+		return "", finish
+	}
+
+	var sb strings.Builder
+	for _, part := range cand.Content.Parts {
+		if t, ok := part.(genai.Text); ok {
+			sb.WriteString(string(t))
+		}
+	}
+	return sb.String(), finish
+}
+
+func geminiUsage(resp *genai.GenerateContentResponse) Usage {
+	if resp.UsageMetadata == nil {
+		return Usage{}
+	}
+	return Usage{
+		PromptTokens:     int(resp.UsageMetadata.PromptTokenCount),
+		CompletionTokens: int(resp.UsageMetadata.CandidatesTokenCount),
+	}
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// OpenAIChatModel talks to any server exposing the OpenAI /v1/chat/completions API
+type OpenAIChatModel struct {
+	// BaseURL includes the version prefix, e.g. https://api.openai.com/v1 or http://localhost:11434/v1
+	BaseURL string
+	APIKey  string
+	Model   string
+	client  *http.Client
+}
+
+func NewOpenAIChatModel(baseURL string, apiKey string, model string) *OpenAIChatModel {
+	return &OpenAIChatModel{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		APIKey:  apiKey,
+		Model:   model,
+		client:  &http.Client{},
+	}
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+func (o *OpenAIChatModel) post(ctx context.Context, req ChatRequest, stream bool) (*http.Response, error) {
+	if o.BaseURL == "" || o.Model == "" {
+		return nil, errors.New("openai chat model requires LLM_BASE_URL and LLM_MODEL")
+	}
+	if len(req.Messages) == 0 {
+		return nil, errors.New("chat request has no messages")
+	}
+
+	messages := make([]openAIMessage, 0, len(req.Messages)+1)
+	if req.System != "" {
+		messages = append(messages, openAIMessage{Role: "system", Content: req.System})
+	}
+	for _, m := range req.Messages {
+		messages = append(messages, openAIMessage{Role: m.Role, Content: m.Content})
+	}
+
+	body := map[string]interface{}{
+		"model":    o.Model,
+		"messages": messages,
+		"stream":   stream,
+	}
+	if stream {
+		body["stream_options"] = map[string]bool{"include_usage": true}
+	}
+	payload, _ := json.Marshal(body)
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", o.BaseURL+"/chat/completions", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if o.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+o.APIKey)
+	}
+
+	resp, err := o.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("chat completions API error: status %d: %s", resp.StatusCode, msg)
+	}
+	return resp, nil
+}
+
+func (o *OpenAIChatModel) Generate(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	resp, err := o.post(ctx, req, false)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Choices []struct {
+			Message      openAIMessage `json:"message"`
+			FinishReason string        `json:"finish_reason"`
+		} `json:"choices"`
+		Usage openAIUsage `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return ChatResponse{}, err
+	}
+	if len(result.Choices) == 0 || result.Choices[0].Message.Content == "" {
+		return ChatResponse{}, errors.New("empty LLM response")
+	}
+
+	return ChatResponse{
+		Text:         result.Choices[0].Message.Content,
+		FinishReason: result.Choices[0].FinishReason,
+		Usage:        Usage(result.Usage),
+	}, nil
+}
+
+func (o *OpenAIChatModel) Stream(ctx context.Context, req ChatRequest) (<-chan StreamChunk, error) {
+	resp, err := o.post(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan StreamChunk)
+	go func() {
+		defer close(out)
+		defer resp.Body.Close()
+
+		var finish string
+		var usage Usage
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			if data == "[DONE]" {
+				sendChunk(ctx, out, StreamChunk{Done: true, FinishReason: finish, Usage: usage})
+				return
+			}
+
+			var event struct {
+				Choices []struct {
+					Delta        openAIMessage `json:"delta"`
+					FinishReason *string       `json:"finish_reason"`
+				} `json:"choices"`
+				Usage *openAIUsage `json:"usage"`
+			}
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				sendChunk(ctx, out, StreamChunk{Err: fmt.Errorf("malformed stream event: %v", err)})
+				return
+			}
+			if event.Usage != nil {
+				usage = Usage(*event.Usage)
+			}
+			if len(event.Choices) == 0 {
+				continue
+			}
+			if event.Choices[0].FinishReason != nil {
+				finish = *event.Choices[0].FinishReason
+			}
+			if text := event.Choices[0].Delta.Content; text != "" {
+				if !sendChunk(ctx, out, StreamChunk{Text: text}) {
+					return
+				}
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			sendChunk(ctx, out, StreamChunk{Err: err})
+			return
+		}
+		// Some local servers close the stream without sending [DONE]
+		sendChunk(ctx, out, StreamChunk{Done: true, FinishReason: finish, Usage: usage})
+	}()
+
+	return out, nil
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// ScriptedChatModel is an in-memory ChatModel for tests and offline development.
+// It replies with Responses in order, repeating the last one once the script runs out,
+// and records every request it receives.
+type ScriptedChatModel struct {
+	mu        sync.Mutex
+	Responses []string
+	// Err, when set, is returned by every call
+	Err      error
+	Requests []ChatRequest
+}
+
+// An empty JSON list is a valid reply to every prompt that expects JSON, such as event
+// detection, so jobs do not fail when nothing is scripted
+const scriptedDefaultResponse = "[]"
+
+func (s *ScriptedChatModel) next(req ChatRequest) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Requests = append(s.Requests, req)
+	if s.Err != nil {
+		return "", s.Err
+	}
+	if len(s.Responses) == 0 {
+		return scriptedDefaultResponse, nil
+	}
+
+	reply := s.Responses[0]
+	if len(s.Responses) > 1 {
+		s.Responses = s.Responses[1:]
+	}
+	return reply, nil
+}
+
+func (s *ScriptedChatModel) Generate(_ context.Context, req ChatRequest) (ChatResponse, error) {
+	reply, err := s.next(req)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	return ChatResponse{Text: reply, FinishReason: "stop", Usage: scriptedUsage(req, reply)}, nil
+}
+
+// Stream emits the scripted reply word by word, keeping the separating whitespace
+func (s *ScriptedChatModel) Stream(ctx context.Context, req ChatRequest) (<-chan StreamChunk, error) {
+	reply, err := s.next(req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan StreamChunk)
+	go func() {
+		defer close(out)
+		for _, token := range strings.SplitAfter(reply, " ") {
+			if !sendChunk(ctx, out, StreamChunk{Text: token}) {
+				return
+			}
+		}
+		sendChunk(ctx, out, StreamChunk{Done: true, FinishReason: "stop", Usage: scriptedUsage(req, reply)})
+	}()
+	return out, nil
+}
+
+func scriptedUsage(req ChatRequest, reply string) Usage {
+	prompt := len(strings.Fields(req.System))
+	for _, m := range req.Messages {
+		prompt += len(strings.Fields(m.Content))
+	}
+	return Usage{PromptTokens: prompt, CompletionTokens: len(strings.Fields(reply))}
+}
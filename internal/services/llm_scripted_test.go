@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestScriptedChatModelRepliesInOrder(t *testing.T) {
+	model := &ScriptedChatModel{Responses: []string{"first", "second"}}
+	ctx := context.Background()
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		resp, err := model.Generate(ctx, ChatRequest{Messages: []ChatMessage{{Role: RoleUser, Content: "hi"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, resp.Text)
+	}
+	if got[0] != "first" || got[1] != "second" || got[2] != "second" {
+		t.Errorf("replies = %q, want first, second, then second repeated", got)
+	}
+	if len(model.Requests) != 3 {
+		t.Errorf("recorded %d requests, want 3", len(model.Requests))
+	}
+}
+
+// Event detection parses the model's reply as a JSON list, so the unscripted default must be one
+func TestScriptedChatModelDefaultIsJSONList(t *testing.T) {
+	resp, err := (&ScriptedChatModel{}).Generate(context.Background(), ChatRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []map[string]interface{}
+	if err := json.Unmarshal([]byte(cleanAIJSON(resp.Text)), &events); err != nil {
+		t.Errorf("default reply %q is not a JSON list: %v", resp.Text, err)
+	}
+}
+
+func TestScriptedChatModelStreamsWords(t *testing.T) {
+	model := &ScriptedChatModel{Responses: []string{"one two three"}}
+	chunks, err := model.Stream(context.Background(), ChatRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := ""
+	var last StreamChunk
+	for chunk := range chunks {
+		text += chunk.Text
+		last = chunk
+	}
+	if text != "one two three" {
+		t.Errorf("streamed %q, want the whole reply", text)
+	}
+	if !last.Done || last.Usage.CompletionTokens != 3 {
+		t.Errorf("last chunk = %+v, want Done with 3 completion tokens", last)
+	}
+}
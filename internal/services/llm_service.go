@@ -0,0 +1,106 @@
+package services
+
+import (
+	"context"
+	"dory-backend/internal/config"
+	"log"
+	"strings"
+)
+
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// ChatMessage is one turn of a conversation in provider-neutral form
+type ChatMessage struct {
+	Role    string
+	Content string
+}
+
+// ChatRequest carries an optional system instruction and the turns to send, oldest first.
+// The last message is the one the model answers.
+type ChatRequest struct {
+	System   string
+	Messages []ChatMessage
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+type ChatResponse struct {
+	Text         string
+	FinishReason string
+	Usage        Usage
+}
+
+// StreamChunk is a single item from ChatModel.Stream. Text carries a token delta; the final
+// chunk has Done set along with the finish reason and usage. Err ends the stream early.
+type StreamChunk struct {
+	Text         string
+	Done         bool
+	FinishReason string
+	Usage        Usage
+	Err          error
+}
+
+// ChatModel is a text generation backend. Stream closes its channel after a Done or Err chunk,
+// or when ctx is cancelled.
+type ChatModel interface {
+	Generate(ctx context.Context, req ChatRequest) (ChatResponse, error)
+	Stream(ctx context.Context, req ChatRequest) (<-chan StreamChunk, error)
+}
+
+const defaultGeminiModel = "gemini-2.5-flash"
+
+// ActiveChatModel is the provider selected by LLM_PROVIDER in InitChatModel
+var ActiveChatModel ChatModel
+
+// InitChatModel builds the configured chat provider once so clients are reused across requests
+func InitChatModel() {
+	cfg := config.AppConfig
+	modelName := cfg.LLMModel
+
+	switch strings.ToLower(cfg.LLMProvider) {
+	case "", "gemini":
+		if modelName == "" {
+			modelName = defaultGeminiModel
+		}
+		model, err := NewGeminiChatModel(context.Background(), cfg.GeminiKey, modelName)
+		if err != nil {
+			log.Fatalf("Failed to create Gemini client: %v", err)
+		}
+		ActiveChatModel = model
+	case "openai":
+		ActiveChatModel = NewOpenAIChatModel(cfg.LLMBaseURL, cfg.LLMAPIKey, cfg.LLMModel)
+	case "scripted":
+		ActiveChatModel = &ScriptedChatModel{}
+	default:
+		log.Fatalf("Unknown LLM_PROVIDER %q (expected gemini, openai or scripted)", cfg.LLMProvider)
+	}
+
+	log.Printf("Chat model provider %q initialized with model %q", cfg.LLMProvider, modelName)
+}
+
+// generateText is a convenience for single-prompt calls such as extraction
+func generateText(ctx context.Context, prompt string) (string, error) {
+	resp, err := ActiveChatModel.Generate(ctx, ChatRequest{
+		Messages: []ChatMessage{{Role: RoleUser, Content: prompt}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.Text, nil
+}
+
+// sendChunk delivers a chunk unless the consumer has gone away
+func sendChunk(ctx context.Context, out chan<- StreamChunk, chunk StreamChunk) bool {
+	select {
+	case out <- chunk:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
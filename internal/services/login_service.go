@@ -0,0 +1,502 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	bcryptCost        = 12
+	minPasswordLength = 8
+	// bcrypt ignores everything past 72 bytes
+	maxPasswordLength = 72
+	// At most this many login links are sent to one address per hour
+	maxLoginLinksPerHour = 5
+	// Verification links live longer than login links since they are not a way in
+	verifyLinkTTL    = 48 * time.Hour
+	loginMailTimeout = 30 * time.Second
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrInvalidEmail       = errors.New("invalid email address")
+	ErrInvalidPassword    = fmt.Errorf("password must be %d to %d bytes long", minPasswordLength, maxPasswordLength)
+	ErrEmailTaken         = errors.New("an account with this email already exists")
+	ErrInvalidLoginToken  = errors.New("invalid or expired login link")
+	ErrAccountNotLinkable = errors.New("an account with this email exists; sign in to it and link this identity from there")
+	ErrIdentityInUse      = errors.New("this identity is linked to another account")
+	ErrLastSignInMethod   = errors.New("this is the only way to sign in to the account; set a password or verify the email first")
+	ErrEmailNotVerified   = errors.New("verify the account's email before linking other sign-in methods")
+)
+
+// dummyPasswordHash is compared against when no account matches, so a failed login takes
+// as long whether or not the email is registered
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dory-dummy-password"), bcryptCost)
+
+// NormalizeEmail validates an address and lowercases it, the form emails are stored in
+func NormalizeEmail(email string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || addr.Name != "" || len(addr.Address) > 255 {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// findUserByEmail matches case-insensitively, since accounts created before emails were
+// normalized may be stored with capitals
+func findUserByEmail(tx *gorm.DB, email string) (models.User, error) {
+	var user models.User
+	err := tx.Where("LOWER(email) = ?", email).First(&user).Error
+	return user, err
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return "", ErrInvalidPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	return string(hash), err
+}
+
+// RegisterWithPassword creates an account with an unverified email and mails a link to
+// verify it. Until then identity provider sign-ins are not linked to it by email.
+func RegisterWithPassword(email string, password string, name string) (models.User, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return models.User{}, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	var user models.User
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := findUserByEmail(tx, email); err == nil {
+			return ErrEmailTaken
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		user = models.User{Email: email, Name: strings.TrimSpace(name), PasswordHash: hash}
+		return tx.Create(&user).Error
+	})
+	if err != nil {
+		return models.User{}, err
+	}
+
+	if err := SendVerificationEmail(user); err != nil {
+		log.Printf("Failed to send verification email to user %s: %v", user.ID, err)
+	}
+	return user, nil
+}
+
+// LoginWithPassword checks an email and password, failing the same way for unknown emails,
+// wrong passwords and accounts without a password
+func LoginWithPassword(email string, password string) (models.User, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return models.User{}, ErrInvalidCredentials
+	}
+	user, err := findUserByEmail(config.DB, email)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.User{}, err
+	}
+	if err != nil || user.PasswordHash == "" {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return models.User{}, ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return models.User{}, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// SetPassword sets or changes a user's password. Users that already have one must give it.
+func SetPassword(userID uuid.UUID, current string, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	var user models.User
+	if err := config.DB.First(&user, "id = ?", userID).Error; err != nil {
+		return err
+	}
+	if user.PasswordHash != "" && bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(current)) != nil {
+		return ErrInvalidCredentials
+	}
+	return config.DB.Model(&user).Update("password_hash", hash).Error
+}
+
+func newLoginToken(tx *gorm.DB, email string, userID *uuid.UUID, purpose string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	// Expired and used tokens only matter for the hourly limit
+	if err := tx.Where("email = ? AND expires_at < ? AND created_at < ?", email, time.Now(), time.Now().Add(-time.Hour)).
+		Delete(&models.LoginToken{}).Error; err != nil {
+		return "", err
+	}
+	err := tx.Create(&models.LoginToken{
+		Email:     email,
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: hashRefreshToken(token),
+		ExpiresAt: time.Now().Add(ttl),
+	}).Error
+	return token, err
+}
+
+// tokenLinkURL adds an emailed token to the query of the frontend page that receives it
+func tokenLinkURL(base string, token string) string {
+	if base == "" {
+		return ""
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func sendLoginEmail(email string, name string, subject string, intro string, token string, ttl time.Duration) error {
+	var body strings.Builder
+	body.WriteString(intro + "\n\n")
+	if link := tokenLinkURL(config.AppConfig.MagicLinkURL, token); link != "" {
+		body.WriteString(link + "\n\n")
+		body.WriteString("Or enter this code: " + token + "\n\n")
+	} else {
+		body.WriteString("Your code: " + token + "\n\n")
+	}
+	fmt.Fprintf(&body, "The link expires in %s and works once. If you did not ask for it, ignore this email.\n", ttl.Round(time.Minute))
+
+	ctx, cancel := context.WithTimeout(context.Background(), loginMailTimeout)
+	defer cancel()
+	return ActiveMailer.Send(ctx, Email{
+		To:        email,
+		ToName:    name,
+		Subject:   subject,
+		Body:      body.String(),
+		MessageID: newMessageID("login"),
+	})
+}
+
+// SendMagicLink mails a single-use login link. Nothing tells the caller whether the address
+// has an account or was rate limited, and the mail goes out in the background so the
+// response time does not either.
+func SendMagicLink(email string) error {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		var recent int64
+		if err := config.DB.Model(&models.LoginToken{}).
+			Where("email = ? AND created_at > ?", email, time.Now().Add(-time.Hour)).
+			Count(&recent).Error; err != nil {
+			log.Printf("Magic link for %s not sent: %v", email, err)
+			return
+		}
+		if recent >= maxLoginLinksPerHour {
+			log.Printf("Magic link for %s not sent: rate limited", email)
+			return
+		}
+		name := ""
+		if user, err := findUserByEmail(config.DB, email); err == nil {
+			name = user.Name
+		}
+
+		ttl := config.AppConfig.MagicLinkTTL
+		token, err := newLoginToken(config.DB, email, nil, models.LoginTokenLogin, ttl)
+		if err != nil {
+			log.Printf("Magic link for %s not sent: %v", email, err)
+			return
+		}
+		if err := sendLoginEmail(email, name, "Your Dory login link", "Use this link to log in to Dory:", token, ttl); err != nil {
+			log.Printf("Failed to send magic link to %s: %v", email, err)
+		}
+	}()
+	return nil
+}
+
+// SendVerificationEmail mails a link that verifies the user's address
+func SendVerificationEmail(user models.User) error {
+	token, err := newLoginToken(config.DB, user.Email, &user.ID, models.LoginTokenVerify, verifyLinkTTL)
+	if err != nil {
+		return err
+	}
+	return sendLoginEmail(user.Email, user.Name, "Verify your Dory email address",
+		"Use this link to verify your email address and log in to Dory:", token, verifyLinkTTL)
+}
+
+// RedeemLoginToken consumes an emailed token and returns the user it signs in. Login tokens
+// create the account if there is none. Either kind proves ownership of the address, so the
+// account is marked verified; a login link used on an unverified account also drops what
+// whoever registered it may have set up, see claimAccount.
+func RedeemLoginToken(token string) (models.User, error) {
+	var user models.User
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		var login models.LoginToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashRefreshToken(strings.TrimSpace(token)), now).
+			First(&login).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidLoginToken
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&login).Update("used_at", now).Error; err != nil {
+			return err
+		}
+
+		switch {
+		case login.UserID != nil:
+			err = tx.First(&user, "id = ?", *login.UserID).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !strings.EqualFold(user.Email, login.Email)) {
+				return ErrInvalidLoginToken
+			}
+		case login.Purpose == models.LoginTokenLogin:
+			user, err = findUserByEmail(tx, login.Email)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				user = models.User{Email: login.Email, EmailVerified: true, EmailVerifiedAt: &now}
+				return tx.Create(&user).Error
+			}
+		default:
+			return ErrInvalidLoginToken
+		}
+		if err != nil {
+			return err
+		}
+
+		if user.EmailVerified {
+			return nil
+		}
+		if login.Purpose == models.LoginTokenLogin {
+			return claimAccount(tx, &user)
+		}
+		return tx.Model(&user).Updates(map[string]interface{}{"email_verified": true, "email_verified_at": now}).Error
+	})
+	if err != nil {
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+// SignInWithIdentity finds the account for a verified identity provider sign-in. An unknown
+// identity is linked by email to an existing account when the provider vouches for the
+// address, and otherwise gets a new account.
+func SignInWithIdentity(id Identity) (models.User, error) {
+	var user models.User
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		var identity models.UserIdentity
+		err := tx.Where("provider = ? AND subject = ?", id.Provider, id.Subject).First(&identity).Error
+		if err == nil {
+			if err := tx.First(&user, "id = ?", identity.UserID).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&identity).Updates(map[string]interface{}{"email": id.Email, "last_login_at": now}).Error; err != nil {
+				return err
+			}
+			return markVerifiedBy(tx, &user, id)
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		identity = models.UserIdentity{Provider: id.Provider, Subject: id.Subject, Email: id.Email, LastLoginAt: &now}
+
+		// Google accounts from before identities carry their subject on the user
+		if id.Provider == models.IdentityProviderGoogle {
+			err := tx.Where("google_id = ?", id.Subject).First(&user).Error
+			if err == nil {
+				identity.UserID = user.ID
+				if err := tx.Create(&identity).Error; err != nil {
+					return err
+				}
+				if err := tx.Model(&user).Update("google_id", nil).Error; err != nil {
+					return err
+				}
+				return markVerifiedBy(tx, &user, id)
+			}
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+		}
+
+		email, err := NormalizeEmail(id.Email)
+		if err != nil {
+			return fmt.Errorf("%w: the identity provider did not share one", ErrInvalidEmail)
+		}
+		user, err = findUserByEmail(tx, email)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			user = models.User{
+				Email:         email,
+				Name:          id.Name,
+				ProfilePhoto:  id.Picture,
+				EmailVerified: id.EmailVerified,
+			}
+			if id.EmailVerified {
+				user.EmailVerifiedAt = &now
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			identity.UserID = user.ID
+			return tx.Create(&identity).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		if !id.EmailVerified {
+			return ErrAccountNotLinkable
+		}
+		// A second account at the same provider is more likely a mix-up than the same person
+		var sameProvider int64
+		if err := tx.Model(&models.UserIdentity{}).Where("user_id = ? AND provider = ?", user.ID, id.Provider).
+			Count(&sameProvider).Error; err != nil {
+			return err
+		}
+		if sameProvider > 0 || (id.Provider == models.IdentityProviderGoogle && user.GoogleID != nil) {
+			return ErrAccountNotLinkable
+		}
+		// Claiming first so the identity proving ownership is not dropped with those set up before
+		if err := claimAccount(tx, &user); err != nil {
+			return err
+		}
+		identity.UserID = user.ID
+		return tx.Create(&identity).Error
+	})
+	if err != nil {
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+// markVerifiedBy verifies the user's email when a provider of theirs vouches for it
+func markVerifiedBy(tx *gorm.DB, user *models.User, id Identity) error {
+	if user.EmailVerified || !id.EmailVerified || !strings.EqualFold(user.Email, id.Email) {
+		return nil
+	}
+	return tx.Model(user).Updates(map[string]interface{}{"email_verified": true, "email_verified_at": time.Now()}).Error
+}
+
+// LinkIdentity adds an identity provider account to a signed-in user, whatever its email.
+// Accounts whose email is not verified yet may belong to someone else, so they cannot link.
+func LinkIdentity(userID uuid.UUID, id Identity) (models.UserIdentity, error) {
+	var identity models.UserIdentity
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.First(&user, "id = ?", userID).Error; err != nil {
+			return err
+		}
+		if !user.EmailVerified {
+			return ErrEmailNotVerified
+		}
+		err := tx.Where("provider = ? AND subject = ?", id.Provider, id.Subject).First(&identity).Error
+		if err == nil {
+			if identity.UserID != userID {
+				return ErrIdentityInUse
+			}
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if id.Provider == models.IdentityProviderGoogle {
+			var legacy int64
+			if err := tx.Model(&models.User{}).Where("google_id = ? AND id <> ?", id.Subject, userID).Count(&legacy).Error; err != nil {
+				return err
+			}
+			if legacy > 0 {
+				return ErrIdentityInUse
+			}
+		}
+
+		identity = models.UserIdentity{UserID: userID, Provider: id.Provider, Subject: id.Subject, Email: id.Email}
+		if err := tx.Create(&identity).Error; err != nil {
+			return err
+		}
+		return markVerifiedBy(tx, &user, id)
+	})
+	return identity, err
+}
+
+// UnlinkIdentity removes one of the user's identities, unless the account would be left
+// without a way to sign in. Magic links count as one once the email is verified.
+func UnlinkIdentity(userID uuid.UUID, identityID uuid.UUID) error {
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "id = ?", userID).Error; err != nil {
+			return err
+		}
+		var identity models.UserIdentity
+		if err := tx.Where("id = ? AND user_id = ?", identityID, userID).First(&identity).Error; err != nil {
+			return err
+		}
+		var others int64
+		if err := tx.Model(&models.UserIdentity{}).Where("user_id = ? AND id <> ?", userID, identityID).
+			Count(&others).Error; err != nil {
+			return err
+		}
+		if others == 0 && user.PasswordHash == "" && user.GoogleID == nil && !user.EmailVerified {
+			return ErrLastSignInMethod
+		}
+		return tx.Delete(&identity).Error
+	})
+}
+
+// claimAccount marks the user's email verified after its owner proved it through a login
+// link or an identity provider. An account whose email was never verified may have been
+// registered by someone else in advance, so its password is dropped, its sessions ended,
+// the API keys and calendar feed URL it handed out revoked and its identities unlinked.
+func claimAccount(tx *gorm.DB, user *models.User) error {
+	if user.EmailVerified {
+		return nil
+	}
+	// Access tokens carry whole-second iat claims, so the session started right after this
+	// must not fall before the cutoff
+	now := time.Now().Truncate(time.Second)
+	err := tx.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", user.ID).
+		Update("revoked_at", now).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("user_id = ?", user.ID).Delete(&models.APIKey{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("user_id = ?", user.ID).Delete(&models.UserIdentity{}).Error; err != nil {
+		return err
+	}
+	return tx.Model(user).Updates(map[string]interface{}{
+		"email_verified":      true,
+		"email_verified_at":   now,
+		"password_hash":       "",
+		"tokens_valid_after":  now,
+		"calendar_token_hash": nil,
+		"google_id":           nil,
+	}).Error
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"context"
+	"dory-backend/internal/config"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Email is a plain-text message to one recipient
+type Email struct {
+	To     string
+	ToName string
+	// Subject and Body are plain text; MessageID is the local part of the Message-ID header
+	Subject   string
+	Body      string
+	MessageID string
+}
+
+// Mailer sends email. Errors wrapping ErrUndeliverable are not worth retrying.
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// ActiveMailer is the mailer selected by MAILER in InitMailer
+var ActiveMailer Mailer
+
+// InitMailer picks the mailer for login links and email reminders: SMTP when SMTP_HOST is
+// set, otherwise the server log
+func InitMailer() {
+	cfg := config.AppConfig
+
+	provider := strings.ToLower(cfg.Mailer)
+	if provider == "" {
+		provider = "log"
+		if cfg.SMTPHost != "" {
+			provider = "smtp"
+		}
+	}
+
+	switch provider {
+	case "smtp":
+		if cfg.SMTPHost == "" {
+			log.Fatal("MAILER=smtp needs SMTP_HOST")
+		}
+		ActiveMailer = &SMTPMailer{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.SMTPFrom,
+		}
+	case "log":
+		ActiveMailer = LogMailer{}
+	default:
+		log.Fatalf("Unknown MAILER %q (expected smtp or log)", cfg.Mailer)
+	}
+
+	log.Printf("Mailer %q initialized", provider)
+}
+
+// LogMailer writes email to the server log instead of sending it, for local development
+// and end-to-end tests
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, email Email) error {
+	log.Printf("Email to %s: %s\n%s", email.To, email.Subject, email.Body)
+	return nil
+}
+
+func newMessageID(kind string) string {
+	return kind + "-" + uuid.NewString()
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const smtpDialTimeout = 10 * time.Second
+
+// SMTPMailer sends email through an SMTP server. STARTTLS is used when the server offers it
+// and credentials are only sent when configured, so a local stand-in such as MailHog works
+// without either.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPMailer) Send(ctx context.Context, email Email) error {
+	if email.To == "" {
+		return fmt.Errorf("%w: no recipient address", ErrUndeliverable)
+	}
+	from := s.From
+	if from == "" {
+		from = "dory@" + s.Host
+	}
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("%w: invalid SMTP_FROM: %v", ErrUndeliverable, err)
+	}
+	toAddr := &mail.Address{Name: email.ToName, Address: email.To}
+
+	dialer := net.Dialer{Timeout: smtpDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(s.Host, s.Port))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return fmt.Errorf("%w: SMTP authentication failed: %v", ErrUndeliverable, err)
+		}
+	}
+
+	if err := client.Mail(fromAddr.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(toAddr.Address); err != nil {
+		// 5xx replies reject the recipient for good; 4xx ones are worth retrying
+		var reply *textproto.Error
+		if errors.As(err, &reply) && reply.Code >= 500 {
+			return fmt.Errorf("%w: %v", ErrUndeliverable, err)
+		}
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buildEmail(fromAddr, toAddr, email)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// buildEmail renders a plain-text UTF-8 message
+func buildEmail(from *mail.Address, to *mail.Address, email Email) []byte {
+	var msg bytes.Buffer
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to.String())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", email.MessageID, domain)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(strings.ReplaceAll(email.Body, "\n", "\r\n")))
+	qp.Close()
+	msg.WriteString("\r\n")
+	return msg.Bytes()
+}
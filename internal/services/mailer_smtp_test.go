@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer is a minimal SMTP stand-in that accepts one message per connection.
+// rcptReply, when set, is sent in answer to RCPT TO instead of "250 OK".
+type fakeSMTPServer struct {
+	listener  net.Listener
+	rcptReply string
+
+	mu       sync.Mutex
+	commands []string
+	messages [][]byte
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{listener: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) mailer() *SMTPMailer {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &SMTPMailer{Host: host, Port: port, From: "Dory <dory@uni.example>"}
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP fake")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			if s.rcptReply != "" {
+				tp.PrintfLine("%s", s.rcptReply)
+			} else {
+				tp.PrintfLine("250 OK")
+			}
+		case "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, data)
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK queued")
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) received() ([]string, [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...), append([][]byte(nil), s.messages...)
+}
+
+func TestSMTPMailerSendsMessage(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	body := "Your chemistry exam starts in one hour.\nRoom: Hörsaal B12\n" +
+		"A line long enough to be wrapped by quoted-printable encoding, which limits lines to seventy-six characters."
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := server.mailer().Send(ctx, Email{
+		To:        "alice@uni.example",
+		ToName:    "Alice Müller",
+		Subject:   "Reminder: Prüfung Chemie",
+		Body:      body,
+		MessageID: "reminder-123",
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	commands, messages := server.received()
+	if len(messages) != 1 {
+		t.Fatalf("server received %d messages, want 1", len(messages))
+	}
+	joined := strings.Join(commands, "\n")
+	if !strings.Contains(joined, "MAIL FROM:<dory@uni.example>") || !strings.Contains(joined, "RCPT TO:<alice@uni.example>") {
+		t.Errorf("envelope commands = %q", commands)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(messages[0])))
+	if err != nil {
+		t.Fatalf("parsing message: %v", err)
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Address != "dory@uni.example" || from[0].Name != "Dory" {
+		t.Errorf("From = %q (%v)", msg.Header.Get("From"), err)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 1 || to[0].Address != "alice@uni.example" || to[0].Name != "Alice Müller" {
+		t.Errorf("To = %q (%v)", msg.Header.Get("To"), err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Reminder: Prüfung Chemie" {
+		t.Errorf("Subject = %q decoded to %q (%v)", msg.Header.Get("Subject"), subject, err)
+	}
+	if got := msg.Header.Get("Message-ID"); got != "<reminder-123@uni.example>" {
+		t.Errorf("Message-ID = %q, want <reminder-123@uni.example>", got)
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("Date header: %v", err)
+	}
+	if got := msg.Header.Get("Content-Type"); got != "text/plain; charset=UTF-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := msg.Header.Get("Content-Transfer-Encoding"); got != "quoted-printable" {
+		t.Errorf("Content-Transfer-Encoding = %q", got)
+	}
+
+	// ReadDotBytes has already turned the CRLF line endings into LF
+	raw, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(raw), "\n") {
+		if len(line) > 76 {
+			t.Errorf("encoded body line is %d characters long, over the quoted-printable limit", len(line))
+		}
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(string(raw))))
+	if err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+	if got := strings.TrimSuffix(string(decoded), "\n"); got != body {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+}
+
+func TestSMTPMailerRejectedRecipientIsUndeliverable(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.rcptReply = "550 5.1.1 No such user"
+
+	err := server.mailer().Send(context.Background(), Email{To: "nobody@uni.example", Subject: "Hi", Body: "Hi"})
+	if !errors.Is(err, ErrUndeliverable) {
+		t.Fatalf("Send error = %v, want ErrUndeliverable", err)
+	}
+	if _, messages := server.received(); len(messages) != 0 {
+		t.Errorf("server received %d messages after rejecting the recipient", len(messages))
+	}
+}
+
+func TestSMTPMailerTemporaryFailureIsRetryable(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.rcptReply = "451 4.7.1 Try again later"
+
+	err := server.mailer().Send(context.Background(), Email{To: "alice@uni.example", Subject: "Hi", Body: "Hi"})
+	if err == nil {
+		t.Fatal("Send succeeded despite a 451 reply")
+	}
+	if errors.Is(err, ErrUndeliverable) {
+		t.Errorf("Send error = %v, a 4xx reply should be retryable", err)
+	}
+}
+
+func TestSMTPMailerWithoutRecipient(t *testing.T) {
+	err := (&SMTPMailer{Host: "127.0.0.1", Port: "1"}).Send(context.Background(), Email{Subject: "Hi"})
+	if !errors.Is(err, ErrUndeliverable) {
+		t.Errorf("Send error = %v, want ErrUndeliverable", err)
+	}
+}
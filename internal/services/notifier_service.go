@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrUndeliverable marks a notification that retrying cannot deliver, such as a user without
+// an email address or a webhook that rejects the request
+var ErrUndeliverable = errors.New("notification cannot be delivered")
+
+// Notification is a reminder or digest rendered for delivery, with the recipient details each channel
+// needs
+type Notification struct {
+	ReminderID    uuid.UUID
+	UserID        uuid.UUID
+	Email         string
+	Name          string
+	WebhookURL    string
+	WebhookSecret string
+	Subject       string
+	Body          string
+	Event         models.EventOccurrence
+	OffsetMinutes int
+	// Location is the user's time zone, used to show event times
+	Location *time.Location
+	// Digest is set instead of the reminder fields when the notification is a digest
+	Digest *Digest
+}
+
+// Notifier delivers notifications through one channel. Errors wrapping ErrUndeliverable are
+// not retried.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Notifiers maps each configured reminder channel to its Notifier
+var Notifiers = map[string]Notifier{}
+
+// InitNotifiers sets up the reminder channels. Email is only available when mail goes out
+// over SMTP. InitMailer must run first.
+func InitNotifiers() {
+	cfg := config.AppConfig
+
+	Notifiers = map[string]Notifier{
+		models.ReminderChannelLog:     LogNotifier{},
+		models.ReminderChannelWebhook: NewWebhookNotifier(cfg.WebhookAllowPrivate),
+	}
+	// The log mailer would only duplicate the log channel
+	if _, ok := ActiveMailer.(*SMTPMailer); ok {
+		Notifiers[models.ReminderChannelEmail] = &EmailNotifier{Mailer: ActiveMailer}
+	}
+
+	channels := make([]string, 0, len(Notifiers))
+	for name := range Notifiers {
+		channels = append(channels, name)
+	}
+	log.Printf("Reminder channels available: %v", channels)
+}
+
+// EmailNotifier emails reminders and digests through a Mailer
+type EmailNotifier struct {
+	Mailer Mailer
+}
+
+func (e *EmailNotifier) Notify(ctx context.Context, n Notification) error {
+	if n.Email == "" {
+		return fmt.Errorf("%w: user has no email address", ErrUndeliverable)
+	}
+	messageID := "reminder-" + n.ReminderID.String()
+	if n.Digest != nil {
+		messageID = newMessageID("digest")
+	}
+	return e.Mailer.Send(ctx, Email{
+		To:        n.Email,
+		ToName:    n.Name,
+		Subject:   n.Subject,
+		Body:      n.Body,
+		MessageID: messageID,
+	})
+}
+
+// LogNotifier writes reminders to the server log, for development and as a fallback when no
+// other channel is configured
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, n Notification) error {
+	log.Printf("Reminder for user %s: %s", n.UserID, n.Subject)
+	return nil
+}
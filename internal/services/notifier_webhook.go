@@ -0,0 +1,154 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+const webhookTimeout = 10 * time.Second
+
+var errPrivateWebhookAddress = errors.New("webhook address is not public")
+
+// WebhookNotifier POSTs reminders and digests as JSON to the URL in the user's reminder settings. The body
+// is signed with the user's webhook secret in an X-Dory-Signature header as sha256=<hex HMAC>.
+type WebhookNotifier struct {
+	client *http.Client
+}
+
+// NewWebhookNotifier builds a notifier whose client refuses to connect to loopback, private
+// and link-local addresses unless allowPrivate is set, since the URLs come from users
+func NewWebhookNotifier(allowPrivate bool) *WebhookNotifier {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !allowPrivate {
+		dialer.Control = func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+				ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+				return errPrivateWebhookAddress
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return &WebhookNotifier{
+		client: &http.Client{Transport: transport, Timeout: webhookTimeout},
+	}
+}
+
+// Webhook payloads carry a type of "reminder" or "digest"
+type webhookPayload struct {
+	Type          string     `json:"type"`
+	ReminderID    string     `json:"reminder_id"`
+	EventID       string     `json:"event_id"`
+	Title         string     `json:"title"`
+	StartTime     time.Time  `json:"start_time"`
+	EndTime       *time.Time `json:"end_time,omitempty"`
+	Location      *string    `json:"location,omitempty"`
+	AllDay        bool       `json:"all_day"`
+	OffsetMinutes int        `json:"offset_minutes"`
+	Subject       string     `json:"subject"`
+	Body          string     `json:"body"`
+}
+
+type digestWebhookPayload struct {
+	Type    string  `json:"type"`
+	Period  string  `json:"period"`
+	Subject string  `json:"subject"`
+	Body    string  `json:"body"`
+	Digest  *Digest `json:"digest"`
+}
+
+// ValidateWebhookURL checks a URL users save for the webhook channel
+func ValidateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("webhook_url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	if n.WebhookURL == "" {
+		return fmt.Errorf("%w: no webhook URL configured", ErrUndeliverable)
+	}
+	if err := ValidateWebhookURL(n.WebhookURL); err != nil {
+		return fmt.Errorf("%w: %v", ErrUndeliverable, err)
+	}
+
+	var payload interface{} = webhookPayload{
+		Type:          "reminder",
+		ReminderID:    n.ReminderID.String(),
+		EventID:       n.Event.EventID.String(),
+		Title:         n.Event.Title,
+		StartTime:     n.Event.StartTime,
+		EndTime:       n.Event.EndTime,
+		Location:      n.Event.Location,
+		AllDay:        n.Event.AllDay,
+		OffsetMinutes: n.OffsetMinutes,
+		Subject:       n.Subject,
+		Body:          n.Body,
+	}
+	if n.Digest != nil {
+		payload = digestWebhookPayload{
+			Type:    "digest",
+			Period:  n.Digest.Period,
+			Subject: n.Subject,
+			Body:    n.Body,
+			Digest:  n.Digest,
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUndeliverable, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Dory-Reminders/1.0")
+	if n.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(n.WebhookSecret))
+		mac.Write(body)
+		req.Header.Set("X-Dory-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		if errors.Is(err, errPrivateWebhookAddress) {
+			return fmt.Errorf("%w: %v", ErrUndeliverable, err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		return fmt.Errorf("%w: webhook returned %s", ErrUndeliverable, resp.Status)
+	}
+}
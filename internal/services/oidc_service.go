@@ -0,0 +1,451 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	oidcHTTPTimeout = 10 * time.Second
+	// Discovery documents and key sets are refetched this often
+	oidcCacheTTL = time.Hour
+	// A token signed with an unknown kid triggers a refetch at most this often
+	oidcRefetchInterval = time.Minute
+	oidcClockSkew       = time.Minute
+	maxOIDCResponse     = 1 << 20
+	// A sign-in has this long between asking for a nonce and presenting the ID token
+	oidcNonceTTL = 10 * time.Minute
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	ErrInvalidIDToken  = errors.New("invalid ID token")
+)
+
+var oidcProviderIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,49}$`)
+
+// Identity is a verified sign-in at an identity provider
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+}
+
+// OIDCProvider is an OpenID Connect identity provider whose ID tokens are accepted for
+// sign-in. Its endpoints come from issuer discovery and its keys are cached.
+type OIDCProvider struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Issuer string `json:"issuer"`
+	// Audiences are the client IDs tokens may be issued to, e.g. one per app
+	Audiences []string `json:"audiences"`
+	// TrustEmail treats every email the provider asserts as verified, for providers that only
+	// issue addresses they own but leave out the email_verified claim
+	TrustEmail bool `json:"trust_email"`
+
+	client      *http.Client
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+// OIDCProviders are the providers from OIDC_PROVIDERS by ID
+var OIDCProviders = map[string]*OIDCProvider{}
+
+// InitOIDCProviders reads OIDC_PROVIDERS. Discovery happens on first use, so a provider
+// that is down does not keep the server from starting.
+func InitOIDCProviders() error {
+	raw := strings.TrimSpace(config.AppConfig.OIDCProviders)
+	if raw == "" {
+		return nil
+	}
+	var providers []*OIDCProvider
+	if err := json.Unmarshal([]byte(raw), &providers); err != nil {
+		return fmt.Errorf("OIDC_PROVIDERS is not a JSON list of providers: %w", err)
+	}
+
+	for _, p := range providers {
+		if !oidcProviderIDPattern.MatchString(p.ID) || p.ID == models.IdentityProviderGoogle {
+			return fmt.Errorf("OIDC provider ID %q must be lowercase letters, digits, - and _, and not %q", p.ID, models.IdentityProviderGoogle)
+		}
+		if _, dup := OIDCProviders[p.ID]; dup {
+			return fmt.Errorf("OIDC provider %q is configured twice", p.ID)
+		}
+		p.Issuer = strings.TrimRight(p.Issuer, "/")
+		if err := checkIssuerURL(p.Issuer); err != nil {
+			return fmt.Errorf("OIDC provider %q: %w", p.ID, err)
+		}
+		if len(p.Audiences) == 0 {
+			return fmt.Errorf("OIDC provider %q needs at least one audience", p.ID)
+		}
+		if p.Name == "" {
+			p.Name = p.ID
+		}
+		p.client = &http.Client{Timeout: oidcHTTPTimeout}
+		OIDCProviders[p.ID] = p
+		log.Printf("OIDC provider %q (%s) configured", p.ID, p.Issuer)
+	}
+	return nil
+}
+
+// checkIssuerURL requires HTTPS, except on loopback so a local mock issuer can be used
+func checkIssuerURL(issuer string) error {
+	u, err := url.Parse(issuer)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("issuer %q is not a URL", issuer)
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); u.Scheme == "http" && (host == "localhost" || (ip != nil && ip.IsLoopback())) {
+		return nil
+	}
+	return fmt.Errorf("issuer %q must use https", issuer)
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponse)).Decode(out)
+}
+
+// refreshKeys runs discovery and fetches the provider's key set. p.mu must be held.
+func (p *OIDCProvider) refreshKeys(ctx context.Context) error {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return fmt.Errorf("discovery failed: %w", err)
+	}
+	// OpenID Connect Discovery requires the document to name the issuer it was fetched for
+	if strings.TrimRight(discovery.Issuer, "/") != p.Issuer {
+		return fmt.Errorf("discovery names issuer %q, expected %q", discovery.Issuer, p.Issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return errors.New("discovery has no jwks_uri")
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := p.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return fmt.Errorf("fetching keys failed: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, raw := range set.Keys {
+		kid, key, err := parseJWK(raw)
+		if err != nil {
+			// Providers may publish keys for other uses or algorithms we do not verify
+			continue
+		}
+		keys[kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("key set has no usable signing keys")
+	}
+	p.keys = keys
+	p.fetchedAt = time.Now()
+	return nil
+}
+
+// publicKey returns the key for kid, refetching when the cache is old or the kid is unknown
+// because the provider rotated its keys. Fetches are attempted at most once a minute.
+func (p *OIDCProvider) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fresh := time.Since(p.fetchedAt) < oidcCacheTTL
+	key, ok := p.lookupKey(kid)
+	if ok && fresh {
+		return key, nil
+	}
+	if time.Since(p.attemptedAt) >= oidcRefetchInterval {
+		p.attemptedAt = time.Now()
+		if err := p.refreshKeys(ctx); err != nil {
+			// A provider that is briefly down should not stop sign-ins with known keys
+			if !ok {
+				return nil, err
+			}
+			log.Printf("OIDC provider %q: %v; using cached keys", p.ID, err)
+		}
+		key, ok = p.lookupKey(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// lookupKey finds a cached key by kid; tokens without a kid match a provider's only key
+func (p *OIDCProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// parseJWK reads an RSA, EC or Ed25519 signing key from a JSON Web Key
+func parseJWK(raw json.RawMessage) (string, crypto.PublicKey, error) {
+	var jwk struct {
+		KTY string `json:"kty"`
+		KID string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		CRV string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return "", nil, errors.New("not a signing key")
+	}
+	b64 := base64.RawURLEncoding
+	switch jwk.KTY {
+	case "RSA":
+		n, err := b64.DecodeString(jwk.N)
+		if err != nil {
+			return "", nil, err
+		}
+		e, err := b64.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return "", nil, errors.New("invalid RSA exponent")
+		}
+		return jwk.KID, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.CRV {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return "", nil, fmt.Errorf("unsupported curve %q", jwk.CRV)
+		}
+		x, errX := b64.DecodeString(jwk.X)
+		y, errY := b64.DecodeString(jwk.Y)
+		if errX != nil || errY != nil {
+			return "", nil, errors.New("invalid EC point")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return "", nil, errors.New("EC point is not on the curve")
+		}
+		return jwk.KID, key, nil
+	case "OKP":
+		x, err := b64.DecodeString(jwk.X)
+		if err != nil || jwk.CRV != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return "", nil, errors.New("invalid Ed25519 key")
+		}
+		return jwk.KID, ed25519.PublicKey(x), nil
+	default:
+		return "", nil, fmt.Errorf("unsupported key type %q", jwk.KTY)
+	}
+}
+
+// oidcClaims are the ID token claims used for sign-in
+type oidcClaims struct {
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	Name          string      `json:"name"`
+	Picture       string      `json:"picture"`
+	Nonce         string      `json:"nonce"`
+	AZP           string      `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// emailVerified reads email_verified, which some providers send as a string
+func (c oidcClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// VerifyIDToken checks an ID token's signature, issuer, audience and lifetime and, when
+// nonce is given, that the token was issued for it
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, raw string, nonce string) (Identity, error) {
+	var claims oidcClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(oidcClockSkew),
+	)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	matched := ""
+	for _, aud := range claims.Audience {
+		if slices.Contains(p.Audiences, aud) {
+			matched = aud
+			break
+		}
+	}
+	if matched == "" {
+		return Identity{}, fmt.Errorf("%w: not issued to a configured audience", ErrInvalidIDToken)
+	}
+	// A token for several audiences must name the one it was issued to
+	if len(claims.Audience) > 1 && claims.AZP != "" && !slices.Contains(p.Audiences, claims.AZP) {
+		return Identity{}, fmt.Errorf("%w: authorized party %q is not a configured audience", ErrInvalidIDToken, claims.AZP)
+	}
+	if nonce != "" && claims.Nonce != nonce {
+		return Identity{}, fmt.Errorf("%w: nonce does not match", ErrInvalidIDToken)
+	}
+	if claims.Subject == "" {
+		return Identity{}, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+
+	return Identity{
+		Provider:      p.ID,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.Email != "" && (p.TrustEmail || claims.emailVerified()),
+		Name:          claims.Name,
+		Picture:       claims.Picture,
+	}, nil
+}
+
+// VerifyIdentityToken verifies an ID token from a provider by ID, Google included. The token
+// must carry nonce, which must have come from IssueOIDCNonce; it is used up here, so a
+// captured token cannot be replayed.
+func VerifyIdentityToken(ctx context.Context, provider string, raw string, nonce string) (Identity, error) {
+	if nonce == "" {
+		return Identity{}, fmt.Errorf("%w: nonce is required", ErrInvalidIDToken)
+	}
+
+	var identity Identity
+	if provider == models.IdentityProviderGoogle {
+		payload, err := VerfiyGoogleToken(raw)
+		if err != nil || payload == nil {
+			return Identity{}, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+		}
+		if payload.Claims["nonce"] != nonce {
+			return Identity{}, fmt.Errorf("%w: nonce does not match", ErrInvalidIDToken)
+		}
+		identity = GoogleIdentity(payload.Subject, payload.Claims)
+	} else {
+		p, ok := OIDCProviders[provider]
+		if !ok {
+			return Identity{}, ErrUnknownProvider
+		}
+		var err error
+		if identity, err = p.VerifyIDToken(ctx, raw, nonce); err != nil {
+			return Identity{}, err
+		}
+	}
+
+	// Only a verified token uses up its nonce, so a forged one cannot spend it
+	if err := consumeOIDCNonce(nonce); err != nil {
+		return Identity{}, err
+	}
+	return identity, nil
+}
+
+// IssueOIDCNonce hands out a single-use nonce for the client to put in its authorization
+// request; the ID token it gets back is then accepted once, within oidcNonceTTL
+func IssueOIDCNonce() (string, time.Time, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(raw)
+	expiresAt := time.Now().Add(oidcNonceTTL)
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		// Sign-ins that were never finished leave their nonces behind
+		if err := tx.Where("expires_at < ?", time.Now()).Delete(&models.OIDCNonce{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.OIDCNonce{NonceHash: hashRefreshToken(nonce), ExpiresAt: expiresAt}).Error
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return nonce, expiresAt, nil
+}
+
+func consumeOIDCNonce(nonce string) error {
+	result := config.DB.Where("nonce_hash = ? AND expires_at > ?", hashRefreshToken(nonce), time.Now()).
+		Delete(&models.OIDCNonce{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: nonce was not issued, has expired or was already used", ErrInvalidIDToken)
+	}
+	return nil
+}
+
+// GoogleIdentity reads the identity from verified Google ID token claims
+func GoogleIdentity(subject string, claims map[string]interface{}) Identity {
+	email, _ := claims["email"].(string)
+	verified, _ := claims["email_verified"].(bool)
+	name, _ := claims["name"].(string)
+	picture, _ := claims["picture"].(string)
+	return Identity{
+		Provider:      models.IdentityProviderGoogle,
+		Subject:       subject,
+		Email:         email,
+		EmailVerified: verified,
+		Name:          name,
+		Picture:       picture,
+	}
+}
@@ -0,0 +1,408 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testIssuer is an OpenID Connect issuer on an httptest.Server whose discovery document
+// and published keys can be changed between requests
+type testIssuer struct {
+	url string
+
+	mu              sync.Mutex
+	discoveryIssuer string
+	keys            map[string]crypto.Signer
+	jwksFetches     int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	ti := &testIssuer{keys: map[string]crypto.Signer{}}
+	srv := httptest.NewServer(http.HandlerFunc(ti.serveHTTP))
+	t.Cleanup(srv.Close)
+	ti.url = srv.URL
+	ti.discoveryIssuer = srv.URL
+	return ti
+}
+
+func (ti *testIssuer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(map[string]string{"issuer": ti.discoveryIssuer, "jwks_uri": ti.url + "/jwks"})
+	case "/jwks":
+		ti.jwksFetches++
+		b64 := base64.RawURLEncoding
+		var keys []map[string]string
+		for kid, signer := range ti.keys {
+			switch pub := signer.Public().(type) {
+			case *rsa.PublicKey:
+				keys = append(keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig",
+					"n": b64.EncodeToString(pub.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())})
+			case ed25519.PublicKey:
+				keys = append(keys, map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64.EncodeToString(pub)})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ti *testIssuer) publish(kid string, signer crypto.Signer) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.keys[kid] = signer
+}
+
+func (ti *testIssuer) fetches() int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.jwksFetches
+}
+
+// sign issues an ID token with kid. The claims start as a valid token for audience
+// dory-web and are then overridden by extra; nil values remove a claim.
+func (ti *testIssuer) sign(t *testing.T, kid string, extra jwt.MapClaims) string {
+	t.Helper()
+	ti.mu.Lock()
+	signer := ti.keys[kid]
+	ti.mu.Unlock()
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            ti.url,
+		"sub":            "alice-123",
+		"aud":            "dory-web",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"email":          "alice@uni.example",
+		"email_verified": true,
+	}
+	for k, v := range extra {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+
+	method := jwt.SigningMethod(jwt.SigningMethodRS256)
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		method = jwt.SigningMethodEdDSA
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (ti *testIssuer) provider() *OIDCProvider {
+	return &OIDCProvider{
+		ID:        "uni",
+		Name:      "University login",
+		Issuer:    ti.url,
+		Audiences: []string{"dory-web", "dory-ios"},
+		client:    &http.Client{Timeout: oidcHTTPTimeout},
+	}
+}
+
+var (
+	testRSAKeyOnce sync.Once
+	testRSAKey     *rsa.PrivateKey
+)
+
+func rsaTestKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	testRSAKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testRSAKey = key
+	})
+	return testRSAKey
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	ti := newTestIssuer(t)
+	ti.publish("k1", rsaTestKey(t))
+	p := ti.provider()
+
+	id, err := p.VerifyIDToken(context.Background(), ti.sign(t, "k1", jwt.MapClaims{"name": "Alice", "nonce": "n-1"}), "n-1")
+	if err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+	if id.Provider != "uni" || id.Subject != "alice-123" || id.Email != "alice@uni.example" || !id.EmailVerified || id.Name != "Alice" {
+		t.Errorf("identity = %+v", id)
+	}
+
+	// Some providers send email_verified as a string; an absent claim is unverified
+	id, err = p.VerifyIDToken(context.Background(), ti.sign(t, "k1", jwt.MapClaims{"email_verified": "true"}), "")
+	if err != nil || !id.EmailVerified {
+		t.Errorf("string email_verified: verified = %v, err = %v", id.EmailVerified, err)
+	}
+	id, err = p.VerifyIDToken(context.Background(), ti.sign(t, "k1", jwt.MapClaims{"email_verified": nil}), "")
+	if err != nil || id.EmailVerified {
+		t.Errorf("missing email_verified: verified = %v, err = %v", id.EmailVerified, err)
+	}
+
+	// The key set is cached between sign-ins
+	if _, err := p.VerifyIDToken(context.Background(), ti.sign(t, "k1", nil), ""); err != nil {
+		t.Fatal(err)
+	}
+	if ti.fetches() != 1 {
+		t.Errorf("key set fetched %d times, want 1", ti.fetches())
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	ti := newTestIssuer(t)
+	ti.publish("k1", rsaTestKey(t))
+	ti.discoveryIssuer = "https://evil.example"
+
+	_, err := ti.provider().VerifyIDToken(context.Background(), ti.sign(t, "k1", nil), "")
+	if !errors.Is(err, ErrInvalidIDToken) || !strings.Contains(err.Error(), "discovery names issuer") {
+		t.Errorf("err = %v, want a discovery issuer mismatch", err)
+	}
+	if ti.fetches() != 0 {
+		t.Errorf("keys were fetched from a discovery document for another issuer")
+	}
+}
+
+func TestOIDCUnknownKeyRefetch(t *testing.T) {
+	ti := newTestIssuer(t)
+	ti.publish("k1", rsaTestKey(t))
+	p := ti.provider()
+	ctx := context.Background()
+
+	if _, err := p.VerifyIDToken(ctx, ti.sign(t, "k1", nil), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The provider rotates to a new key
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti.publish("k2", newKey)
+	rotated := ti.sign(t, "k2", nil)
+
+	// Within a minute of the last fetch an unknown kid does not hit the provider again
+	if _, err := p.VerifyIDToken(ctx, rotated, ""); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Errorf("err = %v, want an unknown signing key", err)
+	}
+	if ti.fetches() != 1 {
+		t.Errorf("key set fetched %d times within the refetch interval, want 1", ti.fetches())
+	}
+
+	p.attemptedAt = p.attemptedAt.Add(-oidcRefetchInterval)
+	id, err := p.VerifyIDToken(ctx, rotated, "")
+	if err != nil {
+		t.Fatalf("token signed with the rotated key: %v", err)
+	}
+	if id.Subject != "alice-123" || ti.fetches() != 2 {
+		t.Errorf("subject = %q after %d fetches, want alice-123 after 2", id.Subject, ti.fetches())
+	}
+
+	// A kid the provider never published stays unknown after the refetch
+	p.attemptedAt = p.attemptedAt.Add(-oidcRefetchInterval)
+	forged := ti.sign(t, "k1", nil)
+	forged = strings.Replace(forged, strings.SplitN(forged, ".", 2)[0],
+		base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"k9","typ":"JWT"}`)), 1)
+	if _, err := p.VerifyIDToken(ctx, forged, ""); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("unpublished kid: err = %v, want ErrInvalidIDToken", err)
+	}
+}
+
+func TestOIDCAudience(t *testing.T) {
+	ti := newTestIssuer(t)
+	ti.publish("k1", rsaTestKey(t))
+	p := ti.provider()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		ok     bool
+	}{
+		{"other audience", jwt.MapClaims{"aud": "someone-else"}, false},
+		{"second configured audience", jwt.MapClaims{"aud": "dory-ios"}, true},
+		{"several audiences with ours as azp", jwt.MapClaims{"aud": []string{"someone-else", "dory-web"}, "azp": "dory-web"}, true},
+		{"several audiences with a foreign azp", jwt.MapClaims{"aud": []string{"someone-else", "dory-web"}, "azp": "someone-else"}, false},
+		{"no audience", jwt.MapClaims{"aud": nil}, false},
+	}
+	for _, tt := range tests {
+		_, err := p.VerifyIDToken(context.Background(), ti.sign(t, "k1", tt.claims), "")
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("%s: err = %v, want ErrInvalidIDToken", tt.name, err)
+		}
+	}
+}
+
+func TestOIDCNonce(t *testing.T) {
+	ti := newTestIssuer(t)
+	ti.publish("k1", rsaTestKey(t))
+	p := ti.provider()
+
+	if _, err := p.VerifyIDToken(context.Background(), ti.sign(t, "k1", jwt.MapClaims{"nonce": "abc"}), "xyz"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("mismatched nonce: err = %v, want ErrInvalidIDToken", err)
+	}
+	if _, err := p.VerifyIDToken(context.Background(), ti.sign(t, "k1", nil), "xyz"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("token without the expected nonce: err = %v, want ErrInvalidIDToken", err)
+	}
+	if _, err := p.VerifyIDToken(context.Background(), ti.sign(t, "k1", jwt.MapClaims{"nonce": "abc"}), "abc"); err != nil {
+		t.Errorf("matching nonce: %v", err)
+	}
+}
+
+func TestOIDCExpiryAndIssuer(t *testing.T) {
+	ti := newTestIssuer(t)
+	ti.publish("k1", rsaTestKey(t))
+	p := ti.provider()
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		ok     bool
+	}{
+		{"expired", jwt.MapClaims{"iat": now.Add(-2 * time.Hour).Unix(), "exp": now.Add(-10 * time.Minute).Unix()}, false},
+		{"expired within the clock skew", jwt.MapClaims{"exp": now.Add(-30 * time.Second).Unix()}, true},
+		{"without expiry", jwt.MapClaims{"exp": nil}, false},
+		{"issued in the future", jwt.MapClaims{"iat": now.Add(10 * time.Minute).Unix()}, false},
+		{"other issuer", jwt.MapClaims{"iss": "https://evil.example"}, false},
+		{"without subject", jwt.MapClaims{"sub": nil}, false},
+	}
+	for _, tt := range tests {
+		_, err := p.VerifyIDToken(context.Background(), ti.sign(t, "k1", tt.claims), "")
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("%s: err = %v, want ErrInvalidIDToken", tt.name, err)
+		}
+	}
+}
+
+func TestOIDCRejectsSymmetricTokens(t *testing.T) {
+	ti := newTestIssuer(t)
+	ti.publish("k1", rsaTestKey(t))
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": ti.url, "sub": "alice-123", "aud": "dory-web",
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString([]byte("guessable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ti.provider().VerifyIDToken(context.Background(), signed, ""); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("HS256 token: err = %v, want ErrInvalidIDToken", err)
+	}
+}
+
+func TestCheckIssuerURL(t *testing.T) {
+	for issuer, ok := range map[string]bool{
+		"https://login.uni.example": true,
+		"http://127.0.0.1:9000":     true,
+		"http://localhost:9000":     true,
+		"http://login.uni.example":  false,
+		"login.uni.example":         false,
+	} {
+		if err := checkIssuerURL(issuer); (err == nil) != ok {
+			t.Errorf("checkIssuerURL(%q) = %v, want ok = %v", issuer, err, ok)
+		}
+	}
+}
+
+func TestVerifyIdentityTokenUsesUpNonce(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a new database
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&models.OIDCNonce{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ti := newTestIssuer(t)
+	ti.publish("k1", rsaTestKey(t))
+	prevDB, prevProviders := config.DB, OIDCProviders
+	t.Cleanup(func() { config.DB, OIDCProviders = prevDB, prevProviders })
+	config.DB = db
+	OIDCProviders = map[string]*OIDCProvider{"uni": ti.provider()}
+
+	ctx := context.Background()
+	verify := func(claimed, sent string) error {
+		_, err := VerifyIdentityToken(ctx, "uni", ti.sign(t, "k1", jwt.MapClaims{"nonce": claimed}), sent)
+		return err
+	}
+
+	if err := verify("", ""); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("no nonce: err = %v, want ErrInvalidIDToken", err)
+	}
+	if err := verify("made-up", "made-up"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("nonce never issued: err = %v, want ErrInvalidIDToken", err)
+	}
+
+	nonce, _, err := IssueOIDCNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A token for another nonce is rejected without spending this one
+	if err := verify("other", nonce); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("mismatched nonce: err = %v, want ErrInvalidIDToken", err)
+	}
+	if err := verify(nonce, nonce); err != nil {
+		t.Fatalf("issued nonce: %v", err)
+	}
+	if err := verify(nonce, nonce); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("replayed token: err = %v, want ErrInvalidIDToken", err)
+	}
+
+	expired, _, err := IssueOIDCNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&models.OIDCNonce{}).Where("nonce_hash = ?", hashRefreshToken(expired)).Update("expires_at", time.Now().Add(-time.Minute))
+	if err := verify(expired, expired); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("expired nonce: err = %v, want ErrInvalidIDToken", err)
+	}
+}
@@ -0,0 +1,286 @@
+package services
+
+import (
+	"bytes"
+	"dory-backend/internal/models"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// pageSeparator sits between pages in a document's content; the blank line lets the
+// chunker treat a page break like a paragraph break
+const pageSeparator = "\n\n"
+
+// ExtractPDFText extracts text page by page and joins it into a single string, returning
+// where each page starts in that string so chunks can be mapped back to page numbers
+func ExtractPDFText(data []byte) (string, []models.PageStat, error) {
+	if len(data) < 4 || string(data[0:4]) != "%PDF" {
+		return "", nil, fmt.Errorf("invalid PDF file: file does not start with PDF header")
+	}
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create PDF reader: %v", err)
+	}
+
+	fonts := make(map[string]*pdf.Font)
+	var sb strings.Builder
+	var pages []models.PageStat
+	offset := 0
+
+	for i := 1; i <= reader.NumPage(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+
+		text := strings.TrimSpace(extractPageText(page, fonts))
+
+		// Skipped null pages must not leave a separator before the first page's text
+		if sb.Len() > 0 {
+			sb.WriteString(pageSeparator)
+			offset += utf8.RuneCountInString(pageSeparator)
+		}
+		chars := utf8.RuneCountInString(text)
+		pages = append(pages, models.PageStat{Page: i, CharStart: offset, Chars: chars})
+		sb.WriteString(text)
+		offset += chars
+	}
+
+	content := sb.String()
+	if strings.TrimSpace(content) == "" {
+		return "", nil, fmt.Errorf("PDF appears to be empty or text extraction returned no content")
+	}
+
+	return content, pages, nil
+}
+
+var pdfDatePattern = regexp.MustCompile(`^D:(\d{4})(\d{2})?(\d{2})?(\d{2})?(\d{2})?(\d{2})?([Z+-])?(\d{2})?'?(\d{2})?`)
+
+// pdfCreationDate reads CreationDate from the document information dictionary, written as
+// D:YYYYMMDDHHmmSSOHH'mm' with every part after the year optional
+func pdfCreationDate(data []byte) (date *time.Time) {
+	defer func() {
+		if recover() != nil {
+			date = nil
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil
+	}
+	m := pdfDatePattern.FindStringSubmatch(reader.Trailer().Key("Info").Key("CreationDate").RawString())
+	if m == nil {
+		return nil
+	}
+
+	part := func(i int, def int) int {
+		if m[i] == "" {
+			return def
+		}
+		n, _ := strconv.Atoi(m[i])
+		return n
+	}
+	loc := time.UTC
+	if m[7] == "+" || m[7] == "-" {
+		offset := part(8, 0)*3600 + part(9, 0)*60
+		if m[7] == "-" {
+			offset = -offset
+		}
+		loc = time.FixedZone("", offset)
+	}
+	t := time.Date(part(1, 0), time.Month(part(2, 1)), part(3, 1), part(4, 0), part(5, 0), part(6, 0), 0, loc)
+	if t.Year() <= 1970 {
+		return nil
+	}
+	return &t
+}
+
+// extractPageText rebuilds reading order from glyph positions, falling back to the raw
+// content stream order when the page cannot be laid out
+func extractPageText(page pdf.Page, fonts map[string]*pdf.Font) string {
+	if text, err := layoutPageText(page); err == nil && strings.TrimSpace(text) != "" {
+		return text
+	}
+
+	for _, name := range page.Fonts() {
+		if _, ok := fonts[name]; !ok {
+			f := page.Font(name)
+			fonts[name] = &f
+		}
+	}
+	text, err := page.GetPlainText(fonts)
+	if err != nil {
+		return ""
+	}
+	return text
+}
+
+type pdfSegment struct {
+	x0, x1 float64
+	text   string
+}
+
+type pdfLine struct {
+	y        float64
+	size     float64
+	segments []pdfSegment
+}
+
+// layoutPageText groups glyphs into lines by baseline and lines into segments split at wide
+// horizontal gaps. When most lines break at a shared gutter the page is read as two columns,
+// left column first, instead of interleaving them line by line.
+func layoutPageText(page pdf.Page) (result string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = "", fmt.Errorf("layout failed: %v", r)
+		}
+	}()
+
+	glyphs := page.Content().Text
+	if len(glyphs) == 0 {
+		return "", errors.New("no positioned text")
+	}
+
+	sort.SliceStable(glyphs, func(i, j int) bool {
+		if math.Abs(glyphs[i].Y-glyphs[j].Y) > 0.5 {
+			return glyphs[i].Y > glyphs[j].Y
+		}
+		return glyphs[i].X < glyphs[j].X
+	})
+
+	var lines []*pdfLine
+	for _, g := range glyphs {
+		size := g.FontSize
+		if size <= 0 {
+			size = 10
+		}
+
+		var line *pdfLine
+		if n := len(lines); n > 0 && math.Abs(lines[n-1].y-g.Y) < size*0.5 {
+			line = lines[n-1]
+		} else {
+			line = &pdfLine{y: g.Y, size: size}
+			lines = append(lines, line)
+		}
+
+		segs := line.segments
+		if n := len(segs); n > 0 {
+			last := &segs[n-1]
+			gap := g.X - last.x1
+			switch {
+			case gap > size*1.5:
+				// Far enough apart to be a separate column or table cell
+			case gap > size*0.15 && !strings.HasSuffix(last.text, " ") && g.S != " ":
+				last.text += " " + g.S
+				last.x1 = g.X + g.W
+				continue
+			default:
+				last.text += g.S
+				last.x1 = math.Max(last.x1, g.X+g.W)
+				continue
+			}
+		}
+		line.segments = append(segs, pdfSegment{x0: g.X, x1: g.X + g.W, text: g.S})
+	}
+
+	if gutter, ok := findGutter(lines); ok {
+		var left, right []string
+		for _, line := range lines {
+			var l, r []string
+			for _, seg := range line.segments {
+				if seg.x0 < gutter {
+					l = append(l, seg.text)
+				} else {
+					r = append(r, seg.text)
+				}
+			}
+			if len(l) > 0 {
+				left = append(left, strings.Join(l, " "))
+			}
+			if len(r) > 0 {
+				right = append(right, strings.Join(r, " "))
+			}
+		}
+		return strings.Join(left, "\n") + "\n\n" + strings.Join(right, "\n"), nil
+	}
+
+	out := make([]string, 0, len(lines))
+	for i, line := range lines {
+		parts := make([]string, len(line.segments))
+		for j, seg := range line.segments {
+			parts[j] = seg.text
+		}
+		// A vertical gap well beyond normal line spacing marks a new paragraph
+		if i > 0 && lines[i-1].y-line.y > line.size*2 {
+			out = append(out, "")
+		}
+		out = append(out, strings.Join(parts, "\t"))
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// findGutter looks for an x position where at least a third of the multi-segment lines
+// break, which is what a two-column layout looks like
+func findGutter(lines []*pdfLine) (float64, bool) {
+	var breaks []float64
+	multi := 0
+	for _, line := range lines {
+		if len(line.segments) < 2 {
+			continue
+		}
+		multi++
+		for i := 1; i < len(line.segments); i++ {
+			breaks = append(breaks, line.segments[i].x0)
+		}
+	}
+	if multi < 5 || multi*3 < len(lines) {
+		return 0, false
+	}
+
+	sort.Float64s(breaks)
+	median := breaks[len(breaks)/2]
+
+	near := 0
+	for _, b := range breaks {
+		if math.Abs(b-median) < 20 {
+			near++
+		}
+	}
+	if near*3 < len(lines) {
+		return 0, false
+	}
+	// Split just left of where the right column starts
+	return median - 1, true
+}
+
+// pageRange maps a chunk's code point offsets onto the pages it spans
+func pageRange(pages []models.PageStat, start int, end int) (int, int) {
+	if len(pages) == 0 {
+		return 0, 0
+	}
+
+	pageAt := func(offset int) int {
+		i := sort.Search(len(pages), func(i int) bool { return pages[i].CharStart > offset })
+		if i == 0 {
+			return pages[0].Page
+		}
+		return pages[i-1].Page
+	}
+
+	last := end - 1
+	if last < start {
+		last = start
+	}
+	return pageAt(start), pageAt(last)
+}
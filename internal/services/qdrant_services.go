@@ -5,12 +5,14 @@ import (
 	"context"
 	"crypto/md5"
 	"dory-backend/internal/config"
+	"dory-backend/internal/models"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
 
+	"github.com/google/uuid"
 	"github.com/qdrant/go-client/qdrant"
 )
 
@@ -24,9 +26,9 @@ func InitQdrant() {
 
 	QClient, err = qdrant.NewClient(&qdrant.Config{
 		Host:   host,
-		Port:   6334,
+		Port:   config.AppConfig.QdrantPort,
 		APIKey: config.AppConfig.QdrantKey,
-		UseTLS: true,
+		UseTLS: config.AppConfig.QdrantTLS,
 	})
 
 	if err != nil {
@@ -34,31 +36,56 @@ func InitQdrant() {
 	}
 
 	log.Println("Qdrant Client connected successfully to:", host)
+	ActiveSearcher = QdrantSearcher{}
 
 	ctx := context.Background()
 	collectionName := "user_text_embeddings"
 
+	dimension := uint64(ActiveEmbedder.Dimension())
+
 	err = QClient.CreateCollection(ctx, &qdrant.CreateCollection{
 		CollectionName: collectionName,
 		VectorsConfig: qdrant.NewVectorsConfig(&qdrant.VectorParams{
-			Size:     1024,
+			Size:     dimension,
 			Distance: qdrant.Distance_Cosine,
 		}),
 	})
 
 	if err != nil {
 		log.Println("Collection might already exist or: ", err)
+		checkCollectionDimension(ctx, collectionName, dimension)
 	} else {
 		log.Println("Qdrant Collection 'user_text_embeddings' initialized.")
 	}
 
 	// Create index via REST API (more reliable than gRPC enums)
 	createFieldIndexViaREST(host, collectionName, "user_id")
+	createFieldIndexViaREST(host, collectionName, "document_id")
+	createFieldIndexViaREST(host, collectionName, "workspace_id")
 }
 
-// createFieldIndexViaREST uses the REST API to create a keyword index on user_id
+// checkCollectionDimension fails fast when an existing collection was built by a different embedder,
+// since every upsert and query would otherwise be rejected
+func checkCollectionDimension(ctx context.Context, collectionName string, dimension uint64) {
+	info, err := QClient.GetCollectionInfo(ctx, collectionName)
+	if err != nil {
+		log.Println("Could not read collection info: ", err)
+		return
+	}
+
+	existing := info.GetConfig().GetParams().GetVectorsConfig().GetParams().GetSize()
+	if existing != 0 && existing != dimension {
+		log.Fatalf("Qdrant collection '%s' has dimension %d but the embedding provider produces %d; recreate the collection or switch providers", collectionName, existing, dimension)
+	}
+}
+
+// createFieldIndexViaREST uses the REST API to create a keyword index on the given payload field
 func createFieldIndexViaREST(host string, collectionName string, fieldName string) {
-	url := fmt.Sprintf("https://%s:6333/collections/%s/index", host, collectionName)
+	scheme := "https"
+	if !config.AppConfig.QdrantTLS {
+		scheme = "http"
+	}
+	url := fmt.Sprintf("%s://%s:%d/collections/%s/index", scheme, host, config.AppConfig.QdrantRESTPort, collectionName)
 
 	payload := map[string]interface{}{
 		"field_name": fieldName,
@@ -86,14 +113,28 @@ func createFieldIndexViaREST(host string, collectionName string, fieldName strin
 	}
 }
 
-func StoreChunksInQdrant(userID string, docID string, chunks []string) error {
+// StoreChunksInQdrant embeds and upserts chunks; pages, when given, add page_start/page_end to each payload.
+// Chunks of workspace documents also carry workspace_id, which is what searches match them by.
+func StoreChunksInQdrant(doc models.Document, chunks []TextChunk, pages []models.PageStat) error {
+	docID := doc.ID.String()
 	var points []*qdrant.PointStruct
 
-	for i, text := range chunks {
-		vector, err := EmbedText(text)
+	for i, chunk := range chunks {
+		// Embedding the heading breadcrumb with the text helps sections whose body never names its topic
+		embedInput := chunk.Content
+		if len(chunk.Headings) > 0 {
+			embedInput = strings.Join(chunk.Headings, " > ") + "\n\n" + chunk.Content
+		}
+
+		headings := make([]interface{}, len(chunk.Headings))
+		for j, h := range chunk.Headings {
+			headings[j] = h
+		}
+
+		vector, err := EmbedText(embedInput)
 		if err != nil {
-			log.Printf("Embedding failed for chunk %d of doc %s: %v", i, docID, err)
-			continue
+			// Fail the whole document so the job is retried; point IDs are deterministic, so re-upserting is safe
+			return fmt.Errorf("embedding failed for chunk %d of doc %s: %v", i, docID, err)
 		}
 		uniqueID := fmt.Sprintf("%s_%d", docID, i)
 		hash := md5.Sum([]byte(uniqueID))
@@ -101,15 +142,28 @@ func StoreChunksInQdrant(userID string, docID string, chunks []string) error {
 		idNum := uint64(hash[0]) | uint64(hash[1])<<8 | uint64(hash[2])<<16 | uint64(hash[3])<<24 |
 			uint64(hash[4])<<32 | uint64(hash[5])<<40 | uint64(hash[6])<<48 | uint64(hash[7])<<56
 
+		payload := map[string]any{
+			"user_id":     doc.UserID.String(),
+			"document_id": docID,
+			"chunk_index": int64(i),
+			"char_start":  int64(chunk.Start),
+			"char_end":    int64(chunk.End),
+			"headings":    headings,
+			"content":     chunk.Content,
+		}
+		if doc.WorkspaceID != nil {
+			payload["workspace_id"] = doc.WorkspaceID.String()
+		}
+		if len(pages) > 0 {
+			pageStart, pageEnd := pageRange(pages, chunk.Start, chunk.End)
+			payload["page_start"] = int64(pageStart)
+			payload["page_end"] = int64(pageEnd)
+		}
+
 		point := &qdrant.PointStruct{
 			Id:      qdrant.NewIDNum(idNum),
 			Vectors: qdrant.NewVectors(vector...),
-			Payload: qdrant.NewValueMap(map[string]any{
-				"user_id":     userID,
-				"document_id": docID,
-				"chunk_index": int64(i),
-				"content":     text,
-			}),
+			Payload: qdrant.NewValueMap(payload),
 		}
 		points = append(points, point)
 	}
@@ -135,7 +189,60 @@ func boolPtr(b bool) *bool {
 	return &b
 }
 
-func SearchSimilarChunks(userID string, queryText string) ([]string, error) {
+// SearchScope is the set of documents a search covers: the user's personal documents,
+// those of some workspaces, or both
+type SearchScope struct {
+	UserID       uuid.UUID
+	Personal     bool
+	WorkspaceIDs []uuid.UUID
+}
+
+// filter matches the chunks in scope. Personal documents are the user's chunks without a
+// workspace_id, so a member's uploads to a workspace are only found through the workspace.
+func (s SearchScope) filter() *qdrant.Filter {
+	var should []*qdrant.Condition
+	if s.Personal {
+		should = append(should, qdrant.NewFilterAsCondition(&qdrant.Filter{
+			Must: []*qdrant.Condition{
+				qdrant.NewMatch("user_id", s.UserID.String()),
+				qdrant.NewIsEmpty("workspace_id"),
+			},
+		}))
+	}
+	if len(s.WorkspaceIDs) > 0 {
+		ids := make([]string, len(s.WorkspaceIDs))
+		for i, id := range s.WorkspaceIDs {
+			ids[i] = id.String()
+		}
+		should = append(should, qdrant.NewMatchKeywords("workspace_id", ids...))
+	}
+	return &qdrant.Filter{Should: should}
+}
+
+// Empty reports whether the scope covers no documents at all
+func (s SearchScope) Empty() bool {
+	return !s.Personal && len(s.WorkspaceIDs) == 0
+}
+
+// ChunkSearcher finds the chunks most similar to a query among the documents in scope
+type ChunkSearcher interface {
+	SearchChunks(scope SearchScope, query string) ([]models.Source, error)
+}
+
+// ActiveSearcher is the search chat retrieves context with, set by InitQdrant
+var ActiveSearcher ChunkSearcher
+
+// QdrantSearcher searches the chunks stored in Qdrant
+type QdrantSearcher struct{}
+
+func (QdrantSearcher) SearchChunks(scope SearchScope, query string) ([]models.Source, error) {
+	return SearchSimilarChunks(scope, query)
+}
+
+func SearchSimilarChunks(scope SearchScope, queryText string) ([]models.Source, error) {
+	if scope.Empty() {
+		return []models.Source{}, nil
+	}
 	queryVector, err := EmbedText(queryText)
 	if err != nil {
 		return nil, err
@@ -145,27 +252,98 @@ func SearchSimilarChunks(userID string, queryText string) ([]string, error) {
 	searchResponse, err := QClient.Query(ctx, &qdrant.QueryPoints{
 		CollectionName: "user_text_embeddings",
 		Query:          qdrant.NewQuery(queryVector...),
-		Filter: &qdrant.Filter{
-			Must: []*qdrant.Condition{
-				qdrant.NewMatch("user_id", userID),
-			},
-		},
-		Limit:       uint64Ptr(5),
-		WithPayload: qdrant.NewWithPayload(true),
+		Filter:         scope.filter(),
+		Limit:          uint64Ptr(5),
+		WithPayload:    qdrant.NewWithPayload(true),
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	var results []string
+	var results []models.Source
+	var docIDs []string
 	for _, hit := range searchResponse {
-		if content, ok := hit.Payload["content"]; ok {
-			results = append(results, content.GetStringValue())
+		content, ok := hit.Payload["content"]
+		if !ok {
+			continue
+		}
+		docID := hit.Payload["document_id"].GetStringValue()
+		var headings []string
+		for _, h := range hit.Payload["headings"].GetListValue().GetValues() {
+			headings = append(headings, h.GetStringValue())
 		}
+		results = append(results, models.Source{
+			DocumentID:  docID,
+			WorkspaceID: hit.Payload["workspace_id"].GetStringValue(),
+			ChunkIndex:  int(hit.Payload["chunk_index"].GetIntegerValue()),
+			Score:       hit.GetScore(),
+			CharStart:   int(hit.Payload["char_start"].GetIntegerValue()),
+			CharEnd:     int(hit.Payload["char_end"].GetIntegerValue()),
+			Headings:    headings,
+			PageStart:   int(hit.Payload["page_start"].GetIntegerValue()),
+			PageEnd:     int(hit.Payload["page_end"].GetIntegerValue()),
+			Content:     content.GetStringValue(),
+		})
+		docIDs = append(docIDs, docID)
+	}
+
+	// Filenames are looked up rather than stored in the payload so renames show up immediately
+	var docs []models.Document
+	if len(docIDs) > 0 {
+		if err := config.DB.Select("id", "filename").Where("id IN ?", docIDs).Scopes(DocumentsInScope(scope)).Find(&docs).Error; err != nil {
+			return nil, err
+		}
+	}
+	filenames := make(map[string]string, len(docs))
+	for _, d := range docs {
+		filenames[d.ID.String()] = d.Filename
+	}
+	for i := range results {
+		results[i].Filename = filenames[results[i].DocumentID]
 	}
 
 	return results, nil
 }
 
 func uint64Ptr(i uint64) *uint64 { return &i }
+
+// DeleteStaleDocumentChunks removes the document's points from chunk index keep onwards,
+// left over from an earlier chunking that produced more chunks
+func DeleteStaleDocumentChunks(userID string, docID string, keep int) error {
+	_, err := QClient.Delete(context.Background(), &qdrant.DeletePoints{
+		CollectionName: "user_text_embeddings",
+		Wait:           boolPtr(true),
+		Points: qdrant.NewPointsSelectorFilter(&qdrant.Filter{
+			Must: []*qdrant.Condition{
+				qdrant.NewMatch("user_id", userID),
+				qdrant.NewMatch("document_id", docID),
+				qdrant.NewRange("chunk_index", &qdrant.Range{Gte: float64Ptr(float64(keep))}),
+			},
+		}),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete stale points from Qdrant for doc %s: %v", docID, err)
+	}
+	return nil
+}
+
+func float64Ptr(f float64) *float64 { return &f }
+
+// DeleteDocumentChunks removes every point that belongs to the given document
+func DeleteDocumentChunks(userID string, docID string) error {
+	_, err := QClient.Delete(context.Background(), &qdrant.DeletePoints{
+		CollectionName: "user_text_embeddings",
+		Wait:           boolPtr(true),
+		Points: qdrant.NewPointsSelectorFilter(&qdrant.Filter{
+			Must: []*qdrant.Condition{
+				qdrant.NewMatch("user_id", userID),
+				qdrant.NewMatch("document_id", docID),
+			},
+		}),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete points from Qdrant for doc %s: %v", docID, err)
+	}
+	return nil
+}
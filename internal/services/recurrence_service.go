@@ -0,0 +1,187 @@
+package services
+
+import (
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// unboundedRangeEnd stands in for the end of an open range query
+var unboundedRangeEnd = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// EventLocation is the zone an event's occurrences are laid out in. All-day events and
+// events without a zone recur in UTC.
+func EventLocation(e models.Event) *time.Location {
+	if e.AllDay || e.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(e.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// zoneName returns the IANA name of loc, or "" for zones that cannot be loaded back by name
+// such as fixed offsets; those have no DST, so recurring in UTC keeps the same instants
+func zoneName(loc *time.Location) string {
+	name := loc.String()
+	if name == "" || name == "Local" || name == "UTC" {
+		return ""
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return ""
+	}
+	return name
+}
+
+// NormalizeRRule validates a recurrence rule and returns it in its stored form, upper case
+// and without the "RRULE:" prefix. An empty value means the event does not recur.
+func NormalizeRRule(value string, loc *time.Location) (string, *RecurrenceRule, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSpace(strings.TrimPrefix(value, "RRULE:"))
+	if value == "" {
+		return "", nil, nil
+	}
+	rule, err := ParseRRule(value, loc)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidRecurrence, err)
+	}
+	return value, &rule, nil
+}
+
+// EventSeries is the schedule of a stored event; a rule that no longer parses leaves only
+// the first occurrence
+func EventSeries(e models.Event) Series {
+	loc := EventLocation(e)
+	series := Series{Start: e.StartTime.In(loc), ExDates: e.ExDates}
+	if e.RRule != "" {
+		if rule, err := ParseRRule(e.RRule, loc); err == nil {
+			series.Rule = &rule
+		}
+	}
+	return series
+}
+
+// eventDuration is the length of every occurrence of an event
+func eventDuration(e models.Event) time.Duration {
+	if e.EndTime != nil && e.EndTime.After(e.StartTime) {
+		return e.EndTime.Sub(e.StartTime)
+	}
+	if e.AllDay {
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+// PrepareEventRecurrence normalises an event's rule and time zone and works out
+// RecurrenceEnd. Call it before saving an event.
+func PrepareEventRecurrence(event *models.Event) error {
+	if event.TimeZone != "" {
+		if _, err := time.LoadLocation(event.TimeZone); err != nil || event.TimeZone == "Local" {
+			return fmt.Errorf("%w: unknown time zone %q", ErrInvalidRecurrence, event.TimeZone)
+		}
+	}
+
+	rrule, rule, err := NormalizeRRule(event.RRule, EventLocation(*event))
+	if err != nil {
+		return err
+	}
+	event.RRule = rrule
+	event.RecurrenceEnd = nil
+	if rule == nil {
+		event.ExDates = nil
+		return nil
+	}
+	if rule.Count == 0 && rule.Until.IsZero() {
+		return nil
+	}
+
+	// Bounded series end with their last occurrence that was not skipped
+	last := event.StartTime
+	if starts := EventSeries(*event).Between(event.StartTime, unboundedRangeEnd, 0); len(starts) > 0 {
+		last = starts[len(starts)-1]
+	}
+	end := last.Add(eventDuration(*event))
+	event.RecurrenceEnd = &end
+	return nil
+}
+
+// EventsInRange loads a user's events with at least one occurrence overlapping [from, to),
+// ordered by first start. Nil bounds leave that side of the range open.
+func EventsInRange(userID uuid.UUID, from *time.Time, to *time.Time) ([]models.Event, error) {
+	query := config.DB.Where("user_id = ?", userID)
+	if from != nil {
+		// Single events without an end are treated as instants at their start
+		query = query.Where("((COALESCE(rrule, '') = '' AND COALESCE(end_time, start_time) >= ?) OR "+
+			"(COALESCE(rrule, '') <> '' AND (recurrence_end IS NULL OR recurrence_end >= ?)))", *from, *from)
+	}
+	if to != nil {
+		query = query.Where("start_time < ?", *to)
+	}
+
+	var events []models.Event
+	if err := query.Order("start_time ASC, id ASC").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	if from == nil {
+		return events, nil
+	}
+
+	// The query above only bounds each series as a whole; a series can still have a gap
+	// over the range
+	end := unboundedRangeEnd
+	if to != nil {
+		end = *to
+	}
+	matching := events[:0]
+	for _, e := range events {
+		if e.RRule == "" || len(ExpandEvents([]models.Event{e}, *from, end, 1)) > 0 {
+			matching = append(matching, e)
+		}
+	}
+	return matching, nil
+}
+
+// ExpandEvents lays out the occurrences of events that overlap [from, to), ordered by start
+// and capped at limit when limit > 0
+func ExpandEvents(events []models.Event, from time.Time, to time.Time, limit int) []models.EventOccurrence {
+	var occurrences []models.EventOccurrence
+	for _, e := range events {
+		d := eventDuration(e)
+		// An occurrence that started before from overlaps the range while it is still running
+		seriesFrom := from
+		if d > 0 {
+			seriesFrom = from.Add(-d).Add(time.Nanosecond)
+		}
+
+		for _, start := range EventSeries(e).Between(seriesFrom, to, limit) {
+			occurrence := models.EventOccurrence{
+				EventID:   e.ID,
+				Title:     e.Title,
+				StartTime: start,
+				Location:  e.Location,
+				AllDay:    e.AllDay,
+				Recurring: e.RRule != "",
+			}
+			if e.EndTime != nil {
+				end := start.Add(d)
+				occurrence.EndTime = &end
+			}
+			occurrences = append(occurrences, occurrence)
+		}
+	}
+
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].StartTime.Before(occurrences[j].StartTime)
+	})
+	if limit > 0 && len(occurrences) > limit {
+		occurrences = occurrences[:limit]
+	}
+	return occurrences
+}
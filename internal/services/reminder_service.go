@@ -0,0 +1,591 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	reminderPollInterval = 30 * time.Second
+	// Reminders are planned this far beyond their user's longest offset, so each is stored
+	// well before it is due
+	reminderPlanAhead        = time.Hour
+	reminderMaxAttempts      = 5
+	reminderSendTimeout      = 30 * time.Second
+	reminderLockTimeout      = 5 * time.Minute
+	maxReminderOffsets       = 10
+	maxReminderOffsetMinutes = 28 * 24 * 60
+)
+
+var (
+	ErrInvalidReminderSettings = errors.New("invalid reminder settings")
+	ErrReminderNotPending      = errors.New("reminder is not pending")
+)
+
+// DefaultReminderSettings reminds a day and an hour before each event, by email when SMTP
+// is configured and in the server log otherwise. Digests are off until a period is chosen.
+func DefaultReminderSettings(userID uuid.UUID) models.ReminderSettings {
+	channel := models.ReminderChannelLog
+	if _, ok := Notifiers[models.ReminderChannelEmail]; ok {
+		channel = models.ReminderChannelEmail
+	}
+	return models.ReminderSettings{
+		UserID:        userID,
+		Offsets:       models.JSONList[int]{24 * 60, 60},
+		Channels:      models.JSONList[string]{channel},
+		DigestHour:    7,
+		DigestWeekday: int(time.Monday),
+	}
+}
+
+// LoadReminderSettings returns the user's saved preferences or the defaults
+func LoadReminderSettings(userID uuid.UUID) (models.ReminderSettings, error) {
+	var settings models.ReminderSettings
+	err := config.DB.First(&settings, "user_id = ?", userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return DefaultReminderSettings(userID), nil
+	}
+	return settings, err
+}
+
+// SaveReminderSettings validates and stores a user's preferences. Pending reminders that no
+// longer match are dropped by the scheduler's next pass.
+func SaveReminderSettings(settings *models.ReminderSettings) error {
+	if len(settings.Offsets) > maxReminderOffsets {
+		return fmt.Errorf("%w: at most %d offsets", ErrInvalidReminderSettings, maxReminderOffsets)
+	}
+	seen := map[int]bool{}
+	var offsets models.JSONList[int]
+	for _, o := range settings.Offsets {
+		if o < 0 || o > maxReminderOffsetMinutes {
+			return fmt.Errorf("%w: offsets must be between 0 and %d minutes", ErrInvalidReminderSettings, maxReminderOffsetMinutes)
+		}
+		if !seen[o] {
+			seen[o] = true
+			offsets = append(offsets, o)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(offsets)))
+	settings.Offsets = offsets
+
+	var channels models.JSONList[string]
+	for _, ch := range settings.Channels {
+		ch = strings.ToLower(strings.TrimSpace(ch))
+		switch ch {
+		case models.ReminderChannelEmail, models.ReminderChannelWebhook, models.ReminderChannelLog:
+		default:
+			return fmt.Errorf("%w: unknown channel %q", ErrInvalidReminderSettings, ch)
+		}
+		if _, ok := Notifiers[ch]; !ok {
+			return fmt.Errorf("%w: channel %q is not configured on this server", ErrInvalidReminderSettings, ch)
+		}
+		if !containsString(channels, ch) {
+			channels = append(channels, ch)
+		}
+	}
+	settings.Channels = channels
+
+	settings.WebhookURL = strings.TrimSpace(settings.WebhookURL)
+	if containsString(channels, models.ReminderChannelWebhook) && settings.WebhookURL == "" {
+		return fmt.Errorf("%w: the webhook channel needs webhook_url", ErrInvalidReminderSettings)
+	}
+	if settings.WebhookURL != "" {
+		if err := ValidateWebhookURL(settings.WebhookURL); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidReminderSettings, err)
+		}
+	}
+	if settings.WebhookURL == "" {
+		settings.WebhookSecret = ""
+	} else if settings.WebhookSecret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			return err
+		}
+		settings.WebhookSecret = secret
+	}
+
+	settings.DigestPeriod = strings.ToLower(strings.TrimSpace(settings.DigestPeriod))
+	settings.DigestNextAt = nil
+	if settings.DigestPeriod != "" {
+		if _, err := digestPeriodLength(settings.DigestPeriod); err != nil {
+			return fmt.Errorf("%w: digest_period must be day, week or empty", ErrInvalidReminderSettings)
+		}
+		if settings.DigestHour < 0 || settings.DigestHour > 23 {
+			return fmt.Errorf("%w: digest_hour must be between 0 and 23", ErrInvalidReminderSettings)
+		}
+		if settings.DigestWeekday < 0 || settings.DigestWeekday > 6 {
+			return fmt.Errorf("%w: digest_weekday must be between 0 (Sunday) and 6", ErrInvalidReminderSettings)
+		}
+		next := NextDigestAt(settings.DigestPeriod, settings.DigestHour, settings.DigestWeekday, UserLocation(settings.UserID), time.Now())
+		settings.DigestNextAt = &next
+	}
+
+	return config.DB.Save(settings).Error
+}
+
+// newWebhookSecret generates a signing key for one user's webhook. Unlike other secrets it is
+// stored as is, since signing needs it.
+func newWebhookSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SnoozeReminder delivers a reminder again after d, whether it was pending, sent or muted
+func SnoozeReminder(reminder *models.Reminder, d time.Duration) error {
+	remindAt := time.Now().Add(d)
+	result := config.DB.Model(&models.Reminder{}).
+		Where("id = ? AND status <> ?", reminder.ID, models.ReminderStatusSending).
+		Updates(map[string]interface{}{
+			"status":     models.ReminderStatusPending,
+			"remind_at":  remindAt,
+			"attempts":   0,
+			"last_error": "",
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrReminderNotPending
+	}
+	reminder.Status = models.ReminderStatusPending
+	reminder.RemindAt = remindAt
+	reminder.Attempts = 0
+	reminder.LastError = ""
+	return nil
+}
+
+// MuteReminder cancels a single pending reminder
+func MuteReminder(reminder *models.Reminder) error {
+	result := config.DB.Model(&models.Reminder{}).
+		Where("id = ? AND status = ?", reminder.ID, models.ReminderStatusPending).
+		Update("status", models.ReminderStatusMuted)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrReminderNotPending
+	}
+	reminder.Status = models.ReminderStatusMuted
+	return nil
+}
+
+// StartReminderScheduler plans and delivers reminders, and sends digests, in the background. Several instances
+// may run it: planning is idempotent and delivery claims each reminder with a row lock.
+func StartReminderScheduler() {
+	go func() {
+		ticker := time.NewTicker(reminderPollInterval)
+		defer ticker.Stop()
+		for {
+			requeueStaleReminders()
+			if err := PlanReminders(time.Now()); err != nil {
+				log.Printf("Reminder planning failed: %v", err)
+			}
+			DeliverDueReminders()
+			<-ticker.C
+		}
+	}()
+	// Digests wait on the model for up to digestSendTimeout each, so they get their own loop
+	// and never hold up due reminders
+	go func() {
+		ticker := time.NewTicker(reminderPollInterval)
+		defer ticker.Stop()
+		for {
+			DeliverDueDigests(time.Now())
+			<-ticker.C
+		}
+	}()
+	log.Printf("Started reminder scheduler")
+}
+
+// reminderSlot identifies a planned reminder the same way the unique index does
+type reminderSlot struct {
+	eventID uuid.UUID
+	start   int64
+	offset  int
+	channel string
+}
+
+// PlanReminders stores the reminders due within each user's planning horizon and drops
+// pending ones whose event, time or preferences changed
+func PlanReminders(now time.Time) error {
+	var userIDs []uuid.UUID
+	err := config.DB.Model(&models.Event{}).Distinct("user_id").
+		Where("reminders_muted = ? AND (start_time >= ? OR (COALESCE(rrule, '') <> '' AND (recurrence_end IS NULL OR recurrence_end >= ?)))", false, now, now).
+		Pluck("user_id", &userIDs).Error
+	if err != nil {
+		return err
+	}
+	// Users whose events all passed or were deleted may still have pending reminders to drop
+	var withPending []uuid.UUID
+	if err := config.DB.Model(&models.Reminder{}).Distinct("user_id").
+		Where("status = ?", models.ReminderStatusPending).Pluck("user_id", &withPending).Error; err != nil {
+		return err
+	}
+	for _, id := range withPending {
+		if !containsUUID(userIDs, id) {
+			userIDs = append(userIDs, id)
+		}
+	}
+
+	for _, userID := range userIDs {
+		if err := planUserReminders(userID, now); err != nil {
+			log.Printf("Reminder planning failed for user %s: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUUID(list []uuid.UUID, id uuid.UUID) bool {
+	for _, x := range list {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+func planUserReminders(userID uuid.UUID, now time.Time) error {
+	settings, err := LoadReminderSettings(userID)
+	if err != nil {
+		return err
+	}
+	maxOffset := 0
+	for _, o := range settings.Offsets {
+		maxOffset = max(maxOffset, o)
+	}
+	horizon := now.Add(time.Duration(maxOffset)*time.Minute + reminderPlanAhead)
+	loc := UserLocation(userID)
+
+	events, err := EventsInRange(userID, &now, &horizon)
+	if err != nil {
+		return err
+	}
+	muted := map[uuid.UUID]bool{}
+	for _, e := range events {
+		muted[e.ID] = e.RemindersMuted
+	}
+
+	expected := map[reminderSlot]bool{}
+	var planned []models.Reminder
+	for _, occ := range ExpandEvents(events, now, horizon, 0) {
+		if muted[occ.EventID] || occ.StartTime.Before(now) {
+			continue
+		}
+		start := reminderAnchor(occ, loc)
+		due := dueOffsets(settings.Offsets, start, now)
+		for _, channel := range settings.Channels {
+			for _, o := range settings.Offsets {
+				remindAt := start.Add(-time.Duration(o) * time.Minute)
+				if settings.MutedUntil != nil && remindAt.Before(*settings.MutedUntil) {
+					continue
+				}
+				// Past offsets stay expected so rows not delivered yet are kept, but are not
+				// planned again
+				expected[reminderSlot{occ.EventID, occ.StartTime.Unix(), o, channel}] = true
+				if !containsInt(due, o) {
+					continue
+				}
+				if remindAt.Before(now) {
+					// A late reminder is better than none for an event that has not started
+					remindAt = now
+				}
+				planned = append(planned, models.Reminder{
+					ID:              uuid.New(),
+					UserID:          userID,
+					EventID:         occ.EventID,
+					OccurrenceStart: occ.StartTime,
+					OffsetMinutes:   o,
+					Channel:         channel,
+					Status:          models.ReminderStatusPending,
+					RemindAt:        remindAt,
+				})
+			}
+		}
+	}
+
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		if len(planned) > 0 {
+			err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&planned, 200).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		var pending []models.Reminder
+		if err := tx.Where("user_id = ? AND status = ?", userID, models.ReminderStatusPending).Find(&pending).Error; err != nil {
+			return err
+		}
+		var stale []uuid.UUID
+		for _, r := range pending {
+			slot := reminderSlot{r.EventID, r.OccurrenceStart.Unix(), r.OffsetMinutes, r.Channel}
+			// Reminders for occurrences already under way, i.e. snoozed or retried ones, are kept
+			// until their event is gone or muted
+			started := r.OccurrenceStart.Before(now)
+			if !expected[slot] && (!started || muted[r.EventID] || !eventExists(events, r.EventID)) {
+				stale = append(stale, r.ID)
+			}
+		}
+		if len(stale) > 0 {
+			return tx.Where("id IN ?", stale).Delete(&models.Reminder{}).Error
+		}
+		return nil
+	})
+}
+
+func eventExists(events []models.Event, id uuid.UUID) bool {
+	for _, e := range events {
+		if e.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// reminderAnchor is the moment offsets count back from. All-day events start at midnight
+// in the user's own zone rather than UTC.
+func reminderAnchor(occ models.EventOccurrence, loc *time.Location) time.Time {
+	if !occ.AllDay {
+		return occ.StartTime
+	}
+	d := occ.StartTime.UTC()
+	return time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, loc)
+}
+
+// dueOffsets keeps the offsets whose time has not passed. When every one has, as for an event
+// added shortly before it starts, the smallest is kept so the user still hears about it.
+func dueOffsets(offsets []int, start time.Time, now time.Time) []int {
+	var due []int
+	smallest := -1
+	for _, o := range offsets {
+		if !start.Add(-time.Duration(o) * time.Minute).Before(now) {
+			due = append(due, o)
+		}
+		if smallest < 0 || o < smallest {
+			smallest = o
+		}
+	}
+	if len(due) == 0 && smallest >= 0 {
+		due = []int{smallest}
+	}
+	return due
+}
+
+// requeueStaleReminders releases reminders claimed by an instance that died while sending
+func requeueStaleReminders() {
+	result := config.DB.Model(&models.Reminder{}).
+		Where("status = ? AND locked_at < ?", models.ReminderStatusSending, time.Now().Add(-reminderLockTimeout)).
+		Updates(map[string]interface{}{"status": models.ReminderStatusPending, "locked_at": nil})
+	if result.Error != nil {
+		log.Printf("Failed to requeue stale reminders: %v", result.Error)
+	}
+}
+
+// DeliverDueReminders sends every reminder that is due
+func DeliverDueReminders() {
+	for {
+		reminder, err := claimNextReminder()
+		if err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Printf("Failed to claim reminder: %v", err)
+			}
+			return
+		}
+		deliverReminder(reminder)
+	}
+}
+
+func claimNextReminder() (models.Reminder, error) {
+	var reminder models.Reminder
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND remind_at <= ?", models.ReminderStatusPending, time.Now()).
+			Order("remind_at ASC").
+			First(&reminder).Error
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		reminder.Status = models.ReminderStatusSending
+		reminder.Attempts++
+		reminder.LockedAt = &now
+		return tx.Model(&reminder).Updates(map[string]interface{}{
+			"status":    reminder.Status,
+			"attempts":  reminder.Attempts,
+			"locked_at": reminder.LockedAt,
+		}).Error
+	})
+	return reminder, err
+}
+
+func deliverReminder(reminder models.Reminder) {
+	finish := func(status string, lastError string, extra map[string]interface{}) {
+		updates := map[string]interface{}{"status": status, "last_error": lastError, "locked_at": nil}
+		for k, v := range extra {
+			updates[k] = v
+		}
+		config.DB.Model(&reminder).Updates(updates)
+	}
+
+	notification, err := buildNotification(reminder)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// The event was deleted after the reminder was planned
+		config.DB.Delete(&reminder)
+		return
+	}
+	if errors.Is(err, errReminderMuted) {
+		finish(models.ReminderStatusMuted, "", nil)
+		return
+	}
+	if err == nil {
+		notifier, ok := Notifiers[reminder.Channel]
+		if !ok {
+			err = fmt.Errorf("%w: channel %q is not configured", ErrUndeliverable, reminder.Channel)
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), reminderSendTimeout)
+			err = notifier.Notify(ctx, notification)
+			cancel()
+		}
+	}
+
+	if err == nil {
+		finish(models.ReminderStatusSent, "", map[string]interface{}{"sent_at": time.Now()})
+		return
+	}
+	if errors.Is(err, ErrUndeliverable) || reminder.Attempts >= reminderMaxAttempts {
+		log.Printf("Reminder %s failed after %d attempts: %v", reminder.ID, reminder.Attempts, err)
+		finish(models.ReminderStatusFailed, err.Error(), nil)
+		return
+	}
+	finish(models.ReminderStatusPending, err.Error(), map[string]interface{}{
+		"remind_at": time.Now().Add(jobBackoff(reminder.Attempts)),
+	})
+}
+
+var errReminderMuted = errors.New("reminder muted")
+
+// buildNotification loads what a reminder needs and renders its text in the user's zone
+func buildNotification(reminder models.Reminder) (Notification, error) {
+	var event models.Event
+	if err := config.DB.First(&event, "id = ?", reminder.EventID).Error; err != nil {
+		return Notification{}, err
+	}
+	var user models.User
+	if err := config.DB.First(&user, "id = ?", reminder.UserID).Error; err != nil {
+		return Notification{}, err
+	}
+	settings, err := LoadReminderSettings(reminder.UserID)
+	if err != nil {
+		return Notification{}, err
+	}
+	// Muting may have happened after the reminder was planned
+	if event.RemindersMuted || (settings.MutedUntil != nil && time.Now().Before(*settings.MutedUntil)) {
+		return Notification{}, errReminderMuted
+	}
+
+	loc := UserLocation(reminder.UserID)
+	occ := models.EventOccurrence{
+		EventID:   event.ID,
+		Title:     event.Title,
+		StartTime: reminder.OccurrenceStart,
+		Location:  event.Location,
+		AllDay:    event.AllDay,
+		Recurring: event.RRule != "",
+	}
+	if event.EndTime != nil {
+		end := reminder.OccurrenceStart.Add(eventDuration(event))
+		occ.EndTime = &end
+	}
+
+	subject, body := renderReminder(occ, reminder.OffsetMinutes, loc)
+	return Notification{
+		ReminderID:    reminder.ID,
+		UserID:        user.ID,
+		Email:         user.Email,
+		Name:          user.Name,
+		WebhookURL:    settings.WebhookURL,
+		WebhookSecret: settings.WebhookSecret,
+		Subject:       subject,
+		Body:          body,
+		Event:         occ,
+		OffsetMinutes: reminder.OffsetMinutes,
+		Location:      loc,
+	}, nil
+}
+
+func renderReminder(occ models.EventOccurrence, offsetMinutes int, loc *time.Location) (string, string) {
+	var when string
+	if occ.AllDay {
+		when = occ.StartTime.UTC().Format("Monday 2 January 2006")
+	} else {
+		when = occ.StartTime.In(loc).Format("Monday 2 January 2006, 15:04 MST")
+	}
+
+	subject := fmt.Sprintf("Reminder: %s", occ.Title)
+	if offsetMinutes > 0 {
+		subject += " in " + humanizeMinutes(offsetMinutes)
+	} else {
+		subject += " is starting"
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s\n\nWhen: %s\n", occ.Title, when)
+	if occ.Location != nil && *occ.Location != "" {
+		fmt.Fprintf(&body, "Where: %s\n", *occ.Location)
+	}
+	body.WriteString("\nSent by Dory. Change or mute reminders in the app.\n")
+	return subject, body.String()
+}
+
+func humanizeMinutes(m int) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case m%(7*24*60) == 0:
+		return plural(m/(7*24*60), "week")
+	case m%(24*60) == 0:
+		return plural(m/(24*60), "day")
+	case m%60 == 0:
+		return plural(m/60, "hour")
+	default:
+		return plural(m, "minute")
+	}
+}
@@ -0,0 +1,465 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurrence frequencies supported from RFC 5545
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+	FreqYearly  = "YEARLY"
+)
+
+// maxRecurrencePeriods bounds expansion of rules that never match, e.g. FREQ=YEARLY;BYMONTHDAY=31;BYMONTH=2
+const maxRecurrencePeriods = 50000
+
+// WeekdayNum is a BYDAY entry such as MO, 2TU or -1FR; N is 0 when no ordinal is given
+type WeekdayNum struct {
+	N       int
+	Weekday time.Weekday
+}
+
+// RecurrenceRule is a parsed RRULE. Times produced by it keep the wall-clock time and
+// location of the series start, so a 10:00 class stays at 10:00 across DST changes.
+type RecurrenceRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByMonth    []int
+	BySetPos   []int
+	WeekStart  time.Weekday
+}
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// ParseRRule parses an RRULE value. loc is the series start's location, used for an UNTIL
+// given as a floating time or a date.
+func ParseRRule(value string, loc *time.Location) (RecurrenceRule, error) {
+	rule := RecurrenceRule{Interval: 1, WeekStart: time.Monday}
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+
+	for _, part := range strings.Split(value, ";") {
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return rule, fmt.Errorf("invalid RRULE part %q", part)
+		}
+
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(val)
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(val)
+			if err == nil && rule.Interval < 1 {
+				err = errors.New("INTERVAL must be positive")
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(val)
+		case "UNTIL":
+			rule.Until, err = parseRRuleUntil(val, loc)
+		case "BYDAY":
+			for _, d := range strings.Split(val, ",") {
+				d = strings.ToUpper(strings.TrimSpace(d))
+				if len(d) < 2 {
+					return rule, fmt.Errorf("invalid BYDAY %q", d)
+				}
+				wd, known := icsWeekdays[d[len(d)-2:]]
+				if !known {
+					return rule, fmt.Errorf("invalid BYDAY %q", d)
+				}
+				n := 0
+				if prefix := d[:len(d)-2]; prefix != "" {
+					if n, err = strconv.Atoi(prefix); err != nil {
+						return rule, fmt.Errorf("invalid BYDAY %q", d)
+					}
+				}
+				rule.ByDay = append(rule.ByDay, WeekdayNum{N: n, Weekday: wd})
+			}
+		case "BYMONTHDAY":
+			rule.ByMonthDay, err = parseIntList(val, -31, 31)
+		case "BYMONTH":
+			rule.ByMonth, err = parseIntList(val, 1, 12)
+		case "BYSETPOS":
+			rule.BySetPos, err = parseIntList(val, -366, 366)
+		case "WKST":
+			wd, known := icsWeekdays[strings.ToUpper(val)]
+			if !known {
+				err = fmt.Errorf("invalid WKST %q", val)
+			}
+			rule.WeekStart = wd
+		default:
+			// BYHOUR, BYMINUTE, BYWEEKNO and the like are rare in calendars students receive;
+			// ignoring them yields the series' main occurrences rather than failing the import
+		}
+		if err != nil {
+			return rule, fmt.Errorf("invalid RRULE %s: %v", key, err)
+		}
+	}
+
+	switch rule.Freq {
+	case FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+	case "":
+		return rule, errors.New("RRULE is missing FREQ")
+	default:
+		return rule, fmt.Errorf("unsupported RRULE frequency %s", rule.Freq)
+	}
+	return rule, nil
+}
+
+func parseRRuleUntil(val string, loc *time.Location) (time.Time, error) {
+	switch {
+	case strings.HasSuffix(val, "Z"):
+		return time.Parse("20060102T150405Z", val)
+	case len(val) == 8:
+		// A date UNTIL includes the whole day
+		d, err := time.ParseInLocation("20060102", val, loc)
+		if err != nil {
+			return d, err
+		}
+		return d.AddDate(0, 0, 1).Add(-time.Second), nil
+	default:
+		return time.ParseInLocation("20060102T150405", val, loc)
+	}
+}
+
+func parseIntList(val string, min int, max int) ([]int, error) {
+	var out []int
+	for _, s := range strings.Split(val, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 || n < min || n > max {
+			return nil, fmt.Errorf("%d out of range", n)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// Occurrences returns the starts of a series beginning at dtstart that fall in [from, to),
+// in order, stopping after limit results when limit > 0. DTSTART is always the first
+// occurrence and counts towards COUNT.
+func (r RecurrenceRule) Occurrences(dtstart time.Time, from time.Time, to time.Time, limit int) []time.Time {
+	var out []time.Time
+	count := 0
+	emit := func(t time.Time) bool {
+		if r.Count > 0 && count >= r.Count {
+			return false
+		}
+		if !r.Until.IsZero() && t.After(r.Until) {
+			return false
+		}
+		if !t.Before(to) {
+			return false
+		}
+		count++
+		if !t.Before(from) {
+			out = append(out, t)
+			if limit > 0 && len(out) >= limit {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !emit(dtstart) {
+		return out
+	}
+	interval := r.Interval
+	if interval < 1 {
+		interval = 1
+	}
+	for period := 0; period < maxRecurrencePeriods; period++ {
+		for _, t := range r.candidates(dtstart, period*interval) {
+			if !t.After(dtstart) {
+				continue
+			}
+			if !emit(t) {
+				return out
+			}
+		}
+	}
+	return out
+}
+
+// candidates lists, in order, the occurrences in the period offset periods after dtstart's
+func (r RecurrenceRule) candidates(dtstart time.Time, offset int) []time.Time {
+	y, m, d := dtstart.Date()
+	var dates []time.Time
+
+	switch r.Freq {
+	case FreqDaily:
+		day := civilDate(y, m, d+offset)
+		if r.matchesMonth(day.Month()) && r.matchesMonthDay(day) && r.matchesWeekday(day.Weekday()) {
+			dates = []time.Time{day}
+		}
+	case FreqWeekly:
+		start := civilDate(y, m, d)
+		start = start.AddDate(0, 0, -((int(start.Weekday())-int(r.WeekStart)+7)%7)+offset*7)
+		for i := 0; i < 7; i++ {
+			day := start.AddDate(0, 0, i)
+			if !r.matchesMonth(day.Month()) {
+				continue
+			}
+			if len(r.ByDay) == 0 && day.Weekday() != dtstart.Weekday() {
+				continue
+			}
+			if len(r.ByDay) > 0 && !r.matchesWeekday(day.Weekday()) {
+				continue
+			}
+			dates = append(dates, day)
+		}
+	case FreqMonthly:
+		month := civilDate(y, m+time.Month(offset), 1)
+		if r.matchesMonth(month.Month()) {
+			dates = r.monthDays(month.Year(), month.Month(), d)
+		}
+	case FreqYearly:
+		year := y + offset
+		switch {
+		case len(r.ByMonth) > 0:
+			for _, bm := range sortedInts(r.ByMonth) {
+				dates = append(dates, r.monthDays(year, time.Month(bm), d)...)
+			}
+		case len(r.ByDay) > 0:
+			// BYDAY ordinals count within the whole year when no BYMONTH narrows it
+			dates = weekdaysInRange(civilDate(year, 1, 1), civilDate(year+1, 1, 1), r.ByDay)
+			if len(r.ByMonthDay) > 0 {
+				dates = filterDates(dates, r.matchesMonthDay)
+			}
+		case len(r.ByMonthDay) > 0:
+			for mo := time.January; mo <= time.December; mo++ {
+				dates = append(dates, r.monthDays(year, mo, d)...)
+			}
+		default:
+			if d <= daysIn(year, m) {
+				dates = []time.Time{civilDate(year, m, d)}
+			}
+		}
+	}
+
+	dates = applySetPos(dates, r.BySetPos)
+
+	hh, mm, ss := dtstart.Clock()
+	out := make([]time.Time, len(dates))
+	for i, day := range dates {
+		out[i] = time.Date(day.Year(), day.Month(), day.Day(), hh, mm, ss, dtstart.Nanosecond(), dtstart.Location())
+	}
+	return out
+}
+
+// monthDays resolves BYMONTHDAY and BYDAY within one month, defaulting to the series' day
+func (r RecurrenceRule) monthDays(year int, month time.Month, defaultDay int) []time.Time {
+	first := civilDate(year, month, 1)
+	if len(r.ByMonthDay) == 0 && len(r.ByDay) == 0 {
+		if defaultDay > daysIn(year, month) {
+			return nil
+		}
+		return []time.Time{civilDate(year, month, defaultDay)}
+	}
+
+	if len(r.ByDay) > 0 {
+		dates := weekdaysInRange(first, first.AddDate(0, 1, 0), r.ByDay)
+		if len(r.ByMonthDay) > 0 {
+			dates = filterDates(dates, r.matchesMonthDay)
+		}
+		return dates
+	}
+
+	var dates []time.Time
+	n := daysIn(year, month)
+	seen := map[int]bool{}
+	for _, md := range r.ByMonthDay {
+		day := md
+		if md < 0 {
+			day = n + md + 1
+		}
+		if day >= 1 && day <= n && !seen[day] {
+			seen[day] = true
+			dates = append(dates, civilDate(year, month, day))
+		}
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+	return dates
+}
+
+func (r RecurrenceRule) matchesMonth(m time.Month) bool {
+	if len(r.ByMonth) == 0 {
+		return true
+	}
+	for _, bm := range r.ByMonth {
+		if time.Month(bm) == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (r RecurrenceRule) matchesMonthDay(day time.Time) bool {
+	if len(r.ByMonthDay) == 0 {
+		return true
+	}
+	n := daysIn(day.Year(), day.Month())
+	for _, md := range r.ByMonthDay {
+		if md == day.Day() || (md < 0 && n+md+1 == day.Day()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r RecurrenceRule) matchesWeekday(wd time.Weekday) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, bd := range r.ByDay {
+		if bd.Weekday == wd {
+			return true
+		}
+	}
+	return false
+}
+
+// weekdaysInRange expands BYDAY entries over [start, end); an ordinal picks the nth match
+// from the start, or from the end when negative
+func weekdaysInRange(start time.Time, end time.Time, byDay []WeekdayNum) []time.Time {
+	matches := map[time.Weekday][]time.Time{}
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		matches[day.Weekday()] = append(matches[day.Weekday()], day)
+	}
+
+	seen := map[time.Time]bool{}
+	var dates []time.Time
+	add := func(t time.Time) {
+		if !seen[t] {
+			seen[t] = true
+			dates = append(dates, t)
+		}
+	}
+	for _, bd := range byDay {
+		days := matches[bd.Weekday]
+		switch {
+		case bd.N == 0:
+			for _, t := range days {
+				add(t)
+			}
+		case bd.N > 0 && bd.N <= len(days):
+			add(days[bd.N-1])
+		case bd.N < 0 && -bd.N <= len(days):
+			add(days[len(days)+bd.N])
+		}
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+	return dates
+}
+
+func applySetPos(dates []time.Time, setPos []int) []time.Time {
+	if len(setPos) == 0 || len(dates) == 0 {
+		return dates
+	}
+	seen := map[int]bool{}
+	var out []time.Time
+	for _, p := range setPos {
+		i := p - 1
+		if p < 0 {
+			i = len(dates) + p
+		}
+		if i >= 0 && i < len(dates) && !seen[i] {
+			seen[i] = true
+			out = append(out, dates[i])
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Before(out[j]) })
+	return out
+}
+
+func filterDates(dates []time.Time, keep func(time.Time) bool) []time.Time {
+	out := dates[:0]
+	for _, d := range dates {
+		if keep(d) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func sortedInts(in []int) []int {
+	out := append([]int(nil), in...)
+	sort.Ints(out)
+	return out
+}
+
+// civilDate is a calendar date for day arithmetic; UTC avoids DST gaps
+func civilDate(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// Series is the full schedule of a possibly recurring event
+type Series struct {
+	Start   time.Time
+	Rule    *RecurrenceRule
+	RDates  []time.Time
+	ExDates []time.Time
+}
+
+// Between lists the series' starts in [from, to), after adding RDATEs and removing EXDATEs
+func (s Series) Between(from time.Time, to time.Time, limit int) []time.Time {
+	var starts []time.Time
+	if s.Rule != nil {
+		starts = s.Rule.Occurrences(s.Start, from, to, 0)
+	} else if !s.Start.Before(from) && s.Start.Before(to) {
+		starts = []time.Time{s.Start}
+	}
+	for _, rd := range s.RDates {
+		if !rd.Before(from) && rd.Before(to) {
+			starts = append(starts, rd)
+		}
+	}
+
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	var out []time.Time
+	for i, t := range starts {
+		if i > 0 && t.Equal(starts[i-1]) {
+			continue
+		}
+		if containsTime(s.ExDates, t) {
+			continue
+		}
+		out = append(out, t)
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+	}
+	return out
+}
+
+func containsTime(list []time.Time, t time.Time) bool {
+	for _, x := range list {
+		if x.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
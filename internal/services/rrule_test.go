@@ -0,0 +1,254 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata" // the RFC examples are in America/New_York
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+// dates parses "YYYYMMDD" days into starts at 09:00 local time, the time every RFC 5545
+// example uses
+func dates(t *testing.T, loc *time.Location, days string) []time.Time {
+	t.Helper()
+	var out []time.Time
+	for _, d := range strings.Fields(days) {
+		day, err := time.ParseInLocation("20060102", d, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, time.Date(day.Year(), day.Month(), day.Day(), 9, 0, 0, 0, loc))
+	}
+	return out
+}
+
+func formatStarts(starts []time.Time) string {
+	parts := make([]string, len(starts))
+	for i, s := range starts {
+		parts[i] = s.Format("20060102T1504 MST")
+	}
+	return strings.Join(parts, " ")
+}
+
+// The examples are from RFC 5545 section 3.8.5.3, all starting at 09:00 New York time
+func TestRecurrenceRuleOccurrences(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+
+	tests := []struct {
+		name    string
+		dtstart string
+		rrule   string
+		limit   int
+		want    string
+	}{
+		{
+			name:    "daily for 10 occurrences",
+			dtstart: "19970902",
+			rrule:   "FREQ=DAILY;COUNT=10",
+			want:    "19970902 19970903 19970904 19970905 19970906 19970907 19970908 19970909 19970910 19970911",
+		},
+		{
+			name:    "every 10 days, 5 occurrences",
+			dtstart: "19970902",
+			rrule:   "FREQ=DAILY;INTERVAL=10;COUNT=5",
+			want:    "19970902 19970912 19970922 19971002 19971012",
+		},
+		{
+			name:    "every other day",
+			dtstart: "19970902",
+			rrule:   "FREQ=DAILY;INTERVAL=2",
+			limit:   4,
+			want:    "19970902 19970904 19970906 19970908",
+		},
+		{
+			name:    "UNTIL as a date includes that day",
+			dtstart: "19970902",
+			rrule:   "FREQ=DAILY;UNTIL=19970905",
+			want:    "19970902 19970903 19970904 19970905",
+		},
+		{
+			name:    "UNTIL in UTC before the last day's start",
+			dtstart: "19970902",
+			rrule:   "FREQ=DAILY;UNTIL=19970905T120000Z",
+			want:    "19970902 19970903 19970904",
+		},
+		{
+			// Crosses the end of daylight saving time on 26 October 1997
+			name:    "weekly for 10 occurrences keeps the wall-clock time",
+			dtstart: "19970902",
+			rrule:   "FREQ=WEEKLY;COUNT=10",
+			want:    "19970902 19970909 19970916 19970923 19970930 19971007 19971014 19971021 19971028 19971104",
+		},
+		{
+			name:    "weekly on Tuesday and Thursday for five weeks",
+			dtstart: "19970902",
+			rrule:   "FREQ=WEEKLY;UNTIL=19971007T000000Z;WKST=SU;BYDAY=TU,TH",
+			want:    "19970902 19970904 19970909 19970911 19970916 19970918 19970923 19970925 19970930 19971002",
+		},
+		{
+			name:    "every other week on Monday, Wednesday and Friday",
+			dtstart: "19970901",
+			rrule:   "FREQ=WEEKLY;INTERVAL=2;UNTIL=19971224T000000Z;WKST=SU;BYDAY=MO,WE,FR",
+			want: "19970901 19970903 19970905 19970915 19970917 19970919 19970929 19971001 19971003 " +
+				"19971013 19971015 19971017 19971027 19971029 19971031 19971110 19971112 19971114 " +
+				"19971124 19971126 19971128 19971208 19971210 19971212 19971222",
+		},
+		{
+			name:    "monthly on the first Friday for 10 occurrences",
+			dtstart: "19970905",
+			rrule:   "FREQ=MONTHLY;COUNT=10;BYDAY=1FR",
+			want:    "19970905 19971003 19971107 19971205 19980102 19980206 19980306 19980403 19980501 19980605",
+		},
+		{
+			name:    "monthly on the second-to-last Monday for 6 months",
+			dtstart: "19970922",
+			rrule:   "FREQ=MONTHLY;COUNT=6;BYDAY=-2MO",
+			want:    "19970922 19971020 19971117 19971222 19980119 19980216",
+		},
+		{
+			name:    "monthly on the third-to-last day",
+			dtstart: "19970928",
+			rrule:   "FREQ=MONTHLY;BYMONTHDAY=-3",
+			limit:   6,
+			want:    "19970928 19971029 19971128 19971229 19980129 19980226",
+		},
+		{
+			name:    "monthly on the 2nd and 15th for 10 occurrences",
+			dtstart: "19970902",
+			rrule:   "FREQ=MONTHLY;COUNT=10;BYMONTHDAY=2,15",
+			want:    "19970902 19970915 19971002 19971015 19971102 19971115 19971202 19971215 19980102 19980115",
+		},
+		{
+			name:    "monthly on the first and last day for 10 occurrences",
+			dtstart: "19970930",
+			rrule:   "FREQ=MONTHLY;COUNT=10;BYMONTHDAY=1,-1",
+			want:    "19970930 19971001 19971031 19971101 19971130 19971201 19971231 19980101 19980131 19980201",
+		},
+		{
+			name:    "last work day of the month",
+			dtstart: "19970930",
+			rrule:   "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1",
+			limit:   7,
+			want:    "19970930 19971031 19971128 19971231 19980130 19980227 19980331",
+		},
+		{
+			name:    "third Tuesday, Wednesday or Thursday for 3 months",
+			dtstart: "19970904",
+			rrule:   "FREQ=MONTHLY;COUNT=3;BYDAY=TU,WE,TH;BYSETPOS=3",
+			want:    "19970904 19971007 19971106",
+		},
+		{
+			name:    "monthly on the 31st skips shorter months",
+			dtstart: "19970131",
+			rrule:   "FREQ=MONTHLY;COUNT=4",
+			want:    "19970131 19970331 19970531 19970731",
+		},
+		{
+			name:    "yearly in June and July for 10 occurrences",
+			dtstart: "19970610",
+			rrule:   "FREQ=YEARLY;COUNT=10;BYMONTH=6,7",
+			want:    "19970610 19970710 19980610 19980710 19990610 19990710 20000610 20000710 20010610 20010710",
+		},
+		{
+			name:    "yearly on 29 February only in leap years",
+			dtstart: "20000229",
+			rrule:   "FREQ=YEARLY;COUNT=3",
+			want:    "20000229 20040229 20080229",
+		},
+		{
+			name:    "yearly rule that never matches again stops",
+			dtstart: "19970902",
+			rrule:   "FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=31",
+			want:    "19970902",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := ParseRRule(tt.rrule, ny)
+			if err != nil {
+				t.Fatalf("ParseRRule(%q): %v", tt.rrule, err)
+			}
+			dtstart := dates(t, ny, tt.dtstart)[0]
+			got := rule.Occurrences(dtstart, dtstart, dtstart.AddDate(10, 0, 0), tt.limit)
+			if want := dates(t, ny, tt.want); formatStarts(got) != formatStarts(want) {
+				t.Errorf("occurrences\n got %s\nwant %s", formatStarts(got), formatStarts(want))
+			}
+		})
+	}
+}
+
+func TestRecurrenceRuleCountIncludesStartBeforeRange(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+	rule, err := ParseRRule("FREQ=DAILY;COUNT=5", ny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dtstart := dates(t, ny, "19970902")[0]
+
+	// Occurrences before the range still use up the count
+	got := rule.Occurrences(dtstart, dates(t, ny, "19970905")[0], dtstart.AddDate(1, 0, 0), 0)
+	if want := dates(t, ny, "19970905 19970906"); formatStarts(got) != formatStarts(want) {
+		t.Errorf("occurrences\n got %s\nwant %s", formatStarts(got), formatStarts(want))
+	}
+}
+
+func TestSeriesBetweenAppliesRDatesAndExDates(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+	rule, err := ParseRRule("FREQ=WEEKLY;COUNT=4", ny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := Series{
+		Start:   dates(t, ny, "19970902")[0],
+		Rule:    &rule,
+		RDates:  dates(t, ny, "19970912 19970916"),
+		ExDates: dates(t, ny, "19970909"),
+	}
+
+	// The RDATE repeating a rule occurrence is listed once
+	got := series.Between(series.Start, series.Start.AddDate(1, 0, 0), 0)
+	if want := dates(t, ny, "19970902 19970912 19970916 19970923"); formatStarts(got) != formatStarts(want) {
+		t.Errorf("starts\n got %s\nwant %s", formatStarts(got), formatStarts(want))
+	}
+}
+
+func TestParseRRuleRejectsInvalidRules(t *testing.T) {
+	for _, rrule := range []string{
+		"",
+		"COUNT=3",
+		"FREQ=HOURLY",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=MONTHLY;BYMONTHDAY=0",
+		"FREQ=MONTHLY;BYMONTHDAY=32",
+		"FREQ=YEARLY;BYMONTH=13",
+		"FREQ=DAILY;UNTIL=tomorrow",
+		"FREQ=DAILY;COUNT",
+	} {
+		if _, err := ParseRRule(rrule, time.UTC); err == nil {
+			t.Errorf("ParseRRule(%q) succeeded, want an error", rrule)
+		}
+	}
+}
+
+func TestParseRRuleUntilAsDateUsesSeriesZone(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+	rule, err := ParseRRule("RRULE:FREQ=DAILY;UNTIL=19970905", ny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(1997, 9, 5, 23, 59, 59, 0, ny)
+	if !rule.Until.Equal(want) {
+		t.Errorf("Until = %s, want the end of 5 September in New York (%s)", rule.Until, want)
+	}
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used; the session has been revoked")
+	ErrTokenRevoked        = errors.New("token has been revoked")
+)
+
+// TokenPair is what a client gets on login and on every refresh
+type TokenPair struct {
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// ClientInfo describes the device a session was started from
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createRefreshToken stores a new refresh token in family and returns it; only its hash is kept
+func createRefreshToken(tx *gorm.DB, userID uuid.UUID, familyID uuid.UUID, client ClientInfo) (string, time.Time, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	userAgent := client.UserAgent
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	record := models.RefreshToken{
+		ID:        uuid.New(),
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: hashRefreshToken(token),
+		UserAgent: userAgent,
+		IP:        client.IP,
+		ExpiresAt: time.Now().Add(config.AppConfig.RefreshTokenTTL),
+	}
+	if err := tx.Create(&record).Error; err != nil {
+		return "", time.Time{}, err
+	}
+	return token, record.ExpiresAt, nil
+}
+
+func issueTokenPair(tx *gorm.DB, user models.User, familyID uuid.UUID, client ClientInfo) (TokenPair, error) {
+	refresh, refreshExpires, err := createRefreshToken(tx, user.ID, familyID, client)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	access, accessExpires, err := GenerateAccessToken(user.ID.String(), user.Email, familyID.String())
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:      access,
+		AccessExpiresAt:  accessExpires,
+		RefreshToken:     refresh,
+		RefreshExpiresAt: refreshExpires,
+	}, nil
+}
+
+// StartSession logs a user in on a new device, starting a new refresh token family
+func StartSession(user models.User, client ClientInfo) (TokenPair, error) {
+	var pair TokenPair
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		// Expired tokens are no longer needed for reuse detection
+		if err := tx.Where("user_id = ? AND expires_at < ?", user.ID, time.Now()).Delete(&models.RefreshToken{}).Error; err != nil {
+			return err
+		}
+		var err error
+		pair, err = issueTokenPair(tx, user, uuid.New(), client)
+		return err
+	})
+	return pair, err
+}
+
+// RefreshSession exchanges a refresh token for a new pair. Each refresh token works once:
+// presenting a used one again revokes its whole family, since either the client or an
+// attacker holds a stolen copy.
+func RefreshSession(token string, client ClientInfo) (TokenPair, error) {
+	var pair TokenPair
+	reused := false
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		var current models.RefreshToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", hashRefreshToken(token)).First(&current).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if current.RevokedAt != nil || !now.Before(current.ExpiresAt) {
+			return ErrInvalidRefreshToken
+		}
+		if current.UsedAt != nil {
+			reused = true
+			return revokeFamily(tx, current.FamilyID, now)
+		}
+
+		var user models.User
+		if err := tx.First(&user, "id = ?", current.UserID).Error; err != nil {
+			return ErrInvalidRefreshToken
+		}
+		if err := tx.Model(&current).Update("used_at", now).Error; err != nil {
+			return err
+		}
+		pair, err = issueTokenPair(tx, user, current.FamilyID, client)
+		return err
+	})
+	if err == nil && reused {
+		return TokenPair{}, ErrRefreshTokenReused
+	}
+	return pair, err
+}
+
+func revokeFamily(tx *gorm.DB, familyID uuid.UUID, now time.Time) error {
+	return tx.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", now).Error
+}
+
+// revokeAccessToken adds an access token's jti to the denylist until it expires
+func revokeAccessToken(tx *gorm.DB, claims *AccessClaims) error {
+	userID, err := uuid.Parse(claims.UserID)
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(config.AppConfig.AccessTokenTTL)
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	// Entries past their token's expiry guard nothing
+	if err := tx.Where("expires_at < ?", time.Now()).Delete(&models.RevokedToken{}).Error; err != nil {
+		return err
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.RevokedToken{
+		JTI:       claims.ID,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+	}).Error
+}
+
+// Logout ends the session an access token belongs to: the token itself is denylisted and
+// its refresh token family revoked
+func Logout(claims *AccessClaims) error {
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		if familyID, err := uuid.Parse(claims.SessionID); err == nil {
+			if err := revokeFamily(tx, familyID, time.Now()); err != nil {
+				return err
+			}
+		}
+		return revokeAccessToken(tx, claims)
+	})
+}
+
+// LogoutEverywhere revokes every refresh token of the calling token's user and every access
+// token issued so far
+func LogoutEverywhere(claims *AccessClaims) error {
+	userID, err := uuid.Parse(claims.UserID)
+	if err != nil {
+		return err
+	}
+	// Access tokens carry whole-second iat claims, so a session started right after this
+	// must not fall before the cutoff
+	now := time.Now().Truncate(time.Second)
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.RefreshToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", now).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).Update("tokens_valid_after", now).Error; err != nil {
+			return err
+		}
+		// The cutoff only catches tokens from earlier seconds, and the caller's own may have
+		// been issued in this one
+		return revokeAccessToken(tx, claims)
+	})
+}
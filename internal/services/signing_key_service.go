@@ -0,0 +1,364 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Supported access token algorithms
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+)
+
+const (
+	signingKeyCheckInterval = time.Minute
+	// A new key is published this long before it starts signing, so verifiers refreshing
+	// their JWKS cache pick it up first
+	signingKeyPrepublish = time.Hour
+	// Allowance for clock skew between us and verifiers
+	signingKeySkew = 5 * time.Minute
+	// Unknown kids trigger a reload at most this often
+	signingKeyReloadInterval = 10 * time.Second
+	rsaKeyBits               = 2048
+	// signingKeyLockID serializes rotation across instances with a Postgres advisory lock
+	signingKeyLockID = 727274
+)
+
+var ErrUnknownSigningKey = errors.New("unknown signing key")
+
+type signingKey struct {
+	kid         string
+	alg         string
+	private     crypto.Signer
+	activatesAt time.Time
+}
+
+func (k *signingKey) method() jwt.SigningMethod {
+	if k.alg == AlgEdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// keyring caches the signing keys from the database
+var keyring struct {
+	sync.RWMutex
+	keys     map[string]*signingKey
+	loadedAt time.Time
+}
+
+// asymmetricSigning reports whether access tokens are signed with the keyring rather than
+// JWT_SECRET
+func asymmetricSigning() bool {
+	return config.AppConfig.JWTAlgorithm != AlgHS256
+}
+
+// InitSigningKeys validates JWT_ALGORITHM and makes sure a signing key exists
+func InitSigningKeys() error {
+	switch config.AppConfig.JWTAlgorithm {
+	case AlgRS256, AlgEdDSA:
+	case AlgHS256:
+		if config.AppConfig.JWTSecret == "" {
+			return errors.New("JWT_ALGORITHM=HS256 needs JWT_SECRET")
+		}
+		// Keys from an earlier asymmetric setup are still loaded so their tokens verify
+		return loadSigningKeys()
+	default:
+		return fmt.Errorf("unknown JWT_ALGORITHM %q (expected RS256, EdDSA or HS256)", config.AppConfig.JWTAlgorithm)
+	}
+	if err := RotateSigningKeys(time.Now()); err != nil {
+		return err
+	}
+	return loadSigningKeys()
+}
+
+// StartSigningKeyRotation rotates keys on schedule and reloads keys other instances created
+func StartSigningKeyRotation() {
+	go func() {
+		ticker := time.NewTicker(signingKeyCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if asymmetricSigning() {
+				if err := RotateSigningKeys(time.Now()); err != nil {
+					log.Printf("Signing key rotation failed: %v", err)
+				}
+			}
+			if err := loadSigningKeys(); err != nil {
+				log.Printf("Failed to load signing keys: %v", err)
+			}
+		}
+	}()
+}
+
+// RotateSigningKeys creates the next key ahead of schedule, or one that signs right away
+// when there is none for the configured algorithm, and deletes keys no token can still
+// carry
+func RotateSigningKeys(now time.Time) error {
+	cfg := config.AppConfig
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", signingKeyLockID).Error; err != nil {
+			return err
+		}
+		var keys []models.SigningKey
+		if err := tx.Order("activates_at").Find(&keys).Error; err != nil {
+			return err
+		}
+
+		var current, pending *models.SigningKey
+		for i := range keys {
+			if !keys[i].ActivatesAt.After(now) {
+				current = &keys[i]
+			} else {
+				pending = &keys[i]
+			}
+		}
+
+		prepublish := min(signingKeyPrepublish, cfg.JWTKeyRotation/2)
+		switch {
+		case current == nil || current.Algorithm != cfg.JWTAlgorithm:
+			key, err := newSigningKey(cfg.JWTAlgorithm, now)
+			if err != nil {
+				return err
+			}
+			log.Printf("Created %s signing key %s", key.Algorithm, key.KID)
+			return tx.Create(&key).Error
+		case pending == nil && !now.Before(current.ActivatesAt.Add(cfg.JWTKeyRotation-prepublish)):
+			activatesAt := current.ActivatesAt.Add(cfg.JWTKeyRotation)
+			if earliest := now.Add(prepublish); activatesAt.Before(earliest) {
+				activatesAt = earliest
+			}
+			key, err := newSigningKey(cfg.JWTAlgorithm, activatesAt)
+			if err != nil {
+				return err
+			}
+			log.Printf("Created %s signing key %s, signing from %s", key.Algorithm, key.KID, activatesAt.Format(time.RFC3339))
+			return tx.Create(&key).Error
+		}
+
+		// A key is done once its successor has signed for longer than any token lives
+		var expired []string
+		for i := 0; i+1 < len(keys); i++ {
+			retiredAt := keys[i+1].ActivatesAt
+			if retiredAt.Add(cfg.AccessTokenTTL + signingKeySkew).Before(now) {
+				expired = append(expired, keys[i].KID)
+			}
+		}
+		if len(expired) > 0 {
+			return tx.Where("kid IN ?", expired).Delete(&models.SigningKey{}).Error
+		}
+		return nil
+	})
+}
+
+func newSigningKey(alg string, activatesAt time.Time) (models.SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("cannot generate keys for %s", alg)
+	}
+	if err != nil {
+		return models.SigningKey{}, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return models.SigningKey{}, err
+	}
+	return models.SigningKey{
+		KID:         uuid.NewString(),
+		Algorithm:   alg,
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ActivatesAt: activatesAt,
+	}, nil
+}
+
+func loadSigningKeys() error {
+	var rows []models.SigningKey
+	if err := config.DB.Find(&rows).Error; err != nil {
+		return err
+	}
+
+	keys := map[string]*signingKey{}
+	for _, row := range rows {
+		block, _ := pem.Decode([]byte(row.PrivateKey))
+		if block == nil {
+			log.Printf("Signing key %s is not PEM, skipping", row.KID)
+			continue
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			log.Printf("Signing key %s cannot be parsed, skipping: %v", row.KID, err)
+			continue
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			continue
+		}
+		keys[row.KID] = &signingKey{kid: row.KID, alg: row.Algorithm, private: signer, activatesAt: row.ActivatesAt}
+	}
+
+	keyring.Lock()
+	keyring.keys = keys
+	keyring.loadedAt = time.Now()
+	keyring.Unlock()
+	return nil
+}
+
+// currentSigningKey is the newest key that has started signing
+func currentSigningKey() (*signingKey, error) {
+	now := time.Now()
+	keyring.RLock()
+	defer keyring.RUnlock()
+
+	var current *signingKey
+	for _, k := range keyring.keys {
+		if k.alg != config.AppConfig.JWTAlgorithm || k.activatesAt.After(now) {
+			continue
+		}
+		if current == nil || k.activatesAt.After(current.activatesAt) {
+			current = k
+		}
+	}
+	if current == nil {
+		return nil, errors.New("no active signing key")
+	}
+	return current, nil
+}
+
+// signAccessToken signs claims with the configured algorithm, naming the key in the kid header
+func signAccessToken(claims jwt.Claims) (string, error) {
+	if !asymmetricSigning() {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.AppConfig.JWTSecret))
+	}
+	key, err := currentSigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// lookupSigningKey finds a key by kid, reloading the keyring once if another instance may
+// have created it since
+func lookupSigningKey(kid string) (*signingKey, bool) {
+	keyring.RLock()
+	key, ok := keyring.keys[kid]
+	stale := time.Since(keyring.loadedAt) > signingKeyReloadInterval
+	keyring.RUnlock()
+	if ok || !stale {
+		return key, ok
+	}
+	if err := loadSigningKeys(); err != nil {
+		log.Printf("Failed to reload signing keys: %v", err)
+		return nil, false
+	}
+	keyring.RLock()
+	defer keyring.RUnlock()
+	key, ok = keyring.keys[kid]
+	return key, ok
+}
+
+// accessTokenKey is the jwt.Keyfunc for access tokens: keyring keys by kid, and JWT_SECRET
+// for HS256 while that is signing or still accepted
+func accessTokenKey(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		cfg := config.AppConfig
+		if cfg.JWTSecret == "" || (asymmetricSigning() && !cfg.JWTAcceptHS256) {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(cfg.JWTSecret), nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodEd25519:
+		kid, _ := token.Header["kid"].(string)
+		key, ok := lookupSigningKey(kid)
+		if !ok {
+			return nil, ErrUnknownSigningKey
+		}
+		if key.method().Alg() != token.Method.Alg() {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return key.private.Public(), nil
+	default:
+		return nil, jwt.ErrSignatureInvalid
+	}
+}
+
+// JWK is one public key in a JSON Web Key Set (RFC 7517)
+type JWK struct {
+	KTY string `json:"kty"`
+	KID string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	CRV string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// PublicJWKS lists the public half of every key that signs, will sign or may still have
+// signed a live token
+func PublicJWKS() []JWK {
+	keyring.RLock()
+	keys := make([]*signingKey, 0, len(keyring.keys))
+	for _, k := range keyring.keys {
+		keys = append(keys, k)
+	}
+	keyring.RUnlock()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].activatesAt.After(keys[j].activatesAt)
+	})
+
+	b64 := base64.RawURLEncoding
+	jwks := []JWK{}
+	for _, k := range keys {
+		jwk := JWK{KID: k.kid, Use: "sig", Alg: k.alg}
+		switch pub := k.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.KTY = "RSA"
+			jwk.N = b64.EncodeToString(pub.N.Bytes())
+			jwk.E = b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KTY = "OKP"
+			jwk.CRV = "Ed25519"
+			jwk.X = b64.EncodeToString(pub)
+		default:
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
+
+// tokenIssuer is the iss claim of access tokens, set when the public URL is known
+func tokenIssuer() string {
+	return strings.TrimRight(config.AppConfig.PublicBaseURL, "/")
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// streamRetention is how long a finished stream stays replayable for reconnecting clients
+const streamRetention = 5 * time.Minute
+
+// StreamEvent is one server-sent event. ID has the form "<stream id>:<sequence>".
+type StreamEvent struct {
+	ID    string
+	Event string
+	Data  interface{}
+}
+
+// StreamBuffer records every event of a chat stream so a client that drops can resume
+// from its Last-Event-ID. Buffers live in memory, so resuming only works against the
+// instance that started the stream.
+type StreamBuffer struct {
+	ID     string
+	userID string
+
+	mu       sync.Mutex
+	events   []StreamEvent
+	closed   bool
+	closedAt time.Time
+	// changed is closed and replaced on every append so any number of readers can wait on it
+	changed chan struct{}
+}
+
+var (
+	streamsMu sync.Mutex
+	streams   = make(map[string]*StreamBuffer)
+)
+
+func NewStreamBuffer(userID string) *StreamBuffer {
+	b := &StreamBuffer{
+		ID:      uuid.New().String(),
+		userID:  userID,
+		changed: make(chan struct{}),
+	}
+
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	purgeExpiredStreams()
+	streams[b.ID] = b
+	return b
+}
+
+// purgeExpiredStreams must be called with streamsMu held
+func purgeExpiredStreams() {
+	cutoff := time.Now().Add(-streamRetention)
+	for id, b := range streams {
+		b.mu.Lock()
+		expired := b.closed && b.closedAt.Before(cutoff)
+		b.mu.Unlock()
+		if expired {
+			delete(streams, id)
+		}
+	}
+}
+
+// ResumeStream resolves a Last-Event-ID to the user's buffer and the sequence to continue after
+func ResumeStream(lastEventID string, userID string) (*StreamBuffer, int, error) {
+	streamID, seqStr, found := strings.Cut(lastEventID, ":")
+	if !found {
+		return nil, 0, fmt.Errorf("malformed Last-Event-ID %q", lastEventID)
+	}
+	seq, err := strconv.Atoi(seqStr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed Last-Event-ID %q", lastEventID)
+	}
+
+	streamsMu.Lock()
+	b, ok := streams[streamID]
+	streamsMu.Unlock()
+	if !ok || b.userID != userID {
+		return nil, 0, fmt.Errorf("stream %s not found or expired", streamID)
+	}
+	return b, seq, nil
+}
+
+// Append adds an event unless the stream is already closed
+func (b *StreamBuffer) Append(event string, data interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	b.events = append(b.events, StreamEvent{
+		ID:    fmt.Sprintf("%s:%d", b.ID, len(b.events)+1),
+		Event: event,
+		Data:  data,
+	})
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Close marks the stream finished; readers drain what is left and stop
+func (b *StreamBuffer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	b.closedAt = time.Now()
+	close(b.changed)
+}
+
+// Since returns the events after sequence number seq, whether the stream is finished,
+// and a channel that is closed when more events arrive
+func (b *StreamBuffer) Since(seq int) ([]StreamEvent, bool, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if seq < 0 {
+		seq = 0
+	}
+	var pending []StreamEvent
+	if seq < len(b.events) {
+		pending = append(pending, b.events[seq:]...)
+	}
+	return pending, b.closed, b.changed
+}
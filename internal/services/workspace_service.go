@@ -0,0 +1,417 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"dory-backend/internal/config"
+	"dory-backend/internal/models"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Which documents a search or listing covers
+const (
+	SearchScopeMine      = "mine"
+	SearchScopeWorkspace = "workspace"
+	SearchScopeBoth      = "both"
+)
+
+const (
+	workspaceInviteTTL   = 7 * 24 * time.Hour
+	maxWorkspaceNameLen  = 100
+	maxWorkspacesPerUser = 50
+)
+
+var (
+	ErrWorkspaceNotFound    = errors.New("workspace does not exist or you are not a member")
+	ErrWorkspaceForbidden   = errors.New("your role in this workspace does not allow this")
+	ErrInvalidWorkspace     = errors.New("invalid workspace")
+	ErrInvalidWorkspaceRole = errors.New("role must be owner, editor or viewer")
+	ErrInvalidSearchScope   = errors.New("scope must be mine, workspace or both, and workspace needs a workspace_id")
+	ErrInvalidInvitation    = errors.New("invalid or expired invitation")
+	ErrAlreadyMember        = errors.New("this user is already a member of the workspace")
+	ErrLastWorkspaceOwner   = errors.New("a workspace needs at least one owner")
+	ErrTooManyWorkspaces    = fmt.Errorf("a user can be in at most %d workspaces", maxWorkspacesPerUser)
+	ErrMemberNotFound       = errors.New("member not found")
+)
+
+var workspaceRoleRank = map[string]int{
+	models.WorkspaceRoleViewer: 1,
+	models.WorkspaceRoleEditor: 2,
+	models.WorkspaceRoleOwner:  3,
+}
+
+// RoleAtLeast reports whether role grants everything min does
+func RoleAtLeast(role string, min string) bool {
+	return workspaceRoleRank[role] >= workspaceRoleRank[min]
+}
+
+// WorkspaceRole is the user's role in a workspace, or ErrWorkspaceNotFound when they are not
+// a member
+func WorkspaceRole(workspaceID uuid.UUID, userID uuid.UUID) (string, error) {
+	var member models.WorkspaceMember
+	err := config.DB.Where("workspace_id = ? AND user_id = ?", workspaceID, userID).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrWorkspaceNotFound
+	}
+	return member.Role, err
+}
+
+// RequireWorkspaceRole checks the user has at least min in the workspace
+func RequireWorkspaceRole(workspaceID uuid.UUID, userID uuid.UUID, min string) (string, error) {
+	role, err := WorkspaceRole(workspaceID, userID)
+	if err != nil {
+		return "", err
+	}
+	if !RoleAtLeast(role, min) {
+		return role, ErrWorkspaceForbidden
+	}
+	return role, nil
+}
+
+// UserWorkspaceIDs lists the workspaces the user is a member of
+func UserWorkspaceIDs(userID uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := config.DB.Model(&models.WorkspaceMember{}).Where("user_id = ?", userID).Pluck("workspace_id", &ids).Error
+	return ids, err
+}
+
+// ResolveSearchScope turns a scope name and optional workspace ID from a request into the
+// documents it covers. Without a name the scope is the user's own documents, plus the
+// workspace's when one is given.
+func ResolveSearchScope(userID uuid.UUID, name string, workspaceID string) (SearchScope, error) {
+	scope := SearchScope{UserID: userID}
+
+	var workspace *uuid.UUID
+	if workspaceID != "" {
+		id, err := uuid.Parse(workspaceID)
+		if err != nil {
+			return scope, ErrInvalidWorkspace
+		}
+		if _, err := WorkspaceRole(id, userID); err != nil {
+			return scope, err
+		}
+		workspace = &id
+	}
+	if name == "" {
+		name = SearchScopeMine
+		if workspace != nil {
+			name = SearchScopeBoth
+		}
+	}
+
+	switch name {
+	case SearchScopeMine:
+		scope.Personal = true
+	case SearchScopeWorkspace:
+		if workspace == nil {
+			return scope, ErrInvalidSearchScope
+		}
+		scope.WorkspaceIDs = []uuid.UUID{*workspace}
+	case SearchScopeBoth:
+		scope.Personal = true
+		if workspace != nil {
+			scope.WorkspaceIDs = []uuid.UUID{*workspace}
+		} else {
+			ids, err := UserWorkspaceIDs(userID)
+			if err != nil {
+				return scope, err
+			}
+			scope.WorkspaceIDs = ids
+		}
+	default:
+		return scope, ErrInvalidSearchScope
+	}
+	return scope, nil
+}
+
+// DocumentsInScope is a gorm scope restricting a documents query to the search scope
+func DocumentsInScope(scope SearchScope) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		var conds []string
+		var args []interface{}
+		if scope.Personal {
+			conds = append(conds, "(workspace_id IS NULL AND user_id = ?)")
+			args = append(args, scope.UserID)
+		}
+		if len(scope.WorkspaceIDs) > 0 {
+			conds = append(conds, "workspace_id IN ?")
+			args = append(args, scope.WorkspaceIDs)
+		}
+		if len(conds) == 0 {
+			return db.Where("1 = 0")
+		}
+		return db.Where("("+strings.Join(conds, " OR ")+")", args...)
+	}
+}
+
+// DocumentRole is the access a user has to a document: owner for their personal documents,
+// their workspace role for workspace documents, or ErrWorkspaceNotFound for none
+func DocumentRole(doc models.Document, userID uuid.UUID) (string, error) {
+	if doc.WorkspaceID == nil {
+		if doc.UserID != userID {
+			return "", ErrWorkspaceNotFound
+		}
+		return models.WorkspaceRoleOwner, nil
+	}
+	return WorkspaceRole(*doc.WorkspaceID, userID)
+}
+
+func validateWorkspaceName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxWorkspaceNameLen {
+		return "", fmt.Errorf("%w: name must be 1 to %d characters", ErrInvalidWorkspace, maxWorkspaceNameLen)
+	}
+	return name, nil
+}
+
+// CreateWorkspace creates a workspace with the user as its owner
+func CreateWorkspace(userID uuid.UUID, name string, description string) (models.Workspace, error) {
+	name, err := validateWorkspaceName(name)
+	if err != nil {
+		return models.Workspace{}, err
+	}
+	workspace := models.Workspace{Name: name, Description: strings.TrimSpace(description), CreatedBy: userID}
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.WorkspaceMember{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= maxWorkspacesPerUser {
+			return ErrTooManyWorkspaces
+		}
+		if err := tx.Create(&workspace).Error; err != nil {
+			return err
+		}
+		owner := models.WorkspaceMember{WorkspaceID: workspace.ID, UserID: userID, Role: models.WorkspaceRoleOwner}
+		if err := tx.Create(&owner).Error; err != nil {
+			return err
+		}
+		workspace.Members = []models.WorkspaceMember{owner}
+		return nil
+	})
+	return workspace, err
+}
+
+// UpdateWorkspace renames a workspace or changes its description; nil fields are kept
+func UpdateWorkspace(workspace *models.Workspace, name *string, description *string) error {
+	if name != nil {
+		valid, err := validateWorkspaceName(*name)
+		if err != nil {
+			return err
+		}
+		workspace.Name = valid
+	}
+	if description != nil {
+		workspace.Description = strings.TrimSpace(*description)
+	}
+	return config.DB.Model(workspace).Select("name", "description").Updates(workspace).Error
+}
+
+// DeleteWorkspace deletes a workspace with its documents, members and invitations. Documents
+// go first, one by one, so a failure leaves the workspace in place for a retry.
+func DeleteWorkspace(workspaceID uuid.UUID) error {
+	var docs []models.Document
+	if err := config.DB.Omit("content").Where("workspace_id = ?", workspaceID).Find(&docs).Error; err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if err := DeleteDocument(doc); err != nil {
+			return fmt.Errorf("deleting document %s: %w", doc.ID, err)
+		}
+	}
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("workspace_id = ?", workspaceID).Delete(&models.WorkspaceInvitation{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("workspace_id = ?", workspaceID).Delete(&models.WorkspaceMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.Workspace{}, "id = ?", workspaceID).Error
+	})
+}
+
+// lockOwners locks the workspace row so concurrent role changes cannot remove the last owner
+// together, and returns how many owners it has
+func lockOwners(tx *gorm.DB, workspaceID uuid.UUID) (int64, error) {
+	var workspace models.Workspace
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&workspace, "id = ?", workspaceID).Error; err != nil {
+		return 0, err
+	}
+	var owners int64
+	err := tx.Model(&models.WorkspaceMember{}).
+		Where("workspace_id = ? AND role = ?", workspaceID, models.WorkspaceRoleOwner).Count(&owners).Error
+	return owners, err
+}
+
+// SetMemberRole changes a member's role, keeping at least one owner
+func SetMemberRole(workspaceID uuid.UUID, userID uuid.UUID, role string) (models.WorkspaceMember, error) {
+	var member models.WorkspaceMember
+	if _, ok := workspaceRoleRank[role]; !ok {
+		return member, ErrInvalidWorkspaceRole
+	}
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		owners, err := lockOwners(tx, workspaceID)
+		if err != nil {
+			return err
+		}
+		err = tx.Where("workspace_id = ? AND user_id = ?", workspaceID, userID).First(&member).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrMemberNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if member.Role == models.WorkspaceRoleOwner && role != models.WorkspaceRoleOwner && owners <= 1 {
+			return ErrLastWorkspaceOwner
+		}
+		member.Role = role
+		return tx.Model(&member).Update("role", role).Error
+	})
+	return member, err
+}
+
+// RemoveMember takes a user out of a workspace, keeping at least one owner. The documents
+// they uploaded stay, since they belong to the workspace.
+func RemoveMember(workspaceID uuid.UUID, userID uuid.UUID) error {
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		owners, err := lockOwners(tx, workspaceID)
+		if err != nil {
+			return err
+		}
+		var member models.WorkspaceMember
+		err = tx.Where("workspace_id = ? AND user_id = ?", workspaceID, userID).First(&member).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrMemberNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if member.Role == models.WorkspaceRoleOwner && owners <= 1 {
+			return ErrLastWorkspaceOwner
+		}
+		return tx.Delete(&member).Error
+	})
+}
+
+// InviteToWorkspace emails an invitation to join with role. The invitation is only kept if
+// the email could be sent.
+func InviteToWorkspace(workspace models.Workspace, inviter models.User, email string, role string) (models.WorkspaceInvitation, error) {
+	var invitation models.WorkspaceInvitation
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return invitation, err
+	}
+	if _, ok := workspaceRoleRank[role]; !ok {
+		return invitation, ErrInvalidWorkspaceRole
+	}
+
+	var members int64
+	err = config.DB.Model(&models.WorkspaceMember{}).
+		Joins("JOIN users ON users.id = workspace_members.user_id").
+		Where("workspace_members.workspace_id = ? AND LOWER(users.email) = ?", workspace.ID, email).
+		Count(&members).Error
+	if err != nil {
+		return invitation, err
+	}
+	if members > 0 {
+		return invitation, ErrAlreadyMember
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return invitation, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	invitation = models.WorkspaceInvitation{
+		WorkspaceID: workspace.ID,
+		Email:       email,
+		Role:        role,
+		TokenHash:   hashRefreshToken(token),
+		InvitedBy:   inviter.ID,
+		ExpiresAt:   time.Now().Add(workspaceInviteTTL),
+	}
+	if err := config.DB.Create(&invitation).Error; err != nil {
+		return invitation, err
+	}
+
+	if err := sendWorkspaceInvitation(workspace, inviter, invitation, token); err != nil {
+		config.DB.Delete(&invitation)
+		return models.WorkspaceInvitation{}, fmt.Errorf("sending the invitation failed: %w", err)
+	}
+	return invitation, nil
+}
+
+func sendWorkspaceInvitation(workspace models.Workspace, inviter models.User, invitation models.WorkspaceInvitation, token string) error {
+	who := inviter.Name
+	if who == "" {
+		who = inviter.Email
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s invited you to join the workspace %q on Dory as %s.\n\n", who, workspace.Name, invitation.Role)
+	if link := tokenLinkURL(config.AppConfig.WorkspaceInviteURL, token); link != "" {
+		body.WriteString(link + "\n\n")
+		body.WriteString("Or enter this code in Dory: " + token + "\n\n")
+	} else {
+		body.WriteString("Enter this code in Dory to join: " + token + "\n\n")
+	}
+	fmt.Fprintf(&body, "The invitation expires on %s.\n", invitation.ExpiresAt.UTC().Format("2 January 2006"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), loginMailTimeout)
+	defer cancel()
+	return ActiveMailer.Send(ctx, Email{
+		To:        invitation.Email,
+		Subject:   fmt.Sprintf("Join %s on Dory", workspace.Name),
+		Body:      body.String(),
+		MessageID: "invitation-" + invitation.ID.String(),
+	})
+}
+
+// AcceptInvitation adds the user to the invitation's workspace. The emailed token is what
+// proves the invitation was meant for them, so the account's email does not have to match.
+// Members who are already in the workspace keep their role.
+func AcceptInvitation(userID uuid.UUID, token string) (models.Workspace, error) {
+	var workspace models.Workspace
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		var invitation models.WorkspaceInvitation
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND accepted_at IS NULL AND expires_at > ?", hashRefreshToken(strings.TrimSpace(token)), now).
+			First(&invitation).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidInvitation
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.First(&workspace, "id = ?", invitation.WorkspaceID).Error; err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&models.WorkspaceMember{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= maxWorkspacesPerUser {
+			return ErrTooManyWorkspaces
+		}
+		member := models.WorkspaceMember{WorkspaceID: workspace.ID, UserID: userID, Role: invitation.Role}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error; err != nil {
+			return err
+		}
+		return tx.Model(&invitation).Updates(map[string]interface{}{"accepted_at": now, "accepted_by": userID}).Error
+	})
+	if err != nil {
+		return models.Workspace{}, err
+	}
+	log.Printf("User %s joined workspace %s", userID, workspace.ID)
+	return workspace, nil
+}